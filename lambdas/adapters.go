@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// The routing layer works on API Gateway REST (v1) requests. Other invocation payloads
+// (HTTP API, Function URL, ALB) are normalized into that shape on the way in and
+// converted back into their own response type on the way out.
+
+// payloadProbe holds the fields used to tell invocation payloads apart
+type payloadProbe struct {
+	Version        string `json:"version"`
+	RouteKey       string `json:"routeKey"`
+	HTTPMethod     string `json:"httpMethod"`
+	RequestContext struct {
+		ELB        json.RawMessage `json:"elb"`
+		DomainName string          `json:"domainName"`
+	} `json:"requestContext"`
+}
+
+// decodeBody returns the request body, decoding it when the payload marks it as base64
+func decodeBody(body string, isBase64Encoded bool) (string, error) {
+	if !isBase64Encoded {
+		return body, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 body: %w", err)
+	}
+	return string(decoded), nil
+}
+
+// dispatch is the Lambda entry point. It detects the payload format and adapts it to handler.
+func dispatch(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var probe payloadProbe
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, fmt.Errorf("unrecognized invocation payload: %w", err)
+	}
+
+	switch {
+	case len(probe.RequestContext.ELB) > 0:
+		var request events.ALBTargetGroupRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, fmt.Errorf("invalid ALB payload: %w", err)
+		}
+		proxyRequest, err := fromALBRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		response, err := handler(ctx, proxyRequest)
+		if err != nil {
+			return nil, err
+		}
+		return toALBResponse(response, len(request.MultiValueHeaders) > 0), nil
+	case probe.Version == "2.0" && strings.Contains(probe.RequestContext.DomainName, ".lambda-url."):
+		var request events.LambdaFunctionURLRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, fmt.Errorf("invalid Function URL payload: %w", err)
+		}
+		proxyRequest, err := fromFunctionURLRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		response, err := handler(ctx, proxyRequest)
+		if err != nil {
+			return nil, err
+		}
+		return toFunctionURLResponse(response), nil
+	case probe.Version == "2.0" && probe.RouteKey != "":
+		var request events.APIGatewayV2HTTPRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, fmt.Errorf("invalid HTTP API payload: %w", err)
+		}
+		proxyRequest, err := fromHTTPAPIRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		response, err := handler(ctx, proxyRequest)
+		if err != nil {
+			return nil, err
+		}
+		return toHTTPAPIResponse(response), nil
+	case probe.HTTPMethod != "":
+		var request events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, fmt.Errorf("invalid REST API payload: %w", err)
+		}
+		return handler(ctx, request)
+	default:
+		return nil, fmt.Errorf("unsupported invocation payload (version=%q)", probe.Version)
+	}
+}
+
+// fromHTTPAPIRequest converts an HTTP API (payload v2) request into the REST (v1) shape
+func fromHTTPAPIRequest(request events.APIGatewayV2HTTPRequest) (events.APIGatewayProxyRequest, error) {
+	body, err := decodeBody(request.Body, request.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayProxyRequest{}, err
+	}
+
+	headers := make(map[string]string, len(request.Headers)+1)
+	for name, value := range request.Headers {
+		headers[name] = value
+	}
+	if len(request.Cookies) > 0 {
+		headers["cookie"] = strings.Join(request.Cookies, "; ")
+	}
+
+	// The route key is "<METHOD> <resource>", or "$default" for the catch-all route. The
+	// resource is left empty for the catch-all route, so the router matches the raw path; the
+	// path is chosen by the client and must not be taken for a route pattern.
+	resource := ""
+	if _, path, ok := strings.Cut(request.RouteKey, " "); ok {
+		resource = path
+	}
+
+	// JWT authorizer claims are exposed like the REST API's Cognito authorizer claims
+	var authorizer map[string]interface{}
+	if request.RequestContext.Authorizer != nil && request.RequestContext.Authorizer.JWT != nil {
+		claims := make(map[string]interface{}, len(request.RequestContext.Authorizer.JWT.Claims))
+		for name, value := range request.RequestContext.Authorizer.JWT.Claims {
+			claims[name] = value
+		}
+		authorizer = map[string]interface{}{"claims": claims}
+	}
+	identity := events.APIGatewayRequestIdentity{
+		SourceIP:  request.RequestContext.HTTP.SourceIP,
+		UserAgent: request.RequestContext.HTTP.UserAgent,
+	}
+	// An IAM authorizer's principal is exposed like the REST API's IAM identity, for requireIAMCaller
+	if request.RequestContext.Authorizer != nil && request.RequestContext.Authorizer.IAM != nil {
+		iam := request.RequestContext.Authorizer.IAM
+		identity.UserArn, identity.Caller, identity.User = iam.UserARN, iam.CallerID, iam.UserID
+		identity.AccountID, identity.AccessKey = iam.AccountID, iam.AccessKey
+	}
+
+	return events.APIGatewayProxyRequest{
+		Resource:              resource,
+		Path:                  request.RawPath,
+		HTTPMethod:            request.RequestContext.HTTP.Method,
+		Headers:               headers,
+		QueryStringParameters: request.QueryStringParameters,
+		PathParameters:        request.PathParameters,
+		StageVariables:        request.StageVariables,
+		Body:                  body,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			AccountID:    request.RequestContext.AccountID,
+			RequestID:    request.RequestContext.RequestID,
+			APIID:        request.RequestContext.APIID,
+			Stage:        request.RequestContext.Stage,
+			DomainName:   request.RequestContext.DomainName,
+			HTTPMethod:   request.RequestContext.HTTP.Method,
+			Path:         request.RequestContext.HTTP.Path,
+			ResourcePath: resource,
+			Authorizer:   authorizer,
+			Identity:     identity,
+		},
+	}, nil
+}
+
+// toHTTPAPIResponse converts a REST (v1) response into the HTTP API (payload v2) response
+func toHTTPAPIResponse(response events.APIGatewayProxyResponse) events.APIGatewayV2HTTPResponse {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode:        response.StatusCode,
+		Headers:           response.Headers,
+		MultiValueHeaders: response.MultiValueHeaders,
+		Body:              response.Body,
+		IsBase64Encoded:   response.IsBase64Encoded,
+	}
+}
+
+// fromFunctionURLRequest converts a Lambda Function URL request into the REST (v1) shape
+func fromFunctionURLRequest(request events.LambdaFunctionURLRequest) (events.APIGatewayProxyRequest, error) {
+	body, err := decodeBody(request.Body, request.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayProxyRequest{}, err
+	}
+
+	headers := make(map[string]string, len(request.Headers)+1)
+	for name, value := range request.Headers {
+		headers[name] = value
+	}
+	if len(request.Cookies) > 0 {
+		headers["cookie"] = strings.Join(request.Cookies, "; ")
+	}
+
+	identity := events.APIGatewayRequestIdentity{
+		SourceIP:  request.RequestContext.HTTP.SourceIP,
+		UserAgent: request.RequestContext.HTTP.UserAgent,
+	}
+	// With AWS_IAM auth the signing principal is exposed like the REST API's IAM identity, for requireIAMCaller
+	if request.RequestContext.Authorizer != nil && request.RequestContext.Authorizer.IAM != nil {
+		iam := request.RequestContext.Authorizer.IAM
+		identity.UserArn, identity.Caller, identity.User = iam.UserARN, iam.CallerID, iam.UserID
+		identity.AccountID, identity.AccessKey = iam.AccountID, iam.AccessKey
+	}
+
+	// Function URLs have no resources; the router matches the raw path
+	return events.APIGatewayProxyRequest{
+		Path:                  request.RawPath,
+		HTTPMethod:            request.RequestContext.HTTP.Method,
+		Headers:               headers,
+		QueryStringParameters: request.QueryStringParameters,
+		Body:                  body,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			AccountID:  request.RequestContext.AccountID,
+			RequestID:  request.RequestContext.RequestID,
+			APIID:      request.RequestContext.APIID,
+			DomainName: request.RequestContext.DomainName,
+			HTTPMethod: request.RequestContext.HTTP.Method,
+			Path:       request.RequestContext.HTTP.Path,
+			Identity:   identity,
+		},
+	}, nil
+}
+
+// toFunctionURLResponse converts a REST (v1) response into a Function URL response
+func toFunctionURLResponse(response events.APIGatewayProxyResponse) events.LambdaFunctionURLResponse {
+	return events.LambdaFunctionURLResponse{
+		StatusCode:      response.StatusCode,
+		Headers:         response.Headers,
+		Body:            response.Body,
+		IsBase64Encoded: response.IsBase64Encoded,
+	}
+}
+
+// fromALBRequest converts an ALB target group request into the REST (v1) shape.
+// ALB passes query strings URL-encoded and has no request ID, so the trace ID is used instead.
+func fromALBRequest(request events.ALBTargetGroupRequest) (events.APIGatewayProxyRequest, error) {
+	body, err := decodeBody(request.Body, request.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayProxyRequest{}, err
+	}
+
+	headers := request.Headers
+	if len(request.MultiValueHeaders) > 0 {
+		headers = make(map[string]string, len(request.MultiValueHeaders))
+		for name, values := range request.MultiValueHeaders {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+
+	rawQuery := request.QueryStringParameters
+	if len(request.MultiValueQueryStringParameters) > 0 {
+		rawQuery = make(map[string]string, len(request.MultiValueQueryStringParameters))
+		for name, values := range request.MultiValueQueryStringParameters {
+			if len(values) > 0 {
+				rawQuery[name] = values[0]
+			}
+		}
+	}
+	query := make(map[string]string, len(rawQuery))
+	for name, value := range rawQuery {
+		decodedName, err := url.QueryUnescape(name)
+		if err != nil {
+			decodedName = name
+		}
+		decodedValue, err := url.QueryUnescape(value)
+		if err != nil {
+			decodedValue = value
+		}
+		query[decodedName] = decodedValue
+	}
+
+	var requestID string
+	for name, value := range headers {
+		if strings.EqualFold(name, "X-Amzn-Trace-Id") {
+			requestID = value
+		}
+	}
+
+	// ALB has no resources; the router matches the raw path
+	return events.APIGatewayProxyRequest{
+		Path:                  request.Path,
+		HTTPMethod:            request.HTTPMethod,
+		Headers:               headers,
+		QueryStringParameters: query,
+		Body:                  body,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			RequestID:  requestID,
+			HTTPMethod: request.HTTPMethod,
+			Path:       request.Path,
+		},
+	}, nil
+}
+
+// toALBResponse converts a REST (v1) response into an ALB response. When the target group
+// has multi-value headers enabled, ALB only accepts multi-value headers in the response too.
+func toALBResponse(response events.APIGatewayProxyResponse, multiValueHeaders bool) events.ALBTargetGroupResponse {
+	albResponse := events.ALBTargetGroupResponse{
+		StatusCode:        response.StatusCode,
+		StatusDescription: fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode)),
+		Body:              response.Body,
+		IsBase64Encoded:   response.IsBase64Encoded,
+	}
+	if !multiValueHeaders {
+		albResponse.Headers = response.Headers
+		return albResponse
+	}
+
+	albResponse.MultiValueHeaders = make(map[string][]string, len(response.Headers)+len(response.MultiValueHeaders))
+	for name, values := range response.MultiValueHeaders {
+		albResponse.MultiValueHeaders[name] = values
+	}
+	for name, value := range response.Headers {
+		albResponse.MultiValueHeaders[name] = append(albResponse.MultiValueHeaders[name], value)
+	}
+	return albResponse
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/uuid"
+)
+
+var (
+	// anonymizationsTableName tracks anonymization jobs (ANONYMIZATIONS_TABLE_NAME); ANONYMIZE_QUEUE_URL hands them to the anonymize lambda
+	anonymizationsTableName = settings.AnonymizationsTableName
+	anonymizeQueueURL       = settings.AnonymizeQueueURL
+)
+
+// anonymizationQueued is the state of a new anonymization job; the anonymize lambda moves it
+// to running, then completed or failed
+const anonymizationQueued = "queued"
+
+// AnonymizeRequest is the body of POST /admin/anonymize
+type AnonymizeRequest struct {
+	// TenantID limits the job to one tenant; all tenants when empty
+	TenantID string `json:"tenantId"`
+	// InactiveDays selects the persons not updated for at least this many days
+	InactiveDays int `json:"inactiveDays"`
+}
+
+// AnonymizationJob is the response of POST /admin/anonymize and GET /admin/anonymize/{jobId}
+type AnonymizationJob struct {
+	JobID        string `json:"jobId" dynamodbav:"jobId"`
+	Status       string `json:"status" dynamodbav:"status"`
+	TenantID     string `json:"tenantId,omitempty" dynamodbav:"tenantId,omitempty"`
+	InactiveDays int    `json:"inactiveDays" dynamodbav:"inactiveDays"`
+	// Cutoff is fixed when the job is created, so a queued job selects the same persons whenever it runs
+	Cutoff      string `json:"cutoff" dynamodbav:"cutoff"`
+	CreatedAt   string `json:"createdAt" dynamodbav:"createdAt"`
+	StartedAt   string `json:"startedAt,omitempty" dynamodbav:"startedAt,omitempty"`
+	FinishedAt  string `json:"finishedAt,omitempty" dynamodbav:"finishedAt,omitempty"`
+	RequestedBy string `json:"requestedBy,omitempty" dynamodbav:"requestedBy,omitempty"`
+	Matched     int    `json:"matched" dynamodbav:"matched"`
+	Anonymized  int    `json:"anonymized" dynamodbav:"anonymized"`
+	Held        int    `json:"held" dynamodbav:"held"`
+	Conflicts   int    `json:"conflicts" dynamodbav:"conflicts"`
+	Reason      string `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+}
+
+// handleCreateAnonymization queues a job that pseudonymizes the PII of inactive persons and
+// answers 202 with its ID
+func handleCreateAnonymization(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if anonymizationsTableName == "" || anonymizeQueueURL == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Anonymization is not enabled"), nil
+	}
+	var anonymizeRequest AnonymizeRequest
+	if err := json.Unmarshal([]byte(request.Body), &anonymizeRequest); err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid anonymize request"), nil
+	}
+	if anonymizeRequest.InactiveDays < 1 {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "inactiveDays must be at least 1"), nil
+	}
+
+	now := time.Now().UTC()
+	job := AnonymizationJob{
+		JobID:        uuid.New().String(),
+		Status:       anonymizationQueued,
+		TenantID:     anonymizeRequest.TenantID,
+		InactiveDays: anonymizeRequest.InactiveDays,
+		Cutoff:       now.AddDate(0, 0, -anonymizeRequest.InactiveDays).Format(time.RFC3339),
+		CreatedAt:    now.Format(time.RFC3339),
+		RequestedBy:  rateLimitClient(request),
+	}
+	item, err := attributevalue.MarshalMap(job)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal anonymization", err), nil
+	}
+	if _, err := svc.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(anonymizationsTableName), Item: item}); err != nil {
+		return internalErrorResponse(ctx, request, "create anonymization", err), nil
+	}
+
+	message, err := json.Marshal(map[string]string{
+		"jobId":         job.JobID,
+		"correlationId": logger.CorrelationID(ctx),
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal anonymize message", err), nil
+	}
+	if _, err := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(anonymizeQueueURL),
+		MessageBody: aws.String(string(message)),
+	}); err != nil {
+		return internalErrorResponse(ctx, request, "queue anonymization", err), nil
+	}
+	logger.FromContext(ctx).Info("Anonymization queued", "jobId", job.JobID, "tenantId", job.TenantID, "cutoff", job.Cutoff)
+
+	response, err := jsonResponse(ctx, request, http.StatusAccepted, job)
+	if err == nil && response.StatusCode == http.StatusAccepted {
+		response.Headers["Location"] = "/admin/anonymize/" + job.JobID
+	}
+	return response, err
+}
+
+// handleGetAnonymization reports the progress and outcome of an anonymization job
+func handleGetAnonymization(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if anonymizationsTableName == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Anonymization is not enabled"), nil
+	}
+	jobID := request.PathParameters["jobId"]
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(anonymizationsTableName),
+		Key:       map[string]types.AttributeValue{"jobId": &types.AttributeValueMemberS{Value: jobID}},
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "get anonymization", err), nil
+	}
+	if result.Item == nil {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Anonymization job not found"), nil
+	}
+
+	var job AnonymizationJob
+	if err := attributevalue.UnmarshalMap(result.Item, &job); err != nil {
+		return internalErrorResponse(ctx, request, "unmarshal anonymization", err), nil
+	}
+	return jsonResponse(ctx, request, http.StatusOK, job)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/consumer"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/fieldcrypt"
+	"aws-lambda-go/internal/legalhold"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Job states, as reported by GET /admin/anonymize/{jobId}
+const (
+	statusQueued    = "queued"
+	statusRunning   = "running"
+	statusCompleted = "completed"
+	statusFailed    = "failed"
+)
+
+var settings, settingsErr = config.LoadAnonymize()
+
+var (
+	dynamo *dynamodb.Client
+	pii    *fieldcrypt.Encryptor
+	// legalHolds keeps held persons from being anonymized
+	legalHolds *legalhold.Checker
+)
+
+func init() {
+	logger.Init("anonymize")
+	metrics.Init("anonymize")
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	if err := tracing.Init(context.TODO(), "anonymize"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	metrics.InstrumentDynamoDB(&cfg)
+	dynamo = ddbclient.New(cfg, settings.DynamoDB)
+	pii = fieldcrypt.New(cfg, settings.PII.KMSKeyID, settings.PII.Fields)
+	legalHolds = legalhold.New(dynamo, settings.LegalHoldsTableName)
+}
+
+// AnonymizeMessage is the SQS message the HTTP lambda queues for POST /admin/anonymize
+type AnonymizeMessage struct {
+	JobID         string `json:"jobId"`
+	CorrelationID string `json:"correlationId"`
+}
+
+// jobFilter selects the persons of a job: those of the tenant (all tenants when empty) that
+// were last updated before the cutoff
+type jobFilter struct {
+	TenantID string `dynamodbav:"tenantId"`
+	Cutoff   string `dynamodbav:"cutoff"`
+}
+
+// jobCounts are the outcomes of a job
+type jobCounts struct {
+	// Matched persons passed the filter
+	Matched int
+	// Anonymized persons had their PII replaced
+	Anonymized int
+	// Held persons are under an active legal hold and were left alone
+	Held int
+	// Conflicts were changed while the job ran and are picked up by the next job
+	Conflicts int
+}
+
+// runJob claims a queued job, anonymizes the matching persons and records the outcome
+func runJob(ctx context.Context, message AnonymizeMessage) error {
+	ctx = logger.With(logger.WithCorrelationID(ctx, message.CorrelationID), "jobId", message.JobID)
+	filter, claimed, err := claimJob(ctx, message.JobID)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		logger.FromContext(ctx).Info("Job is not queued anymore, skipping")
+		return nil
+	}
+
+	start := time.Now()
+	counts, err := anonymizePersons(ctx, filter)
+	metrics.Emit(map[string]string{"Outcome": metrics.ErrorOutcome(err)}, map[string]interface{}{"jobId": message.JobID},
+		metrics.Count("PersonsAnonymized", counts.Anonymized),
+		metrics.Count("PersonsHeld", counts.Held),
+		metrics.Duration("AnonymizeDuration", time.Since(start)),
+	)
+	if err != nil {
+		logger.FromContext(ctx).Error("Anonymization failed", "error", err)
+		return finishJob(ctx, message.JobID, statusFailed, counts, err.Error())
+	}
+	logger.FromContext(ctx).Info("Anonymization complete", "matched", counts.Matched, "anonymized", counts.Anonymized, "held", counts.Held, "conflicts", counts.Conflicts)
+	return finishJob(ctx, message.JobID, statusCompleted, counts, "")
+}
+
+// anonymizePersons scans for the persons the filter selects and anonymizes each one. Persons
+// that were anonymized before are not selected again.
+func anonymizePersons(ctx context.Context, filter jobFilter) (jobCounts, error) {
+	var counts jobCounts
+	pseudonyms, err := newPseudonymizer()
+	if err != nil {
+		return counts, err
+	}
+	condition, _ := ddbexpr.All(
+		expression.Name("updatedAt").LessThan(expression.Value(filter.Cutoff)),
+		expression.AttributeNotExists(expression.Name("anonymized")),
+	)
+	if filter.TenantID != "" {
+		condition = condition.And(expression.Name("tenantId").Equal(expression.Value(filter.TenantID)))
+	}
+	expr, err := expression.NewBuilder().WithFilter(condition).Build()
+	if err != nil {
+		return counts, err
+	}
+
+	paginator := dynamodb.NewScanPaginator(dynamo, &dynamodb.ScanInput{
+		TableName:                 aws.String(settings.TableName),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return counts, fmt.Errorf("failed to scan persons: %w", err)
+		}
+		for _, item := range page.Items {
+			personID, _ := item["personId"].(*types.AttributeValueMemberS)
+			if personID == nil {
+				continue
+			}
+			counts.Matched++
+			held, err := legalHolds.Active(ctx, personID.Value)
+			if err != nil {
+				return counts, fmt.Errorf("failed to check legal holds of %s: %w", personID.Value, err)
+			}
+			if held {
+				counts.Held++
+				continue
+			}
+			if err := pii.DecryptItem(ctx, personID.Value, item); err != nil {
+				return counts, err
+			}
+			person, err := models.UnmarshalPerson(item)
+			if err != nil {
+				return counts, fmt.Errorf("failed to unmarshal person %s: %w", personID.Value, err)
+			}
+			err = anonymizePerson(ctx, pseudonyms, person)
+			var conditionErr *types.ConditionalCheckFailedException
+			switch {
+			case errors.As(err, &conditionErr):
+				counts.Conflicts++
+			case err != nil:
+				return counts, fmt.Errorf("failed to anonymize %s: %w", person.PersonID, err)
+			default:
+				counts.Anonymized++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// anonymizePerson replaces the PII of a person with pseudonyms, unless the person changed
+// since it was read. The lookup keys and identity hashes are removed, so anonymized persons
+// never match or join real ones. updatedAt is kept for the analyses of activity; the version
+// is incremented, so clients holding the old ETag cannot write the PII back.
+func anonymizePerson(ctx context.Context, pseudonyms *pseudonymizer, person models.Person) error {
+	update := expression.
+		Set(expression.Name("anonymized"), expression.Value(true)).
+		Set(expression.Name("anonymizedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339))).
+		Set(expression.Name("version"), expression.Plus(expression.Name("version"), expression.Value(1))).
+		Set(expression.Name("updatedBy"), expression.Value("system:anonymize")).
+		Remove(expression.Name("emailKey")).
+		Remove(expression.Name("lastNameKey")).
+		Remove(expression.Name("emailHash")).
+		Remove(expression.Name("phoneHash"))
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"firstName", person.FirstName},
+		{"lastName", person.LastName},
+	} {
+		if f.value != "" {
+			update = update.Set(expression.Name(f.name), expression.Value(pseudonyms.name(f.name, f.value)))
+		}
+	}
+	if person.Email != "" {
+		update = update.Set(expression.Name("email"), expression.Value(pseudonyms.email(person.Email)))
+	}
+	if person.PhoneNumber != "" {
+		update = update.Set(expression.Name("phoneNumber"), expression.Value(pseudonyms.phone(person.PhoneNumber)))
+	}
+	if person.Address != "" {
+		address, addressParts := pseudonyms.address(person.Address, person.AddressParts)
+		update = update.Set(expression.Name("address"), expression.Value(address))
+		if addressParts != "" {
+			update = update.Set(expression.Name("addressParts"), expression.Value(addressParts))
+		} else {
+			update = update.Remove(expression.Name("addressParts"))
+		}
+	}
+
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.Name("version").Equal(expression.Value(person.Version))).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(settings.TableName),
+		Key:                       map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: person.PersonID}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
+
+// claimJob moves a queued job to running and returns its filter. It returns false when the
+// job was already picked up, e.g. when SQS delivers the message twice.
+func claimJob(ctx context.Context, jobID string) (jobFilter, bool, error) {
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.
+			Set(expression.Name("status"), expression.Value(statusRunning)).
+			Set(expression.Name("startedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339)))).
+		WithCondition(expression.Name("status").Equal(expression.Value(statusQueued))).
+		Build()
+	if err != nil {
+		return jobFilter{}, false, err
+	}
+	result, err := dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(settings.AnonymizationsTableName),
+		Key:                       map[string]types.AttributeValue{"jobId": &types.AttributeValueMemberS{Value: jobID}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return jobFilter{}, false, nil
+	}
+	if err != nil {
+		return jobFilter{}, false, fmt.Errorf("failed to claim job %s: %w", jobID, err)
+	}
+	var filter jobFilter
+	if err := attributevalue.UnmarshalMap(result.Attributes, &filter); err != nil {
+		return jobFilter{}, false, errclass.Mark(errclass.Permanent, fmt.Errorf("job %s has an invalid filter: %w", jobID, err))
+	}
+	if filter.Cutoff == "" {
+		return jobFilter{}, false, errclass.New(errclass.Permanent, fmt.Sprintf("job %s has no cutoff", jobID))
+	}
+	return filter, true, nil
+}
+
+// finishJob records the outcome of a job
+func finishJob(ctx context.Context, jobID string, status string, counts jobCounts, reason string) error {
+	update := expression.
+		Set(expression.Name("status"), expression.Value(status)).
+		Set(expression.Name("finishedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339))).
+		Set(expression.Name("matched"), expression.Value(counts.Matched)).
+		Set(expression.Name("anonymized"), expression.Value(counts.Anonymized)).
+		Set(expression.Name("held"), expression.Value(counts.Held)).
+		Set(expression.Name("conflicts"), expression.Value(counts.Conflicts))
+	if reason != "" {
+		update = update.Set(expression.Name("reason"), expression.Value(reason))
+	}
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return err
+	}
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(settings.AnonymizationsTableName),
+		Key:                       map[string]types.AttributeValue{"jobId": &types.AttributeValueMemberS{Value: jobID}},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record job %s: %w", jobID, err)
+	}
+	return nil
+}
+
+// handler processes anonymization jobs one message at a time; failed messages are retried by SQS
+func handler(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	response := events.SQSEventResponse{}
+	for _, record := range event.Records {
+		var message AnonymizeMessage
+		if err := json.Unmarshal([]byte(record.Body), &message); err != nil {
+			logger.FromContext(ctx).Error("Dropping invalid anonymize message", "messageId", record.MessageId, "error", err)
+			continue
+		}
+		if err := errclass.Retry(ctx, runJob(ctx, message), "Failed to process anonymization", "jobId", message.JobID); err != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+	return response, nil
+}
+
+func main() {
+	config.Check(settingsErr)
+	lambda.Start(consumer.Invocation(handler))
+}
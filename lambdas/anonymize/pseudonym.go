@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// tokenLength is the number of hex characters of a pseudonym token
+const tokenLength = 12
+
+// pseudonymizer replaces PII with pseudonyms that keep the analytical shape of the values:
+// equal values get equal pseudonyms within a job, emails keep their domain, phone numbers
+// their length and formatting, addresses their country. The HMAC key is random per job and
+// never stored, so the pseudonyms cannot be reversed or linked across jobs.
+type pseudonymizer struct {
+	key []byte
+}
+
+func newPseudonymizer() (*pseudonymizer, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &pseudonymizer{key: key}, nil
+}
+
+// digest is the HMAC of a value, scoped to its field so equal values of different fields differ
+func (p *pseudonymizer) digest(field string, value string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(field + "\n" + strings.ToLower(strings.TrimSpace(value))))
+	return mac.Sum(nil)
+}
+
+func (p *pseudonymizer) token(field string, value string) string {
+	return hex.EncodeToString(p.digest(field, value))[:tokenLength]
+}
+
+// name returns e.g. "Anon-3f9a2c41d0b7"
+func (p *pseudonymizer) name(field string, value string) string {
+	return "Anon-" + p.token(field, value)
+}
+
+// email replaces the local part and keeps the domain
+func (p *pseudonymizer) email(value string) string {
+	domain := "anonymized.invalid"
+	if at := strings.LastIndex(value, "@"); at >= 0 && at < len(value)-1 {
+		domain = strings.ToLower(value[at+1:])
+	}
+	return p.token("email", value) + "@" + domain
+}
+
+// phone replaces every digit and keeps the leading "+" and the formatting characters
+func (p *pseudonymizer) phone(value string) string {
+	digest := p.digest("phoneNumber", value)
+	var b strings.Builder
+	k := 0
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteByte('0' + digest[k%len(digest)]%10)
+		k++
+	}
+	return b.String()
+}
+
+// addressCountry is the part of a structured address that is kept
+type addressCountry struct {
+	Country string `json:"country,omitempty"`
+}
+
+// address returns the pseudonymous single-line address and structured address. Only the
+// country of the structured address is kept; addressParts is empty when there is none.
+func (p *pseudonymizer) address(value string, addressParts string) (string, string) {
+	var parts addressCountry
+	if addressParts != "" {
+		_ = json.Unmarshal([]byte(addressParts), &parts)
+	}
+	formatted := "Anonymized " + p.token("address", value)
+	if parts.Country == "" {
+		return formatted, ""
+	}
+	encoded, err := json.Marshal(parts)
+	if err != nil {
+		return formatted, ""
+	}
+	return formatted + ", " + parts.Country, string(encoded)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	// authRequired rejects requests without authorizer claims (AUTH_REQUIRED=true).
+	// Without it, anonymous requests keep working unscoped, as before authentication existed.
+	authRequired = settings.AuthRequired
+	// adminGroup is the Cognito group whose members bypass ownership checks (ADMIN_GROUP)
+	adminGroup = settings.AdminGroup
+)
+
+// Caller is the authenticated user, taken from the Cognito claims API Gateway validated
+type Caller struct {
+	Subject  string
+	Username string
+	Groups   []string
+	Role     string
+	// Tenant is the custom:tenantId claim, matched by tenantMatch policy conditions
+	Tenant string
+}
+
+// isAdmin reports whether the caller may access every person record
+func (c *Caller) isAdmin() bool {
+	return c.Role == roleAdmin
+}
+
+type callerKey struct{}
+
+// callerFromContext returns the authenticated caller, or nil for anonymous requests
+func callerFromContext(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerKey{}).(*Caller)
+	return caller
+}
+
+// errTenantMismatch is returned when X-Tenant-Id names a tenant other than the caller's
+var errTenantMismatch = errors.New("X-Tenant-Id does not match the caller's tenant")
+
+// writeTenant returns the tenant of the persons a request creates: the caller's tenant
+// (custom:tenantId), not the client's X-Tenant-Id header. A header naming another tenant is
+// rejected, except from admins, who may create persons for any tenant.
+func writeTenant(ctx context.Context, request events.APIGatewayProxyRequest) (string, error) {
+	header := headerValue(request, "X-Tenant-Id")
+	caller := callerFromContext(ctx)
+	if caller != nil && caller.isAdmin() && header != "" {
+		return header, nil
+	}
+	tenant := ""
+	if caller != nil {
+		tenant = caller.Tenant
+	}
+	if header != "" && header != tenant {
+		return "", errTenantMismatch
+	}
+	return tenant, nil
+}
+
+type actorKey struct{}
+
+// actorMiddleware remembers who made the request, so person writes can record it in updatedBy
+// for the audit trail
+func actorMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return next(context.WithValue(ctx, actorKey{}, rateLimitClient(request)), request)
+	}
+}
+
+// actorFromContext returns who made the request (user:<sub>, iam:<arn> or ip:<address>), or
+// "" outside a request
+func actorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// callerFromRequest reads the claims a Cognito user pool authorizer (REST API) or JWT
+// authorizer (HTTP API, see fromHTTPAPIRequest) attached to the request
+func callerFromRequest(request events.APIGatewayProxyRequest) *Caller {
+	claims, _ := request.RequestContext.Authorizer["claims"].(map[string]interface{})
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil
+	}
+	username, _ := claims["cognito:username"].(string)
+	tenant, _ := claims["custom:tenantId"].(string)
+	groups := parseGroups(claims["cognito:groups"])
+	return &Caller{Subject: subject, Username: username, Groups: groups, Role: roleFromClaims(claims, groups), Tenant: tenant}
+}
+
+// parseGroups reads the cognito:groups claim, which API Gateway flattens into a string
+// such as "[admin editors]" or "admin,editors", or passes through as a list
+func parseGroups(claim interface{}) []string {
+	switch value := claim.(type) {
+	case []interface{}:
+		groups := make([]string, 0, len(value))
+		for _, group := range value {
+			if name, ok := group.(string); ok {
+				groups = append(groups, name)
+			}
+		}
+		return groups
+	case string:
+		return strings.FieldsFunc(strings.Trim(value, "[]"), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	}
+	return nil
+}
+
+// authMiddleware identifies the caller from the authorizer claims and resolves their role
+func authMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		caller := callerFromRequest(request)
+		if caller == nil {
+			if authRequired {
+				return errorResponse(request, http.StatusUnauthorized, errCodeUnauthorized, "Authentication required"), nil
+			}
+			return next(ctx, request)
+		}
+		role, err := storedRole(ctx, caller.Subject)
+		if err != nil {
+			return internalErrorResponse(ctx, request, "look up role", err), nil
+		}
+		if role != "" {
+			caller.Role = role
+		}
+		ctx = context.WithValue(ctx, callerKey{}, caller)
+		ctx = logger.With(ctx, "callerId", caller.Subject, "role", caller.Role)
+		return next(ctx, request)
+	}
+}
+
+// requireOwner restricts /persons/{personId} routes to the person's owner. Records owned by
+// someone else are reported as not found so their existence is not revealed; admins and
+// anonymous requests (when authentication is not required) are not restricted.
+func requireOwner(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		caller := callerFromContext(ctx)
+		if caller == nil || caller.isAdmin() {
+			return next(ctx, request)
+		}
+
+		expr, err := expression.NewBuilder().WithProjection(expression.NamesList(expression.Name("ownerId"))).Build()
+		if err != nil {
+			return internalErrorResponse(ctx, request, "build owner projection", err), nil
+		}
+		result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:                aws.String(tableName),
+			Key:                      map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: request.PathParameters["personId"]}},
+			ProjectionExpression:     expr.Projection(),
+			ExpressionAttributeNames: expr.Names(),
+		})
+		if err != nil {
+			return internalErrorResponse(ctx, request, "check owner", err), nil
+		}
+		// Missing items are left to the handler (PUT creates them, GET/DELETE report them)
+		if result.Item != nil {
+			owner, _ := result.Item["ownerId"].(*types.AttributeValueMemberS)
+			if owner == nil || owner.Value != caller.Subject {
+				return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
+			}
+		}
+		return next(ctx, request)
+	}
+}
+
+// ownerScope returns the owner a list request is restricted to, or "" for unrestricted callers
+func ownerScope(ctx context.Context) string {
+	caller := callerFromContext(ctx)
+	if caller == nil || caller.isAdmin() {
+		return ""
+	}
+	return caller.Subject
+}
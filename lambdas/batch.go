@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/validation"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxBatchPersons is the BatchWriteItem limit, so a batch is written in a single request
+	maxBatchPersons = 25
+	// maxBatchAttempts bounds how often unprocessed items are resubmitted
+	maxBatchAttempts = 5
+	// batchRetryBackoff is the pause before the first resubmission; it doubles per attempt
+	batchRetryBackoff = 50 * time.Millisecond
+)
+
+// BatchCreateRequest is the body of POST /persons/batch
+type BatchCreateRequest struct {
+	Persons []json.RawMessage `json:"persons"`
+}
+
+// BatchItemResult is the outcome for one person of a batch, in request order
+type BatchItemResult struct {
+	Index    int             `json:"index"`
+	PersonID string          `json:"personId,omitempty"`
+	Error    *BatchItemError `json:"error,omitempty"`
+}
+
+// BatchItemError explains why a person of a batch was not created
+type BatchItemError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields lists every invalid field of an INVALID_INPUT error
+	Fields []validation.FieldError `json:"fields,omitempty"`
+}
+
+// BatchCreateResponse summarizes a batch create
+type BatchCreateResponse struct {
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Results []BatchItemResult `json:"results"`
+}
+
+// handleBatchCreate creates up to 25 persons with one BatchWriteItem call. Invalid persons are
+// reported per item and do not stop the others; items DynamoDB leaves unprocessed are retried
+// with backoff. A batch in which every person failed is still answered with 200.
+func handleBatchCreate(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var batch BatchCreateRequest
+	if err := json.Unmarshal([]byte(request.Body), &batch); err != nil {
+		logger.FromContext(ctx).Warn("Failed to parse batch body", "error", err)
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid input for batch create"), nil
+	}
+	if len(batch.Persons) == 0 || len(batch.Persons) > maxBatchPersons {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "persons must contain between 1 and 25 entries"), nil
+	}
+
+	tenant, err := writeTenant(ctx, request)
+	if err != nil {
+		return errorResponse(request, http.StatusForbidden, errCodeForbidden, err.Error()), nil
+	}
+
+	results := make([]BatchItemResult, len(batch.Persons))
+	// pending maps the personId of every item to write to its index in the batch
+	pending := map[string]int{}
+	var writes []types.WriteRequest
+	for i, raw := range batch.Persons {
+		results[i].Index = i
+		person, addressParts, err := decodePerson(ctx, string(raw))
+		if err != nil {
+			results[i].Error = &BatchItemError{Code: errCodeInvalidInput, Message: "Invalid person"}
+			continue
+		}
+		if errs := validation.Validate(person); len(errs) > 0 {
+			results[i].Error = &BatchItemError{Code: errCodeInvalidInput, Message: errs[0].Error(), Fields: errs}
+			continue
+		}
+
+		person.TenantID = tenant
+		personID := uuid.New().String()
+		item, err := newPersonItem(ctx, personID, person, addressParts)
+		if err != nil {
+			return internalErrorResponse(ctx, request, "encrypt item", err), nil
+		}
+		pending[personID] = i
+		writes = append(writes, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+
+	unprocessed, err := batchWritePersons(ctx, writes)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "batch write items", err), nil
+	}
+	for _, write := range unprocessed {
+		personID := write.PutRequest.Item["personId"].(*types.AttributeValueMemberS).Value
+		results[pending[personID]].Error = &BatchItemError{Code: errCodeThrottled, Message: "The person was not written, please retry"}
+		delete(pending, personID)
+	}
+	for personID, i := range pending {
+		results[i].PersonID = personID
+	}
+
+	response := BatchCreateResponse{Created: len(pending), Failed: len(batch.Persons) - len(pending), Results: results}
+	metrics.Emit(nil, nil,
+		metrics.Count("BatchCreated", response.Created),
+		metrics.Count("BatchFailed", response.Failed),
+	)
+	logger.FromContext(ctx).Info("Batch create finished", "created", response.Created, "failed", response.Failed)
+	if apiVersion(ctx) == apiV2 {
+		return envelopeResponse(ctx, request, http.StatusOK, response, nil)
+	}
+	return jsonResponse(ctx, request, http.StatusOK, response)
+}
+
+// batchWritePersons writes the items, resubmitting unprocessed ones with exponential backoff.
+// It returns the writes that were still unprocessed after the last attempt.
+func batchWritePersons(ctx context.Context, writes []types.WriteRequest) ([]types.WriteRequest, error) {
+	backoff := batchRetryBackoff
+	for attempt := 1; len(writes) > 0; attempt++ {
+		result, err := svc.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{tableName: writes},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writes = result.UnprocessedItems[tableName]
+		if len(writes) == 0 || attempt == maxBatchAttempts {
+			break
+		}
+
+		logger.FromContext(ctx).Warn("Retrying unprocessed batch items", "unprocessed", len(writes), "attempt", attempt)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return writes, nil
+		}
+		backoff *= 2
+	}
+	return writes, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// captureBucket enables debug capture of failing requests when set (DEBUG_CAPTURE_BUCKET).
+// Objects expire through the bucket lifecycle rule, so nothing is cleaned up here.
+var captureBucket = settings.DebugCaptureBucket
+
+// sensitiveHeaders are never written to the capture bucket
+var sensitiveHeaders = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"x-api-key":     true,
+}
+
+// CapturedExchange is the request/response pair stored for a failing request
+type CapturedExchange struct {
+	RequestID      string            `json:"requestId"`
+	CapturedAt     string            `json:"capturedAt"`
+	HTTPMethod     string            `json:"httpMethod"`
+	Path           string            `json:"path"`
+	Resource       string            `json:"resource"`
+	PathParameters map[string]string `json:"pathParameters,omitempty"`
+	QueryString    map[string]string `json:"queryStringParameters,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	RequestBody    string            `json:"requestBody,omitempty"`
+	StatusCode     int               `json:"statusCode"`
+	ResponseBody   string            `json:"responseBody,omitempty"`
+}
+
+// captureKey returns the object key of the capture for a request ID
+func captureKey(requestID string) string {
+	return "captures/" + requestID + ".json"
+}
+
+// sanitizeHeaders drops credentials and session headers from a header map
+func sanitizeHeaders(headers map[string]string) map[string]string {
+	sanitized := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if sensitiveHeaders[strings.ToLower(name)] {
+			continue
+		}
+		sanitized[name] = value
+	}
+	return sanitized
+}
+
+// sanitizeBody masks the PII fields of a JSON body the way the logger does. Bodies that are not
+// JSON, e.g. base64-encoded ones, are masked as a whole.
+func sanitizeBody(body string) string {
+	if body == "" {
+		return ""
+	}
+	var generic any
+	if err := json.Unmarshal([]byte(body), &generic); err != nil {
+		return logger.MaskString(body)
+	}
+	sanitized, err := json.Marshal(logger.Sanitize(generic))
+	if err != nil {
+		return logger.MaskString(body)
+	}
+	return string(sanitized)
+}
+
+// sanitizeQuery masks PII query parameters, and the free text of searches
+func sanitizeQuery(query map[string]string) map[string]string {
+	if query == nil {
+		return nil
+	}
+	sanitized := make(map[string]string, len(query))
+	for name, value := range query {
+		if name == "q" || logger.IsPIIField(name) {
+			value = logger.MaskString(value)
+		}
+		sanitized[name] = value
+	}
+	return sanitized
+}
+
+// captureFailure stores a sanitized copy of a 4xx/5xx exchange in the capture bucket. PII in
+// the bodies and query is masked as in the logs (LOG_PII_MODE).
+// Failures to capture are only logged; they must never change the client response.
+func captureFailure(ctx context.Context, request events.APIGatewayProxyRequest, response events.APIGatewayProxyResponse) {
+	if captureBucket == "" || s3Client == nil || response.StatusCode < 400 {
+		return
+	}
+
+	requestID := request.RequestContext.RequestID
+	if requestID == "" {
+		return
+	}
+
+	exchange := CapturedExchange{
+		RequestID:      requestID,
+		CapturedAt:     time.Now().UTC().Format(time.RFC3339),
+		HTTPMethod:     request.HTTPMethod,
+		Path:           request.Path,
+		Resource:       request.Resource,
+		PathParameters: request.PathParameters,
+		QueryString:    sanitizeQuery(request.QueryStringParameters),
+		Headers:        sanitizeHeaders(request.Headers),
+		RequestBody:    sanitizeBody(request.Body),
+		StatusCode:     response.StatusCode,
+		ResponseBody:   sanitizeBody(response.Body),
+	}
+
+	body, err := json.Marshal(exchange)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal debug capture", "error", err)
+		return
+	}
+
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(captureBucket),
+		Key:         aws.String(captureKey(requestID)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to store debug capture", "error", err)
+		return
+	}
+	logger.FromContext(ctx).Info("Stored debug capture", "location", "s3://"+captureBucket+"/"+captureKey(requestID))
+}
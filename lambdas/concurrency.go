@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// versionOf returns the numeric version attribute of an item. Items written before
+// versioning was introduced have no version attribute and are treated as version 0.
+func versionOf(item map[string]types.AttributeValue) int64 {
+	return numberAttribute(item, "version")
+}
+
+// etag formats a version as a strong entity tag
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// parseIfMatch extracts the expected version from an If-Match header.
+// ok is false when the header is absent or "*", i.e. no version check is requested.
+func parseIfMatch(header string) (version int64, ok bool, err error) {
+	value := strings.TrimSpace(header)
+	if value == "" || value == "*" {
+		return 0, false, nil
+	}
+	value = strings.TrimPrefix(value, "W/")
+	value = strings.Trim(value, `"`)
+
+	version, err = strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"aws-lambda-go/internal/accessaudit"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// accessAuditor records unscoped reads of person data (ACCESS_AUDIT_TABLE_NAME)
+var accessAuditor *accessaudit.Auditor
+
+// auditDataAccess records a broad read made by the request's caller. Reads scoped to the
+// caller's own persons are not audited.
+func auditDataAccess(ctx context.Context, request events.APIGatewayProxyRequest, operation string, filter map[string]string, rows int, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	accessAuditor.Record(ctx, accessaudit.Access{
+		Actor:     rateLimitClient(request),
+		Operation: operation,
+		Filter:    filter,
+		Rows:      rows,
+		Duration:  time.Since(start),
+		Outcome:   outcome,
+	})
+}
+
+// listAuditFilter describes the parameters of a list scan, without any of the values returned
+func listAuditFilter(request events.APIGatewayProxyRequest, segments int, partial bool) map[string]string {
+	filter := map[string]string{
+		"segments": strconv.Itoa(segments),
+		"partial":  strconv.FormatBool(partial),
+	}
+	if value := request.QueryStringParameters["includeDeleted"]; value != "" {
+		filter["includeDeleted"] = value
+	}
+	if request.QueryStringParameters["nextToken"] != "" {
+		filter["continued"] = "true"
+	}
+	return filter
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Response formats that can be deprecated like routes, keyed as "format:<name>"
+const (
+	formatLegacyGet = "format:legacy-attribute-values"
+)
+
+// Deprecation describes a deprecated route or response format. Routes are keyed by
+// "METHOD /resource/{param}", formats by their format key.
+type Deprecation struct {
+	// Deprecated is when the route or format was deprecated (Deprecation header)
+	Deprecated time.Time `json:"deprecated"`
+	// Sunset is when it will stop working (Sunset header), if decided
+	Sunset time.Time `json:"sunset,omitempty"`
+	// Link points to migration documentation
+	Link string `json:"link,omitempty"`
+}
+
+// deprecations is read from DEPRECATIONS, a JSON object of keys to deprecations, e.g.
+// {"format:legacy-attribute-values": {"deprecated": "2025-01-01T00:00:00Z", "sunset": "2025-07-01T00:00:00Z"}}
+var deprecations = loadDeprecations(settings.Deprecations)
+
+func loadDeprecations(config string) map[string]Deprecation {
+	loaded := map[string]Deprecation{}
+	if config == "" {
+		return loaded
+	}
+	if err := json.Unmarshal([]byte(config), &loaded); err != nil {
+		logger.FromContext(context.Background()).Error("Ignoring invalid DEPRECATIONS", "error", err)
+		return map[string]Deprecation{}
+	}
+	return loaded
+}
+
+// deprecationUsage collects the deprecated formats a handler served during one request
+type deprecationUsage struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+type deprecationKey struct{}
+
+// useDeprecated records that a request was served with a deprecated response format
+func useDeprecated(ctx context.Context, key string) {
+	usage, ok := ctx.Value(deprecationKey{}).(*deprecationUsage)
+	if !ok {
+		return
+	}
+	usage.mu.Lock()
+	usage.keys = append(usage.keys, key)
+	usage.mu.Unlock()
+}
+
+// deprecationMiddleware sets the Deprecation, Sunset and Link headers (RFC 9745, RFC 8594)
+// when a request used a deprecated route or response format, and counts every such use, so
+// the remaining clients can be found before the sunset.
+func deprecationMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if len(deprecations) == 0 {
+			return next(ctx, request)
+		}
+
+		usage := &deprecationUsage{}
+		ctx = context.WithValue(ctx, deprecationKey{}, usage)
+		response, err := next(ctx, request)
+
+		keys := append([]string{request.HTTPMethod + " " + request.Resource}, usage.keys...)
+		for _, key := range keys {
+			deprecation, ok := deprecations[key]
+			if !ok {
+				continue
+			}
+			deprecation.apply(&response)
+			recordDeprecatedUsage(ctx, request, key)
+		}
+		return response, err
+	}
+}
+
+// apply sets the deprecation headers. When several deprecations apply, the earliest dates win.
+func (d Deprecation) apply(response *events.APIGatewayProxyResponse) {
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	deprecated := d.Deprecated.Unix()
+	if current, err := strconv.ParseInt(trimAt(response.Headers["Deprecation"]), 10, 64); err == nil && current < deprecated {
+		deprecated = current
+	}
+	response.Headers["Deprecation"] = "@" + strconv.FormatInt(deprecated, 10)
+
+	if !d.Sunset.IsZero() {
+		sunset := d.Sunset.UTC()
+		if current, err := http.ParseTime(response.Headers["Sunset"]); err == nil && current.Before(sunset) {
+			sunset = current
+		}
+		response.Headers["Sunset"] = sunset.Format(http.TimeFormat)
+	}
+	if d.Link != "" {
+		link := "<" + d.Link + `>; rel="deprecation"; type="text/html"`
+		// Keep the links the handler set, e.g. the next page of a list
+		if current := response.Headers["Link"]; current != "" {
+			link = current + ", " + link
+		}
+		response.Headers["Link"] = link
+	}
+}
+
+// trimAt strips the "@" of a structured-field date
+func trimAt(value string) string {
+	if len(value) > 0 && value[0] == '@' {
+		return value[1:]
+	}
+	return value
+}
+
+// recordDeprecatedUsage counts a deprecated use by key, with the tenant and caller as properties
+// so the clients still using it can be identified
+func recordDeprecatedUsage(ctx context.Context, request events.APIGatewayProxyRequest, key string) {
+	properties := map[string]interface{}{
+		"route":    request.HTTPMethod + " " + request.Resource,
+		"tenantId": headerValue(request, "X-Tenant-Id"),
+		"client":   rateLimitClient(request),
+	}
+	metrics.Emit(map[string]string{"Deprecation": key}, properties, metrics.Count("DeprecatedUsage", 1))
+	logger.FromContext(ctx).Info("Deprecated usage", "deprecation", key, "client", properties["client"])
+}
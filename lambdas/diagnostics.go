@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"aws-lambda-go/internal/config"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// dependencyCheckTimeout bounds each reachability check of GET /admin/diagnostics
+const dependencyCheckTimeout = 2 * time.Second
+
+// Diagnostics is the body of GET /admin/diagnostics, for comparing how two deployments are
+// configured and whether they can reach what they depend on
+type Diagnostics struct {
+	Lambda      string `json:"lambda"`
+	Environment string `json:"environment,omitempty"`
+	Region      string `json:"region,omitempty"`
+	GoVersion   string `json:"goVersion"`
+	// Modules are the versions of the AWS modules the lambda was built with
+	Modules       map[string]string `json:"modules"`
+	Features      map[string]bool   `json:"features"`
+	Configuration []config.Variable `json:"configuration"`
+	// Healthy is set when every dependency was reachable
+	Healthy      bool               `json:"healthy"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// DependencyStatus is the outcome of one reachability check
+type DependencyStatus struct {
+	Name      string `json:"name"`
+	Target    string `json:"target"`
+	Reachable bool   `json:"reachable"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// dependency is a resource the lambda uses, with a cheap read-only call that proves the
+// lambda can reach it with its permissions
+type dependency struct {
+	name   string
+	target string
+	check  func(ctx context.Context) error
+}
+
+// enabledFeatures lists the optional features and whether this deployment has them on
+func enabledFeatures() map[string]bool {
+	return map[string]bool{
+		"authRequired":    settings.AuthRequired,
+		"idempotency":     settings.IdempotencyTableName != "",
+		"rateLimit":       settings.RateLimitTableName != "",
+		"notifications":   settings.NotificationsTableName != "",
+		"templates":       settings.TemplatesTableName != "",
+		"imports":         settings.ImportsTableName != "",
+		"exports":         settings.ExportsTableName != "",
+		"legalHolds":      settings.LegalHoldsTableName != "",
+		"anonymization":   settings.AnonymizationsTableName != "",
+		"replays":         settings.ReplaysTableName != "",
+		"search":          searchIndex.Enabled(),
+		"roles":           settings.RolesTableName != "",
+		"debugCapture":    settings.DebugCaptureBucket != "",
+		"gdprAuditSearch": settings.AuditLogGroup != "",
+		"piiEncryption":   fieldEncryptor.Enabled(),
+		"identityHashes":  identityHasher.Enabled(),
+		"maintenanceMode": maintenanceMode,
+		"standbyRegion":   regionRole == regionStandby,
+		"deprecations":    settings.Deprecations != "",
+		"responseFields":  settings.ResponseFieldRules != "",
+		"accessPolicy":    accessPolicy != nil,
+	}
+}
+
+// dependencies returns the configured resources of the lambda
+func dependencies() []dependency {
+	tables := []struct{ name, table string }{
+		{"personsTable", settings.TableName},
+		{"idempotencyTable", settings.IdempotencyTableName},
+		{"rateLimitTable", settings.RateLimitTableName},
+		{"notificationsTable", settings.NotificationsTableName},
+		{"templatesTable", settings.TemplatesTableName},
+		{"importsTable", settings.ImportsTableName},
+		{"exportsTable", settings.ExportsTableName},
+		{"legalHoldsTable", settings.LegalHoldsTableName},
+		{"anonymizationsTable", settings.AnonymizationsTableName},
+		{"replaysTable", settings.ReplaysTableName},
+		{"rolesTable", settings.RolesTableName},
+		{"pipelineStatusTable", settings.PipelineStatusTableName},
+	}
+	buckets := []struct{ name, bucket string }{
+		{"templatesBucket", settings.TemplatesBucket},
+		{"exportBucket", settings.ExportBucket},
+		{"legalHoldBucket", settings.LegalHoldBucket},
+		{"debugCaptureBucket", settings.DebugCaptureBucket},
+	}
+	queues := []struct{ name, url string }{
+		{"exportQueue", settings.ExportQueueURL},
+		{"anonymizeQueue", settings.AnonymizeQueueURL},
+	}
+
+	var deps []dependency
+	for _, t := range tables {
+		if t.table == "" {
+			continue
+		}
+		table := t.table
+		deps = append(deps, dependency{name: t.name, target: table, check: func(ctx context.Context) error {
+			_, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+			return err
+		}})
+	}
+	for _, b := range buckets {
+		if b.bucket == "" {
+			continue
+		}
+		bucket := b.bucket
+		deps = append(deps, dependency{name: b.name, target: bucket, check: func(ctx context.Context) error {
+			_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+			return err
+		}})
+	}
+	for _, q := range queues {
+		if q.url == "" {
+			continue
+		}
+		url := q.url
+		deps = append(deps, dependency{name: q.name, target: url, check: func(ctx context.Context) error {
+			_, err := sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+				QueueUrl:       aws.String(url),
+				AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameQueueArn},
+			})
+			return err
+		}})
+	}
+	deps = append(deps, dependency{name: "eventBus", target: settings.EventBusName, check: func(ctx context.Context) error {
+		_, err := eventsClient.DescribeEventBus(ctx, &eventbridge.DescribeEventBusInput{Name: aws.String(settings.EventBusName)})
+		return err
+	}})
+	return deps
+}
+
+// checkDependencies runs every reachability check at once, each with its own timeout
+func checkDependencies(ctx context.Context, deps []dependency) []DependencyStatus {
+	statuses := make([]DependencyStatus, len(deps))
+	var wg sync.WaitGroup
+	for i, dep := range deps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := dep.check(checkCtx)
+			statuses[i] = DependencyStatus{Name: dep.name, Target: dep.target, Reachable: err == nil, LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				statuses[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+// awsModules returns the versions of the AWS modules in the build
+func awsModules() map[string]string {
+	modules := map[string]string{}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return modules
+	}
+	for _, dep := range info.Deps {
+		if strings.HasPrefix(dep.Path, "github.com/aws/") {
+			modules[dep.Path] = dep.Version
+		}
+	}
+	return modules
+}
+
+// handleDiagnostics reports the resolved configuration (secrets redacted), module versions,
+// enabled features and the reachability of every configured dependency
+func handleDiagnostics(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	diagnostics := Diagnostics{
+		Lambda:        "http",
+		Environment:   settings.Environment,
+		Region:        settings.AWSRegion,
+		GoVersion:     runtime.Version(),
+		Modules:       awsModules(),
+		Features:      enabledFeatures(),
+		Configuration: config.Resolved(),
+		Healthy:       true,
+		Dependencies:  checkDependencies(ctx, dependencies()),
+	}
+	for _, status := range diagnostics.Dependencies {
+		diagnostics.Healthy = diagnostics.Healthy && status.Reachable
+	}
+	return jsonResponse(ctx, request, http.StatusOK, diagnostics)
+}
+
+// logSelfCheck logs the configuration and enabled features once at cold start, so every
+// deployment's setup can be read from its logs. Dependencies are only checked on request.
+func logSelfCheck() {
+	var enabled []string
+	for feature, on := range enabledFeatures() {
+		if on {
+			enabled = append(enabled, feature)
+		}
+	}
+	sort.Strings(enabled)
+	var configured []any
+	for _, variable := range config.Resolved() {
+		if !variable.Default {
+			configured = append(configured, variable.Name, variable.Value)
+		}
+	}
+	slog.Info("Startup self-check",
+		"goVersion", runtime.Version(),
+		"features", enabled,
+		slog.Group("configuration", configured...),
+	)
+}
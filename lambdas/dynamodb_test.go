@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// ddbCall is one request the fake DynamoDB received
+type ddbCall struct {
+	operation string
+	input     map[string]interface{}
+}
+
+// ddbError is returned by a fake DynamoDB responder to fail the call with an error code
+type ddbError string
+
+// fakeDynamoDB answers DynamoDB calls with a responder and records them
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	calls []ddbCall
+}
+
+// useFakeDynamoDB points svc at a fake DynamoDB for the duration of the test. The responder
+// returns the output of each call as JSON, or a ddbError; nil answers with an empty output.
+func useFakeDynamoDB(t *testing.T, respond func(operation string, input map[string]interface{}) interface{}) *fakeDynamoDB {
+	t.Helper()
+	fake := &fakeDynamoDB{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, operation, _ := strings.Cut(r.Header.Get("X-Amz-Target"), ".")
+		var input map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Errorf("decode %s input: %v", operation, err)
+		}
+		fake.mu.Lock()
+		fake.calls = append(fake.calls, ddbCall{operation: operation, input: input})
+		fake.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		output := respond(operation, input)
+		if code, ok := output.(ddbError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.dynamodb.v20120810#" + string(code), "message": string(code)})
+			return
+		}
+		if output == nil {
+			output = map[string]interface{}{}
+		}
+		json.NewEncoder(w).Encode(output)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := svc
+	svc = dynamodb.NewFromConfig(aws.Config{
+		Region:       "us-east-1",
+		Credentials:  aws.AnonymousCredentials{},
+		BaseEndpoint: aws.String(server.URL),
+	})
+	t.Cleanup(func() { svc = previous })
+	return fake
+}
+
+// operations returns the operations called so far, in order
+func (f *fakeDynamoDB) operations() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	operations := make([]string, 0, len(f.calls))
+	for _, call := range f.calls {
+		operations = append(operations, call.operation)
+	}
+	return operations
+}
+
+// callsTo returns the inputs of the calls to an operation, in order
+func (f *fakeDynamoDB) callsTo(operation string) []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var inputs []map[string]interface{}
+	for _, call := range f.calls {
+		if call.operation == operation {
+			inputs = append(inputs, call.input)
+		}
+	}
+	return inputs
+}
+
+// stringItem returns a GetItem output whose item has the given string attributes
+func stringItem(attributes map[string]string) map[string]interface{} {
+	item := map[string]interface{}{}
+	for name, value := range attributes {
+		item[name] = map[string]string{"S": value}
+	}
+	return map[string]interface{}{"Item": item}
+}
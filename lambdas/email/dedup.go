@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// dedupStore limits notifications to one per person and event type within a window,
+// e.g. at most one "profile updated" email per hour during bulk corrections. Each send
+// claims a marker item that DynamoDB TTL expires after the window.
+type dedupStore struct {
+	tableName string
+	windows   map[string]time.Duration
+	dynamo    *dynamodb.Client
+}
+
+func newDedupStore(dynamo *dynamodb.Client) *dedupStore {
+	return &dedupStore{
+		tableName: settings.DedupTableName,
+		windows:   parseDedupWindows(settings.DedupWindows),
+		dynamo:    dynamo,
+	}
+}
+
+// parseDedupWindows reads windows per event name, e.g. "MODIFY=1h,INSERT=24h".
+// Invalid entries are ignored.
+func parseDedupWindows(value string) map[string]time.Duration {
+	windows := map[string]time.Duration{}
+	for _, entry := range strings.Split(value, ",") {
+		eventName, window, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(window))
+		if err != nil || duration <= 0 {
+			continue
+		}
+		windows[strings.ToUpper(strings.TrimSpace(eventName))] = duration
+	}
+	return windows
+}
+
+// window returns the suppression window for an event name, or 0 when there is none
+func (d *dedupStore) window(eventName string) time.Duration {
+	if d.tableName == "" {
+		return 0
+	}
+	return d.windows[eventName]
+}
+
+func dedupKey(personID string, eventName string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"dedupKey": &types.AttributeValueMemberS{Value: personID + "#" + eventName},
+	}
+}
+
+// claim marks a notification as sent for the window. It returns false when another
+// notification for the same person and event type was already sent within the window.
+func (d *dedupStore) claim(ctx context.Context, personID string, eventName string) (bool, error) {
+	window := d.window(eventName)
+	if window == 0 || personID == "" {
+		return true, nil
+	}
+
+	now := time.Now()
+	item := dedupKey(personID, eventName)
+	item["expiresAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(window).Unix(), 10)}
+
+	// TTL deletes expired markers lazily, so an expired marker that still exists is reclaimed
+	expr, err := expression.NewBuilder().WithCondition(expression.
+		AttributeNotExists(expression.Name("dedupKey")).
+		Or(expression.Name("expiresAt").LessThan(expression.Value(now.Unix())))).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	_, err = d.dynamo.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(d.tableName),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim notification dedup marker: %w", err)
+	}
+	return true, nil
+}
+
+// release removes a marker again, so a notification that failed to send can be retried
+func (d *dedupStore) release(ctx context.Context, personID string, eventName string) error {
+	if d.window(eventName) == 0 || personID == "" {
+		return nil
+	}
+	_, err := d.dynamo.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       dedupKey(personID, eventName),
+	})
+	return err
+}
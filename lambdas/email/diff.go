@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"strings"
+	"unicode"
+)
+
+// fieldChange is one entry of the changedFields list the stream lambda adds to MODIFY events
+type fieldChange struct {
+	Field  string
+	Label  string
+	Before string
+	After  string
+}
+
+// changesTableTemplate renders the "what changed" table: the old value struck through,
+// the new value highlighted
+var changesTableTemplate = htmltemplate.Must(htmltemplate.New("changes-table").Parse(
+	`<table style="border-collapse:collapse">` +
+		`<tr><th align="left">Field</th><th align="left">Before</th><th align="left">After</th></tr>` +
+		`{{range .}}<tr>` +
+		`<td style="padding:4px 8px">{{.Label}}</td>` +
+		`<td style="padding:4px 8px;color:#888"><del>{{if .Before}}{{.Before}}{{else}}(empty){{end}}</del></td>` +
+		`<td style="padding:4px 8px"><mark style="background:#fff3a3"><strong>{{if .After}}{{.After}}{{else}}(empty){{end}}</strong></mark></td>` +
+		`</tr>{{end}}</table>`))
+
+// mergeChangedFields combines the changedFields of all events for one person in a batch,
+// keeping the value before the first change and after the last one. Fields that ended up
+// unchanged are dropped; the order is the order in which fields were first changed.
+func mergeChangedFields(changes []*personEvent) []fieldChange {
+	var merged []fieldChange
+	index := map[string]int{}
+	for _, change := range changes {
+		for _, entry := range change.event.ChangedFields {
+			if entry.Field == "" {
+				continue
+			}
+			if i, ok := index[entry.Field]; ok {
+				merged[i].After = entry.After
+				continue
+			}
+			index[entry.Field] = len(merged)
+			merged = append(merged, fieldChange{Field: entry.Field, Label: fieldLabel(entry.Field), Before: entry.Before, After: entry.After})
+		}
+	}
+
+	result := merged[:0]
+	for _, change := range merged {
+		if change.Before != change.After {
+			result = append(result, change)
+		}
+	}
+	return result
+}
+
+// renderChangesTable renders the changes as an HTML table for email bodies
+func renderChangesTable(changes []fieldChange) (htmltemplate.HTML, error) {
+	var table bytes.Buffer
+	if err := changesTableTemplate.Execute(&table, changes); err != nil {
+		return "", err
+	}
+	return htmltemplate.HTML(table.String()), nil
+}
+
+// fieldLabel turns an attribute name into a label, e.g. phoneNumber -> Phone number
+func fieldLabel(name string) string {
+	var label strings.Builder
+	for i, r := range name {
+		switch {
+		case i == 0:
+			label.WriteRune(unicode.ToUpper(r))
+		case unicode.IsUpper(r):
+			label.WriteRune(' ')
+			label.WriteRune(unicode.ToLower(r))
+		default:
+			label.WriteRune(r)
+		}
+	}
+	return label.String()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// digestTemplateName is the stored template of digest emails; the built-in one is PersonDigest
+	digestTemplateName = "person-digest"
+	// digestRetention is how long events stay buffered past their interval when their digest
+	// keeps failing, before DynamoDB TTL drops them
+	digestRetention = 7 * 24 * time.Hour
+)
+
+// digestStore buffers the email notifications of DIGEST_EVENT_TYPES, so bulk imports and
+// corrections send one summary per recipient and interval instead of an email per change.
+// The scheduled digest run sends the summaries of the recipients whose interval has passed.
+type digestStore struct {
+	tableName  string
+	interval   time.Duration
+	eventTypes map[string]bool
+	dynamo     *dynamodb.Client
+}
+
+func newDigestStore(dynamo *dynamodb.Client) *digestStore {
+	eventTypes := map[string]bool{}
+	for _, eventName := range settings.DigestEventTypes {
+		eventTypes[eventName] = true
+	}
+	return &digestStore{
+		tableName:  settings.DigestTableName,
+		interval:   settings.DigestInterval,
+		eventTypes: eventTypes,
+		dynamo:     dynamo,
+	}
+}
+
+// enabled reports whether digest mode is configured
+func (d *digestStore) enabled() bool {
+	return d.tableName != ""
+}
+
+// covers reports whether emails of an event name are sent as part of a digest
+func (d *digestStore) covers(eventName string) bool {
+	return d.enabled() && d.eventTypes[eventName]
+}
+
+// digestEntry is one buffered event. Body is the queue message as received, so PII stays
+// encrypted in the buffer and the event is parsed again when the digest is sent.
+type digestEntry struct {
+	PersonID   string `dynamodbav:"personId"`
+	EventID    string `dynamodbav:"eventId"`
+	Body       string `dynamodbav:"body"`
+	BufferedAt string `dynamodbav:"bufferedAt"`
+	ExpiresAt  int64  `dynamodbav:"expiresAt"`
+}
+
+// add buffers the changes of one person. A redelivered event keeps the entry it was first
+// buffered with.
+func (d *digestStore) add(ctx context.Context, changes []*personEvent) error {
+	now := time.Now().UTC()
+	expr, err := expression.NewBuilder().WithCondition(expression.AttributeNotExists(expression.Name("eventId"))).Build()
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		eventID := change.event.EventID
+		if eventID == "" {
+			eventID = change.message.MessageId
+		}
+		item, err := attributevalue.MarshalMap(digestEntry{
+			PersonID:   change.personID,
+			EventID:    eventID,
+			Body:       change.message.Body,
+			BufferedAt: now.Format(time.RFC3339Nano),
+			ExpiresAt:  now.Add(d.interval + digestRetention).Unix(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = d.dynamo.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(d.tableName),
+			Item:                      item,
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		var conditionErr *types.ConditionalCheckFailedException
+		if err != nil && !errors.As(err, &conditionErr) {
+			return fmt.Errorf("failed to buffer event %s for the digest: %w", eventID, err)
+		}
+	}
+	logger.FromContext(ctx).Info("Buffered changes for the digest", "eventName", changes[len(changes)-1].eventName, "changeCount", len(changes))
+	metrics.Emit(nil, nil, metrics.Count("ChangesDigested", len(changes)))
+	return nil
+}
+
+// flush sends the digests that are due: one email per recipient whose oldest buffered event
+// is at least one interval old. Digests that fail stay buffered for the next run.
+func (d *digestStore) flush(ctx context.Context) error {
+	if !d.enabled() {
+		logger.FromContext(ctx).Info("Digest mode is not configured (DIGEST_TABLE_NAME), nothing to send")
+		return nil
+	}
+	due, err := d.due(ctx, time.Now().UTC().Add(-d.interval))
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, personID := range due {
+		if err := d.send(ctx, personID); err != nil {
+			logger.FromContext(ctx).Error("Failed to send digest", "personId", personID, "class", errclass.Classify(err), "error", err)
+			failed++
+		}
+	}
+	logger.FromContext(ctx).Info("Digest run completed", "due", len(due), "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d digests failed", failed, len(due))
+	}
+	return nil
+}
+
+// due returns the recipients with an event buffered before the cutoff, in ID order
+func (d *digestStore) due(ctx context.Context, cutoff time.Time) ([]string, error) {
+	projection := expression.NamesList(expression.Name("personId"), expression.Name("bufferedAt"))
+	expr, err := expression.NewBuilder().WithProjection(projection).Build()
+	if err != nil {
+		return nil, err
+	}
+	paginator := dynamodb.NewScanPaginator(d.dynamo, &dynamodb.ScanInput{
+		TableName:                aws.String(d.tableName),
+		ProjectionExpression:     expr.Projection(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	recipients := map[string]bool{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the digest buffer: %w", err)
+		}
+		var entries []digestEntry
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &entries); err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			bufferedAt, err := time.Parse(time.RFC3339Nano, entry.BufferedAt)
+			if err != nil || !bufferedAt.After(cutoff) {
+				recipients[entry.PersonID] = true
+			}
+		}
+	}
+	due := make([]string, 0, len(recipients))
+	for personID := range recipients {
+		due = append(due, personID)
+	}
+	sort.Strings(due)
+	return due, nil
+}
+
+// send sends the digest of one recipient and removes the events it covered from the buffer.
+// Events that can never be parsed are dropped with a log line instead of blocking the digest.
+func (d *digestStore) send(ctx context.Context, personID string) (err error) {
+	ctx = logger.With(ctx, "personId", personID)
+	ctx, span := tracing.Tracer().Start(ctx, "send digest")
+	defer func() { tracing.End(span, err) }()
+
+	entries, err := d.entries(ctx, personID)
+	if err != nil {
+		return err
+	}
+	var changes []*personEvent
+	for _, entry := range entries {
+		change, err := parsePersonEvent(ctx, events.SQSMessage{MessageId: entry.EventID, Body: entry.Body})
+		if err != nil && errclass.Classify(err).Retryable() {
+			return err
+		}
+		if err != nil {
+			logger.FromContext(ctx).Error("Dropping buffered event that cannot be parsed", "eventId", entry.EventID, "error", err)
+			continue
+		}
+		if change != nil {
+			changes = append(changes, change)
+		}
+	}
+	span.SetAttributes(attribute.Int("notification.change_count", len(changes)))
+
+	if len(changes) > 0 {
+		if err := sendDigest(ctx, changes); err != nil {
+			return err
+		}
+	}
+	return d.remove(ctx, entries)
+}
+
+// entries reads the buffered events of a recipient, oldest first
+func (d *digestStore) entries(ctx context.Context, personID string) ([]digestEntry, error) {
+	expr, err := expression.NewBuilder().WithKeyCondition(expression.Key("personId").Equal(expression.Value(personID))).Build()
+	if err != nil {
+		return nil, err
+	}
+	paginator := dynamodb.NewQueryPaginator(d.dynamo, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.tableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+	})
+	var entries []digestEntry
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the digest buffer: %w", err)
+		}
+		var pageEntries []digestEntry
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageEntries); err != nil {
+			return nil, err
+		}
+		entries = append(entries, pageEntries...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].BufferedAt < entries[j].BufferedAt })
+	return entries, nil
+}
+
+// remove deletes sent entries from the buffer. BatchWriteItem takes up to 25 requests;
+// unprocessed ones are sent again.
+func (d *digestStore) remove(ctx context.Context, entries []digestEntry) error {
+	for start := 0; start < len(entries); start += 25 {
+		var requests []types.WriteRequest
+		for _, entry := range entries[start:min(start+25, len(entries))] {
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{
+				"personId": &types.AttributeValueMemberS{Value: entry.PersonID},
+				"eventId":  &types.AttributeValueMemberS{Value: entry.EventID},
+			}}})
+		}
+		pending := map[string][]types.WriteRequest{d.tableName: requests}
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt*50) * time.Millisecond)
+			}
+			output, err := d.dynamo.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				return fmt.Errorf("failed to clear the digest buffer: %w", err)
+			}
+			pending = output.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+// sendDigest sends one email summarizing a recipient's buffered changes, oldest first. The
+// latest change is the recipient; its preferences and email route apply. Each change is
+// available to the template in "changes" with its eventName, eventType and changedFields.
+func sendDigest(ctx context.Context, changes []*personEvent) (err error) {
+	latest := changes[len(changes)-1]
+	start := time.Now()
+	defer func() {
+		metrics.Emit(
+			map[string]string{"Channel": channelEmail, "Outcome": metrics.ErrorOutcome(err)},
+			nil,
+			metrics.Count("DigestsSent", 1),
+			metrics.Count("ChangesNotified", len(changes)),
+			metrics.Duration("NotificationDuration", time.Since(start)),
+		)
+	}()
+
+	summaries := make([]map[string]interface{}, 0, len(changes))
+	for _, change := range changes {
+		summaries = append(summaries, map[string]interface{}{
+			"eventName":     change.eventName,
+			"eventType":     eventType(change.detailType, change.eventName),
+			"changedFields": mergeChangedFields([]*personEvent{change}),
+			"detail":        change.data,
+		})
+	}
+	data := map[string]interface{}{
+		"changes":     summaries,
+		"changeCount": len(changes),
+		"firstName":   latest.person.FirstName,
+		"lastName":    latest.person.LastName,
+		"email":       latest.person.Email,
+		"phoneNumber": latest.person.PhoneNumber,
+	}
+
+	var notificationID string
+	if notifications.enabled() {
+		notificationID, err = notifications.create(ctx, latest.personID, channelEmail, digestTemplateName)
+		if err != nil {
+			return err
+		}
+	}
+	if !latest.person.Allows(channelEmail) {
+		logger.FromContext(ctx).Info("Skipping digest: recipient opted out", "channel", channelEmail)
+		if notificationID != "" {
+			return notifications.setStatus(ctx, latest.personID, notificationID, statusSuppressed, "opted out")
+		}
+		return nil
+	}
+	return sendEmail(ctx, latest.personID, latest.person, digestTemplateName, "PersonDigest", routes.resolve(latest.person), notificationID, data)
+}
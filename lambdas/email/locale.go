@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// defaultLocale is the language of the built-in templates at the top of templates/ and of
+// stored templates without a locale suffix
+const defaultLocale = "en"
+
+// localeChain returns the locales to try for a person's locale, most specific first and ending
+// with the default locale, e.g. fr-CA -> fr-ca, fr, en
+func localeChain(locale string) []string {
+	locale = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+	var chain []string
+	for locale != "" {
+		if locale != defaultLocale {
+			chain = append(chain, locale)
+		}
+		cut := strings.LastIndex(locale, "-")
+		if cut < 0 {
+			break
+		}
+		locale = locale[:cut]
+	}
+	return append(chain, defaultLocale)
+}
+
+// localizedName names a template in a locale: built-in templates by their directory, e.g.
+// fr/PersonCreated, stored ones by a suffix, e.g. person-insert-fr. The default locale keeps
+// the plain name.
+func localizedName(name string, locale string, builtin bool) string {
+	switch {
+	case locale == defaultLocale:
+		return name
+	case builtin:
+		return locale + "/" + name
+	default:
+		return name + "-" + locale
+	}
+}
+
+// pickLocale chooses the template of a notification in the person's language. Each locale of
+// the chain is tried in turn: its active stored template, then its built-in one, as reported
+// by hasBuiltin. It returns the stored template and its name when one wins, and the chosen
+// locale, which is empty when no locale has a template.
+func pickLocale(ctx context.Context, name string, locale string, hasBuiltin func(locale string) bool) (stored *cachedTemplate, storedName string, chosen string, err error) {
+	for _, chosen := range localeChain(locale) {
+		if templates.enabled() {
+			storedName := localizedName(name, chosen, false)
+			stored, err := templates.active(ctx, storedName)
+			if err != nil {
+				return nil, "", "", err
+			}
+			if stored != nil {
+				return stored, storedName, chosen, nil
+			}
+		}
+		if hasBuiltin(chosen) {
+			return nil, "", chosen, nil
+		}
+	}
+	return nil, "", "", nil
+}
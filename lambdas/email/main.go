@@ -3,29 +3,584 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
 
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/consumer"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/fieldcrypt"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/internal/slack"
+	"aws-lambda-go/internal/tracing"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// baseRetryDelaySeconds is the visibility timeout applied after the first failed attempt
+	baseRetryDelaySeconds = 30
+	// maxRetryDelaySeconds caps the visibility timeout (SQS allows up to 12 hours)
+	maxRetryDelaySeconds = 15 * 60
+)
+
+// settings are loaded before the package variables that read them; main stops the lambda
+// when they are invalid
+var settings, settingsErr = config.LoadEmail()
+
+var (
+	queueURL      string
+	deadLetterURL string
+	sqsClient     *sqs.Client
+	templates     *templateStore
+	notifications *notificationStore
+	sms           *smsSender
+	dedup         *dedupStore
+	digests       *digestStore
+	undeliverable *undeliverableMarker
+	mailer        *emailSender
+	pii           *fieldcrypt.Encryptor
+	opsAlerts     = slack.New(settings.SlackWebhookURL, settings.Environment, "email")
 )
 
-func handler(ctx context.Context, event map[string]interface{}) error {
-	// Print the received event for debugging purposes
-	eventJson, err := json.MarshalIndent(event, "", "  ")
+func init() {
+	logger.Init("email")
+	metrics.Init("email")
+	queueURL = settings.QueueURL // Used to back off failed messages
+	// Messages that fail permanently go here right away instead of after every retry
+	deadLetterURL = settings.DeadLetterQueueURL
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	if err := tracing.Init(context.TODO(), "email"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	metrics.InstrumentDynamoDB(&cfg)
+	sqsClient = sqs.NewFromConfig(cfg)
+	// Retries, deadlines and the throttling breaker from DYNAMODB_* (see ddbclient)
+	dynamoClient := ddbclient.New(cfg, settings.DynamoDB)
+	templates = newTemplateStore(dynamoClient, s3.NewFromConfig(cfg))
+	notifications = newNotificationStore(dynamoClient)
+	sms = newSMSSender(sns.NewFromConfig(cfg), dynamoClient)
+	dedup = newDedupStore(dynamoClient)
+	digests = newDigestStore(dynamoClient)
+	undeliverable = newUndeliverableMarker(dynamoClient)
+	mailer = newEmailSender(cfg)
+	pii = fieldcrypt.New(cfg, settings.PII.KMSKeyID, settings.PII.Fields)
+}
+
+// templateName maps a stream event to the notification template rendered for it,
+// e.g. INSERT -> person-insert
+func templateName(eventName string) string {
+	return "person-" + strings.ToLower(eventName)
+}
+
+// personEvent is a person change event parsed from an email queue message
+type personEvent struct {
+	message events.SQSMessage
+	event   models.PersonChangedEvent
+	// person is decoded from the event's image, with PII decrypted
+	person models.Person
+	// data is the event detail as template data, with PII decrypted
+	data map[string]interface{}
+	// detailType selects the built-in template, e.g. PersonCreated; stream events carry DynamoDBStreamEvent
+	detailType    string
+	eventName     string
+	personID      string
+	correlationID string
+}
+
+// parsePersonEvent parses and checks an EventBridge person event delivered through the email
+// queue. Malformed events, and events of a newer schema than this lambda understands, fail
+// permanently, so they go to the dead-letter queue instead of being retried. Events outside
+// the person catalog, erasures and synthetic events have nothing to notify and return nil.
+func parsePersonEvent(ctx context.Context, message events.SQSMessage) (*personEvent, error) {
+	var envelope events.CloudWatchEvent
+	if err := json.Unmarshal([]byte(message.Body), &envelope); err != nil {
+		return nil, errclass.Mark(errclass.Permanent, fmt.Errorf("message %s is not an EventBridge event: %w", message.MessageId, err))
+	}
+	if envelope.ID == "" || envelope.Source == "" || envelope.DetailType == "" || len(envelope.Detail) == 0 {
+		return nil, errclass.New(errclass.Permanent, fmt.Sprintf("message %s is not an EventBridge event: id, source, detail-type and detail are required", message.MessageId))
+	}
+
+	changed, err := personevents.Parse(envelope)
+	if errors.Is(err, personevents.ErrNotPersonEvent) {
+		logger.FromContext(ctx).Info("Ignoring event outside the person catalog", "eventId", envelope.ID, "source", envelope.Source, "detailType", envelope.DetailType, "messageId", message.MessageId)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errclass.Mark(errclass.Permanent, fmt.Errorf("message %s: %w", message.MessageId, err))
+	}
+	logger.FromContext(ctx).Info("Received person event", "eventId", changed.ID, "detailType", envelope.DetailType, "eventName", changed.EventName,
+		"schemaVersion", changed.SchemaVersion, "messageId", message.MessageId, "correlationId", changed.CorrelationID)
+	// Nothing happened to the person of an erasure or a synthetic backfill event
+	if changed.EventName == personevents.EventErase || changed.Synthetic {
+		return nil, nil
+	}
+	// Neither did the person's own data change when their address was marked undeliverable
+	if changed.EventName == personevents.EventModify && onlyDeliveryFields(changed.ChangedFields) {
+		return nil, nil
+	}
+
+	// Templates are rendered with the detail's own field names, so it is read once more as the stream lambda wrote it
+	var event models.PersonChangedEvent
+	if err := json.Unmarshal(personevents.UnwrapCloudEvent(envelope.Detail), &event); err != nil {
+		return nil, errclass.Mark(errclass.Permanent, fmt.Errorf("message %s has an invalid detail: %w", message.MessageId, err))
+	}
+	if err := decryptEvent(ctx, changed.PersonID, &event); err != nil {
+		return nil, fmt.Errorf("message %s: %w", message.MessageId, err)
+	}
+	person, err := event.Person()
+	if err != nil {
+		return nil, errclass.Mark(errclass.Permanent, fmt.Errorf("message %s has an invalid image: %w", message.MessageId, err))
+	}
+	data, err := templateData(event)
+	if err != nil {
+		return nil, fmt.Errorf("message %s: %w", message.MessageId, err)
+	}
+
+	return &personEvent{
+		message:       message,
+		event:         event,
+		person:        person,
+		data:          data,
+		detailType:    envelope.DetailType,
+		eventName:     changed.EventName,
+		personID:      changed.PersonID,
+		correlationID: changed.CorrelationID,
+	}, nil
+}
+
+// decryptEvent replaces the encrypted PII attributes of the stream image and the
+// before/after values of changedFields with their plaintext
+func decryptEvent(ctx context.Context, personID string, event *models.PersonChangedEvent) error {
+	for name, value := range event.Image {
+		if value.DataType() != events.DataTypeString || !fieldcrypt.IsEncrypted(value.String()) {
+			continue
+		}
+		plaintext, err := pii.Decrypt(ctx, personID, name, value.String())
+		if err != nil {
+			return err
+		}
+		event.Image[name] = events.NewStringAttribute(plaintext)
+	}
+
+	for i := range event.ChangedFields {
+		change := &event.ChangedFields[i]
+		for _, value := range []*string{&change.Before, &change.After} {
+			if !fieldcrypt.IsEncrypted(*value) {
+				continue
+			}
+			plaintext, err := pii.Decrypt(ctx, personID, change.Field, *value)
+			if err != nil {
+				return err
+			}
+			*value = plaintext
+		}
+	}
+	return nil
+}
+
+// templateData converts an event into the generic form templates are rendered with, keeping
+// the detail's field names (e.g. .dynamodbData.firstName.S) that stored templates refer to
+func templateData(event models.PersonChangedEvent) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(encoded, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// groupByRecipient groups events by person, keeping the order in which persons and their
+// events were received. Events without a personId are never merged.
+func groupByRecipient(personEvents []*personEvent) [][]*personEvent {
+	var groups [][]*personEvent
+	index := map[string]int{}
+	for _, event := range personEvents {
+		if event.personID == "" {
+			groups = append(groups, []*personEvent{event})
+			continue
+		}
+		if i, ok := index[event.personID]; ok {
+			groups[i] = append(groups[i], event)
+			continue
+		}
+		index[event.personID] = len(groups)
+		groups = append(groups, []*personEvent{event})
+	}
+	return groups
+}
+
+// sendNotification sends a single email for all changes to one person in this batch.
+// The latest event selects the template; every event is available to it as "changes".
+func sendNotification(ctx context.Context, changes []*personEvent) (err error) {
+	latest := changes[len(changes)-1]
+	name := templateName(latest.eventName)
+	ctx = logger.WithCorrelationID(ctx, latest.correlationID)
+	ctx = logger.With(ctx, "personId", latest.personID)
+
+	// EventBridge passed the stream lambda's trace on to SQS as the AWSTraceHeader attribute
+	ctx = tracing.Extract(ctx, latest.message.Attributes["AWSTraceHeader"])
+	ctx, span := tracing.Tracer().Start(ctx, "send notification",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("event.name", latest.eventName),
+			attribute.Int("notification.change_count", len(changes)),
+		),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	data := make(map[string]interface{}, len(latest.data)+3)
+	for key, value := range latest.data {
+		data[key] = value
+	}
+	details := make([]map[string]interface{}, 0, len(changes))
+	for _, change := range changes {
+		details = append(details, change.data)
+	}
+	data["changes"] = details
+	data["changeCount"] = len(changes)
+	data["firstName"] = latest.person.FirstName
+	data["lastName"] = latest.person.LastName
+	data["email"] = latest.person.Email
+	data["phoneNumber"] = latest.person.PhoneNumber
+
+	channel := selectChannel(latest.person, sms.isHighPriority(latest.eventName))
+	if channel == channelSMS && !sms.enabled() {
+		channel = channelEmail
+	}
+	// Emails of digest event types are buffered and sent by the scheduled digest run
+	if channel == channelEmail && digests.covers(latest.eventName) {
+		return digests.add(ctx, changes)
+	}
+	properties := map[string]interface{}{"eventName": latest.eventName}
+	var route emailRoute
+	if channel == channelEmail {
+		// Tenants with their own verified sending domain send from it (EMAIL_ROUTES)
+		route = routes.resolve(latest.person)
+		properties["emailRoute"] = route.Name
+	}
+
+	// At most one notification per person and event type within the dedup window
+	claimed, err := dedup.claim(ctx, latest.personID, latest.eventName)
 	if err != nil {
-		log.Printf("Error marshalling event: %v", err)
 		return err
 	}
+	if !claimed {
+		logger.FromContext(ctx).Info("Skipping notification within dedup window", "eventName", latest.eventName, "changeCount", len(changes))
+		metrics.Emit(map[string]string{"Channel": channel}, map[string]interface{}{"eventName": latest.eventName}, metrics.Count("NotificationsDeduplicated", 1))
+		return nil
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if releaseErr := dedup.release(ctx, latest.personID, latest.eventName); releaseErr != nil {
+			logger.FromContext(ctx).Error("Failed to release notification dedup marker", "error", releaseErr)
+		}
+	}()
+
+	start := time.Now()
+	defer func() {
+		metrics.Emit(
+			map[string]string{"Channel": channel, "Outcome": metrics.ErrorOutcome(err)},
+			properties,
+			metrics.Count("NotificationsSent", 1),
+			metrics.Count("ChangesNotified", len(changes)),
+			metrics.Duration("NotificationDuration", time.Since(start)),
+		)
+	}()
+
+	// Track the notification from the moment it is queued for sending
+	var notificationID string
+	if notifications.enabled() && latest.personID != "" {
+		notificationID, err = notifications.create(ctx, latest.personID, channel, name)
+		if err != nil {
+			return err
+		}
+	}
 
-	fmt.Printf("Received event: %s\n", string(eventJson))
+	// Persons opted out of the channel (PUT /persons/{personId}/preferences) are not notified
+	if !latest.person.Allows(channel) {
+		logger.FromContext(ctx).Info("Skipping notification: recipient opted out", "channel", channel)
+		if notificationID != "" {
+			return notifications.setStatus(ctx, latest.personID, notificationID, statusSuppressed, "opted out")
+		}
+		return nil
+	}
 
-	// Add logic to send email notifications here
-	fmt.Println("Sending email notification...")
+	if channel == channelSMS {
+		return sendSMS(ctx, latest, name, notificationID, data)
+	}
 
+	// Updates list what changed: .changedFields for custom templates, .changesTable as ready-made HTML
+	changedFields := mergeChangedFields(changes)
+	data["changedFields"] = changedFields
+	if len(changedFields) > 0 {
+		table, err := renderChangesTable(changedFields)
+		if err != nil {
+			return fmt.Errorf("failed to render changes table: %w", err)
+		}
+		data["changesTable"] = table
+	}
+
+	return sendEmail(ctx, latest.personID, latest.person, name, eventType(latest.detailType, latest.eventName), route, notificationID, data)
+}
+
+// sendEmail renders the active stored template of the given name, or without one the built-in
+// template builtinName, in the person's language, and sends it to the person. The
+// notification, when tracked, moves on to sent.
+func sendEmail(ctx context.Context, personID string, person models.Person, name string, builtinName string, route emailRoute, notificationID string, data map[string]interface{}) error {
+	stored, storedName, locale, err := pickLocale(ctx, name, person.Locale, func(locale string) bool {
+		return builtinTemplates[localizedName(builtinName, locale, true)] != nil
+	})
+	if err != nil {
+		return err
+	}
+	template := stored
+	if stored != nil {
+		name = storedName
+	} else if locale != "" {
+		template = builtinTemplates[localizedName(builtinName, locale, true)]
+	}
+	if template == nil {
+		return errclass.New(errclass.Permanent, fmt.Sprintf("no template %s", name))
+	}
+	data["locale"] = locale
+	email, err := template.render(sanitizeData(data))
+	if err != nil {
+		return errclass.Mark(errclass.Permanent, fmt.Errorf("failed to render template %s: %w", name, err))
+	}
+	if reason := enforceContentSafety(email); reason != "" {
+		logger.FromContext(ctx).Warn("Falling back to plain-text email", "templateName", name, "version", template.version, "reason", reason)
+	}
+	logger.FromContext(ctx).Info("Rendered email", "templateName", name, "version", template.version, "locale", locale, "html", email.Body != "")
+
+	// A person without an email address cannot be notified; retrying would not change that.
+	// Neither can one whose address the stream lambda masked.
+	if person.Email == "" || person.Email == models.MaskedValue {
+		logger.FromContext(ctx).Info("Skipping email: recipient has no email address")
+		if notificationID != "" {
+			return notifications.setStatus(ctx, personID, notificationID, statusSuppressed, "no email address")
+		}
+		return nil
+	}
+	// Addresses that bounced permanently or complained are not mailed again, to protect the sender reputation
+	if !person.EmailDeliverable() {
+		logger.FromContext(ctx).Info("Skipping email: recipient address is undeliverable", "reason", person.EmailUndeliverable)
+		if notificationID != "" {
+			return notifications.setStatus(ctx, personID, notificationID, statusSuppressed, "undeliverable")
+		}
+		return nil
+	}
+
+	logger.FromContext(ctx).Info("Sending email notification", "changeCount", data["changeCount"], "emailRoute", route.Name, "fromAddress", route.FromAddress, "region", route.Region)
+	messageID, err := mailer.send(ctx, route, person.Email, email, map[string]string{
+		"personId":       personID,
+		"notificationId": notificationID,
+	})
+	if err != nil {
+		return err
+	}
+	if messageID != "" {
+		logger.FromContext(ctx).Info("Email sent", "messageId", messageID)
+	}
+
+	// SES events move the notification on to delivered or bounced
+	if notificationID != "" {
+		reason := ""
+		if mailer.dryRun {
+			reason = "dry run"
+		}
+		return notifications.setStatus(ctx, personID, notificationID, statusSent, reason)
+	}
 	return nil
 }
 
+// sendSMS sends the short message for the latest change. Opted-out recipients are
+// recorded as suppressed rather than failed, so the message is not retried.
+func sendSMS(ctx context.Context, latest *personEvent, name string, notificationID string, data map[string]interface{}) error {
+	text, err := renderSMS(ctx, latest, name, data)
+	if err != nil {
+		return err
+	}
+
+	err = sms.send(ctx, latest.person.PhoneNumber, text)
+	if errors.Is(err, errOptedOut) {
+		logger.FromContext(ctx).Info("Skipping SMS: recipient opted out")
+		opsAlerts.NotifyBestEffort(ctx, slack.Alert{
+			Title:    "SMS suppressed by opt-out list",
+			Severity: slack.SeverityInfo,
+			Fields:   map[string]string{"personId": latest.personID, "eventName": latest.eventName},
+		})
+		if notificationID != "" {
+			return notifications.setStatus(ctx, latest.personID, notificationID, statusSuppressed, "sms opt-out")
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if notificationID != "" {
+		return notifications.setStatus(ctx, latest.personID, notificationID, statusSent, "")
+	}
+	return nil
+}
+
+// retryDelay grows the visibility timeout with every receive so failing messages back off
+// instead of being redelivered immediately; the queue's redrive policy moves them to the DLQ.
+func retryDelay(message events.SQSMessage) int32 {
+	receiveCount, err := strconv.Atoi(message.Attributes["ApproximateReceiveCount"])
+	if err != nil || receiveCount < 1 {
+		receiveCount = 1
+	}
+
+	delay := baseRetryDelaySeconds
+	for i := 1; i < receiveCount && delay < maxRetryDelaySeconds; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelaySeconds {
+		delay = maxRetryDelaySeconds
+	}
+	return int32(delay)
+}
+
+// backOff extends the visibility timeout of a failed message. Errors are only logged because
+// the message is retried after the queue's default visibility timeout either way.
+func backOff(ctx context.Context, message events.SQSMessage) {
+	if queueURL == "" {
+		return
+	}
+	_, err := sqsClient.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueURL),
+		ReceiptHandle:     aws.String(message.ReceiptHandle),
+		VisibilityTimeout: retryDelay(message),
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to change message visibility", "messageId", message.MessageId, "error", err)
+	}
+}
+
+// deadLetter moves a message that can never be processed to the dead-letter queue, with the
+// error that stopped it. It reports false when there is no queue or the move failed, in which
+// case the message is retried like any other.
+func deadLetter(ctx context.Context, message events.SQSMessage, err error) bool {
+	if deadLetterURL == "" {
+		return false
+	}
+	_, sendErr := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(deadLetterURL),
+		MessageBody: aws.String(message.Body),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"errorClass":   {DataType: aws.String("String"), StringValue: aws.String(string(errclass.Classify(err)))},
+			"errorMessage": {DataType: aws.String("String"), StringValue: aws.String(err.Error())},
+		},
+	})
+	if sendErr != nil {
+		logger.FromContext(ctx).Error("Failed to move message to the dead-letter queue", "messageId", message.MessageId, "error", sendErr)
+		return false
+	}
+	return true
+}
+
+func handler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	response := events.SQSEventResponse{}
+	fail := func(message events.SQSMessage, err error) {
+		class := errclass.Classify(err)
+		if !class.Retryable() && deadLetter(ctx, message, err) {
+			logger.FromContext(ctx).Error("Moved message that cannot be processed to the dead-letter queue", "messageId", message.MessageId, "class", class, "error", err)
+			metrics.Emit(map[string]string{"Class": string(class), "Action": "dead-lettered"}, nil, metrics.Count("Errors", 1))
+			return
+		}
+		logger.FromContext(ctx).Error("Failed to process message", "messageId", message.MessageId, "class", class, "error", err)
+		metrics.Emit(map[string]string{"Class": string(class), "Action": "retried"}, nil, metrics.Count("Errors", 1))
+		backOff(ctx, message)
+		response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+			ItemIdentifier: message.MessageId,
+		})
+	}
+
+	var personEvents []*personEvent
+	for _, message := range sqsEvent.Records {
+		// SES delivery events and SMS replies arrive on the same queue wrapped in an SNS envelope
+		var envelope SNSEnvelope
+		if err := json.Unmarshal([]byte(message.Body), &envelope); err == nil && envelope.Type == "Notification" {
+			if inbound, ok := parseInboundSMS(envelope.Message); ok && sms.enabled() {
+				err = sms.handleInbound(ctx, inbound)
+			} else {
+				err = processSESEvent(ctx, envelope)
+			}
+			if err != nil {
+				fail(message, err)
+			}
+			continue
+		}
+
+		event, err := parsePersonEvent(ctx, message)
+		if err != nil {
+			fail(message, err)
+			continue
+		}
+		if event == nil {
+			continue
+		}
+		personEvents = append(personEvents, event)
+	}
+
+	// One email per person, however many of their changes landed in this batch
+	for _, changes := range groupByRecipient(personEvents) {
+		if err := sendNotification(ctx, changes); err != nil {
+			for _, change := range changes {
+				fail(change.message, err)
+			}
+		}
+	}
+
+	return response, nil
+}
+
+// invocation is a batch of the email queue or, in digest mode, the scheduled digest run
+type invocation struct {
+	events.SQSEvent
+	DetailType string `json:"detail-type"`
+}
+
+// dispatch sends the digests on scheduled runs and handles queue batches otherwise
+func dispatch(ctx context.Context, in invocation) (events.SQSEventResponse, error) {
+	if in.DetailType == "Scheduled Event" {
+		return events.SQSEventResponse{}, digests.flush(ctx)
+	}
+	return handler(ctx, in.SQSEvent)
+}
+
 func main() {
-	log.Print("email lambda invoked....")
-	lambda.Start(handler)
+	config.Check(settingsErr)
+	slog.Info("email lambda invoked....")
+	lambda.Start(consumer.Invocation(dispatch))
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/slack"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Notification lifecycle states
+const (
+	statusQueued     = "queued"
+	statusSent       = "sent"
+	statusDelivered  = "delivered"
+	statusBounced    = "bounced"
+	statusSuppressed = "suppressed"
+)
+
+// notificationStore persists one item per notification (personId + notificationId)
+type notificationStore struct {
+	tableName string
+	dynamo    *dynamodb.Client
+}
+
+func newNotificationStore(dynamo *dynamodb.Client) *notificationStore {
+	return &notificationStore{
+		tableName: settings.NotificationsTableName,
+		dynamo:    dynamo,
+	}
+}
+
+// enabled reports whether delivery tracking is configured
+func (n *notificationStore) enabled() bool {
+	return n.tableName != ""
+}
+
+// create records a new queued notification and returns its ID. IDs are UUIDv7,
+// so sorting by notificationId lists a person's notifications in send order.
+func (n *notificationStore) create(ctx context.Context, personID string, channel string, template string) (string, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	notificationID := id.String()
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	_, err = n.dynamo.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(n.tableName),
+		Item: map[string]types.AttributeValue{
+			"personId":       &types.AttributeValueMemberS{Value: personID},       // Partition Key
+			"notificationId": &types.AttributeValueMemberS{Value: notificationID}, // Sort Key
+			"channel":        &types.AttributeValueMemberS{Value: channel},
+			"templateName":   &types.AttributeValueMemberS{Value: template},
+			"status":         &types.AttributeValueMemberS{Value: statusQueued},
+			"createdAt":      &types.AttributeValueMemberS{Value: now},
+			"updatedAt":      &types.AttributeValueMemberS{Value: now},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to record notification for person %s: %w", personID, err)
+	}
+	return notificationID, nil
+}
+
+// setStatus moves a notification to a new lifecycle state, keeping an optional reason
+// (e.g. the bounce type reported by SES)
+func (n *notificationStore) setStatus(ctx context.Context, personID string, notificationID string, status string, reason string) error {
+	update := expression.
+		Set(expression.Name("status"), expression.Value(status)).
+		Set(expression.Name("updatedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339)))
+	if reason != "" {
+		update = update.Set(expression.Name("statusReason"), expression.Value(reason))
+	}
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.AttributeExists(expression.Name("notificationId"))).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = n.dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(n.tableName),
+		Key: map[string]types.AttributeValue{
+			"personId":       &types.AttributeValueMemberS{Value: personID},
+			"notificationId": &types.AttributeValueMemberS{Value: notificationID},
+		},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set notification %s to %s: %w", notificationID, status, err)
+	}
+	logger.FromContext(ctx).Info("Notification status updated", "notificationId", notificationID, "personId", personID, "status", status)
+	return nil
+}
+
+// SNSEnvelope is the wrapper SNS puts around messages delivered to SQS
+type SNSEnvelope struct {
+	Type     string `json:"Type"`
+	TopicArn string `json:"TopicArn"`
+	Message  string `json:"Message"`
+}
+
+// SESEvent is the subset of an SES event notification used for delivery tracking.
+// notificationId and personId are attached as message tags when the email is sent.
+type SESEvent struct {
+	EventType string `json:"eventType"`
+	Mail      struct {
+		MessageID   string              `json:"messageId"`
+		Destination []string            `json:"destination"`
+		Tags        map[string][]string `json:"tags"`
+	} `json:"mail"`
+	Bounce *struct {
+		BounceType    string `json:"bounceType"`
+		BounceSubType string `json:"bounceSubType"`
+	} `json:"bounce,omitempty"`
+}
+
+// sesStatus maps an SES event type to a notification status
+func sesStatus(event SESEvent) (status string, reason string, ok bool) {
+	switch event.EventType {
+	case "Send":
+		return statusSent, "", true
+	case "Delivery":
+		return statusDelivered, "", true
+	case "Bounce":
+		if event.Bounce != nil {
+			reason = event.Bounce.BounceType + "/" + event.Bounce.BounceSubType
+		}
+		return statusBounced, reason, true
+	case "Complaint":
+		return statusSuppressed, "complaint", true
+	case "Reject":
+		return statusSuppressed, "rejected", true
+	default:
+		return "", "", false
+	}
+}
+
+// firstTag returns the first value of an SES message tag
+func firstTag(tags map[string][]string, name string) string {
+	if values := tags[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// processSESEvent applies an SES event notification (delivered via SNS) to the notification it belongs to
+func processSESEvent(ctx context.Context, envelope SNSEnvelope) error {
+	var event SESEvent
+	if err := json.Unmarshal([]byte(envelope.Message), &event); err != nil {
+		return fmt.Errorf("invalid SES event from %s: %w", envelope.TopicArn, err)
+	}
+
+	status, reason, ok := sesStatus(event)
+	if !ok {
+		logger.FromContext(ctx).Info("Ignoring SES event", "eventType", event.EventType, "messageId", event.Mail.MessageID)
+		return nil
+	}
+
+	personID := firstTag(event.Mail.Tags, "personId")
+	notificationID := firstTag(event.Mail.Tags, "notificationId")
+	if personID == "" || notificationID == "" {
+		logger.FromContext(ctx).Warn("SES event carries no notification tags", "eventType", event.EventType, "messageId", event.Mail.MessageID)
+		return nil
+	}
+	// Bounces from the account-level suppression list have the OnSuppressionList subtype
+	if status == statusSuppressed || strings.HasSuffix(reason, "/OnSuppressionList") {
+		opsAlerts.NotifyBestEffort(ctx, slack.Alert{
+			Title:    fmt.Sprintf("Email %s: %s", status, event.EventType),
+			Severity: slack.SeverityWarning,
+			Fields:   map[string]string{"personId": personID, "eventType": event.EventType, "reason": reason},
+		})
+	}
+	if err := undeliverable.apply(ctx, personID, event); err != nil {
+		return err
+	}
+	if !notifications.enabled() {
+		return nil
+	}
+	return notifications.setStatus(ctx, personID, notificationID, status, reason)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/models"
+)
+
+// emailRoute is the SES identity and region an email is sent through
+type emailRoute struct {
+	// Name identifies the route in logs and metrics, e.g. "tenant:acme" or "domain:example.com"
+	Name string `json:"-"`
+	// FromAddress is the sender, on a domain verified in Region
+	FromAddress string `json:"fromAddress"`
+	// IdentityARN authorizes sending for an identity owned by another account
+	IdentityARN string `json:"identityArn,omitempty"`
+	// Region is the SES region; empty uses the lambda's region
+	Region string `json:"region,omitempty"`
+	// ConfigurationSet receives the route's delivery events
+	ConfigurationSet string `json:"configurationSet,omitempty"`
+}
+
+// emailRoutes are the routes configured in EMAIL_ROUTES, e.g.
+//
+//	{"tenants": {"acme": {"fromAddress": "noreply@mail.acme.com", "region": "eu-west-1"}},
+//	 "domains": {"example.org": {"fromAddress": "noreply@example.com", "configurationSet": "example-org"}},
+//	 "default": {"fromAddress": "noreply@example.com"}}
+type emailRoutes struct {
+	Tenants map[string]emailRoute `json:"tenants"`
+	Domains map[string]emailRoute `json:"domains"`
+	Default emailRoute            `json:"default"`
+}
+
+// routes is loaded once per cold start
+var routes = loadEmailRoutes(settings.EmailRoutes)
+
+// loadEmailRoutes parses EMAIL_ROUTES. Invalid routes are logged and ignored, so every email
+// takes the default route. Routes without a fromAddress are dropped, except the default route,
+// which falls back to EMAIL_FROM_ADDRESS.
+func loadEmailRoutes(config string) emailRoutes {
+	var loaded emailRoutes
+	if config == "" {
+		loaded.Default.Name = "default"
+		return loaded
+	}
+	if err := json.Unmarshal([]byte(config), &loaded); err != nil {
+		logger.FromContext(context.Background()).Error("Ignoring invalid EMAIL_ROUTES", "error", err)
+		return emailRoutes{Default: emailRoute{Name: "default"}}
+	}
+	normalize := func(kind string, byKey map[string]emailRoute, lower bool) map[string]emailRoute {
+		normalized := make(map[string]emailRoute, len(byKey))
+		for key, route := range byKey {
+			if lower {
+				key = strings.ToLower(strings.TrimSpace(key))
+			}
+			if route.FromAddress == "" {
+				logger.FromContext(context.Background()).Error("Ignoring email route without fromAddress", "route", kind+":"+key)
+				continue
+			}
+			route.Name = kind + ":" + key
+			normalized[key] = route
+		}
+		return normalized
+	}
+	loaded.Tenants = normalize("tenant", loaded.Tenants, false)
+	loaded.Domains = normalize("domain", loaded.Domains, true)
+	loaded.Default.Name = "default"
+	return loaded
+}
+
+// resolve picks the route of a recipient: the route of their tenant, which sends from the
+// tenant's own domain, then the route of their email domain or its closest parent domain,
+// then the default route
+func (r emailRoutes) resolve(person models.Person) emailRoute {
+	if route, ok := r.Tenants[person.TenantID]; ok && person.TenantID != "" {
+		return route
+	}
+	if at := strings.LastIndex(person.Email, "@"); at >= 0 {
+		domain := strings.ToLower(person.Email[at+1:])
+		for domain != "" {
+			if route, ok := r.Domains[domain]; ok {
+				return route
+			}
+			_, parent, found := strings.Cut(domain, ".")
+			if !found {
+				break
+			}
+			domain = parent
+		}
+	}
+	return r.Default
+}
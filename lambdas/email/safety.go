@@ -0,0 +1,130 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// maxSubjectLength is the longest subject sent; longer ones are cut
+const maxSubjectLength = 200
+
+var (
+	// maxEmailBodyBytes caps the rendered HTML body (MAX_EMAIL_BODY_BYTES, default 100 KiB,
+	// far below the SES message size limit)
+	maxEmailBodyBytes = settings.MaxEmailBodyBytes
+
+	htmlTagPattern = regexp.MustCompile(`(?s)<[^>]*>`)
+	// unsafeHTMLPattern finds active content that has no place in a notification email
+	unsafeHTMLPattern = regexp.MustCompile(`(?i)<\s*(script|iframe|object|embed|form|meta|link|style)\b|\bon[a-z]+\s*=|javascript\s*:|vbscript\s*:|data\s*:\s*text/html`)
+	blockEndPattern   = regexp.MustCompile(`(?i)<\s*(br\s*/?|/p|/div|/tr|/h[1-6]|/li)\s*>`)
+	blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+)
+
+// sanitizeData strips markup and control characters from every string in the template data.
+// Person fields are user input; they must never add HTML to an email, even through a
+// template that marks them safe or interpolates them into a text subject.
+func sanitizeData(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return sanitizeText(v)
+	case map[string]interface{}:
+		clean := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			clean[key] = sanitizeData(item)
+		}
+		return clean
+	case []interface{}:
+		clean := make([]interface{}, len(v))
+		for i, item := range v {
+			clean[i] = sanitizeData(item)
+		}
+		return clean
+	case []map[string]interface{}:
+		clean := make([]map[string]interface{}, len(v))
+		for i, item := range v {
+			clean[i] = sanitizeData(item).(map[string]interface{})
+		}
+		return clean
+	case []fieldChange:
+		clean := make([]fieldChange, len(v))
+		for i, change := range v {
+			clean[i] = fieldChange{
+				Field:  sanitizeText(change.Field),
+				Label:  sanitizeText(change.Label),
+				Before: sanitizeText(change.Before),
+				After:  sanitizeText(change.After),
+			}
+		}
+		return clean
+	}
+	return value
+}
+
+// sanitizeText removes HTML tags and control characters (including line breaks) from user input
+func sanitizeText(text string) string {
+	text = htmlTagPattern.ReplaceAllString(text, "")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+// enforceContentSafety checks a rendered email before it is sent. Subjects are kept to a
+// single short line. Bodies that are too large or contain active content (scripts, event
+// handlers, javascript: URLs) fail safe to a plain-text version of the same message.
+// It returns the reason the HTML body was dropped, or "" when it was kept.
+func enforceContentSafety(email *RenderedEmail) string {
+	email.Subject = strings.Join(strings.Fields(sanitizeText(email.Subject)), " ")
+	if len(email.Subject) > maxSubjectLength {
+		email.Subject = truncateUTF8(email.Subject, maxSubjectLength-3) + "..."
+	}
+
+	var reason string
+	switch {
+	case unsafeHTMLPattern.MatchString(email.Body):
+		reason = "unsafe html"
+	case len(email.Body) > maxEmailBodyBytes:
+		reason = "body too large"
+	default:
+		email.Text = plainText(email.Body)
+		return ""
+	}
+
+	email.Text = plainText(email.Body)
+	if len(email.Text) > maxEmailBodyBytes {
+		email.Text = truncateUTF8(email.Text, maxEmailBodyBytes)
+	}
+	email.Body = ""
+	return reason
+}
+
+// plainText converts an HTML body into readable text
+func plainText(body string) string {
+	text := blockEndPattern.ReplaceAllString(body, "\n")
+	text = htmlTagPattern.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// truncateUTF8 cuts text to at most limit bytes without splitting a character
+func truncateUTF8(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	for limit > 0 && !utf8RuneStart(text[limit]) {
+		limit--
+	}
+	return text[:limit]
+}
+
+func utf8RuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// emailSender sends rendered emails through SES v2, with a client per route region
+type emailSender struct {
+	cfg              aws.Config
+	fromAddress      string
+	configurationSet string
+	dryRun           bool
+
+	mu      sync.Mutex
+	clients map[string]*sesv2.Client
+}
+
+func newEmailSender(cfg aws.Config) *emailSender {
+	return &emailSender{
+		cfg:              cfg,
+		fromAddress:      settings.FromAddress,
+		configurationSet: settings.ConfigurationSet,
+		dryRun:           settings.DryRun,
+		clients:          map[string]*sesv2.Client{},
+	}
+}
+
+// client returns the SES client of a region; "" is the lambda's region
+func (s *emailSender) client(region string) *sesv2.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client, ok := s.clients[region]; ok {
+		return client
+	}
+	client := sesv2.NewFromConfig(s.cfg, func(o *sesv2.Options) {
+		if region != "" {
+			o.Region = region
+		}
+	})
+	s.clients[region] = client
+	return client
+}
+
+// send sends an email to one recipient through the given route and returns the SES message
+// ID. The notification's personId and notificationId are attached as message tags, so the
+// SES events of the message find their notification. A dry run only logs the email.
+func (s *emailSender) send(ctx context.Context, route emailRoute, to string, email *RenderedEmail, tags map[string]string) (string, error) {
+	from := route.FromAddress
+	if from == "" {
+		from = s.fromAddress
+	}
+	if from == "" {
+		return "", errclass.New(errclass.Permanent, fmt.Sprintf("email route %s has no fromAddress and EMAIL_FROM_ADDRESS is not set", route.Name))
+	}
+	configurationSet := route.ConfigurationSet
+	if configurationSet == "" {
+		configurationSet = s.configurationSet
+	}
+
+	if s.dryRun {
+		logger.FromContext(ctx).Info("Dry run: email not sent", "fromAddress", from, "emailRoute", route.Name, "subject", email.Subject, "html", email.Body != "")
+		return "", nil
+	}
+
+	body := &sestypes.Body{Text: &sestypes.Content{Data: aws.String(email.Text), Charset: aws.String("UTF-8")}}
+	if email.Body != "" {
+		body.Html = &sestypes.Content{Data: aws.String(email.Body), Charset: aws.String("UTF-8")}
+	}
+	input := &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(from),
+		Destination:      &sestypes.Destination{ToAddresses: []string{to}},
+		Content: &sestypes.EmailContent{Simple: &sestypes.Message{
+			Subject: &sestypes.Content{Data: aws.String(email.Subject), Charset: aws.String("UTF-8")},
+			Body:    body,
+		}},
+	}
+	if route.IdentityARN != "" {
+		input.FromEmailAddressIdentityArn = aws.String(route.IdentityARN)
+	}
+	if configurationSet != "" {
+		input.ConfigurationSetName = aws.String(configurationSet)
+	}
+	for name, value := range tags {
+		if value != "" {
+			input.EmailTags = append(input.EmailTags, sestypes.MessageTag{Name: aws.String(name), Value: aws.String(value)})
+		}
+	}
+
+	output, err := s.client(route.Region).SendEmail(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to send email through %s: %w", route.Name, classifySendError(err))
+	}
+	return aws.ToString(output.MessageId), nil
+}
+
+// classifySendError keeps account-level pauses retryable: they answer 4xx like a rejected
+// message, but the email goes out once sending resumes
+func classifySendError(err error) error {
+	var paused *sestypes.SendingPausedException
+	var suspended *sestypes.AccountSuspendedException
+	if errors.As(err, &paused) || errors.As(err, &suspended) {
+		return errclass.Mark(errclass.Transient, err)
+	}
+	return err
+}
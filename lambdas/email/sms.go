@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/models"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// Notification channels
+const (
+	channelEmail = "email"
+	channelSMS   = "sms"
+)
+
+// maxSMSLength keeps messages within a single GSM-7 SMS segment
+const maxSMSLength = 160
+
+// e164Pattern matches phone numbers in E.164 format, e.g. +14155550123
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// errOptedOut is returned when the recipient replied STOP to an earlier message
+var errOptedOut = errors.New("recipient opted out of SMS")
+
+// Inbound keywords, matched case-insensitively against the whole message
+var (
+	optOutKeywords = map[string]bool{"STOP": true, "STOPALL": true, "UNSUBSCRIBE": true, "CANCEL": true, "END": true, "QUIT": true}
+	optInKeywords  = map[string]bool{"START": true, "UNSTOP": true, "SUBSCRIBE": true}
+)
+
+// builtinSMSTemplates are the short messages per event type, from templates/sms/<detail-type>.txt,
+// and per locale from templates/sms/<locale>/<detail-type>.txt, keyed like fr/PersonCreated
+var builtinSMSTemplates = loadBuiltinSMSTemplates(builtinTemplateFiles)
+
+// loadBuiltinSMSTemplates parses the embedded SMS templates; like the email ones, a broken
+// one stops the lambda at its cold start
+func loadBuiltinSMSTemplates(files fs.FS) map[string]*texttemplate.Template {
+	names, err := fs.Glob(files, "templates/sms/*.txt")
+	if err != nil {
+		panic(err)
+	}
+	localized, err := fs.Glob(files, "templates/sms/*/*.txt")
+	if err != nil {
+		panic(err)
+	}
+	names = append(names, localized...)
+	loaded := make(map[string]*texttemplate.Template, len(names))
+	for _, file := range names {
+		content, err := fs.ReadFile(files, file)
+		if err != nil {
+			panic(err)
+		}
+		name := strings.TrimPrefix(strings.TrimSuffix(file, ".txt"), "templates/sms/")
+		loaded[name] = texttemplate.Must(texttemplate.New(name + "-sms").Parse(strings.TrimSpace(string(content))))
+	}
+	return loaded
+}
+
+// smsSender publishes SMS through SNS and keeps the list of numbers that opted out
+type smsSender struct {
+	optOutTableName string
+	senderID        string
+	sns             *sns.Client
+	dynamo          *dynamodb.Client
+	// highPriority are the event names sent by SMS rather than email (SMS_EVENT_TYPES)
+	highPriority map[string]bool
+}
+
+func newSMSSender(snsClient *sns.Client, dynamo *dynamodb.Client) *smsSender {
+	highPriority := map[string]bool{}
+	for _, eventName := range settings.SMSEventTypes {
+		highPriority[eventName] = true
+	}
+	return &smsSender{
+		optOutTableName: settings.SMSOptOutTableName,
+		senderID:        settings.SMSSenderID,
+		sns:             snsClient,
+		dynamo:          dynamo,
+		highPriority:    highPriority,
+	}
+}
+
+// enabled reports whether the SMS channel is configured
+func (s *smsSender) enabled() bool {
+	return s.optOutTableName != ""
+}
+
+// isHighPriority reports whether an event is sent by SMS to persons who can receive one
+func (s *smsSender) isHighPriority(eventName string) bool {
+	return s.enabled() && s.highPriority[eventName]
+}
+
+// validPhoneNumber reports whether a number is in E.164 format
+func validPhoneNumber(phoneNumber string) bool {
+	return e164Pattern.MatchString(phoneNumber)
+}
+
+// renderSMS renders the short message for an event, truncated to a single segment. Like
+// emails, an active stored template wins: the one named after the email template with an
+// "-sms" suffix, e.g. person-insert-sms, whose body is sent as plain text. Otherwise the
+// built-in template of the event type applies. Both are picked in the person's language.
+func renderSMS(ctx context.Context, latest *personEvent, name string, data map[string]interface{}) (string, error) {
+	data = sanitizeData(data).(map[string]interface{})
+	builtinName := eventType(latest.detailType, latest.eventName)
+	stored, storedName, locale, err := pickLocale(ctx, name+"-sms", latest.person.Locale, func(locale string) bool {
+		return builtinSMSTemplates[localizedName(builtinName, locale, true)] != nil
+	})
+	if err != nil {
+		return "", err
+	}
+	data["locale"] = locale
+	var message string
+	if stored != nil {
+		rendered, err := stored.render(data)
+		if err != nil {
+			return "", errclass.Mark(errclass.Permanent, fmt.Errorf("failed to render template %s: %w", storedName, err))
+		}
+		message = plainText(rendered.Body)
+	} else {
+		template := builtinSMSTemplates[localizedName(builtinName, locale, true)]
+		if locale == "" || template == nil {
+			return "", errclass.New(errclass.Permanent, fmt.Sprintf("no SMS template for event %s (%s)", latest.eventName, latest.detailType))
+		}
+		var text bytes.Buffer
+		if err := template.Execute(&text, data); err != nil {
+			return "", errclass.Mark(errclass.Permanent, fmt.Errorf("failed to render SMS template: %w", err))
+		}
+		message = text.String()
+	}
+	if len(message) > maxSMSLength {
+		message = truncateUTF8(message, maxSMSLength-3) + "..."
+	}
+	return message, nil
+}
+
+// optedOut reports whether a number is on the opt-out list
+func (s *smsSender) optedOut(ctx context.Context, phoneNumber string) (bool, error) {
+	result, err := s.dynamo.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.optOutTableName),
+		Key:       map[string]types.AttributeValue{"phoneNumber": &types.AttributeValueMemberS{Value: phoneNumber}},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check SMS opt-out: %w", err)
+	}
+	return result.Item != nil, nil
+}
+
+// send publishes a transactional SMS to an E.164 number that has not opted out
+func (s *smsSender) send(ctx context.Context, phoneNumber string, message string) error {
+	if !validPhoneNumber(phoneNumber) {
+		return errclass.New(errclass.Permanent, "phone number is not in E.164 format")
+	}
+	optedOut, err := s.optedOut(ctx, phoneNumber)
+	if err != nil {
+		return err
+	}
+	if optedOut {
+		return errOptedOut
+	}
+
+	attributes := map[string]snstypes.MessageAttributeValue{
+		"AWS.SNS.SMS.SMSType": {DataType: aws.String("String"), StringValue: aws.String("Transactional")},
+	}
+	if s.senderID != "" {
+		attributes["AWS.SNS.SMS.SenderID"] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(s.senderID)}
+	}
+
+	_, err = s.sns.Publish(ctx, &sns.PublishInput{
+		PhoneNumber:       aws.String(phoneNumber),
+		Message:           aws.String(message),
+		MessageAttributes: attributes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish SMS: %w", err)
+	}
+	return nil
+}
+
+// InboundSMS is the two-way SMS message published to SNS when a recipient replies
+type InboundSMS struct {
+	OriginationNumber string `json:"originationNumber"`
+	MessageBody       string `json:"messageBody"`
+}
+
+// handleInbound applies STOP/START keywords from recipient replies to the opt-out list
+func (s *smsSender) handleInbound(ctx context.Context, inbound InboundSMS) error {
+	keyword := strings.ToUpper(strings.TrimSpace(inbound.MessageBody))
+
+	switch {
+	case optOutKeywords[keyword]:
+		_, err := s.dynamo.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.optOutTableName),
+			Item: map[string]types.AttributeValue{
+				"phoneNumber": &types.AttributeValueMemberS{Value: inbound.OriginationNumber},
+				"keyword":     &types.AttributeValueMemberS{Value: keyword},
+				"optedOutAt":  &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record SMS opt-out: %w", err)
+		}
+		logger.FromContext(ctx).Info("SMS recipient opted out", "keyword", keyword)
+	case optInKeywords[keyword]:
+		_, err := s.dynamo.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(s.optOutTableName),
+			Key:       map[string]types.AttributeValue{"phoneNumber": &types.AttributeValueMemberS{Value: inbound.OriginationNumber}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove SMS opt-out: %w", err)
+		}
+		// SNS keeps its own opt-out list for STOP replies; clear it as well
+		if _, err := s.sns.OptInPhoneNumber(ctx, &sns.OptInPhoneNumberInput{PhoneNumber: aws.String(inbound.OriginationNumber)}); err != nil {
+			logger.FromContext(ctx).Error("Failed to opt phone number back in with SNS", "error", err)
+		}
+		logger.FromContext(ctx).Info("SMS recipient opted back in", "keyword", keyword)
+	default:
+		logger.FromContext(ctx).Info("Ignoring inbound SMS without a keyword")
+	}
+	return nil
+}
+
+// parseInboundSMS recognizes a two-way SMS reply in an SNS message
+func parseInboundSMS(message string) (InboundSMS, bool) {
+	var inbound InboundSMS
+	if err := json.Unmarshal([]byte(message), &inbound); err != nil || inbound.OriginationNumber == "" {
+		return InboundSMS{}, false
+	}
+	return inbound, true
+}
+
+// selectChannel picks how to reach a person about an event. An explicit notificationChannel
+// wins; high-priority events go by SMS to persons with a phone number; otherwise email is used
+// when an address is known and SMS for persons without one. A channel the person opted out of,
+// or an email address SES reported undeliverable, gives way to the other channel when that is
+// allowed and reachable.
+func selectChannel(person models.Person, highPriority bool) string {
+	var channel string
+	switch strings.ToLower(person.NotificationChannel) {
+	case channelEmail:
+		channel = channelEmail
+	case channelSMS:
+		channel = channelSMS
+	default:
+		if (highPriority || person.Email == "") && person.PhoneNumber != "" {
+			channel = channelSMS
+		} else {
+			channel = channelEmail
+		}
+	}
+
+	other, reachable := channelSMS, person.PhoneNumber != ""
+	if channel == channelSMS {
+		other, reachable = channelEmail, person.Email != "" && person.EmailDeliverable()
+	}
+	if !usable(person, channel) && person.Allows(other) && reachable {
+		return other
+	}
+	return channel
+}
+
+// usable reports whether a person can be notified through a channel: they allow it and, for
+// email, SES has not reported their address as undeliverable
+func usable(person models.Person, channel string) bool {
+	return person.Allows(channel) && (channel != channelEmail || person.EmailDeliverable())
+}
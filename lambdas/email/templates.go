@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// NotificationTemplate is the content of one template version, as uploaded through the admin API
+type NotificationTemplate struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// RenderedEmail is a template rendered for a single event. Body is the HTML part and Text
+// the plain-text part; Body is empty when the content checks fell back to plain text.
+type RenderedEmail struct {
+	Subject string
+	Body    string
+	Text    string
+}
+
+type cachedTemplate struct {
+	version  int64
+	subject  *texttemplate.Template
+	body     *htmltemplate.Template
+	loadedAt time.Time
+}
+
+// Person event types, as EventBridge detail-types, that have a built-in template
+const (
+	detailTypePersonCreated = "PersonCreated"
+	detailTypePersonUpdated = "PersonUpdated"
+	detailTypePersonDeleted = "PersonDeleted"
+)
+
+// streamEventTypes maps the stream events, published with the DynamoDBStreamEvent detail-type,
+// to the person event type of their eventName
+var streamEventTypes = map[string]string{
+	"INSERT": detailTypePersonCreated,
+	"MODIFY": detailTypePersonUpdated,
+	"REMOVE": detailTypePersonDeleted,
+}
+
+// eventType returns the person event type of an event: its detail-type, or for stream events
+// the type of their eventName
+func eventType(detailType string, eventName string) string {
+	if eventType, ok := streamEventTypes[eventName]; ok && (detailType == "" || detailType == personevents.DetailTypeStreamEvent) {
+		return eventType
+	}
+	return detailType
+}
+
+// builtinTemplateFiles holds a <detail-type>.html body and <detail-type>.subject.txt subject
+// per event type, in English, and translations in a directory per locale, e.g. fr/
+//
+//go:embed templates
+var builtinTemplateFiles embed.FS
+
+// builtinTemplates are used per event type while no stored template of the event is active,
+// keyed by detail-type and, for translations, locale and detail-type like fr/PersonCreated
+var builtinTemplates = loadBuiltinTemplates(builtinTemplateFiles)
+
+// loadBuiltinTemplates parses the embedded templates. They ship with the binary, so a broken
+// one stops the lambda at its cold start.
+func loadBuiltinTemplates(files fs.FS) map[string]*cachedTemplate {
+	bodies, err := fs.Glob(files, "templates/*.html")
+	if err != nil {
+		panic(err)
+	}
+	localized, err := fs.Glob(files, "templates/*/*.html")
+	if err != nil {
+		panic(err)
+	}
+	bodies = append(bodies, localized...)
+	loaded := make(map[string]*cachedTemplate, len(bodies))
+	for _, bodyFile := range bodies {
+		name := strings.TrimPrefix(strings.TrimSuffix(bodyFile, ".html"), "templates/")
+		subject, err := fs.ReadFile(files, "templates/"+name+".subject.txt")
+		if err != nil {
+			panic(fmt.Sprintf("built-in template %s has no subject: %v", name, err))
+		}
+		body, err := fs.ReadFile(files, bodyFile)
+		if err != nil {
+			panic(err)
+		}
+		loaded[name] = &cachedTemplate{
+			subject: texttemplate.Must(texttemplate.New(name + "-subject").Parse(strings.TrimSpace(string(subject)))),
+			body:    htmltemplate.Must(htmltemplate.New(name + "-body").Parse(string(body))),
+		}
+	}
+	return loaded
+}
+
+// templateStore loads active templates and keeps them in memory for the lifetime of the container
+type templateStore struct {
+	tableName string
+	bucket    string
+	ttl       time.Duration
+	dynamo    *dynamodb.Client
+	s3        *s3.Client
+
+	mu    sync.Mutex
+	cache map[string]*cachedTemplate
+}
+
+func newTemplateStore(dynamo *dynamodb.Client, s3Client *s3.Client) *templateStore {
+	return &templateStore{
+		tableName: settings.TemplatesTableName,
+		bucket:    settings.TemplatesBucket,
+		ttl:       settings.TemplateCacheTTL,
+		dynamo:    dynamo,
+		s3:        s3Client,
+		cache:     map[string]*cachedTemplate{},
+	}
+}
+
+// enabled reports whether template storage is configured
+func (t *templateStore) enabled() bool {
+	return t.tableName != "" && t.bucket != ""
+}
+
+// active returns the parsed active version of a template, or nil when none is activated
+func (t *templateStore) active(ctx context.Context, name string) (*cachedTemplate, error) {
+	// loadedAt is refreshed under the lock, so it is read under the lock too
+	t.mu.Lock()
+	cached, ok := t.cache[name]
+	fresh := ok && time.Since(cached.loadedAt) < t.ttl
+	t.mu.Unlock()
+	if fresh {
+		return cached, nil
+	}
+
+	result, err := t.dynamo.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(t.tableName),
+		Key:       map[string]types.AttributeValue{"templateName": &types.AttributeValueMemberS{Value: name}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %s: %w", name, err)
+	}
+	v, hasActive := result.Item["activeVersion"].(*types.AttributeValueMemberN)
+	if !hasActive {
+		return nil, nil
+	}
+	version, err := strconv.ParseInt(v.Value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("template %s has invalid active version %q", name, v.Value)
+	}
+
+	// The active version did not change: keep the parsed template and just refresh the timestamp
+	if ok && cached.version == version {
+		t.mu.Lock()
+		cached.loadedAt = time.Now()
+		t.mu.Unlock()
+		return cached, nil
+	}
+
+	loaded, err := t.load(ctx, name, version)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.cache[name] = loaded
+	t.mu.Unlock()
+	logger.FromContext(ctx).Info("Loaded template", "templateName", name, "version", version)
+	return loaded, nil
+}
+
+// load fetches and parses a template version from S3
+func (t *templateStore) load(ctx context.Context, name string, version int64) (*cachedTemplate, error) {
+	object, err := t.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(fmt.Sprintf("templates/%s/v%d.json", name, version)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch template %s v%d: %w", name, version, err)
+	}
+	defer object.Body.Close()
+
+	var content NotificationTemplate
+	if err := json.NewDecoder(object.Body).Decode(&content); err != nil {
+		return nil, fmt.Errorf("failed to decode template %s v%d: %w", name, version, err)
+	}
+
+	subject, err := texttemplate.New(name + "-subject").Parse(content.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject in template %s v%d: %w", name, version, err)
+	}
+	body, err := htmltemplate.New(name + "-body").Parse(content.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body in template %s v%d: %w", name, version, err)
+	}
+
+	return &cachedTemplate{version: version, subject: subject, body: body, loadedAt: time.Now()}, nil
+}
+
+// render executes a template against the event detail
+func (c *cachedTemplate) render(data interface{}) (*RenderedEmail, error) {
+	var subject, body bytes.Buffer
+	if err := c.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := c.body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	return &RenderedEmail{Subject: subject.String(), Body: body.String()}, nil
+}
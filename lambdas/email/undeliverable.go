@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// deliveryFields are the person attributes the email lambda writes when an address turns out
+// to be undeliverable
+var deliveryFields = map[string]bool{
+	"emailUndeliverable":    true,
+	"undeliverableEmailKey": true,
+	"undeliverableAt":       true,
+}
+
+// onlyDeliveryFields reports whether a change touched nothing but the delivery attributes
+func onlyDeliveryFields(changes []personevents.FieldChange) bool {
+	for _, change := range changes {
+		if !deliveryFields[change.Field] {
+			return false
+		}
+	}
+	return len(changes) > 0
+}
+
+// undeliverableMarker marks persons whose email address SES reported as permanently bouncing
+// or complaining, so later notifications skip the address (TABLE_NAME). Transient bounces,
+// e.g. a full mailbox, are only tracked on the notification.
+type undeliverableMarker struct {
+	tableName string
+	dynamo    *dynamodb.Client
+}
+
+func newUndeliverableMarker(dynamo *dynamodb.Client) *undeliverableMarker {
+	return &undeliverableMarker{tableName: settings.TableName, dynamo: dynamo}
+}
+
+// undeliverableReason returns why an SES event makes its recipient undeliverable, or "" when
+// it does not
+func undeliverableReason(event SESEvent) string {
+	switch {
+	case event.EventType == "Complaint":
+		return "complaint"
+	case event.EventType == "Bounce" && event.Bounce != nil && event.Bounce.BounceType == "Permanent":
+		return "bounce"
+	default:
+		return ""
+	}
+}
+
+// apply marks the person an SES event was sent to when the event makes their address
+// undeliverable. The address is the one the email was sent to, so a person who changed their
+// email since is not blocked. Persons deleted since are left alone.
+func (m *undeliverableMarker) apply(ctx context.Context, personID string, event SESEvent) error {
+	reason := undeliverableReason(event)
+	if m.tableName == "" || reason == "" || len(event.Mail.Destination) == 0 {
+		return nil
+	}
+	update := expression.
+		Set(expression.Name("emailUndeliverable"), expression.Value(reason)).
+		Set(expression.Name("undeliverableEmailKey"), expression.Value(models.EmailKey(event.Mail.Destination[0]))).
+		Set(expression.Name("undeliverableAt"), expression.Value(time.Now().UTC().Format(time.RFC3339))).
+		Set(expression.Name("updatedBy"), expression.Value("system:ses"))
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.AttributeExists(expression.Name("personId"))).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = m.dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(m.tableName),
+		Key:                       map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		logger.FromContext(ctx).Info("Person of an undeliverable email no longer exists", "personId", personID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mark person %s undeliverable: %w", personID, err)
+	}
+	logger.FromContext(ctx).Warn("Marked person's email address undeliverable", "personId", personID, "reason", reason, "messageId", event.Mail.MessageID)
+	metrics.Emit(map[string]string{"Reason": reason}, nil, metrics.Count("EmailsMarkedUndeliverable", 1))
+	return nil
+}
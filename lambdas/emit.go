@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/internal/tracing"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxEmitPersons bounds the persons of one POST /admin/events/emit
+	maxEmitPersons = 100
+	// emitBatchSize is the most entries one PutEvents call accepts
+	emitBatchSize = 10
+)
+
+// Outcomes of one person of an emit request
+const (
+	emitStatusEmitted  = "emitted"
+	emitStatusNotFound = "notFound"
+	emitStatusSkipped  = "skipped"
+	emitStatusFailed   = "failed"
+)
+
+// emitEventTypes are the event names that can be synthesized. REMOVE is only emitted for
+// soft-deleted persons, the others only for persons that are not deleted.
+var emitEventTypes = []string{personevents.EventInsert, personevents.EventModify, personevents.EventRemove, personevents.EventRestore}
+
+// EmitRequest is the body of POST /admin/events/emit
+type EmitRequest struct {
+	PersonIDs []string `json:"personIds"`
+	EventType string   `json:"eventType"`
+}
+
+// EmitResponse reports the outcome for every requested person, in request order
+type EmitResponse struct {
+	EventType string         `json:"eventType"`
+	Emitted   int            `json:"emitted"`
+	Results   []EmittedEvent `json:"results"`
+}
+
+// EmittedEvent is the outcome for one person; EventID is set for emitted events
+type EmittedEvent struct {
+	PersonID string `json:"personId"`
+	Status   string `json:"status"`
+	EventID  string `json:"eventId,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// handleEmitEvents publishes synthetic person events for the current state of the given
+// persons, so a new consumer can be bootstrapped without writing to the table. The events
+// have the source and detail type of the stream lambda's events and are marked
+// "synthetic": true; the email lambda ignores them.
+func handleEmitEvents(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var emitRequest EmitRequest
+	if err := json.Unmarshal([]byte(request.Body), &emitRequest); err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid emit request"), nil
+	}
+	if !slices.Contains(emitEventTypes, emitRequest.EventType) {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "eventType must be INSERT, MODIFY, REMOVE or RESTORE"), nil
+	}
+	if len(emitRequest.PersonIDs) == 0 || len(emitRequest.PersonIDs) > maxEmitPersons {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, fmt.Sprintf("personIds must hold 1 to %d IDs", maxEmitPersons)), nil
+	}
+
+	response := EmitResponse{EventType: emitRequest.EventType, Results: make([]EmittedEvent, len(emitRequest.PersonIDs))}
+	var entries []ebtypes.PutEventsRequestEntry
+	var pending []int
+	for i, personID := range emitRequest.PersonIDs {
+		result := &response.Results[i]
+		result.PersonID = personID
+		entry, status, err := syntheticEvent(ctx, personID, emitRequest.EventType)
+		switch {
+		case err != nil:
+			return internalErrorResponse(ctx, request, "build synthetic event", err), nil
+		case entry == nil:
+			result.Status = status
+			if status == emitStatusSkipped {
+				result.Reason = fmt.Sprintf("the person's state does not allow a %s event", emitRequest.EventType)
+			}
+		default:
+			entries = append(entries, *entry)
+			pending = append(pending, i)
+		}
+	}
+
+	for start := 0; start < len(entries); start += emitBatchSize {
+		end := min(start+emitBatchSize, len(entries))
+		output, err := eventsClient.PutEvents(ctx, &eventbridge.PutEventsInput{Entries: entries[start:end]})
+		if err != nil {
+			// The SDK error names ARNs and request IDs; it is logged, not returned
+			logger.FromContext(ctx).Error("Failed to publish synthetic events", "error", err, "events", end-start)
+		}
+		for k, i := range pending[start:end] {
+			result := &response.Results[i]
+			switch {
+			case err != nil:
+				result.Status, result.Reason = emitStatusFailed, "publish failed"
+			case k >= len(output.Entries):
+				result.Status, result.Reason = emitStatusFailed, "no result from EventBridge"
+			case output.Entries[k].ErrorCode != nil:
+				result.Status, result.Reason = emitStatusFailed, aws.ToString(output.Entries[k].ErrorMessage)
+			default:
+				result.Status = emitStatusEmitted
+				result.EventID = aws.ToString(output.Entries[k].EventId)
+				response.Emitted++
+			}
+		}
+	}
+
+	logger.FromContext(ctx).Info("Emitted synthetic events", "eventType", emitRequest.EventType, "requested", len(emitRequest.PersonIDs), "emitted", response.Emitted)
+	return jsonResponse(ctx, request, http.StatusOK, response)
+}
+
+// syntheticEvent builds the event entry for the stored state of a person. Without an entry,
+// status says why: the person does not exist, or its deletion state does not fit the event.
+// The image is published as stored, with PII encrypted, like the stream lambda does.
+func syntheticEvent(ctx context.Context, personID string, eventType string) (entry *ebtypes.PutEventsRequestEntry, status string, err error) {
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if result.Item == nil {
+		return nil, emitStatusNotFound, nil
+	}
+	if isDeleted(result.Item) != (eventType == personevents.EventRemove) {
+		return nil, emitStatusSkipped, nil
+	}
+
+	person, err := models.UnmarshalPerson(result.Item)
+	if err != nil {
+		return nil, "", fmt.Errorf("unmarshal person %s: %w", personID, err)
+	}
+	image, err := models.ImageFromItem(result.Item)
+	if err != nil {
+		return nil, "", fmt.Errorf("convert person %s: %w", personID, err)
+	}
+	detailJSON, err := json.Marshal(models.PersonChangedEvent{
+		SchemaVersion: models.EventSchemaVersion,
+		EventID:       "synthetic-" + uuid.New().String(),
+		PersonID:      personID,
+		EventName:     eventType,
+		CorrelationID: logger.CorrelationID(ctx),
+		Current:       &person,
+		Image:         image,
+		Synthetic:     true,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	entry = &ebtypes.PutEventsRequestEntry{
+		Source:       aws.String(personevents.SourceStream),
+		DetailType:   aws.String(personevents.DetailTypeStreamEvent),
+		Detail:       aws.String(string(detailJSON)),
+		EventBusName: aws.String(eventBusName),
+	}
+	if traceHeader := tracing.Header(ctx); traceHeader != "" {
+		entry.TraceHeader = aws.String(traceHeader)
+	}
+	return entry, "", nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/validation"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Error codes returned to API clients. Internal error details never leave the lambda.
+const (
+	errCodeInvalidInput         = "INVALID_INPUT"
+	errCodeMissingParameter     = "MISSING_PARAMETER"
+	errCodeUnauthorized         = "UNAUTHORIZED"
+	errCodeForbidden            = "FORBIDDEN"
+	errCodeNotFound             = "NOT_FOUND"
+	errCodeConflict             = "CONFLICT"
+	errCodeRestoreExpired       = "RESTORE_EXPIRED"
+	errCodeIdempotencyKeyReused = "IDEMPOTENCY_KEY_REUSED"
+	errCodePreconditionFailed   = "PRECONDITION_FAILED"
+	errCodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	errCodeThrottled            = "THROTTLED"
+	errCodeTimeout              = "TIMEOUT"
+	errCodeInternal             = "INTERNAL_ERROR"
+)
+
+// ErrorResponse is the body returned for every failed request
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId"`
+	// Fields lists every invalid field of an INVALID_INPUT error for a person document
+	Fields []validation.FieldError `json:"fields,omitempty"`
+}
+
+// errorResponse builds a structured JSON error response for the client
+func errorResponse(request events.APIGatewayProxyRequest, statusCode int, code string, message string) events.APIGatewayProxyResponse {
+	body, err := json.Marshal(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: request.RequestContext.RequestID,
+	})
+	if err != nil {
+		// Marshalling three strings cannot realistically fail, but never return an empty error body
+		body = []byte(`{"code":"` + errCodeInternal + `","message":"Internal server error"}`)
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
+
+// invalidPersonResponse answers 400 INVALID_INPUT for a person document that fails validation,
+// with the first problem as message and every problem in fields
+func invalidPersonResponse(request events.APIGatewayProxyRequest, errs []validation.FieldError) events.APIGatewayProxyResponse {
+	body, err := json.Marshal(ErrorResponse{
+		Code:      errCodeInvalidInput,
+		Message:   errs[0].Error(),
+		RequestID: request.RequestContext.RequestID,
+		Fields:    errs,
+	})
+	if err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, errs[0].Error())
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusBadRequest,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
+
+// internalErrorResponse logs the full error server-side and maps it to a safe client-facing code.
+// action describes what was being attempted, e.g. "insert item".
+func internalErrorResponse(ctx context.Context, request events.APIGatewayProxyRequest, action string, err error) events.APIGatewayProxyResponse {
+	logger.FromContext(ctx).Error("Failed to "+action, "error", err)
+
+	switch errclass.Classify(err) {
+	case errclass.Throttle:
+		return errorResponse(request, http.StatusServiceUnavailable, errCodeThrottled, "The service is busy, please retry later")
+	case errclass.Conflict:
+		return errorResponse(request, http.StatusConflict, errCodeConflict, "The request conflicts with the current state of the resource")
+	case errclass.Timeout:
+		return errorResponse(request, http.StatusGatewayTimeout, errCodeTimeout, "The request timed out")
+	default:
+		return errorResponse(request, http.StatusInternalServerError, errCodeInternal, "Internal server error")
+	}
+}
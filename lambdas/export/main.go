@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	"aws-lambda-go/internal/accessaudit"
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/consumer"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/fieldcrypt"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Export states, as reported by GET /exports/{exportId}
+const (
+	statusQueued    = "queued"
+	statusRunning   = "running"
+	statusCompleted = "completed"
+	statusFailed    = "failed"
+)
+
+var settings, settingsErr = config.LoadExport()
+
+var (
+	tableName        string
+	exportsTableName string
+	exportBucket     string
+	scanSegments     int
+	dynamo           *dynamodb.Client
+	s3Client         *s3.Client
+	pii              *fieldcrypt.Encryptor
+	hasher           *fieldcrypt.Hasher
+	auditor          *accessaudit.Auditor
+)
+
+func init() {
+	logger.Init("export")
+	metrics.Init("export")
+	tableName = settings.TableName
+	exportsTableName = settings.ExportsTableName
+	exportBucket = settings.ExportBucket
+	scanSegments = settings.ScanSegments
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	if err := tracing.Init(context.TODO(), "export"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	metrics.InstrumentDynamoDB(&cfg)
+	dynamo = ddbclient.New(cfg, settings.DynamoDB)
+	s3Client = s3.NewFromConfig(cfg)
+	pii = fieldcrypt.New(cfg, settings.PII.KMSKeyID, settings.PII.Fields)
+	hasher = fieldcrypt.NewHasher(cfg, settings.IdentityHashKMSKeyID)
+	auditor = accessaudit.New(dynamo, settings.AccessAuditTableName)
+}
+
+// ExportMessage is the SQS message the HTTP lambda queues for POST /exports
+type ExportMessage struct {
+	ExportID      string `json:"exportId"`
+	CorrelationID string `json:"correlationId"`
+	// RequestedBy is the principal that called POST /exports, recorded in the access audit
+	RequestedBy string `json:"requestedBy"`
+}
+
+// exportOptions are the choices made in POST /exports, stored with the export
+type exportOptions struct {
+	format string
+	// hashedContacts exports the identity hashes instead of email, phone number and address
+	hashedContacts bool
+}
+
+// runExport claims a queued export, writes the file and records the outcome
+func runExport(ctx context.Context, message ExportMessage) error {
+	ctx = logger.With(logger.WithCorrelationID(ctx, message.CorrelationID), "exportId", message.ExportID)
+	options, claimed, err := claimExport(ctx, message.ExportID)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		logger.FromContext(ctx).Info("Export is not queued anymore, skipping")
+		return nil
+	}
+
+	start := time.Now()
+	format := options.format
+	key := fmt.Sprintf("exports/%s.%s", message.ExportID, format)
+	count, err := exportPersons(ctx, message.ExportID, options, key)
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	auditor.Record(ctx, accessaudit.Access{
+		Actor:     message.RequestedBy,
+		Operation: "export",
+		Filter:    map[string]string{"format": format, "exportId": message.ExportID, "hashedContacts": fmt.Sprint(options.hashedContacts)},
+		Rows:      count,
+		Duration:  time.Since(start),
+		Outcome:   outcome,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Export failed", "error", err)
+		return finishExport(ctx, message.ExportID, statusFailed, "", count, err.Error())
+	}
+
+	metrics.Emit(map[string]string{"Format": format}, map[string]interface{}{"exportId": message.ExportID},
+		metrics.Count("ItemsExported", count),
+		metrics.Duration("ExportDuration", time.Since(start)),
+	)
+	logger.FromContext(ctx).Info("Export complete", "items", count, "key", key)
+	return finishExport(ctx, message.ExportID, statusCompleted, key, count, "")
+}
+
+// claimExport moves a queued export to running and returns its options. It returns false when
+// the export was already picked up, e.g. when SQS delivers the message twice.
+func claimExport(ctx context.Context, exportID string) (exportOptions, bool, error) {
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.
+			Set(expression.Name("status"), expression.Value(statusRunning)).
+			Set(expression.Name("startedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339)))).
+		WithCondition(expression.Name("status").Equal(expression.Value(statusQueued))).
+		Build()
+	if err != nil {
+		return exportOptions{}, false, err
+	}
+	result, err := dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(exportsTableName),
+		Key:                       map[string]types.AttributeValue{"exportId": &types.AttributeValueMemberS{Value: exportID}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return exportOptions{}, false, nil
+	}
+	if err != nil {
+		return exportOptions{}, false, fmt.Errorf("failed to claim export %s: %w", exportID, err)
+	}
+	format, _ := result.Attributes["format"].(*types.AttributeValueMemberS)
+	if format == nil {
+		return exportOptions{}, false, fmt.Errorf("export %s has no format", exportID)
+	}
+	contacts, _ := result.Attributes["contacts"].(*types.AttributeValueMemberS)
+	return exportOptions{format: format.Value, hashedContacts: contacts != nil && contacts.Value == "hashed"}, true, nil
+}
+
+// finishExport records the outcome of an export
+func finishExport(ctx context.Context, exportID string, status string, key string, count int, reason string) error {
+	update := expression.
+		Set(expression.Name("status"), expression.Value(status)).
+		Set(expression.Name("finishedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339))).
+		Set(expression.Name("itemsExported"), expression.Value(count))
+	if key != "" {
+		update = update.Set(expression.Name("key"), expression.Value(key))
+	}
+	if reason != "" {
+		update = update.Set(expression.Name("reason"), expression.Value(reason))
+	}
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return err
+	}
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(exportsTableName),
+		Key:                       map[string]types.AttributeValue{"exportId": &types.AttributeValueMemberS{Value: exportID}},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record export %s: %w", exportID, err)
+	}
+	return nil
+}
+
+// handler processes export jobs one message at a time; failed messages are retried by SQS
+func handler(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+
+	response := events.SQSEventResponse{}
+	for _, record := range event.Records {
+		var message ExportMessage
+		if err := json.Unmarshal([]byte(record.Body), &message); err != nil {
+			logger.FromContext(ctx).Error("Dropping invalid export message", "messageId", record.MessageId, "error", err)
+			continue
+		}
+		if err := errclass.Retry(ctx, runExport(ctx, message), "Failed to process export", "exportId", message.ExportID); err != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+	return response, nil
+}
+
+func main() {
+	config.Check(settingsErr)
+	lambda.Start(consumer.Invocation(handler))
+}
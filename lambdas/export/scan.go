@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/models"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// progressInterval is how often the exported item count is written back to the exports table
+const progressInterval = 10 * time.Second
+
+// exportedPerson is the exported representation of a person, with PII decrypted. Unlike the
+// shared person model it always writes the names, address and phone number, which are left empty
+// when contacts are exported hashed.
+type exportedPerson struct {
+	PersonID            string `json:"personId"`
+	FirstName           string `json:"firstName"`
+	LastName            string `json:"lastName"`
+	Address             string `json:"address"`
+	PhoneNumber         string `json:"phoneNumber"`
+	Email               string `json:"email,omitempty"`
+	NotificationChannel string `json:"notificationChannel,omitempty"`
+	TenantID            string `json:"tenantId,omitempty"`
+	OwnerID             string `json:"ownerId,omitempty"`
+	Version             int64  `json:"version,omitempty"`
+	CreatedAt           string `json:"createdAt,omitempty"`
+	UpdatedAt           string `json:"updatedAt,omitempty"`
+	EmailHash           string `json:"emailHash,omitempty"`
+	PhoneHash           string `json:"phoneHash,omitempty"`
+}
+
+// newExportedPerson takes the identity hashes from the person's item, as the shared person model has none
+func newExportedPerson(person models.Person, item map[string]types.AttributeValue, hashedContacts bool) exportedPerson {
+	exported := exportedPerson{
+		PersonID:            person.PersonID,
+		FirstName:           person.FirstName,
+		LastName:            person.LastName,
+		Address:             person.Address,
+		PhoneNumber:         person.PhoneNumber,
+		Email:               person.Email,
+		NotificationChannel: person.NotificationChannel,
+		TenantID:            person.TenantID,
+		OwnerID:             person.OwnerID,
+		Version:             person.Version,
+		CreatedAt:           person.CreatedAt,
+		UpdatedAt:           person.UpdatedAt,
+		EmailHash:           stringAttribute(item, "emailHash"),
+		PhoneHash:           stringAttribute(item, "phoneHash"),
+	}
+	if hashedContacts {
+		exported.Email, exported.PhoneNumber, exported.Address = "", "", ""
+	}
+	return exported
+}
+
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+// csvHeader lists the CSV columns, in the order of csvRow
+var csvHeader = []string{"personId", "firstName", "lastName", "address", "phoneNumber", "email", "notificationChannel", "tenantId", "ownerId", "version", "createdAt", "updatedAt", "emailHash", "phoneHash"}
+
+func (p exportedPerson) csvRow() []string {
+	return []string{p.PersonID, p.FirstName, p.LastName, p.Address, p.PhoneNumber, p.Email, p.NotificationChannel, p.TenantID, p.OwnerID, strconv.FormatInt(p.Version, 10), p.CreatedAt, p.UpdatedAt, p.EmailHash, p.PhoneHash}
+}
+
+// recordWriter writes exported persons in one format
+type recordWriter interface {
+	write(person exportedPerson) error
+	flush() error
+}
+
+type jsonlWriter struct {
+	encoder *json.Encoder
+	buffer  *bufio.Writer
+}
+
+func (w *jsonlWriter) write(person exportedPerson) error { return w.encoder.Encode(person) }
+func (w *jsonlWriter) flush() error                      { return w.buffer.Flush() }
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func (w *csvWriter) write(person exportedPerson) error { return w.writer.Write(person.csvRow()) }
+func (w *csvWriter) flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func newRecordWriter(format string, out io.Writer) (recordWriter, error) {
+	if format == "csv" {
+		writer := csv.NewWriter(out)
+		return &csvWriter{writer: writer}, writer.Write(csvHeader)
+	}
+	buffer := bufio.NewWriter(out)
+	return &jsonlWriter{encoder: json.NewEncoder(buffer), buffer: buffer}, nil
+}
+
+// exportPersons runs a parallel segmented Scan over the persons that are not soft-deleted
+// and streams them into a temporary file, which is uploaded to S3 once complete. Memory stays
+// bounded by one page per segment; the file lives in the lambda's ephemeral storage.
+func exportPersons(ctx context.Context, exportID string, options exportOptions, key string) (int, error) {
+	format := options.format
+	file, err := os.CreateTemp("", "export-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	writer, err := newRecordWriter(format, file)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	persons := make(chan exportedPerson, 100)
+	errs := make(chan error, scanSegments)
+	var workers sync.WaitGroup
+	for segment := 0; segment < scanSegments; segment++ {
+		workers.Add(1)
+		go func(segment int) {
+			defer workers.Done()
+			if err := scanSegment(ctx, segment, options.hashedContacts, persons); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(segment)
+	}
+	go func() {
+		workers.Wait()
+		close(persons)
+	}()
+
+	count := 0
+	lastProgress := time.Now()
+	var writeErr error
+	for person := range persons {
+		if writeErr != nil {
+			continue
+		}
+		if writeErr = writer.write(person); writeErr != nil {
+			cancel()
+			continue
+		}
+		count++
+		if time.Since(lastProgress) > progressInterval {
+			lastProgress = time.Now()
+			reportProgress(ctx, exportID, count)
+		}
+	}
+	// A failed write cancels the scans, so it is reported before their cancellation errors
+	if writeErr != nil {
+		return count, writeErr
+	}
+	close(errs)
+	if err := <-errs; err != nil {
+		return count, err
+	}
+	if err := writer.flush(); err != nil {
+		return count, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return count, err
+	}
+	contentType := "application/x-ndjson"
+	if format == "csv" {
+		contentType = "text/csv"
+	}
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(exportBucket),
+		Key:         aws.String(key),
+		Body:        file,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return count, fmt.Errorf("failed to upload export: %w", err)
+	}
+	return count, nil
+}
+
+// scanSegment scans one segment of the table, decrypting each person before handing it on.
+// Identity hashes are computed from the decrypted values, so persons written before hashing
+// was enabled get them too.
+func scanSegment(ctx context.Context, segment int, hashedContacts bool, persons chan<- exportedPerson) error {
+	expr, err := expression.NewBuilder().WithFilter(ddbexpr.NotDeleted()).Build()
+	if err != nil {
+		return err
+	}
+	paginator := dynamodb.NewScanPaginator(dynamo, &dynamodb.ScanInput{
+		TableName:                 aws.String(tableName),
+		Segment:                   aws.Int32(int32(segment)),
+		TotalSegments:             aws.Int32(int32(scanSegments)),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan segment %d: %w", segment, err)
+		}
+		for _, item := range page.Items {
+			personID, _ := item["personId"].(*types.AttributeValueMemberS)
+			if personID == nil {
+				continue
+			}
+			if err := pii.DecryptItem(ctx, personID.Value, item); err != nil {
+				return err
+			}
+			if err := hasher.HashItem(ctx, item); err != nil {
+				return err
+			}
+			person, err := models.UnmarshalPerson(item)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal person %s: %w", personID.Value, err)
+			}
+			select {
+			case persons <- newExportedPerson(person, item, hashedContacts):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// reportProgress updates the exported item count; failures only cost progress visibility
+func reportProgress(ctx context.Context, exportID string, count int) {
+	expr, err := expression.NewBuilder().WithUpdate(expression.Set(expression.Name("itemsExported"), expression.Value(count))).Build()
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to report export progress", "error", err)
+		return
+	}
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(exportsTableName),
+		Key:                       map[string]types.AttributeValue{"exportId": &types.AttributeValueMemberS{Value: exportID}},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to report export progress", "error", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/uuid"
+)
+
+var (
+	// exportsTableName tracks export jobs (EXPORTS_TABLE_NAME); EXPORT_QUEUE_URL hands them to the export lambda
+	exportsTableName = settings.ExportsTableName
+	exportQueueURL   = settings.ExportQueueURL
+	exportBucket     = settings.ExportBucket
+)
+
+// exportURLExpiry is how long the download URL of a finished export stays valid
+const exportURLExpiry = 15 * time.Minute
+
+// Export states
+const (
+	exportQueued    = "queued"
+	exportRunning   = "running"
+	exportCompleted = "completed"
+	exportFailed    = "failed"
+)
+
+// ExportRequest is the body of POST /exports
+type ExportRequest struct {
+	// Format is "csv" or "jsonl" (default)
+	Format string `json:"format"`
+	// Contacts is "plain" (default), or "hashed" to export the identity hashes of email and
+	// phone number instead of the contact details, for analytics
+	Contacts string `json:"contacts"`
+}
+
+// ExportStatus is the response of POST /exports and GET /exports/{exportId}
+type ExportStatus struct {
+	ExportID      string `json:"exportId" dynamodbav:"exportId"`
+	Format        string `json:"format" dynamodbav:"format"`
+	Contacts      string `json:"contacts,omitempty" dynamodbav:"contacts,omitempty"`
+	Status        string `json:"status" dynamodbav:"status"`
+	Reason        string `json:"reason,omitempty" dynamodbav:"reason"`
+	ItemsExported int    `json:"itemsExported" dynamodbav:"itemsExported"`
+	CreatedAt     string `json:"createdAt" dynamodbav:"createdAt"`
+	FinishedAt    string `json:"finishedAt,omitempty" dynamodbav:"finishedAt"`
+	Key           string `json:"-" dynamodbav:"key"`
+	RequestedBy   string `json:"requestedBy,omitempty" dynamodbav:"requestedBy,omitempty"`
+	// DownloadURL is a pre-signed S3 URL, set once the export is completed
+	DownloadURL string `json:"downloadUrl,omitempty" dynamodbav:"-"`
+}
+
+// handleCreateExport queues an export of every person and answers 202 with its ID
+func handleCreateExport(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if exportsTableName == "" || exportQueueURL == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Exports are not enabled"), nil
+	}
+	exportRequest := ExportRequest{Format: "jsonl"}
+	if request.Body != "" {
+		if err := json.Unmarshal([]byte(request.Body), &exportRequest); err != nil {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid export request"), nil
+		}
+	}
+	if exportRequest.Format != "csv" && exportRequest.Format != "jsonl" {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "format must be csv or jsonl"), nil
+	}
+	switch exportRequest.Contacts {
+	case "", "plain":
+		exportRequest.Contacts = ""
+	case "hashed":
+		if !identityHasher.Enabled() {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Identity hashing is not enabled"), nil
+		}
+	default:
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "contacts must be plain or hashed"), nil
+	}
+
+	status := ExportStatus{
+		ExportID:    uuid.New().String(),
+		Format:      exportRequest.Format,
+		Contacts:    exportRequest.Contacts,
+		Status:      exportQueued,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+		RequestedBy: rateLimitClient(request),
+	}
+	item, err := attributevalue.MarshalMap(status)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal export", err), nil
+	}
+	delete(item, "key")
+	if _, err := svc.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(exportsTableName), Item: item}); err != nil {
+		return internalErrorResponse(ctx, request, "create export", err), nil
+	}
+
+	message, err := json.Marshal(map[string]string{
+		"exportId":      status.ExportID,
+		"correlationId": logger.CorrelationID(ctx),
+		"requestedBy":   status.RequestedBy,
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal export message", err), nil
+	}
+	if _, err := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(exportQueueURL),
+		MessageBody: aws.String(string(message)),
+	}); err != nil {
+		return internalErrorResponse(ctx, request, "queue export", err), nil
+	}
+	logger.FromContext(ctx).Info("Export queued", "exportId", status.ExportID, "format", status.Format)
+
+	response, err := jsonResponse(ctx, request, http.StatusAccepted, status)
+	if err == nil && response.StatusCode == http.StatusAccepted {
+		response.Headers["Location"] = "/exports/" + status.ExportID
+	}
+	return response, err
+}
+
+// handleGetExport reports the progress of an export, with a download URL once it is completed
+func handleGetExport(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if exportsTableName == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Exports are not enabled"), nil
+	}
+	exportID := request.PathParameters["exportId"]
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(exportsTableName),
+		Key:       map[string]types.AttributeValue{"exportId": &types.AttributeValueMemberS{Value: exportID}},
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "get export", err), nil
+	}
+	if result.Item == nil {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Export not found"), nil
+	}
+
+	var status ExportStatus
+	if err := attributevalue.UnmarshalMap(result.Item, &status); err != nil {
+		return internalErrorResponse(ctx, request, "unmarshal export", err), nil
+	}
+	if status.Status == exportCompleted && status.Key != "" {
+		presigned, err := s3.NewPresignClient(s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(exportBucket),
+			Key:    aws.String(status.Key),
+		}, s3.WithPresignExpires(exportURLExpiry))
+		if err != nil {
+			return internalErrorResponse(ctx, request, "presign export", err), nil
+		}
+		status.DownloadURL = presigned.URL
+	}
+	return jsonResponse(ctx, request, http.StatusOK, status)
+}
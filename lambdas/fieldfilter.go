@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// FieldRule restricts the person attributes returned to matching callers. A rule matches when
+// every selector it sets (Role, Tenant) equals the caller's; a rule without selectors matches
+// everyone. Tenant is compared with the caller's custom:tenantId claim, never with a header the
+// client chose. Allow lists the only attributes returned, Deny attributes that are never returned.
+type FieldRule struct {
+	Role   string   `json:"role,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
+	Allow  []string `json:"allow,omitempty"`
+	Deny   []string `json:"deny,omitempty"`
+}
+
+// responseFieldRules is read from RESPONSE_FIELD_RULES, a JSON list of rules, e.g.
+// [{"tenant": "partner-a", "deny": ["address"]}, {"role": "reader", "allow": ["firstName", "lastName"]}]
+var responseFieldRules = loadFieldRules(settings.ResponseFieldRules)
+
+// derivedAttributes are stored next to a person attribute and reveal it, so they are
+// filtered along with it
+var derivedAttributes = map[string][]string{
+	"address":     {"addressParts"},
+	"email":       {emailKeyAttribute, "emailHash"},
+	"lastName":    {lastNameKeyAttribute},
+	"phoneNumber": {"phoneHash"},
+}
+
+func loadFieldRules(config string) []FieldRule {
+	if config == "" {
+		return nil
+	}
+	var rules []FieldRule
+	if err := json.Unmarshal([]byte(config), &rules); err != nil {
+		// Failing closed would take the API down; the broken config is logged loudly instead
+		logger.FromContext(context.Background()).Error("Ignoring invalid RESPONSE_FIELD_RULES", "error", err)
+		return nil
+	}
+	return rules
+}
+
+// fieldFilter removes the attributes a caller must not receive
+type fieldFilter struct {
+	// allow is nil when no matching rule has an allow list
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// responseFilter combines the rules matching the caller: denied attributes add up, and with
+// several allow lists only attributes on all of them are returned. It returns nil when no
+// rule applies.
+func responseFilter(ctx context.Context) *fieldFilter {
+	if len(responseFieldRules) == 0 {
+		return nil
+	}
+	role, tenant := "", ""
+	if caller := callerFromContext(ctx); caller != nil {
+		role, tenant = caller.Role, caller.Tenant
+	}
+
+	var filter *fieldFilter
+	for _, rule := range responseFieldRules {
+		if (rule.Role != "" && rule.Role != role) || (rule.Tenant != "" && rule.Tenant != tenant) {
+			continue
+		}
+		if filter == nil {
+			filter = &fieldFilter{deny: map[string]bool{}}
+		}
+		for _, name := range rule.Deny {
+			filter.deny[name] = true
+			for _, derived := range derivedAttributes[name] {
+				filter.deny[derived] = true
+			}
+		}
+		if rule.Allow != nil {
+			filter.allow = intersectAllow(filter.allow, rule.Allow)
+		}
+	}
+	return filter
+}
+
+// intersectAllow narrows an allow set by another allow list; a nil set allows everything
+func intersectAllow(current map[string]bool, names []string) map[string]bool {
+	next := map[string]bool{}
+	for _, name := range names {
+		for _, attribute := range append([]string{name}, derivedAttributes[name]...) {
+			if current == nil || current[attribute] {
+				next[attribute] = true
+			}
+		}
+	}
+	return next
+}
+
+// apply removes the filtered attributes from a person item. The personId is always kept.
+func (f *fieldFilter) apply(item map[string]types.AttributeValue) {
+	if f == nil {
+		return
+	}
+	for name := range item {
+		if name == "personId" {
+			continue
+		}
+		if !f.allows(name) {
+			delete(item, name)
+		}
+	}
+}
+
+// allows reports whether the caller may receive an attribute
+func (f *fieldFilter) allows(name string) bool {
+	return f == nil || (!f.deny[name] && (f.allow == nil || f.allow[name]))
+}
+
+// applyAll is the list variant of apply
+func (f *fieldFilter) applyAll(items []map[string]types.AttributeValue) {
+	for _, item := range items {
+		f.apply(item)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/erasure"
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	// eventBusName is where PersonErased events are published (EVENT_BUS_NAME)
+	eventBusName = settings.EventBusName
+	// auditLogGroup is the Logging Lambda's log group, searched for a person's audit records (AUDIT_LOG_GROUP)
+	auditLogGroup = settings.AuditLogGroup
+	// eraser removes the notifications of an erased person and publishes PersonErased
+	eraser *erasure.Eraser
+)
+
+// maxAuditRecords bounds the audit records included in one export
+const maxAuditRecords = 1000
+
+// PersonExport is everything the service stores about a person (GET /persons/{personId}/export)
+type PersonExport struct {
+	ExportedAt    string                   `json:"exportedAt"`
+	Person        map[string]interface{}   `json:"person"`
+	Notifications []map[string]interface{} `json:"notifications"`
+	LegalHolds    []map[string]interface{} `json:"legalHolds"`
+	AuditHistory  []json.RawMessage        `json:"auditHistory"`
+}
+
+// ErasureResult reports what DELETE /persons/{personId}/erase removed
+type ErasureResult struct {
+	PersonID      string `json:"personId"`
+	ErasedAt      string `json:"erasedAt"`
+	Notifications int    `json:"notificationsDeleted"`
+}
+
+// handleExportPerson returns a machine-readable dump of a person's record, notification
+// history, legal holds, and audit records
+func handleExportPerson(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	personID := request.PathParameters["personId"]
+
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "get item for export", err), nil
+	}
+	if result.Item == nil {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
+	}
+	if err := fieldEncryptor.DecryptItem(ctx, personID, result.Item); err != nil {
+		return internalErrorResponse(ctx, request, "decrypt item for export", err), nil
+	}
+
+	export := PersonExport{ExportedAt: time.Now().UTC().Format(time.RFC3339)}
+	if err := attributevalue.UnmarshalMap(result.Item, &export.Person); err != nil {
+		return internalErrorResponse(ctx, request, "unmarshal item for export", err), nil
+	}
+	if export.Notifications, err = notificationHistory(ctx, personID); err != nil {
+		return internalErrorResponse(ctx, request, "query notifications for export", err), nil
+	}
+	if export.LegalHolds, err = legalHolds(ctx, personID); err != nil {
+		return internalErrorResponse(ctx, request, "query legal holds for export", err), nil
+	}
+	if export.AuditHistory, err = auditHistory(ctx, personID); err != nil {
+		return internalErrorResponse(ctx, request, "search audit log for export", err), nil
+	}
+
+	return jsonResponse(ctx, request, http.StatusOK, export)
+}
+
+// legalHolds returns the hold records of a person
+func legalHolds(ctx context.Context, personID string) ([]map[string]interface{}, error) {
+	holds := []map[string]interface{}{}
+	if legalHoldsTableName == "" {
+		return holds, nil
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(ddbexpr.KeyEquals("personId", personID)).Build()
+	if err != nil {
+		return nil, err
+	}
+	result, err := svc.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(legalHoldsTableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &holds); err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
+
+// auditHistory returns the audit records the Logging Lambda wrote for a person, oldest first.
+// PII in them is already masked (see internal/logger).
+func auditHistory(ctx context.Context, personID string) ([]json.RawMessage, error) {
+	records := []json.RawMessage{}
+	if auditLogGroup == "" {
+		return records, nil
+	}
+	paginator := cloudwatchlogs.NewFilterLogEventsPaginator(logsClient, &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:  aws.String(auditLogGroup),
+		FilterPattern: aws.String(fmt.Sprintf(`"Audit record" "%s"`, personID)),
+	})
+	for paginator.HasMorePages() && len(records) < maxAuditRecords {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range page.Events {
+			if message := aws.ToString(event.Message); json.Valid([]byte(message)) {
+				records = append(records, json.RawMessage(message))
+			}
+		}
+	}
+	if len(records) > maxAuditRecords {
+		records = records[:maxAuditRecords]
+	}
+	return records, nil
+}
+
+// handleErasePerson hard-deletes a person and their notification history and announces the
+// erasure with a PersonErased event, so services holding derived copies (e.g. a search
+// index) remove them as well
+func handleErasePerson(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	personID := request.PathParameters["personId"]
+
+	held, err := legalHoldChecker.Active(ctx, personID)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "check legal hold", err), nil
+	}
+	if held {
+		return errorResponse(request, http.StatusConflict, errCodeLegalHold, "The person is under legal hold and cannot be erased"), nil
+	}
+
+	deleted, err := svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:    aws.String(tableName),
+		Key:          map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "delete item for erasure", err), nil
+	}
+	if deleted.Attributes == nil {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
+	}
+
+	result := ErasureResult{PersonID: personID, ErasedAt: time.Now().UTC().Format(time.RFC3339)}
+	if result.Notifications, err = eraser.DeleteNotifications(ctx, personID); err != nil {
+		return internalErrorResponse(ctx, request, "delete notifications for erasure", err), nil
+	}
+	if err := eraser.PublishErased(ctx, result.PersonID, result.ErasedAt, actorFromContext(ctx)); err != nil {
+		return internalErrorResponse(ctx, request, "publish PersonErased", err), nil
+	}
+
+	logger.FromContext(ctx).Info("Erased person", "personId", personID, "notificationsDeleted", result.Notifications)
+	return jsonResponse(ctx, request, http.StatusOK, result)
+}
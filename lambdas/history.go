@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	defaultHistoryLimit = 25
+	maxHistoryLimit     = 100
+)
+
+// anonymizeActor is the actor of the anonymization lambda's writes in the audit trail
+const anonymizeActor = "system:anonymize"
+
+// auditTableName holds the audit trail the logging lambda writes (AUDIT_TABLE_NAME)
+var auditTableName = settings.AuditTableName
+
+// HistoryEntry is one change to a person: who made it, when, and what it changed
+type HistoryEntry struct {
+	EventID   string `json:"eventId" dynamodbav:"eventId"`
+	Operation string `json:"operation" dynamodbav:"operation"`
+	Timestamp string `json:"timestamp" dynamodbav:"timestamp"`
+	Actor     string `json:"actor" dynamodbav:"actor"`
+	Version   int64  `json:"version,omitempty" dynamodbav:"version"`
+	// Changes are the field-level diff; creations list every field
+	Changes       []models.FieldChange `json:"changes" dynamodbav:"diff"`
+	CorrelationID string               `json:"correlationId,omitempty" dynamodbav:"correlationId"`
+}
+
+// HistoryPage is the response of GET /persons/{personId}/history
+type HistoryPage struct {
+	Entries   []HistoryEntry `json:"entries"`
+	NextToken string         `json:"nextToken,omitempty"`
+}
+
+// handleHistory returns the changes made to a person, newest first, from the audit trail.
+// Encrypted values are decrypted, and fields the response field rules hide from the caller are
+// left out of the diffs.
+func handleHistory(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if auditTableName == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "The audit trail is not enabled"), nil
+	}
+	personID := request.PathParameters["personId"]
+
+	limit := defaultHistoryLimit
+	if value := request.QueryStringParameters["limit"]; value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxHistoryLimit {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit)), nil
+		}
+		limit = parsed
+	}
+
+	projection := expression.NamesList(expression.Name("auditId"), expression.Name("eventId"), expression.Name("operation"),
+		expression.Name("timestamp"), expression.Name("actor"), expression.Name("version"), expression.Name("diff"), expression.Name("correlationId"))
+	expr, err := expression.NewBuilder().WithKeyCondition(ddbexpr.KeyEquals("personId", personID)).WithProjection(projection).Build()
+	if err != nil {
+		return internalErrorResponse(ctx, request, "build history query", err), nil
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(auditTableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(int32(limit)),
+	}
+
+	// The continuation token is the last auditId of the previous page
+	if token := request.QueryStringParameters["nextToken"]; token != "" {
+		lastID, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid nextToken"), nil
+		}
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"personId": &types.AttributeValueMemberS{Value: personID},
+			"auditId":  &types.AttributeValueMemberS{Value: string(lastID)},
+		}
+	}
+
+	result, err := svc.Query(ctx, input)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "query audit trail", err), nil
+	}
+	page := HistoryPage{Entries: []HistoryEntry{}}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &page.Entries); err != nil {
+		return internalErrorResponse(ctx, request, "unmarshal audit trail", err), nil
+	}
+	anonymized, err := anonymizedAt(ctx, personID)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "read anonymization", err), nil
+	}
+	filter := responseFilter(ctx)
+	for i, entry := range page.Entries {
+		changes, err := visibleChanges(ctx, personID, filter, entry.Changes)
+		if err != nil {
+			return internalErrorResponse(ctx, request, "decrypt history", err), nil
+		}
+		// Changes before the anonymization, and the values it replaced, held the real data
+		if anonymized != "" {
+			for j := range changes {
+				switch {
+				case entry.Timestamp < anonymized:
+					changes[j].Before, changes[j].After = "", ""
+				case entry.Actor == anonymizeActor:
+					changes[j].Before = ""
+				}
+			}
+		}
+		page.Entries[i].Changes = changes
+	}
+	if last, ok := result.LastEvaluatedKey["auditId"].(*types.AttributeValueMemberS); ok {
+		page.NextToken = base64.RawURLEncoding.EncodeToString([]byte(last.Value))
+	}
+	return jsonResponse(ctx, request, http.StatusOK, page)
+}
+
+// visibleChanges decrypts the values of a diff and drops the fields the caller may not see.
+// Fields whose decrypted values are equal did not change: their ciphertext was only renewed
+// by a rewrite. Masked values stay, as equal masks can hide different values.
+func visibleChanges(ctx context.Context, personID string, filter *fieldFilter, changes []models.FieldChange) ([]models.FieldChange, error) {
+	visible := []models.FieldChange{}
+	for _, change := range changes {
+		if !filter.allows(change.Field) {
+			continue
+		}
+		var err error
+		if change.Before, err = fieldEncryptor.Decrypt(ctx, personID, change.Field, change.Before); err != nil {
+			return nil, err
+		}
+		if change.After, err = fieldEncryptor.Decrypt(ctx, personID, change.Field, change.After); err != nil {
+			return nil, err
+		}
+		if change.Before == change.After && change.Before != models.MaskedValue {
+			continue
+		}
+		visible = append(visible, change)
+	}
+	return visible, nil
+}
+
+// handleGetAsOf answers GET /persons/{personId}?asOf=<RFC 3339 time> with the person as it was
+// at that time, replayed from the audit trail: the image of the last change at or before it.
+// Persons that did not exist yet, were deleted or erased by then, or were last changed before
+// the audit trail was enabled are not found, and neither are anonymized persons before their
+// anonymization, whose real data is gone.
+func handleGetAsOf(ctx context.Context, request events.APIGatewayProxyRequest, value string, withDeleted bool, cleanJSON bool) (events.APIGatewayProxyResponse, error) {
+	asOf, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "asOf must be an RFC 3339 timestamp"), nil
+	}
+	if auditTableName == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "The audit trail is not enabled"), nil
+	}
+	personID := request.PathParameters["personId"]
+
+	anonymized, err := anonymizedAt(ctx, personID)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "read anonymization", err), nil
+	}
+	if anonymized != "" && asOf.UTC().Format(time.RFC3339) < anonymized {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
+	}
+
+	item, err := personAsOf(ctx, personID, asOf)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "replay audit trail", err), nil
+	}
+	if item == nil || (isDeleted(item) && !withDeleted) {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
+	}
+	return personResponse(ctx, request, personID, item, cleanJSON)
+}
+
+// personAsOf returns the image of the last audit entry of a person at or before a time, or nil
+// when there is none or the person was erased. Entries carry the whole person after each
+// change, so the last one is the state at that time and nothing needs to be replayed on top.
+func personAsOf(ctx context.Context, personID string, asOf time.Time) (map[string]types.AttributeValue, error) {
+	// auditIds start with the second of the change and then "#", which sorts before "#~"
+	// whatever follows
+	upTo := asOf.UTC().Format(time.RFC3339) + "#~"
+	keyCondition := ddbexpr.KeyEquals("personId", personID).And(expression.Key("auditId").LessThan(expression.Value(upTo)))
+	projection := expression.NamesList(expression.Name("operation"), expression.Name("image"))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCondition).WithProjection(projection).Build()
+	if err != nil {
+		return nil, err
+	}
+	result, err := svc.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(auditTableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(1),
+	})
+	if err != nil || len(result.Items) == 0 {
+		return nil, err
+	}
+	latest := result.Items[0]
+	if operation, _ := latest["operation"].(*types.AttributeValueMemberS); operation != nil && operation.Value == personevents.EventErase {
+		return nil, nil
+	}
+	// Hard deletes leave no image
+	image, _ := latest["image"].(*types.AttributeValueMemberM)
+	if image == nil || len(image.Value) == 0 {
+		return nil, nil
+	}
+	return image.Value, nil
+}
+
+// anonymizedAt returns when a person was anonymized, or "" when they were not (or no longer
+// exist). Timestamps are RFC 3339 in UTC, so they compare as strings.
+func anonymizedAt(ctx context.Context, personID string) (string, error) {
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:            aws.String(tableName),
+		Key:                  map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		ProjectionExpression: aws.String("anonymizedAt"),
+	})
+	if err != nil {
+		return "", err
+	}
+	anonymized, _ := result.Item["anonymizedAt"].(*types.AttributeValueMemberS)
+	if anonymized == nil {
+		return "", nil
+	}
+	return anonymized.Value, nil
+}
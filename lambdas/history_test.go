@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"aws-lambda-go/internal/models"
+)
+
+func TestVisibleChangesDropsUnchangedValues(t *testing.T) {
+	changes := []models.FieldChange{
+		{Field: "address", Before: "1 Main St", After: "1 Main St"},
+		{Field: "firstName", Before: "Ada", After: "Grace"},
+		{Field: "phoneNumber", Before: models.MaskedValue, After: models.MaskedValue},
+	}
+
+	visible, err := visibleChanges(context.Background(), "p-1", nil, changes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(visible) != 2 || visible[0].Field != "firstName" || visible[1].Field != "phoneNumber" {
+		t.Errorf("changes = %+v, want firstName and the masked phoneNumber", visible)
+	}
+}
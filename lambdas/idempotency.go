@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// idempotencyTableName enables Idempotency-Key support on POST when set (IDEMPOTENCY_TABLE_NAME)
+var idempotencyTableName = settings.IdempotencyTableName
+
+// idempotencyTTL is how long a key is remembered; DynamoDB TTL removes the record afterwards
+const idempotencyTTL = 24 * time.Hour
+
+// idempotencyLease is how long a pending claim holds its key. API requests end within API
+// Gateway's 29 second limit, so an older claim belongs to a request that crashed or timed out
+// before inserting its person, and a retry with the same key takes it over.
+const idempotencyLease = time.Minute
+
+// errIdempotencyKeyReused is returned when a key is replayed with a different request body
+var errIdempotencyKeyReused = errors.New("idempotency key reused with a different request body")
+
+// Statuses of an idempotency record. A key is claimed as pending before the person is
+// inserted and completed once it is; records without a status predate it and are complete.
+// Pending records note when they were claimed (claimedAt, Unix seconds); those without it
+// predate the lease and are expired.
+const (
+	idempotencyPending   = "pending"
+	idempotencyCompleted = "completed"
+)
+
+// idempotencyRecord is what is stored per Idempotency-Key
+type idempotencyRecord struct {
+	PersonID    string
+	RequestHash string
+	// Pending is set while the original request has not inserted the person yet
+	Pending bool
+}
+
+// requestHash fingerprints a request body so a reused key with a different payload can be rejected
+func requestHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// scopedIdempotencyKey is the stored form of a caller's key. Keys are chosen by clients, so
+// they are prefixed with who sent them (see actorFromContext): the same key from another caller
+// is another request and never replays someone else's person.
+func scopedIdempotencyKey(ctx context.Context, key string) string {
+	if actor := actorFromContext(ctx); actor != "" {
+		return actor + "#" + key
+	}
+	return key
+}
+
+// claimIdempotencyKey atomically records key -> personID as pending. When the key was already
+// claimed, the original record is returned instead and the caller must not insert again, unless
+// the original claim is pending past its lease: then it is taken over for personID.
+func claimIdempotencyKey(ctx context.Context, key string, personID string, body string) (*idempotencyRecord, error) {
+	key = scopedIdempotencyKey(ctx, key)
+	hash := requestHash(body)
+
+	err := putIdempotencyClaim(ctx, key, personID, hash, expression.AttributeNotExists(expression.Name("idempotencyKey")))
+	if err == nil {
+		return nil, nil
+	}
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return nil, err
+	}
+
+	// The key exists: look up the personId created by the original request
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(idempotencyTableName),
+		Key:            map[string]types.AttributeValue{"idempotencyKey": &types.AttributeValueMemberS{Value: key}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		// The record expired between the two calls; surface the original conflict
+		return nil, conditionErr
+	}
+
+	record := &idempotencyRecord{}
+	if v, ok := result.Item["personId"].(*types.AttributeValueMemberS); ok {
+		record.PersonID = v.Value
+	}
+	if v, ok := result.Item["requestHash"].(*types.AttributeValueMemberS); ok {
+		record.RequestHash = v.Value
+	}
+	if record.RequestHash != hash {
+		return nil, errIdempotencyKeyReused
+	}
+	if v, ok := result.Item["status"].(*types.AttributeValueMemberS); !ok || v.Value != idempotencyPending {
+		return record, nil
+	}
+
+	// The original request may have inserted the person and failed to complete the key
+	person, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:            aws.String(tableName),
+		Key:                  map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: record.PersonID}},
+		ProjectionExpression: aws.String("personId"),
+		ConsistentRead:       aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if person.Item != nil {
+		return record, nil
+	}
+	record.Pending = true
+
+	cutoff := time.Now().Add(-idempotencyLease).Unix()
+	if numberAttribute(result.Item, "claimedAt") >= cutoff {
+		return record, nil
+	}
+	// Only one retry takes over an abandoned claim; the others keep seeing it pending
+	expired := expression.Name("status").Equal(expression.Value(idempotencyPending)).
+		And(expression.Name("requestHash").Equal(expression.Value(hash))).
+		And(expression.Or(
+			expression.AttributeNotExists(expression.Name("claimedAt")),
+			expression.Name("claimedAt").LessThan(expression.Value(cutoff)),
+		))
+	err = putIdempotencyClaim(ctx, key, personID, hash, expired)
+	if errors.As(err, &conditionErr) {
+		return record, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.FromContext(ctx).Warn("Took over an abandoned idempotency key", "abandonedPersonId", record.PersonID)
+	return nil, nil
+}
+
+// putIdempotencyClaim writes a pending claim of a key for personID if the condition holds
+func putIdempotencyClaim(ctx context.Context, key string, personID string, hash string, condition expression.ConditionBuilder) error {
+	now := time.Now()
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(idempotencyTableName),
+		Item: map[string]types.AttributeValue{
+			"idempotencyKey": &types.AttributeValueMemberS{Value: key}, // Partition Key
+			"personId":       &types.AttributeValueMemberS{Value: personID},
+			"requestHash":    &types.AttributeValueMemberS{Value: hash},
+			"status":         &types.AttributeValueMemberS{Value: idempotencyPending},
+			"claimedAt":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			"expiresAt":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(idempotencyTTL).Unix(), 10)},
+		},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
+
+// completeIdempotencyKey marks a claim as completed once its person was inserted, so replays
+// return the person instead of waiting for it. A claim another request took over is left alone.
+func completeIdempotencyKey(ctx context.Context, key string, personID string) error {
+	update, err := expression.NewBuilder().
+		WithUpdate(expression.Set(expression.Name("status"), expression.Value(idempotencyCompleted))).
+		WithCondition(expression.Name("personId").Equal(expression.Value(personID))).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(idempotencyTableName),
+		Key:                       map[string]types.AttributeValue{"idempotencyKey": &types.AttributeValueMemberS{Value: scopedIdempotencyKey(ctx, key)}},
+		UpdateExpression:          update.Update(),
+		ConditionExpression:       update.Condition(),
+		ExpressionAttributeNames:  update.Names(),
+		ExpressionAttributeValues: update.Values(),
+	})
+	return err
+}
+
+// releaseIdempotencyKey removes a claim whose insert failed, so the client can retry with the
+// same key. A claim another request took over is left alone.
+func releaseIdempotencyKey(ctx context.Context, key string, personID string) error {
+	expr, err := expression.NewBuilder().WithCondition(expression.Name("personId").Equal(expression.Value(personID))).Build()
+	if err != nil {
+		return err
+	}
+	_, err = svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(idempotencyTableName),
+		Key:                       map[string]types.AttributeValue{"idempotencyKey": &types.AttributeValueMemberS{Value: scopedIdempotencyKey(ctx, key)}},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClaimIdempotencyKeyLease(t *testing.T) {
+	previousTable, previousIdempotencyTable := tableName, idempotencyTableName
+	tableName, idempotencyTableName = "persons", "idempotency"
+	t.Cleanup(func() { tableName, idempotencyTableName = previousTable, previousIdempotencyTable })
+
+	body := `{"firstName": "Ada"}`
+	tests := []struct {
+		name      string
+		claimedAt time.Time
+		takenOver bool
+	}{
+		{"abandoned claim is taken over", time.Now().Add(-2 * idempotencyLease), true},
+		{"claim within its lease stays pending", time.Now(), false},
+		{"claim without claimedAt is taken over", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			fake := useFakeDynamoDB(t, func(operation string, input map[string]interface{}) interface{} {
+				switch operation {
+				case "PutItem":
+					// The first claim finds the key taken
+					if attempts++; attempts == 1 {
+						return ddbError("ConditionalCheckFailedException")
+					}
+					return nil
+				case "GetItem":
+					if input["TableName"] == "persons" {
+						return nil
+					}
+					item := map[string]interface{}{
+						"personId":    map[string]string{"S": "abandoned"},
+						"requestHash": map[string]string{"S": requestHash(body)},
+						"status":      map[string]string{"S": idempotencyPending},
+					}
+					if !tt.claimedAt.IsZero() {
+						item["claimedAt"] = map[string]string{"N": strconv.FormatInt(tt.claimedAt.Unix(), 10)}
+					}
+					return map[string]interface{}{"Item": item}
+				}
+				t.Errorf("unexpected %s call", operation)
+				return nil
+			})
+
+			record, err := claimIdempotencyKey(context.Background(), "key-1", "retry", body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			puts := fake.callsTo("PutItem")
+			if !tt.takenOver {
+				if record == nil || !record.Pending || record.PersonID != "abandoned" {
+					t.Errorf("record = %+v, want the pending original", record)
+				}
+				if len(puts) != 1 {
+					t.Errorf("PutItem calls = %d, want 1", len(puts))
+				}
+				return
+			}
+
+			if record != nil {
+				t.Fatalf("record = %+v, want the claim taken over", record)
+			}
+			if len(puts) != 2 {
+				t.Fatalf("PutItem calls = %d, want 2", len(puts))
+			}
+			takeover := puts[1]
+			if condition := takeover["ConditionExpression"].(string); !strings.Contains(condition, "attribute_not_exists") || !strings.Contains(condition, "<") {
+				t.Errorf("takeover condition = %q, want the lease check", condition)
+			}
+			item := takeover["Item"].(map[string]interface{})
+			if personID := item["personId"].(map[string]interface{})["S"]; personID != "retry" {
+				t.Errorf("takeover personId = %v, want retry", personID)
+			}
+		})
+	}
+}
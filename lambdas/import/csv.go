@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/internal/validation"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+const (
+	// batchSize is the BatchWriteItem limit
+	batchSize = 25
+	// maxBatchAttempts bounds how often unprocessed items are resubmitted
+	maxBatchAttempts = 5
+	// retryBackoff is the pause before the first resubmission; it doubles per attempt
+	retryBackoff = 100 * time.Millisecond
+	// maxReportedFailures caps the failures kept in the report; Failed still counts all of them
+	maxReportedFailures = 100
+	// maxPreviewRows caps the preview-rows metadata of a file
+	maxPreviewRows = 100000
+	// previewSampleSize is how many transformed rows a preview reports
+	previewSampleSize = 10
+)
+
+// columns are the CSV header names mapped onto person fields. firstName, lastName, address and
+// phoneNumber are required; the other columns are optional.
+var columns = []string{"firstName", "lastName", "address", "phoneNumber", "email", "notificationChannel", "tenantId", "locale"}
+
+// RowFailure explains why a row was not imported. Rows are numbered from 1, the header
+// being row 1, so they match what spreadsheet tools show.
+type RowFailure struct {
+	Row    int      `dynamodbav:"row"`
+	Errors []string `dynamodbav:"errors"`
+}
+
+// ImportReport summarizes an import. A preview writes nothing: it reports the valid rows and a
+// sample of them as they would be stored instead.
+type ImportReport struct {
+	Rows     int
+	Imported int
+	Failed   int
+	Failures []RowFailure
+	// ErrorCounts counts the rows failing with each error, so the most common problems stand out
+	ErrorCounts map[string]int
+	Preview     bool
+	Valid       int
+	Sample      []map[string]string
+}
+
+func (r *ImportReport) fail(row int, errs ...string) {
+	r.Failed++
+	if len(r.Failures) < maxReportedFailures {
+		r.Failures = append(r.Failures, RowFailure{Row: row, Errors: errs})
+	}
+	for _, err := range errs {
+		r.ErrorCounts[err]++
+	}
+}
+
+// previewRows returns how many rows to check when the uploader asked for a preview with the
+// object metadata x-amz-meta-preview: true, or 0 for a regular import. x-amz-meta-preview-rows
+// overrides IMPORT_PREVIEW_ROWS.
+func previewRows(metadata map[string]string) int {
+	if preview, _ := strconv.ParseBool(metadata["preview"]); !preview {
+		return 0
+	}
+	if rows, err := strconv.Atoi(metadata["preview-rows"]); err == nil && rows > 0 {
+		return min(rows, maxPreviewRows)
+	}
+	return settings.PreviewRows
+}
+
+// pendingRow is a validated row waiting to be written
+type pendingRow struct {
+	row  int
+	item map[string]types.AttributeValue
+}
+
+// importFile streams the CSV object, validating every row and writing valid ones in batches.
+// A preview only validates and transforms the first rows of the file.
+func importFile(ctx context.Context, bucket string, key string) (*ImportReport, error) {
+	report := &ImportReport{Failures: []RowFailure{}, ErrorCounts: map[string]int{}}
+	object, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return report, fmt.Errorf("failed to read s3://%s/%s: %w", bucket, key, err)
+	}
+	defer object.Body.Close()
+	limit := previewRows(object.Metadata)
+	report.Preview = limit > 0
+
+	reader := csv.NewReader(object.Body)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return report, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	index, err := columnIndex(header)
+	if err != nil {
+		return report, err
+	}
+
+	var batch []pendingRow
+	for row := 2; !report.Preview || report.Rows < limit; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.Rows++
+			report.fail(row, parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to read CSV row %d: %w", row, err)
+		}
+		report.Rows++
+
+		fields := func(name string) string {
+			if i, ok := index[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		person := models.Person{
+			FirstName:           fields("firstName"),
+			LastName:            fields("lastName"),
+			Address:             fields("address"),
+			PhoneNumber:         fields("phoneNumber"),
+			Email:               fields("email"),
+			NotificationChannel: fields("notificationChannel"),
+			Locale:              fields("locale"),
+		}
+		if errs := validation.Validate(person); len(errs) > 0 {
+			messages := make([]string, len(errs))
+			for i, e := range errs {
+				messages[i] = e.Error()
+			}
+			report.fail(row, messages...)
+			continue
+		}
+
+		if report.Preview {
+			report.Valid++
+			if len(report.Sample) < previewSampleSize {
+				report.Sample = append(report.Sample, sampleRecord(newPersonItem(ctx, person, fields("tenantId"))))
+			}
+			continue
+		}
+		item, err := personItem(ctx, person, fields("tenantId"))
+		if err != nil {
+			return report, err
+		}
+		batch = append(batch, pendingRow{row: row, item: item})
+		if len(batch) == batchSize {
+			if err := writeBatch(ctx, batch, report); err != nil {
+				return report, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := writeBatch(ctx, batch, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// columnIndex maps the header names to their positions and checks the required columns exist
+func columnIndex(header []string) (map[string]int, error) {
+	known := map[string]bool{}
+	for _, column := range columns {
+		known[column] = true
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		// Spreadsheet exports often start with a UTF-8 byte order mark
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if known[name] {
+			index[name] = i
+		}
+	}
+	var missing []string
+	for _, column := range []string{"firstName", "lastName", "address", "phoneNumber"} {
+		if _, ok := index[column]; !ok {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("CSV header is missing columns: %s", strings.Join(missing, ", "))
+	}
+	return index, nil
+}
+
+// lookupKey normalizes a value like normalizeKey of the HTTP lambda, so imported persons can
+// be found by POST /persons/match
+func lookupKey(value string) string {
+	return strings.ToLower(strings.Join(strings.Fields(value), " "))
+}
+
+// personItem builds the item of an imported person the way POST /persons does
+func personItem(ctx context.Context, person models.Person, tenantID string) (map[string]types.AttributeValue, error) {
+	item := newPersonItem(ctx, person, tenantID)
+	personID := item["personId"].(*types.AttributeValueMemberS).Value
+	if err := hasher.HashItem(ctx, item); err != nil {
+		return nil, err
+	}
+	if err := pii.EncryptItem(ctx, personID, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// newPersonItem builds the item of an imported person before its PII is encrypted
+func newPersonItem(ctx context.Context, person models.Person, tenantID string) map[string]types.AttributeValue {
+	personID := uuid.New().String()
+	now := time.Now().UTC().Format(time.RFC3339)
+	item := map[string]types.AttributeValue{
+		"personId":    &types.AttributeValueMemberS{Value: personID},
+		"firstName":   &types.AttributeValueMemberS{Value: person.FirstName},
+		"lastName":    &types.AttributeValueMemberS{Value: person.LastName},
+		"address":     &types.AttributeValueMemberS{Value: person.Address},
+		"phoneNumber": &types.AttributeValueMemberS{Value: person.PhoneNumber},
+		"lastNameKey": &types.AttributeValueMemberS{Value: lookupKey(person.LastName)},
+		"version":     &types.AttributeValueMemberN{Value: "1"},
+		"createdAt":   &types.AttributeValueMemberS{Value: now},
+		"updatedAt":   &types.AttributeValueMemberS{Value: now},
+	}
+	if person.Email != "" {
+		item["email"] = &types.AttributeValueMemberS{Value: person.Email}
+		item["emailKey"] = &types.AttributeValueMemberS{Value: lookupKey(person.Email)}
+	}
+	if person.NotificationChannel != "" {
+		item["notificationChannel"] = &types.AttributeValueMemberS{Value: person.NotificationChannel}
+	}
+	if person.Locale != "" {
+		item["locale"] = &types.AttributeValueMemberS{Value: person.Locale}
+	}
+	if tenantID != "" {
+		item["tenantId"] = &types.AttributeValueMemberS{Value: tenantID}
+	}
+	if correlationID := logger.CorrelationID(ctx); correlationID != "" {
+		item["correlationId"] = &types.AttributeValueMemberS{Value: correlationID}
+	}
+	item["updatedBy"] = &types.AttributeValueMemberS{Value: "system:import"}
+	return item
+}
+
+// sampleRecord is the preview of an item: its text attributes as they would be stored, before
+// encryption, without the ones every import generates
+func sampleRecord(item map[string]types.AttributeValue) map[string]string {
+	record := map[string]string{}
+	for name, value := range item {
+		switch name {
+		case "personId", "createdAt", "updatedAt", "correlationId", "updatedBy":
+			continue
+		}
+		if s, ok := value.(*types.AttributeValueMemberS); ok {
+			record[name] = s.Value
+		}
+	}
+	return record
+}
+
+// writeBatch writes up to 25 rows, resubmitting unprocessed items with exponential backoff.
+// Rows still unprocessed after the last attempt are reported as failed.
+func writeBatch(ctx context.Context, batch []pendingRow, report *ImportReport) error {
+	rows := map[string]int{}
+	writes := make([]types.WriteRequest, len(batch))
+	for i, pending := range batch {
+		rows[pending.item["personId"].(*types.AttributeValueMemberS).Value] = pending.row
+		writes[i] = types.WriteRequest{PutRequest: &types.PutRequest{Item: pending.item}}
+	}
+
+	backoff := retryBackoff
+	for attempt := 1; len(writes) > 0 && attempt <= maxBatchAttempts; attempt++ {
+		if attempt > 1 {
+			logger.FromContext(ctx).Warn("Retrying unprocessed import rows", "unprocessed", len(writes), "attempt", attempt)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+		result, err := dynamo.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{tableName: writes},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write import batch: %w", err)
+		}
+		writes = result.UnprocessedItems[tableName]
+	}
+
+	for _, write := range writes {
+		personID := write.PutRequest.Item["personId"].(*types.AttributeValueMemberS).Value
+		report.fail(rows[personID], "not written: DynamoDB throttled the batch")
+		delete(rows, personID)
+	}
+	report.Imported += len(rows)
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/fieldcrypt"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var settings, settingsErr = config.LoadImport()
+
+var (
+	tableName        string
+	importsTableName string
+	dynamo           *dynamodb.Client
+	s3Client         *s3.Client
+	pii              *fieldcrypt.Encryptor
+	hasher           *fieldcrypt.Hasher
+)
+
+func init() {
+	logger.Init("import")
+	metrics.Init("import")
+	tableName = settings.TableName
+	importsTableName = settings.ImportsTableName
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	if err := tracing.Init(context.TODO(), "import"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	metrics.InstrumentDynamoDB(&cfg)
+	dynamo = ddbclient.New(cfg, settings.DynamoDB)
+	s3Client = s3.NewFromConfig(cfg)
+	pii = fieldcrypt.New(cfg, settings.PII.KMSKeyID, settings.PII.Fields)
+	hasher = fieldcrypt.NewHasher(cfg, settings.IdentityHashKMSKeyID)
+}
+
+// validImportID matches the import IDs uploaders may choose
+var validImportID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// importID is the file name of the object without its extension: the uploader picks the ID
+// when writing imports/<importId>.csv and can then poll GET /imports/{importId}
+func importID(key string) (string, bool) {
+	id := strings.TrimSuffix(path.Base(key), path.Ext(key))
+	return id, validImportID.MatchString(id)
+}
+
+// processRecord imports one uploaded file and records its report
+func processRecord(ctx context.Context, record events.S3EventRecord) error {
+	key, err := url.QueryUnescape(record.S3.Object.Key)
+	if err != nil {
+		return fmt.Errorf("invalid object key %q: %w", record.S3.Object.Key, err)
+	}
+	bucket := record.S3.Bucket.Name
+	id, ok := importID(key)
+	if !ok {
+		logger.FromContext(ctx).Error("Skipping import with an invalid file name", "key", key)
+		return nil
+	}
+	ctx = logger.With(ctx, "importId", id, "key", key)
+
+	started, err := startImport(ctx, id, bucket, key, record.S3.Object.ETag)
+	if err != nil {
+		return err
+	}
+	if !started {
+		logger.FromContext(ctx).Info("Import already processed, skipping")
+		return nil
+	}
+
+	start := time.Now()
+	report, err := importFile(ctx, bucket, key)
+	if err != nil {
+		logger.FromContext(ctx).Error("Import failed", "error", err)
+		if finishErr := finishImport(ctx, id, statusFailed, report, err.Error()); finishErr != nil {
+			return errors.Join(err, finishErr)
+		}
+		// The failure is recorded in the report; retrying the same file would fail the same way
+		return nil
+	}
+
+	if report.Preview {
+		logger.FromContext(ctx).Info("Import preview complete", "rows", report.Rows, "valid", report.Valid, "failed", report.Failed)
+		return finishImport(ctx, id, statusPreviewed, report, "")
+	}
+	metrics.Emit(nil, map[string]interface{}{"importId": id},
+		metrics.Count("RowsImported", report.Imported),
+		metrics.Count("RowsFailed", report.Failed),
+		metrics.Duration("ImportDuration", time.Since(start)),
+	)
+	logger.FromContext(ctx).Info("Import complete", "rows", report.Rows, "imported", report.Imported, "failed", report.Failed)
+	return finishImport(ctx, id, statusCompleted, report, "")
+}
+
+// startImport claims the import. It returns false when this version of the file was already
+// imported or is being imported by another invocation; failed and previewed imports can be
+// restarted, and uploading new content under the same name starts a new import.
+func startImport(ctx context.Context, id string, bucket string, key string, etag string) (bool, error) {
+	expr, err := expression.NewBuilder().WithCondition(expression.
+		AttributeNotExists(expression.Name("importId")).
+		Or(expression.Name("status").Equal(expression.Value(statusFailed))).
+		Or(expression.Name("status").Equal(expression.Value(statusPreviewed))).
+		Or(expression.Name("etag").NotEqual(expression.Value(etag)))).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	_, err = dynamo.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(importsTableName),
+		Item: map[string]types.AttributeValue{
+			"importId":  &types.AttributeValueMemberS{Value: id},
+			"bucket":    &types.AttributeValueMemberS{Value: bucket},
+			"key":       &types.AttributeValueMemberS{Value: key},
+			"etag":      &types.AttributeValueMemberS{Value: etag},
+			"status":    &types.AttributeValueMemberS{Value: statusRunning},
+			"startedAt": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to start import %s: %w", id, err)
+	}
+	return true, nil
+}
+
+func handler(ctx context.Context, event events.S3Event) error {
+	ctx = logger.WithLambda(ctx)
+	ctx = tracing.ExtractLambda(ctx)
+	defer tracing.Flush(ctx)
+
+	for _, record := range event.Records {
+		if err := errclass.Retry(ctx, processRecord(ctx, record), "Failed to import file", "key", record.S3.Object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	config.Check(settingsErr)
+	lambda.Start(handler)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Import states, as returned by GET /imports/{importId}
+const (
+	statusRunning   = "running"
+	statusCompleted = "completed"
+	statusFailed    = "failed"
+	// statusPreviewed reports a preview; the file is imported when it is uploaded again
+	// without the preview metadata
+	statusPreviewed = "previewed"
+)
+
+// finishImport stores the outcome and report of an import. reason explains a failed import.
+func finishImport(ctx context.Context, id string, status string, report *ImportReport, reason string) error {
+	update := expression.
+		Set(expression.Name("status"), expression.Value(status)).
+		Set(expression.Name("finishedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339))).
+		Set(expression.Name("rows"), expression.Value(report.Rows)).
+		Set(expression.Name("imported"), expression.Value(report.Imported)).
+		Set(expression.Name("failed"), expression.Value(report.Failed)).
+		Set(expression.Name("failures"), expression.Value(report.Failures)).
+		Set(expression.Name("errorCounts"), expression.Value(report.ErrorCounts))
+	if report.Preview {
+		update = update.
+			Set(expression.Name("valid"), expression.Value(report.Valid)).
+			Set(expression.Name("sample"), expression.Value(report.Sample))
+	}
+	if reason != "" {
+		update = update.Set(expression.Name("reason"), expression.Value(reason))
+	}
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(importsTableName),
+		Key:                       map[string]types.AttributeValue{"importId": &types.AttributeValueMemberS{Value: id}},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record import %s: %w", id, err)
+	}
+	return nil
+}
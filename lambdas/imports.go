@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// importsTableName holds the reports written by the import lambda (IMPORTS_TABLE_NAME)
+var importsTableName = settings.ImportsTableName
+
+// ImportFailure is a CSV row that was not imported
+type ImportFailure struct {
+	Row    int      `json:"row" dynamodbav:"row"`
+	Errors []string `json:"errors" dynamodbav:"errors"`
+}
+
+// ImportStatus is the response of GET /imports/{importId}
+type ImportStatus struct {
+	ImportID   string          `json:"importId" dynamodbav:"importId"`
+	Key        string          `json:"key" dynamodbav:"key"`
+	Status     string          `json:"status" dynamodbav:"status"`
+	Reason     string          `json:"reason,omitempty" dynamodbav:"reason"`
+	Rows       int             `json:"rows" dynamodbav:"rows"`
+	Imported   int             `json:"imported" dynamodbav:"imported"`
+	Failed     int             `json:"failed" dynamodbav:"failed"`
+	Failures   []ImportFailure `json:"failures,omitempty" dynamodbav:"failures"`
+	StartedAt  string          `json:"startedAt" dynamodbav:"startedAt"`
+	FinishedAt string          `json:"finishedAt,omitempty" dynamodbav:"finishedAt"`
+	// ErrorCounts counts the failed rows per error
+	ErrorCounts map[string]int `json:"errorCounts,omitempty" dynamodbav:"errorCounts"`
+	// Valid and Sample report a preview: the rows that would be imported and the first of
+	// them as they would be stored
+	Valid  int                 `json:"valid,omitempty" dynamodbav:"valid"`
+	Sample []map[string]string `json:"sample,omitempty" dynamodbav:"sample"`
+}
+
+// handleGetImport returns the progress or report of a CSV import
+func handleGetImport(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if importsTableName == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Imports are not enabled"), nil
+	}
+	importID := request.PathParameters["importId"]
+	if importID == "" {
+		return errorResponse(request, http.StatusBadRequest, errCodeMissingParameter, "Missing importId"), nil
+	}
+
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(importsTableName),
+		Key:       map[string]types.AttributeValue{"importId": &types.AttributeValueMemberS{Value: importID}},
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "get import", err), nil
+	}
+	if result.Item == nil {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Import not found"), nil
+	}
+
+	var status ImportStatus
+	if err := attributevalue.UnmarshalMap(result.Item, &status); err != nil {
+		return internalErrorResponse(ctx, request, "unmarshal import", err), nil
+	}
+	return jsonResponse(ctx, request, http.StatusOK, status)
+}
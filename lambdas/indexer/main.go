@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/consumer"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/fieldcrypt"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/searchindex"
+	"aws-lambda-go/internal/tracing"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+var settings, settingsErr = config.LoadIndexer()
+
+var (
+	index *searchindex.Client
+	// pii decrypts the PII attributes of the events, as they are searched in clear text
+	pii *fieldcrypt.Encryptor
+	// onEvent parses and decrypts an event before indexPerson gets it
+	onEvent func(ctx context.Context, event events.CloudWatchEvent) error
+)
+
+func init() {
+	logger.Init("indexer")
+	metrics.Init("indexer")
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	if err := tracing.Init(context.TODO(), "indexer"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	index = searchindex.New(cfg, settings.OpenSearchEndpoint)
+	pii = fieldcrypt.New(cfg, settings.PII.KMSKeyID, settings.PII.Fields)
+	onEvent = personevents.NewEventBridgeHandler(indexPerson, personevents.WithDecrypter(pii))
+}
+
+// document converts the image of a person event into its search document
+func document(person personevents.Person) searchindex.Document {
+	return searchindex.Document{
+		PersonID:            person.PersonID,
+		FirstName:           person.FirstName,
+		LastName:            person.LastName,
+		Address:             person.Address,
+		Email:               person.Email,
+		PhoneNumber:         person.PhoneNumber,
+		NotificationChannel: person.NotificationChannel,
+		TenantID:            person.TenantID,
+		OwnerID:             person.OwnerID,
+		Version:             person.Version,
+		CreatedAt:           person.CreatedAt,
+		UpdatedAt:           person.UpdatedAt,
+		Deleted:             person.Deleted,
+	}
+}
+
+// indexPerson applies one person event to the index. Soft-deleted persons stay in the index
+// flagged as deleted, so admins can still find them; erased persons are removed.
+func indexPerson(ctx context.Context, event personevents.PersonChanged) error {
+	ctx = logger.WithCorrelationID(logger.With(ctx, "personId", event.PersonID, "eventName", event.EventName), event.CorrelationID)
+	outcome := "indexed"
+	if event.EventName == personevents.EventErase {
+		if err := index.Delete(ctx, event.PersonID); err != nil {
+			return err
+		}
+		outcome = "deleted"
+	} else {
+		written, err := index.Put(ctx, document(event.Person))
+		if err != nil {
+			return err
+		}
+		if !written {
+			// A newer version of the person was indexed first
+			outcome = "stale"
+		}
+	}
+	logger.FromContext(ctx).Info("Applied person event to the search index", "outcome", outcome, "version", event.Person.Version)
+	metrics.Emit(map[string]string{"EventName": event.EventName, "Outcome": outcome}, nil, metrics.Count("PersonsIndexed", 1))
+	return nil
+}
+
+// handler receives the person events of the indexer rule, and of search replays. Events that
+// can never be indexed are dropped; other failures are retried by EventBridge.
+func handler(ctx context.Context, event events.CloudWatchEvent) (struct{}, error) {
+	return struct{}{}, errclass.Retry(ctx, onEvent(ctx, event), "Failed to index event", "eventId", event.ID)
+}
+
+func main() {
+	config.Check(settingsErr)
+	lambda.Start(consumer.Invocation(handler))
+}
@@ -0,0 +1,101 @@
+// Package accessaudit records broad reads of person data, such as unscoped lists, match scans
+// and exports, so they can be traced back to whoever ran them. Each access is one item in the
+// table in ACCESS_AUDIT_TABLE_NAME, keyed by actor and time, plus a DataAccess metric.
+package accessaudit
+
+import (
+	"context"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/google/uuid"
+)
+
+// retention is how long audit items are kept before the table's TTL removes them
+const retention = 400 * 24 * time.Hour
+
+// Access describes one audited read
+type Access struct {
+	// Actor is the caller's user sub or IAM principal
+	Actor string
+	// Operation names the kind of access, e.g. "list", "match" or "export"
+	Operation string
+	// Filter holds the parameters that shaped the read. It must not contain PII values.
+	Filter   map[string]string
+	Rows     int
+	Duration time.Duration
+	// Outcome is "success" or "error"
+	Outcome string
+}
+
+// record is the stored form of an Access
+type record struct {
+	Actor         string            `dynamodbav:"actor"`
+	AccessID      string            `dynamodbav:"accessId"`
+	Operation     string            `dynamodbav:"operation"`
+	Filter        map[string]string `dynamodbav:"filter,omitempty"`
+	Rows          int               `dynamodbav:"rows"`
+	DurationMs    int64             `dynamodbav:"durationMs"`
+	Outcome       string            `dynamodbav:"outcome"`
+	CorrelationID string            `dynamodbav:"correlationId,omitempty"`
+	AccessedAt    string            `dynamodbav:"accessedAt"`
+	ExpiresAt     int64             `dynamodbav:"expiresAt"`
+}
+
+// Auditor writes access records
+type Auditor struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+// New creates an Auditor for a table (ACCESS_AUDIT_TABLE_NAME). Without a table, accesses are
+// only counted in the DataAccess metric.
+func New(client *dynamodb.Client, tableName string) *Auditor {
+	return &Auditor{client: client, tableName: tableName}
+}
+
+// Record stores an access and emits the DataAccess metric. A failed write is logged and
+// counted, but does not fail the read it describes; the access already happened.
+func (a *Auditor) Record(ctx context.Context, access Access) {
+	if access.Actor == "" {
+		access.Actor = "anonymous"
+	}
+	if access.Outcome == "" {
+		access.Outcome = "success"
+	}
+	metrics.Emit(map[string]string{"Operation": access.Operation, "Outcome": access.Outcome},
+		map[string]interface{}{"actor": access.Actor, "filter": access.Filter},
+		metrics.Count("DataAccess", 1),
+		metrics.Count("DataAccessRows", access.Rows),
+	)
+	if a == nil || a.tableName == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+	item, err := attributevalue.MarshalMap(record{
+		Actor: access.Actor,
+		// Sorts by time within an actor; the UUID keeps concurrent accesses apart
+		AccessID:      now.Format(time.RFC3339Nano) + "#" + uuid.New().String(),
+		Operation:     access.Operation,
+		Filter:        access.Filter,
+		Rows:          access.Rows,
+		DurationMs:    access.Duration.Milliseconds(),
+		Outcome:       access.Outcome,
+		CorrelationID: logger.CorrelationID(ctx),
+		AccessedAt:    now.Format(time.RFC3339),
+		ExpiresAt:     now.Add(retention).Unix(),
+	})
+	if err == nil {
+		_, err = a.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(a.tableName), Item: item})
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to record data access", "operation", access.Operation, "actor", access.Actor, "error", err)
+		metrics.Emit(map[string]string{"Operation": access.Operation}, nil, metrics.Count("DataAccessAuditFailed", 1))
+	}
+}
@@ -0,0 +1,304 @@
+// Package config loads the settings of each lambda from its environment into a typed struct
+// at cold start. Problems are collected rather than returned one at a time, so a misconfigured
+// deployment fails once, with a message listing every missing or invalid variable.
+//
+// The DynamoDB client settings (see internal/ddbclient) are loaded with the common settings
+// of every lambda; the settings of fieldcrypt, accessaudit and slack by the lambdas that use
+// them. Only logger, metrics and tracing keep reading their own variables.
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"aws-lambda-go/internal/ddbclient"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// Common are the settings of every lambda
+type Common struct {
+	// Environment names the deployment, e.g. "prod" (ENVIRONMENT_NAME)
+	Environment string
+	// Region overrides the region of the AWS clients (REGION_OVERRIDE), e.g. to reach the
+	// tables of another region; empty uses the lambda's own region
+	Region string
+	// DynamoDB configures the lambda's DynamoDB clients (DYNAMODB_*), for ddbclient.New
+	DynamoDB ddbclient.Settings
+}
+
+// AWSOptions returns the SDK load options for the common settings, for
+// config.LoadDefaultConfig(ctx, settings.AWSOptions()...)
+func (c Common) AWSOptions() []func(*awsconfig.LoadOptions) error {
+	if c.Region == "" {
+		return nil
+	}
+	return []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(c.Region)}
+}
+
+func loadCommon(l *loader) Common {
+	return Common{
+		Environment: l.optional("ENVIRONMENT_NAME", ""),
+		Region:      l.optional("REGION_OVERRIDE", ""),
+		DynamoDB:    loadDynamoDB(l),
+	}
+}
+
+// loadDynamoDB reads the DynamoDB client settings, starting from ddbclient.Defaults. Zero
+// attempts or backoff keep the SDK default, a zero timeout or threshold disables it.
+func loadDynamoDB(l *loader) ddbclient.Settings {
+	defaults := ddbclient.Defaults
+	return ddbclient.Settings{
+		MaxAttempts:       l.integer("DYNAMODB_MAX_ATTEMPTS", 0, defaults.MaxAttempts),
+		MaxBackoff:        time.Duration(l.integer("DYNAMODB_MAX_BACKOFF_MS", 0, int(defaults.MaxBackoff/time.Millisecond))) * time.Millisecond,
+		Timeout:           time.Duration(l.integer("DYNAMODB_TIMEOUT_MS", 0, int(defaults.Timeout/time.Millisecond))) * time.Millisecond,
+		OperationTimeouts: l.durations("DYNAMODB_OPERATION_TIMEOUTS"),
+		BreakerThreshold:  l.integer("DYNAMODB_BREAKER_THRESHOLD", 0, defaults.BreakerThreshold),
+		BreakerCooldown:   time.Duration(l.integer("DYNAMODB_BREAKER_COOLDOWN_MS", 0, int(defaults.BreakerCooldown/time.Millisecond))) * time.Millisecond,
+	}
+}
+
+// PII configures the field encryption of internal/fieldcrypt
+type PII struct {
+	// KMSKeyID is the key new PII values are encrypted with (PII_KMS_KEY_ID). Lambdas that
+	// only decrypt may leave it empty.
+	KMSKeyID string
+	// Fields are the encrypted person attributes (PII_FIELDS); empty keeps fieldcrypt's defaults
+	Fields []string
+}
+
+// loadPII reads the PII settings. Lambdas that write persons require the key, so a deployment
+// without it fails its cold start instead of storing PII in plaintext.
+func loadPII(l *loader, writes bool) PII {
+	var keyID string
+	if writes {
+		keyID = l.required("PII_KMS_KEY_ID")
+	} else {
+		keyID = l.optional("PII_KMS_KEY_ID", "")
+	}
+	return PII{KMSKeyID: keyID, Fields: l.list("PII_FIELDS")}
+}
+
+// Error lists what is wrong with the configuration of a lambda
+type Error struct {
+	Lambda  string
+	Missing []string
+	Invalid []string
+}
+
+func (e *Error) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Invalid) > 0 {
+		problems = append(problems, "invalid "+strings.Join(e.Invalid, ", "))
+	}
+	return fmt.Sprintf("invalid configuration of the %s lambda: %s", e.Lambda, strings.Join(problems, "; "))
+}
+
+// Check stops the lambda when its settings failed to load. Every lambda loads its settings in
+// a package variable, so they are there before the other package variables and init read
+// them, and calls Check with the error first in main. The process then exits during the cold
+// start with the problems in the init error, instead of failing requests one by one. Tests
+// never run main and are not affected.
+func Check(err error) {
+	if err == nil {
+		return
+	}
+	slog.Error("Invalid configuration", "error", err)
+	os.Exit(1)
+}
+
+// loader reads variables and collects the problems with them
+type loader struct {
+	lambda  string
+	missing []string
+	invalid []string
+}
+
+func newLoader(lambda string) *loader {
+	return &loader{lambda: lambda}
+}
+
+// err returns the collected problems, or nil
+func (l *loader) err() error {
+	if len(l.missing) == 0 && len(l.invalid) == 0 {
+		return nil
+	}
+	return &Error{Lambda: l.lambda, Missing: l.missing, Invalid: l.invalid}
+}
+
+func (l *loader) fail(name string, value string, want string) {
+	l.invalid = append(l.invalid, fmt.Sprintf("%s=%q (want %s)", name, value, want))
+}
+
+// required reads a variable that must be set
+func (l *loader) required(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		l.missing = append(l.missing, name)
+	}
+	record(name, value, false)
+	return value
+}
+
+// optional reads a variable, falling back when it is unset
+func (l *loader) optional(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		record(name, value, false)
+		return value
+	}
+	record(name, fallback, true)
+	return fallback
+}
+
+// integer reads an integer of at least min, falling back when it is unset
+func (l *loader) integer(name string, min int, fallback int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		record(name, strconv.Itoa(fallback), true)
+		return fallback
+	}
+	record(name, raw, false)
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min {
+		l.fail(name, raw, fmt.Sprintf("an integer >= %d", min))
+		return fallback
+	}
+	return value
+}
+
+// number reads a decimal number of at least min, falling back when it is unset
+func (l *loader) number(name string, min float64, fallback float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		record(name, strconv.FormatFloat(fallback, 'g', -1, 64), true)
+		return fallback
+	}
+	record(name, raw, false)
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value < min {
+		l.fail(name, raw, fmt.Sprintf("a number >= %g", min))
+		return fallback
+	}
+	return value
+}
+
+// percent reads a percentage from 0 to 100, falling back when it is unset
+func (l *loader) percent(name string, fallback int) int {
+	value := l.integer(name, 0, fallback)
+	if value > 100 {
+		l.fail(name, os.Getenv(name), "an integer from 0 to 100")
+		return fallback
+	}
+	return value
+}
+
+// durations reads a comma-separated list of name=duration pairs, e.g. "Scan=10s,GetItem=500ms",
+// empty when unset
+func (l *loader) durations(name string) map[string]time.Duration {
+	raw := os.Getenv(name)
+	record(name, raw, raw == "")
+	values := map[string]time.Duration{}
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, text, ok := strings.Cut(pair, "=")
+		value, err := time.ParseDuration(strings.TrimSpace(text))
+		if !ok || strings.TrimSpace(key) == "" || err != nil || value < 0 {
+			l.fail(name, raw, "a list of name=duration")
+			return map[string]time.Duration{}
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values
+}
+
+// milliseconds reads a positive duration given in milliseconds
+func (l *loader) milliseconds(name string, fallback time.Duration) time.Duration {
+	return time.Duration(l.integer(name, 1, int(fallback/time.Millisecond))) * time.Millisecond
+}
+
+// boolean reads "true" or "false"; unset is false
+func (l *loader) boolean(name string) bool {
+	raw := os.Getenv(name)
+	record(name, strconv.FormatBool(raw == "true"), raw == "")
+	switch raw {
+	case "", "false":
+		return false
+	case "true":
+		return true
+	default:
+		l.fail(name, raw, "true or false")
+		return false
+	}
+}
+
+// oneOf reads a variable that must be one of values, falling back when it is unset
+func (l *loader) oneOf(name string, fallback string, values ...string) string {
+	raw := os.Getenv(name)
+	if raw == "" {
+		record(name, fallback, true)
+		return fallback
+	}
+	record(name, raw, false)
+	for _, value := range values {
+		if raw == value {
+			return raw
+		}
+	}
+	l.fail(name, raw, strings.Join(values, " or "))
+	return fallback
+}
+
+// list reads a comma-separated list, empty when unset. When values are given, every item
+// must be one of them.
+func (l *loader) list(name string, values ...string) []string {
+	raw := os.Getenv(name)
+	record(name, raw, raw == "")
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if len(values) > 0 && !slices.Contains(values, item) {
+			l.fail(name, raw, "a list of "+strings.Join(values, ", "))
+			return nil
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// together reports variables of one feature of which only some are set
+func (l *loader) together(names ...string) {
+	var set, unset []string
+	for _, name := range names {
+		if os.Getenv(name) == "" {
+			unset = append(unset, name)
+		} else {
+			set = append(set, name)
+		}
+	}
+	if len(set) > 0 && len(unset) > 0 {
+		l.invalid = append(l.invalid, fmt.Sprintf("%s without %s (set all or none)", strings.Join(set, ", "), strings.Join(unset, ", ")))
+	}
+}
+
+// anyOf reports a feature that needs at least one of the variables, e.g. a destination
+func (l *loader) anyOf(names ...string) {
+	for _, name := range names {
+		if os.Getenv(name) != "" {
+			return
+		}
+	}
+	l.missing = append(l.missing, strings.Join(names, " or "))
+}
@@ -0,0 +1,583 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// API are the settings of the HTTP lambda. Optional tables and buckets enable their feature
+// when set.
+type API struct {
+	Common
+	TableName string
+	// EventBusName receives the PersonErased events
+	EventBusName string
+	// AuditLogGroup is the Logging Lambda's log group, searched by GDPR exports
+	AuditLogGroup string
+
+	IdempotencyTableName   string
+	RateLimitTableName     string
+	RateLimitPerMinute     int
+	NotificationsTableName string
+	TemplatesTableName     string
+	TemplatesBucket        string
+	ImportsTableName       string
+	ExportsTableName       string
+	ExportQueueURL         string
+	ExportBucket           string
+	// AnonymizationsTableName tracks anonymization jobs, ANONYMIZE_QUEUE_URL hands them to
+	// the anonymize lambda
+	AnonymizationsTableName string
+	AnonymizeQueueURL       string
+	LegalHoldsTableName     string
+	LegalHoldBucket         string
+	LegalHoldKMSKeyID       string
+	RolesTableName          string
+	DebugCaptureBucket      string
+
+	// AuthRequired rejects requests without authorizer claims
+	AuthRequired bool
+	AdminGroup   string
+	EditorGroup  string
+	ReaderGroup  string
+	DefaultRole  string
+
+	RestoreWindowDays  int
+	ListScanSegments   int
+	ListDeadlineMargin time.Duration
+	// POST /persons/match ranks candidates by relevance and by how recently they were updated
+	MatchRelevanceWeight float64
+	MatchRecencyWeight   float64
+	MatchRecencyHalfLife time.Duration
+	// MaxResponseBytes caps the body of a list response; longer lists end with a nextToken
+	MaxResponseBytes int
+	// Deprecations and ResponseFieldRules are JSON documents; invalid ones are logged and
+	// ignored by their features rather than failing the lambda
+	Deprecations       string
+	ResponseFieldRules string
+	// PipelineStatusTableName and the queue URLs feed GET /admin/pipeline/status
+	PipelineStatusTableName string
+	EmailQueueURL           string
+	EmailDeadLetterQueueURL string
+	StreamDLQURL            string
+	// TenantStatsTableName holds the per-tenant counters of GET /tenants/{tenantId}/stats
+	TenantStatsTableName string
+	// AuditTableName holds the Logging Lambda's audit trail, read by GET /persons/{personId}/history
+	AuditTableName string
+	// AccessPolicy is a JSON document of allow and deny statements per action; when set it
+	// replaces the fixed method checks of the roles
+	AccessPolicy string
+	// ReplaysTableName tracks the replays of POST /admin/replays; they replay EventArchiveARN
+	// on EventBusARN to the replay rule (ReplayRuleARN), which feeds the replay lambda
+	ReplaysTableName string
+	EventArchiveARN  string
+	EventBusARN      string
+	ReplayRuleARN    string
+
+	// MaintenanceMode makes the API read-only; writes get 503 with MaintenanceRetryAfter
+	MaintenanceMode       bool
+	MaintenanceMessage    string
+	MaintenanceRetryAfter time.Duration
+
+	// AWSRegion is the region the lambda runs in, set by the Lambda runtime
+	AWSRegion string
+	// RegionRole is "active" or "standby"; a standby region serves reads only
+	RegionRole string
+	// ActiveRegion names the active region in the responses of a standby region
+	ActiveRegion string
+
+	// OpenSearchEndpoint is the search domain of GET /persons/search; unset disables it
+	OpenSearchEndpoint string
+	// RolloutCleanJSONGet is the share of traffic served the clean JSON GET format
+	// (ROLLOUT_CLEAN_JSON_GET_PERCENT)
+	RolloutCleanJSONGet int
+	// RolloutEnvelope is the share of v2 traffic served the Envelope; the rest gets the bare
+	// data (ROLLOUT_ENVELOPE_PERCENT, 100 when unset)
+	RolloutEnvelope int
+
+	// PII encrypts the PII attributes of the persons written
+	PII PII
+	// IdentityHashKMSKeyID derives the key of the emailHash and phoneHash attributes; unset
+	// hashes nothing
+	IdentityHashKMSKeyID string
+	// AccessAuditTableName records unscoped reads of person data; unset only counts them
+	AccessAuditTableName string
+}
+
+// LoadAPI reads the settings of the HTTP lambda
+func LoadAPI() (API, error) {
+	l := newLoader("http")
+	l.together("EXPORTS_TABLE_NAME", "EXPORT_QUEUE_URL", "EXPORT_BUCKET")
+	l.together("ANONYMIZATIONS_TABLE_NAME", "ANONYMIZE_QUEUE_URL")
+	l.together("LEGAL_HOLDS_TABLE_NAME", "LEGAL_HOLD_BUCKET", "LEGAL_HOLD_KMS_KEY_ID")
+	l.together("TEMPLATES_TABLE_NAME", "TEMPLATES_BUCKET")
+	l.together("REPLAYS_TABLE_NAME", "EVENT_ARCHIVE_ARN", "EVENT_BUS_ARN", "REPLAY_RULE_ARN")
+	settings := API{
+		Common:                  loadCommon(l),
+		TableName:               l.required("TABLE_NAME"),
+		EventBusName:            l.required("EVENT_BUS_NAME"),
+		AuditLogGroup:           l.optional("AUDIT_LOG_GROUP", ""),
+		IdempotencyTableName:    l.optional("IDEMPOTENCY_TABLE_NAME", ""),
+		RateLimitTableName:      l.optional("RATE_LIMIT_TABLE_NAME", ""),
+		RateLimitPerMinute:      l.integer("RATE_LIMIT_PER_MINUTE", 1, 600),
+		NotificationsTableName:  l.optional("NOTIFICATIONS_TABLE_NAME", ""),
+		TemplatesTableName:      l.optional("TEMPLATES_TABLE_NAME", ""),
+		TemplatesBucket:         l.optional("TEMPLATES_BUCKET", ""),
+		ImportsTableName:        l.optional("IMPORTS_TABLE_NAME", ""),
+		ExportsTableName:        l.optional("EXPORTS_TABLE_NAME", ""),
+		ExportQueueURL:          l.optional("EXPORT_QUEUE_URL", ""),
+		ExportBucket:            l.optional("EXPORT_BUCKET", ""),
+		AnonymizationsTableName: l.optional("ANONYMIZATIONS_TABLE_NAME", ""),
+		AnonymizeQueueURL:       l.optional("ANONYMIZE_QUEUE_URL", ""),
+		LegalHoldsTableName:     l.optional("LEGAL_HOLDS_TABLE_NAME", ""),
+		LegalHoldBucket:         l.optional("LEGAL_HOLD_BUCKET", ""),
+		LegalHoldKMSKeyID:       l.optional("LEGAL_HOLD_KMS_KEY_ID", ""),
+		RolesTableName:          l.optional("ROLES_TABLE_NAME", ""),
+		DebugCaptureBucket:      l.optional("DEBUG_CAPTURE_BUCKET", ""),
+		AuthRequired:            l.boolean("AUTH_REQUIRED"),
+		AdminGroup:              l.optional("ADMIN_GROUP", "admin"),
+		EditorGroup:             l.optional("EDITOR_GROUP", "editor"),
+		ReaderGroup:             l.optional("READER_GROUP", "reader"),
+		DefaultRole:             l.optional("DEFAULT_ROLE", "reader"),
+		RestoreWindowDays:       l.integer("RESTORE_WINDOW_DAYS", 1, 30),
+		ListScanSegments:        l.integer("LIST_SCAN_SEGMENTS", 1, 1),
+		ListDeadlineMargin:      l.milliseconds("LIST_DEADLINE_MARGIN_MS", 500*time.Millisecond),
+		MaxResponseBytes:        l.integer("MAX_RESPONSE_BYTES", 64*1024, 5*1024*1024),
+		MatchRelevanceWeight:    l.number("MATCH_RELEVANCE_WEIGHT", 0, 1),
+		MatchRecencyWeight:      l.number("MATCH_RECENCY_WEIGHT", 0, 0),
+		MatchRecencyHalfLife:    time.Duration(l.integer("MATCH_RECENCY_HALF_LIFE_DAYS", 1, 30)) * 24 * time.Hour,
+		Deprecations:            l.optional("DEPRECATIONS", ""),
+		ResponseFieldRules:      l.optional("RESPONSE_FIELD_RULES", ""),
+		AccessPolicy:            l.optional("ACCESS_POLICY", ""),
+		PipelineStatusTableName: l.optional("PIPELINE_STATUS_TABLE_NAME", ""),
+		EmailQueueURL:           l.optional("EMAIL_QUEUE_URL", ""),
+		EmailDeadLetterQueueURL: l.optional("EMAIL_DEAD_LETTER_QUEUE_URL", ""),
+		StreamDLQURL:            l.optional("STREAM_DLQ_URL", ""),
+		TenantStatsTableName:    l.optional("TENANT_STATS_TABLE_NAME", ""),
+		AuditTableName:          l.optional("AUDIT_TABLE_NAME", ""),
+		ReplaysTableName:        l.optional("REPLAYS_TABLE_NAME", ""),
+		EventArchiveARN:         l.optional("EVENT_ARCHIVE_ARN", ""),
+		EventBusARN:             l.optional("EVENT_BUS_ARN", ""),
+		ReplayRuleARN:           l.optional("REPLAY_RULE_ARN", ""),
+		MaintenanceMode:         l.boolean("MAINTENANCE_MODE"),
+		MaintenanceMessage:      l.optional("MAINTENANCE_MESSAGE", ""),
+		MaintenanceRetryAfter:   time.Duration(l.integer("MAINTENANCE_RETRY_AFTER_SECONDS", 1, 300)) * time.Second,
+		AWSRegion:               l.optional("AWS_REGION", ""),
+		RegionRole:              l.oneOf("REGION_ROLE", "active", "active", "standby"),
+		ActiveRegion:            l.optional("ACTIVE_REGION", ""),
+		OpenSearchEndpoint:      l.optional("OPENSEARCH_ENDPOINT", ""),
+		RolloutCleanJSONGet:     l.percent("ROLLOUT_CLEAN_JSON_GET_PERCENT", 0),
+		RolloutEnvelope:         l.percent("ROLLOUT_ENVELOPE_PERCENT", 100),
+		PII:                     loadPII(l, true),
+		IdentityHashKMSKeyID:    l.optional("IDENTITY_HASH_KMS_KEY_ID", ""),
+		AccessAuditTableName:    l.optional("ACCESS_AUDIT_TABLE_NAME", ""),
+	}
+	return settings, l.err()
+}
+
+// Stream are the settings of the stream lambda. The optional sinks are enabled when set.
+type Stream struct {
+	Common
+	// EventBusName, SNSTopicARN, SQSQueueURL, KinesisStreamName and FirehoseStreamName are
+	// the sinks every person event is published to; at least one must be set
+	EventBusName string
+	// QuarantineBucket keeps records that cannot be converted into events
+	QuarantineBucket   string
+	SNSTopicARN        string
+	SQSQueueURL        string
+	KinesisStreamName  string
+	FirehoseStreamName string
+	PublishConcurrency int
+	// EventNames limits the published events to these names; empty publishes all
+	EventNames []string
+	// ChangedFields limits published MODIFY events to those changing one of these
+	// attributes; empty publishes all
+	ChangedFields []string
+	// MaskedChangedFields are attributes whose values are masked in published events: in
+	// their changedFields, person and dynamodbData
+	MaskedChangedFields []string
+	// EventFormat is "legacy", the service's own event format, or "cloudevents", which wraps
+	// every event in a CloudEvents 1.0 envelope
+	EventFormat string
+	// Mode is "publish", publishing the records of the table's stream, or "redrive",
+	// publishing the records of the dead-letter queue again
+	Mode string
+	// DeadLetterQueueURL takes the records that failed DeadLetterAfterAttempts deliveries;
+	// without it they are retried until they expire from the stream
+	DeadLetterQueueURL      string
+	DeadLetterAfterAttempts int
+	// DedupTableName remembers the records each sink took, so redelivered batches publish
+	// every record at most once per sink; DedupTTLHours is how long they are remembered, at
+	// least the 24 hours the stream keeps its records
+	DedupTableName string
+	DedupTTLHours  int
+	// PipelineStatusTableName receives the stream lambda's progress for GET /admin/pipeline/status
+	PipelineStatusTableName string
+	// TenantStatsTableName enables the per-tenant counters, kept like a sink
+	TenantStatsTableName string
+	// SlackWebhookURL receives operational alerts; unset sends none
+	SlackWebhookURL string
+}
+
+// LoadStream reads the settings of the stream lambda
+func LoadStream() (Stream, error) {
+	l := newLoader("stream")
+	l.anyOf("EVENT_BUS_NAME", "STREAM_SNS_TOPIC_ARN", "STREAM_SQS_QUEUE_URL", "STREAM_KINESIS_STREAM_NAME", "STREAM_FIREHOSE_STREAM_NAME")
+	settings := Stream{
+		Common:                  loadCommon(l),
+		EventBusName:            l.optional("EVENT_BUS_NAME", ""),
+		QuarantineBucket:        l.optional("QUARANTINE_BUCKET", ""),
+		SNSTopicARN:             l.optional("STREAM_SNS_TOPIC_ARN", ""),
+		SQSQueueURL:             l.optional("STREAM_SQS_QUEUE_URL", ""),
+		KinesisStreamName:       l.optional("STREAM_KINESIS_STREAM_NAME", ""),
+		FirehoseStreamName:      l.optional("STREAM_FIREHOSE_STREAM_NAME", ""),
+		PublishConcurrency:      l.integer("STREAM_PUBLISH_CONCURRENCY", 1, 4),
+		EventNames:              l.list("STREAM_EVENT_NAMES", "INSERT", "MODIFY", "REMOVE", "RESTORE"),
+		ChangedFields:           l.list("STREAM_CHANGED_FIELDS"),
+		MaskedChangedFields:     l.list("STREAM_MASKED_CHANGED_FIELDS"),
+		EventFormat:             l.oneOf("STREAM_EVENT_FORMAT", "legacy", "legacy", "cloudevents"),
+		Mode:                    l.oneOf("STREAM_MODE", "publish", "publish", "redrive"),
+		DeadLetterQueueURL:      l.optional("STREAM_DLQ_URL", ""),
+		DeadLetterAfterAttempts: l.integer("STREAM_DLQ_AFTER_ATTEMPTS", 1, 3),
+		DedupTableName:          l.optional("STREAM_DEDUP_TABLE_NAME", ""),
+		DedupTTLHours:           l.integer("STREAM_DEDUP_TTL_HOURS", 24, 24),
+		PipelineStatusTableName: l.optional("PIPELINE_STATUS_TABLE_NAME", ""),
+		TenantStatsTableName:    l.optional("TENANT_STATS_TABLE_NAME", ""),
+		SlackWebhookURL:         l.optional("SLACK_WEBHOOK_URL", ""),
+	}
+	return settings, l.err()
+}
+
+// Email are the settings of the email lambda. Optional tables and buckets enable their
+// feature when set.
+type Email struct {
+	Common
+	// QueueURL is the email queue, used to back off failed messages
+	QueueURL string
+	// DeadLetterQueueURL takes messages that fail permanently
+	DeadLetterQueueURL     string
+	NotificationsTableName string
+	TemplatesTableName     string
+	TemplatesBucket        string
+	TemplateCacheTTL       time.Duration
+	DedupTableName         string
+	// DedupWindows is a list like "MODIFY=1h,INSERT=0"
+	DedupWindows       string
+	SMSOptOutTableName string
+	SMSSenderID        string
+	MaxEmailBodyBytes  int
+	// EmailRoutes is a JSON document mapping tenants and recipient domains to SES sending
+	// identities and regions; invalid routes are logged and ignored
+	EmailRoutes string
+	// FromAddress sends emails whose route names no fromAddress
+	FromAddress string
+	// ConfigurationSet receives the SES delivery events of emails whose route names none
+	ConfigurationSet string
+	// DryRun logs emails instead of sending them, for SES sandbox accounts and test stacks
+	DryRun bool
+	// SMSEventTypes are the high-priority event names sent by SMS when the person has a phone
+	// number and allows SMS
+	SMSEventTypes []string
+	// DigestTableName buffers the emails of DigestEventTypes for the scheduled digest run;
+	// unset sends every email right away
+	DigestTableName  string
+	DigestEventTypes []string
+	// DigestInterval is how long a recipient's changes are collected into one digest
+	DigestInterval time.Duration
+	// TableName is the person table, where persons whose address SES reports as undeliverable
+	// are marked; unset only tracks the notification
+	TableName string
+	// PII decrypts the PII attributes of the events
+	PII PII
+	// SlackWebhookURL receives operational alerts; unset sends none
+	SlackWebhookURL string
+}
+
+// LoadEmail reads the settings of the email lambda
+func LoadEmail() (Email, error) {
+	l := newLoader("email")
+	l.together("TEMPLATES_TABLE_NAME", "TEMPLATES_BUCKET")
+	l.together("DIGEST_TABLE_NAME", "DIGEST_EVENT_TYPES")
+	settings := Email{
+		Common:                 loadCommon(l),
+		QueueURL:               l.optional("EMAIL_QUEUE_URL", ""),
+		DeadLetterQueueURL:     l.optional("EMAIL_DEAD_LETTER_QUEUE_URL", ""),
+		NotificationsTableName: l.optional("NOTIFICATIONS_TABLE_NAME", ""),
+		TemplatesTableName:     l.optional("TEMPLATES_TABLE_NAME", ""),
+		TemplatesBucket:        l.optional("TEMPLATES_BUCKET", ""),
+		TemplateCacheTTL:       time.Duration(l.integer("TEMPLATE_CACHE_TTL_SECONDS", 0, 300)) * time.Second,
+		DedupTableName:         l.optional("DEDUP_TABLE_NAME", ""),
+		DedupWindows:           l.optional("NOTIFICATION_DEDUP_WINDOWS", ""),
+		SMSOptOutTableName:     l.optional("SMS_OPT_OUT_TABLE_NAME", ""),
+		SMSSenderID:            l.optional("SMS_SENDER_ID", ""),
+		MaxEmailBodyBytes:      l.integer("MAX_EMAIL_BODY_BYTES", 1, 100*1024),
+		EmailRoutes:            l.optional("EMAIL_ROUTES", ""),
+		FromAddress:            l.optional("EMAIL_FROM_ADDRESS", ""),
+		ConfigurationSet:       l.optional("SES_CONFIGURATION_SET", ""),
+		DryRun:                 l.boolean("EMAIL_DRY_RUN"),
+		SMSEventTypes:          l.list("SMS_EVENT_TYPES", "INSERT", "MODIFY", "REMOVE", "RESTORE"),
+		DigestTableName:        l.optional("DIGEST_TABLE_NAME", ""),
+		DigestEventTypes:       l.list("DIGEST_EVENT_TYPES", "INSERT", "MODIFY", "REMOVE", "RESTORE"),
+		DigestInterval:         time.Duration(l.integer("DIGEST_INTERVAL_MINUTES", 1, 60)) * time.Minute,
+		TableName:              l.optional("TABLE_NAME", ""),
+		PII:                    loadPII(l, false),
+		SlackWebhookURL:        l.optional("SLACK_WEBHOOK_URL", ""),
+	}
+	if !settings.DryRun {
+		// Sending needs a sender; a dry run only logs
+		l.anyOf("EMAIL_FROM_ADDRESS", "EMAIL_ROUTES")
+	}
+	return settings, l.err()
+}
+
+// Export are the settings of the export lambda
+type Export struct {
+	Common
+	TableName        string
+	ExportsTableName string
+	ExportBucket     string
+	ScanSegments     int
+	// PII decrypts the exported persons
+	PII PII
+	// IdentityHashKMSKeyID derives the key of the exported hashes; unset refuses hashed exports
+	IdentityHashKMSKeyID string
+	// AccessAuditTableName records every export; unset only counts them
+	AccessAuditTableName string
+}
+
+// LoadExport reads the settings of the export lambda
+func LoadExport() (Export, error) {
+	l := newLoader("export")
+	settings := Export{
+		Common:               loadCommon(l),
+		TableName:            l.required("TABLE_NAME"),
+		ExportsTableName:     l.required("EXPORTS_TABLE_NAME"),
+		ExportBucket:         l.required("EXPORT_BUCKET"),
+		ScanSegments:         l.integer("EXPORT_SCAN_SEGMENTS", 1, 4),
+		PII:                  loadPII(l, false),
+		IdentityHashKMSKeyID: l.optional("IDENTITY_HASH_KMS_KEY_ID", ""),
+		AccessAuditTableName: l.optional("ACCESS_AUDIT_TABLE_NAME", ""),
+	}
+	return settings, l.err()
+}
+
+// Anonymize are the settings of the anonymize lambda
+type Anonymize struct {
+	Common
+	TableName               string
+	AnonymizationsTableName string
+	// LegalHoldsTableName protects held persons from anonymization; unset anonymizes every match
+	LegalHoldsTableName string
+	// PII decrypts the persons checked against the job
+	PII PII
+}
+
+// LoadAnonymize reads the settings of the anonymize lambda
+func LoadAnonymize() (Anonymize, error) {
+	l := newLoader("anonymize")
+	settings := Anonymize{
+		Common:                  loadCommon(l),
+		TableName:               l.required("TABLE_NAME"),
+		AnonymizationsTableName: l.required("ANONYMIZATIONS_TABLE_NAME"),
+		LegalHoldsTableName:     l.optional("LEGAL_HOLDS_TABLE_NAME", ""),
+		PII:                     loadPII(l, false),
+	}
+	return settings, l.err()
+}
+
+// Import are the settings of the import lambda
+type Import struct {
+	Common
+	TableName        string
+	ImportsTableName string
+	// PreviewRows is how many rows a preview checks unless the file's preview-rows metadata says otherwise
+	PreviewRows int
+	// PII encrypts the PII attributes of the imported persons
+	PII PII
+	// IdentityHashKMSKeyID derives the key of the emailHash and phoneHash attributes; unset
+	// hashes nothing
+	IdentityHashKMSKeyID string
+}
+
+// LoadImport reads the settings of the import lambda
+func LoadImport() (Import, error) {
+	l := newLoader("import")
+	settings := Import{
+		Common:               loadCommon(l),
+		TableName:            l.required("TABLE_NAME"),
+		ImportsTableName:     l.required("IMPORTS_TABLE_NAME"),
+		PreviewRows:          l.integer("IMPORT_PREVIEW_ROWS", 1, 1000),
+		PII:                  loadPII(l, true),
+		IdentityHashKMSKeyID: l.optional("IDENTITY_HASH_KMS_KEY_ID", ""),
+	}
+	return settings, l.err()
+}
+
+// Quality are the settings of the data-quality lambda
+type Quality struct {
+	Common
+	TableName string
+	// NotificationsTableName verifies email addresses by their deliveries; without it no
+	// email counts as verified
+	NotificationsTableName string
+	ReportBucket           string
+	// JobLockTableName keeps runs from overlapping
+	JobLockTableName string
+	// PII decrypts the persons checked
+	PII PII
+}
+
+// LoadQuality reads the settings of the data-quality lambda
+func LoadQuality() (Quality, error) {
+	l := newLoader("quality")
+	settings := Quality{
+		Common:                 loadCommon(l),
+		TableName:              l.required("TABLE_NAME"),
+		NotificationsTableName: l.optional("NOTIFICATIONS_TABLE_NAME", ""),
+		ReportBucket:           l.required("REPORT_BUCKET"),
+		JobLockTableName:       l.required("JOB_LOCK_TABLE_NAME"),
+		PII:                    loadPII(l, false),
+	}
+	return settings, l.err()
+}
+
+// Logging are the settings of the logging lambda
+type Logging struct {
+	Common
+	// EventIdempotencyTableName remembers the processed events, so a redelivered event is
+	// logged once; unset logs every delivery
+	EventIdempotencyTableName string
+	// EventIdempotencyTTLHours is how long a processed event is remembered
+	EventIdempotencyTTLHours int
+	// AuditTableName receives an immutable entry per person change; unset only logs them
+	AuditTableName string
+	// SlackWebhookURL receives operational alerts; unset sends none
+	SlackWebhookURL string
+}
+
+// LoadLogging reads the settings of the logging lambda
+func LoadLogging() (Logging, error) {
+	l := newLoader("logging")
+	settings := Logging{
+		Common:                    loadCommon(l),
+		EventIdempotencyTableName: l.optional("EVENT_IDEMPOTENCY_TABLE_NAME", ""),
+		EventIdempotencyTTLHours:  l.integer("EVENT_IDEMPOTENCY_TTL_HOURS", 1, 24),
+		AuditTableName:            l.optional("AUDIT_TABLE_NAME", ""),
+		SlackWebhookURL:           l.optional("SLACK_WEBHOOK_URL", ""),
+	}
+	return settings, l.err()
+}
+
+// Replay are the settings of the replay lambda. Consumers without a target are not offered.
+type Replay struct {
+	Common
+	ReplaysTableName string
+	// EmailQueueURL feeds the email lambda, AuditFunctionName is the logging lambda and
+	// SearchFunctionName the indexer lambda
+	EmailQueueURL      string
+	AuditFunctionName  string
+	SearchFunctionName string
+}
+
+// LoadReplay reads the settings of the replay lambda
+func LoadReplay() (Replay, error) {
+	l := newLoader("replay")
+	settings := Replay{
+		Common:             loadCommon(l),
+		ReplaysTableName:   l.required("REPLAYS_TABLE_NAME"),
+		EmailQueueURL:      l.optional("EMAIL_QUEUE_URL", ""),
+		AuditFunctionName:  l.optional("AUDIT_FUNCTION_NAME", ""),
+		SearchFunctionName: l.optional("SEARCH_FUNCTION_NAME", ""),
+	}
+	return settings, l.err()
+}
+
+// Purge are the settings of the purge lambda
+type Purge struct {
+	Common
+	TableName string
+	// RetentionDays is how long soft-deleted persons are kept before they are purged; it may
+	// not end before the restore window does
+	RetentionDays int
+	// DryRun reports what a run would purge without deleting anything
+	DryRun       bool
+	ReportBucket string
+	// EventBusName receives a PersonErased event per purged person
+	EventBusName string
+	// NotificationsTableName is purged along with the persons; LegalHoldsTableName protects
+	// held persons from the purge. Unset skips the notifications, or purges every match.
+	NotificationsTableName string
+	LegalHoldsTableName    string
+	// JobLockTableName keeps runs from overlapping
+	JobLockTableName string
+}
+
+// LoadPurge reads the settings of the purge lambda
+func LoadPurge() (Purge, error) {
+	l := newLoader("purge")
+	settings := Purge{
+		Common:                 loadCommon(l),
+		TableName:              l.required("TABLE_NAME"),
+		RetentionDays:          l.integer("PURGE_RETENTION_DAYS", 1, 30),
+		DryRun:                 l.boolean("PURGE_DRY_RUN"),
+		ReportBucket:           l.required("REPORT_BUCKET"),
+		EventBusName:           l.required("EVENT_BUS_NAME"),
+		NotificationsTableName: l.optional("NOTIFICATIONS_TABLE_NAME", ""),
+		LegalHoldsTableName:    l.optional("LEGAL_HOLDS_TABLE_NAME", ""),
+		JobLockTableName:       l.required("JOB_LOCK_TABLE_NAME"),
+	}
+	// Persons could otherwise be purged while the API still offers to restore them
+	if restoreWindow := l.integer("RESTORE_WINDOW_DAYS", 1, 30); settings.RetentionDays < restoreWindow {
+		l.fail("PURGE_RETENTION_DAYS", strconv.Itoa(settings.RetentionDays), fmt.Sprintf("at least RESTORE_WINDOW_DAYS=%d", restoreWindow))
+	}
+	return settings, l.err()
+}
+
+// SearchIndex are the settings of the search index lifecycle lambda
+type SearchIndex struct {
+	Common
+	// OpenSearchEndpoint is the search domain; unset leaves the lambda nothing to do
+	OpenSearchEndpoint string
+	// RolloverMaxDocs, RolloverMaxSize (an OpenSearch byte size) and RolloverMaxAge (an
+	// OpenSearch duration; empty means no age limit) roll the write index over
+	RolloverMaxDocs int
+	RolloverMaxSize string
+	RolloverMaxAge  string
+	// JobLockTableName keeps the scheduled and the post-deployment runs apart
+	JobLockTableName string
+}
+
+// LoadSearchIndex reads the settings of the search index lifecycle lambda
+func LoadSearchIndex() (SearchIndex, error) {
+	l := newLoader("searchindex")
+	settings := SearchIndex{
+		Common:             loadCommon(l),
+		OpenSearchEndpoint: l.optional("OPENSEARCH_ENDPOINT", ""),
+		RolloverMaxDocs:    l.integer("SEARCH_ROLLOVER_MAX_DOCS", 1, 10_000_000),
+		RolloverMaxSize:    l.optional("SEARCH_ROLLOVER_MAX_SIZE", "30gb"),
+		RolloverMaxAge:     l.optional("SEARCH_ROLLOVER_MAX_AGE", ""),
+		JobLockTableName:   l.required("JOB_LOCK_TABLE_NAME"),
+	}
+	return settings, l.err()
+}
+
+// Indexer are the settings of the indexer lambda
+type Indexer struct {
+	Common
+	// OpenSearchEndpoint is the search domain the persons are indexed in
+	OpenSearchEndpoint string
+	// PII decrypts the persons indexed
+	PII PII
+}
+
+// LoadIndexer reads the settings of the indexer lambda
+func LoadIndexer() (Indexer, error) {
+	l := newLoader("indexer")
+	settings := Indexer{
+		Common:             loadCommon(l),
+		OpenSearchEndpoint: l.required("OPENSEARCH_ENDPOINT"),
+		PII:                loadPII(l, false),
+	}
+	return settings, l.err()
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Variable is one setting of a lambda as resolved at cold start
+type Variable struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Default is set when the variable is unset and Value is the fallback used
+	Default bool `json:"default,omitempty"`
+	// Redacted is set when Value was hidden because it is a secret
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// redactedValue replaces the value of secret variables
+const redactedValue = "[REDACTED]"
+
+// sharedVariables are read by the shared packages themselves (see the package comment).
+// They are reported with the settings of every lambda.
+var sharedVariables = []string{
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"METRICS_NAMESPACE",
+	"LOG_LEVEL",
+	"LOG_PII_MODE",
+	"LOG_PII_SALT",
+	"LOG_PII_FIELDS",
+}
+
+// secretVariables hold credentials; names containing one of secretMarkers are secret too
+var (
+	secretVariables = map[string]bool{"SLACK_WEBHOOK_URL": true, "LOG_PII_SALT": true}
+	secretMarkers   = []string{"SECRET", "TOKEN", "PASSWORD", "CREDENTIAL"}
+)
+
+var (
+	resolvedMu sync.Mutex
+	resolved   = map[string]Variable{}
+)
+
+// record remembers the value a loader resolved for a variable
+func record(name string, value string, fallback bool) {
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	resolved[name] = Variable{Name: name, Value: value, Default: fallback}
+}
+
+// Resolved returns the settings of the lambda as loaded at cold start, plus the variables
+// of the shared packages, sorted by name. Secret values are redacted.
+func Resolved() []Variable {
+	resolvedMu.Lock()
+	variables := make([]Variable, 0, len(resolved)+len(sharedVariables))
+	for _, variable := range resolved {
+		variables = append(variables, variable)
+	}
+	resolvedMu.Unlock()
+	for _, name := range sharedVariables {
+		value, ok := os.LookupEnv(name)
+		variables = append(variables, Variable{Name: name, Value: value, Default: !ok})
+	}
+
+	sort.Slice(variables, func(i, j int) bool { return variables[i].Name < variables[j].Name })
+	for i, variable := range variables {
+		if variable.Value != "" && secret(variable.Name) {
+			variables[i].Value = redactedValue
+			variables[i].Redacted = true
+		}
+	}
+	return variables
+}
+
+// secret reports whether a variable holds a credential
+func secret(name string) bool {
+	if secretVariables[name] {
+		return true
+	}
+	for _, marker := range secretMarkers {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
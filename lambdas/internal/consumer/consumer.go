@@ -0,0 +1,102 @@
+// Package consumer is the middleware framework of the lambdas that consume events: the stream
+// lambda and the SQS and EventBridge consumers. It is the counterpart of the HTTP lambda's
+// router middlewares, so every consumer gets the same tracing, logging, metrics, panic
+// recovery and, per event, idempotency.
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/tracing"
+)
+
+// Handler handles an invocation or a single event of it, e.g. an events.SQSEvent returning an
+// events.SQSEventResponse, or one EventBridge event returning struct{}
+type Handler[E any, R any] func(ctx context.Context, event E) (R, error)
+
+// Middleware wraps a Handler with cross-cutting behavior
+type Middleware[E any, R any] func(next Handler[E, R]) Handler[E, R]
+
+// Wrap wraps a handler so that middlewares[0] runs first
+func Wrap[E any, R any](handler Handler[E, R], middlewares ...Middleware[E, R]) Handler[E, R] {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Invocation wraps the handler passed to lambda.Start with the middlewares every consumer
+// lambda shares: Tracing, Logging, Metrics and Recovery, then the given ones, e.g.
+// lambda.Start(consumer.Invocation(handler)).
+func Invocation[E any, R any](handler Handler[E, R], middlewares ...Middleware[E, R]) Handler[E, R] {
+	shared := []Middleware[E, R]{Tracing[E, R](), Logging[E, R](), Metrics[E, R](), Recovery[E, R]()}
+	return Wrap(handler, append(shared, middlewares...)...)
+}
+
+// Tracing continues the trace of the Lambda invocation and flushes the spans before the
+// invocation returns, as the Lambda environment may be frozen afterwards
+func Tracing[E any, R any]() Middleware[E, R] {
+	return func(next Handler[E, R]) Handler[E, R] {
+		return func(ctx context.Context, event E) (R, error) {
+			ctx = tracing.ExtractLambda(ctx)
+			defer tracing.Flush(ctx)
+			return next(ctx, event)
+		}
+	}
+}
+
+// Logging attaches the invocation's logger to the context and logs one line per invocation
+// with its outcome and duration
+func Logging[E any, R any]() Middleware[E, R] {
+	return func(next Handler[E, R]) Handler[E, R] {
+		return func(ctx context.Context, event E) (R, error) {
+			start := time.Now()
+			ctx = logger.WithLambda(ctx)
+			response, err := next(ctx, event)
+			if err != nil {
+				logger.FromContext(ctx).Error("Invocation failed", "durationMs", time.Since(start).Milliseconds(), "class", errclass.Classify(err), "error", err)
+				return response, err
+			}
+			logger.FromContext(ctx).Info("Invocation completed", "durationMs", time.Since(start).Milliseconds())
+			return response, nil
+		}
+	}
+}
+
+// Metrics emits the duration and count of invocations by outcome
+func Metrics[E any, R any]() Middleware[E, R] {
+	return func(next Handler[E, R]) Handler[E, R] {
+		return func(ctx context.Context, event E) (R, error) {
+			start := time.Now()
+			response, err := next(ctx, event)
+			metrics.Emit(map[string]string{"Outcome": metrics.ErrorOutcome(err)}, nil,
+				metrics.Duration("InvocationDuration", time.Since(start)),
+				metrics.Count("Invocations", 1),
+			)
+			return response, err
+		}
+	}
+}
+
+// Recovery turns a panic into a transient error, so Lambda retries the invocation as after any
+// other failure and the logging and metrics middlewares see it, instead of the runtime crashing
+func Recovery[E any, R any]() Middleware[E, R] {
+	return func(next Handler[E, R]) Handler[E, R] {
+		return func(ctx context.Context, event E) (response R, err error) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					logger.FromContext(ctx).Error("Recovered from panic", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+					var zero R
+					response, err = zero, errclass.Mark(errclass.Transient, fmt.Errorf("panic: %v", recovered))
+				}
+			}()
+			return next(ctx, event)
+		}
+	}
+}
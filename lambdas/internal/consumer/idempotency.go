@@ -0,0 +1,163 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// processingLease is how long a claimed event counts as being processed. It exceeds the
+// longest Lambda timeout, so a claim left by a crashed invocation expires before the retry.
+const processingLease = 15 * time.Minute
+
+// States of a claimed event
+const (
+	stateProcessing = "processing"
+	stateCompleted  = "completed"
+)
+
+// dynamoAPI is the part of the DynamoDB client the store uses, so tests can substitute a fake
+type dynamoAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// IdempotencyStore records the events a consumer processed, keyed by "eventKey" and expired
+// by DynamoDB TTL on "expiresAt"
+type IdempotencyStore struct {
+	dynamo    dynamoAPI
+	tableName string
+	// ttl is how long a processed event is remembered
+	ttl time.Duration
+}
+
+// NewIdempotencyStore returns a store on the table, nil when tableName is empty; Idempotent
+// passes every event through without a store
+func NewIdempotencyStore(dynamo dynamoAPI, tableName string, ttl time.Duration) *IdempotencyStore {
+	if tableName == "" {
+		return nil
+	}
+	return &IdempotencyStore{dynamo: dynamo, tableName: tableName, ttl: ttl}
+}
+
+// errInProgress is returned for a duplicate of an event that is still being processed; it is
+// retried, so the duplicate is skipped once the first delivery completed, or processed if it failed
+var errInProgress = errclass.New(errclass.Conflict, "consumer: event is being processed by another invocation")
+
+// Idempotent runs the handler at most once per event key, e.g. the EventBridge event ID.
+// Duplicates of processed events are skipped with a zero response; events with an empty key
+// are always processed. A failed event is released, so its retry is processed again.
+func Idempotent[E any, R any](store *IdempotencyStore, key func(E) string) Middleware[E, R] {
+	return func(next Handler[E, R]) Handler[E, R] {
+		if store == nil {
+			return next
+		}
+		return func(ctx context.Context, event E) (R, error) {
+			var zero R
+			eventKey := key(event)
+			if eventKey == "" {
+				return next(ctx, event)
+			}
+			claimed, err := store.Claim(ctx, eventKey)
+			if err != nil {
+				return zero, err
+			}
+			if !claimed {
+				logger.FromContext(ctx).Info("Skipping duplicate event", "eventKey", eventKey)
+				metrics.Emit(nil, nil, metrics.Count("DuplicateEvents", 1))
+				return zero, nil
+			}
+
+			response, err := next(ctx, event)
+			if err != nil {
+				if releaseErr := store.Release(ctx, eventKey); releaseErr != nil {
+					logger.FromContext(ctx).Warn("Failed to release event claim", "eventKey", eventKey, "error", releaseErr)
+				}
+				return response, err
+			}
+			if completeErr := store.Complete(ctx, eventKey); completeErr != nil {
+				// The claim expires after processingLease; until then duplicates are retried
+				logger.FromContext(ctx).Warn("Failed to record processed event", "eventKey", eventKey, "error", completeErr)
+			}
+			return response, nil
+		}
+	}
+}
+
+// Claim marks an event as being processed. It returns false for an event that was already
+// processed, and an error of class Conflict for one that is being processed. Expired claims
+// are reclaimed, as TTL deletes them lazily. Idempotent claims every event; consumers that
+// handle several events per invocation claim each one and Complete or Release it.
+func (s *IdempotencyStore) Claim(ctx context.Context, eventKey string) (bool, error) {
+	now := time.Now()
+	expr, err := expression.NewBuilder().WithCondition(expression.
+		AttributeNotExists(expression.Name("eventKey")).
+		Or(expression.Name("expiresAt").LessThan(expression.Value(now.Unix())))).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	item := map[string]types.AttributeValue{
+		"eventKey":  &types.AttributeValueMemberS{Value: eventKey},
+		"state":     &types.AttributeValueMemberS{Value: stateProcessing},
+		"expiresAt": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(processingLease).Unix())},
+	}
+	_, err = s.dynamo.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                           aws.String(s.tableName),
+		Item:                                item,
+		ConditionExpression:                 expr.Condition(),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		if state, ok := conditionErr.Item["state"].(*types.AttributeValueMemberS); ok && state.Value == stateCompleted {
+			return false, nil
+		}
+		return false, errInProgress
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim event %s: %w", eventKey, err)
+	}
+	return true, nil
+}
+
+// Complete marks a claimed event as processed for the store's ttl
+func (s *IdempotencyStore) Complete(ctx context.Context, eventKey string) error {
+	expr, err := expression.NewBuilder().WithUpdate(expression.
+		Set(expression.Name("state"), expression.Value(stateCompleted)).
+		Set(expression.Name("expiresAt"), expression.Value(time.Now().Add(s.ttl).Unix()))).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = s.dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.tableName),
+		Key:                       map[string]types.AttributeValue{"eventKey": &types.AttributeValueMemberS{Value: eventKey}},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
+
+// Release removes the claim of an event that failed, so its retry is processed
+func (s *IdempotencyStore) Release(ctx context.Context, eventKey string) error {
+	_, err := s.dynamo.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       map[string]types.AttributeValue{"eventKey": &types.AttributeValueMemberS{Value: eventKey}},
+	})
+	return err
+}
@@ -0,0 +1,148 @@
+// Package ddbclient creates DynamoDB clients with configurable retries, a deadline per
+// operation and a circuit breaker that fails fast while DynamoDB keeps throttling.
+package ddbclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// ErrCircuitOpen is returned without calling DynamoDB while the breaker is open
+var ErrCircuitOpen = errclass.New(errclass.Throttle, "ddbclient: circuit open, DynamoDB is throttling")
+
+// Settings configures a client. The zero value of a field keeps the SDK default. Lambdas load
+// them from the environment with internal/config.
+type Settings struct {
+	// MaxAttempts is the number of attempts per call, including the first (DYNAMODB_MAX_ATTEMPTS)
+	MaxAttempts int
+	// MaxBackoff caps the exponential backoff between attempts (DYNAMODB_MAX_BACKOFF_MS)
+	MaxBackoff time.Duration
+	// Timeout bounds a call including its retries (DYNAMODB_TIMEOUT_MS)
+	Timeout time.Duration
+	// OperationTimeouts override Timeout per operation (DYNAMODB_OPERATION_TIMEOUTS, e.g. "Scan=10s,GetItem=500ms")
+	OperationTimeouts map[string]time.Duration
+	// BreakerThreshold is the number of consecutive throttled calls that opens the breaker;
+	// 0 disables it (DYNAMODB_BREAKER_THRESHOLD)
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before a trial call (DYNAMODB_BREAKER_COOLDOWN_MS)
+	BreakerCooldown time.Duration
+}
+
+// Defaults leave retries to the SDK, bound calls to 5 seconds and open the breaker after 10
+// throttled calls in a row for 5 seconds
+var Defaults = Settings{
+	Timeout:          5 * time.Second,
+	BreakerThreshold: 10,
+	BreakerCooldown:  5 * time.Second,
+}
+
+// New creates a client for the config with the given settings
+func New(cfg aws.Config, settings Settings) *dynamodb.Client {
+	breaker := &breaker{threshold: settings.BreakerThreshold, cooldown: settings.BreakerCooldown}
+	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if settings.MaxAttempts > 0 || settings.MaxBackoff > 0 {
+			o.Retryer = retry.NewStandard(func(so *retry.StandardOptions) {
+				if settings.MaxAttempts > 0 {
+					so.MaxAttempts = settings.MaxAttempts
+				}
+				if settings.MaxBackoff > 0 {
+					so.MaxBackoff = settings.MaxBackoff
+					so.Backoff = retry.NewExponentialJitterBackoff(settings.MaxBackoff)
+				}
+			})
+		}
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			// Added first so the deadline and the breaker cover every retry of the call
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("DynamoDBGuard", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				operation := awsmiddleware.GetOperationName(ctx)
+				if err := breaker.allow(); err != nil {
+					metrics.Emit(map[string]string{"Operation": operation}, nil, metrics.Count("DynamoDBCircuitOpen", 1))
+					return middleware.InitializeOutput{}, middleware.Metadata{}, err
+				}
+				if timeout := settings.timeout(operation); timeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, timeout)
+					defer cancel()
+				}
+				out, metadata, err := next.HandleInitialize(ctx, in)
+				if breaker.record(isThrottle(err)) {
+					logger.FromContext(ctx).Warn("DynamoDB keeps throttling, failing calls fast", "operation", operation, "cooldown", settings.BreakerCooldown.String())
+				}
+				return out, metadata, err
+			}), middleware.Before)
+		})
+	})
+}
+
+// timeout returns the deadline for an operation, 0 for none
+func (s Settings) timeout(operation string) time.Duration {
+	if timeout, ok := s.OperationTimeouts[operation]; ok {
+		return timeout
+	}
+	return s.Timeout
+}
+
+// isThrottle reports whether a call failed because DynamoDB throttled it, after all retries
+func isThrottle(err error) bool {
+	return errclass.Classify(err) == errclass.Throttle
+}
+
+// breaker counts consecutive throttled calls. Once open it rejects calls until the cooldown
+// has passed, then lets one trial call through whose outcome closes or reopens it.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	throttled int
+	openedAt  time.Time
+	trial     bool
+}
+
+// allow returns ErrCircuitOpen when a call must not be made
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.throttled < b.threshold {
+		return nil
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	b.trial = true
+	return nil
+}
+
+// record feeds the outcome of a call into the breaker and reports whether it opened
+func (b *breaker) record(throttled bool) bool {
+	if b.threshold <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !throttled {
+		b.throttled = 0
+		return false
+	}
+	b.throttled++
+	if b.throttled < b.threshold {
+		return false
+	}
+	b.openedAt = time.Now()
+	return b.throttled == b.threshold
+}
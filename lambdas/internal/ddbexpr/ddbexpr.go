@@ -0,0 +1,32 @@
+// Package ddbexpr holds the expression helpers shared by the lambdas. Every DynamoDB
+// expression is built with the SDK's expression package, which refers to each attribute
+// through ExpressionAttributeNames, so reserved words ("name", "status", "key", "rows") can
+// be attribute names without breaking a request. Hand-written expression strings are not used.
+package ddbexpr
+
+import (
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+// KeyEquals is the key condition of a query for one partition key value
+func KeyEquals(name string, value interface{}) expression.KeyConditionBuilder {
+	return expression.Key(name).Equal(expression.Value(value))
+}
+
+// NotDeleted matches persons that are not soft-deleted
+func NotDeleted() expression.ConditionBuilder {
+	return expression.AttributeNotExists(expression.Name("deleted")).
+		Or(expression.Name("deleted").NotEqual(expression.Value(true)))
+}
+
+// All combines conditions with AND. It reports false when there are none, in which case
+// the expression must not get a condition at all.
+func All(conditions ...expression.ConditionBuilder) (expression.ConditionBuilder, bool) {
+	switch len(conditions) {
+	case 0:
+		return expression.ConditionBuilder{}, false
+	case 1:
+		return conditions[0], true
+	}
+	return expression.And(conditions[0], conditions[1], conditions[2:]...), true
+}
@@ -0,0 +1,99 @@
+package ddbexpr
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// reservedWords are DynamoDB reserved words that are plausible attribute names
+var reservedWords = []string{"name", "status", "key", "rows", "data", "count", "date", "size", "value", "user", "comment", "timestamp", "ttl", "type", "year"}
+
+// assertNamed fails when word appears in an expression other than through a placeholder
+// that ExpressionAttributeNames maps to it
+func assertNamed(t *testing.T, word string, expr expression.Expression, expressions ...*string) {
+	t.Helper()
+	bare := regexp.MustCompile(`(^|[^#:\w])` + word + `\b`)
+	for _, e := range expressions {
+		if e == nil {
+			t.Fatalf("expression for %q was not built", word)
+		}
+		if bare.MatchString(*e) {
+			t.Errorf("expression %q refers to reserved word %q directly", *e, word)
+		}
+	}
+	found := false
+	for _, name := range expr.Names() {
+		found = found || name == word
+	}
+	if !found {
+		t.Errorf("ExpressionAttributeNames %v do not name %q", expr.Names(), word)
+	}
+}
+
+func TestReservedWordsAreNamed(t *testing.T) {
+	for _, word := range reservedWords {
+		t.Run(word, func(t *testing.T) {
+			update := expression.Set(expression.Name(word), expression.Value("v")).
+				Add(expression.Name("counter"), expression.Value(1))
+			condition := expression.Name(word).Equal(expression.Value("v"))
+			expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertNamed(t, word, expr, expr.Update(), expr.Condition())
+
+			filter, _ := All(NotDeleted(), expression.Name(word).Equal(expression.Value("v")))
+			expr, err = expression.NewBuilder().
+				WithKeyCondition(KeyEquals(word, "v")).
+				WithFilter(filter).
+				WithProjection(expression.NamesList(expression.Name(word), expression.Name("personId"))).
+				Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertNamed(t, word, expr, expr.KeyCondition(), expr.Filter(), expr.Projection())
+		})
+	}
+}
+
+func TestNotDeleted(t *testing.T) {
+	expr, err := expression.NewBuilder().WithFilter(NotDeleted()).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *expr.Filter(), "(attribute_not_exists (#0)) OR (#0 <> :0)"; got != want {
+		t.Errorf("filter = %q, want %q", got, want)
+	}
+	if expr.Names()["#0"] != "deleted" {
+		t.Errorf("names = %v, want #0 = deleted", expr.Names())
+	}
+	if value, ok := expr.Values()[":0"].(*types.AttributeValueMemberBOOL); !ok || !value.Value {
+		t.Errorf("values = %v, want :0 = true", expr.Values())
+	}
+}
+
+func TestAll(t *testing.T) {
+	if _, ok := All(); ok {
+		t.Error("All() reported a condition")
+	}
+	for n := 1; n <= 3; n++ {
+		conditions := make([]expression.ConditionBuilder, n)
+		for i := range conditions {
+			conditions[i] = expression.Name("status").Equal(expression.Value(i))
+		}
+		condition, ok := All(conditions...)
+		if !ok {
+			t.Fatalf("All of %d conditions reported none", n)
+		}
+		expr, err := expression.NewBuilder().WithCondition(condition).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(expr.Values()); got != n {
+			t.Errorf("All of %d conditions bound %d values", n, got)
+		}
+	}
+}
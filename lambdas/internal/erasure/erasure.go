@@ -0,0 +1,136 @@
+// Package erasure carries out the steps that follow the hard delete of a person: removing their
+// notification history and announcing the erasure with a PersonErased event. The HTTP API's
+// erase endpoint and the purge share it, so consumers see both erasures alike.
+package erasure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/tracing"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// dynamoAPI is the part of the DynamoDB client the eraser uses
+type dynamoAPI interface {
+	dynamodb.QueryAPIClient
+	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+// eventsAPI is the part of the EventBridge client the eraser uses
+type eventsAPI interface {
+	PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
+}
+
+// Eraser removes what is left of an erased person and announces the erasure
+type Eraser struct {
+	dynamo             dynamoAPI
+	events             eventsAPI
+	notificationsTable string
+	eventBusName       string
+}
+
+// New returns an eraser. Without a notifications table there are no notifications to delete.
+func New(dynamo dynamoAPI, events eventsAPI, notificationsTable, eventBusName string) *Eraser {
+	return &Eraser{dynamo: dynamo, events: events, notificationsTable: notificationsTable, eventBusName: eventBusName}
+}
+
+// DeleteNotifications removes every notification item of a person and returns how many there were
+func (e *Eraser) DeleteNotifications(ctx context.Context, personID string) (int, error) {
+	if e.notificationsTable == "" {
+		return 0, nil
+	}
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(ddbexpr.KeyEquals("personId", personID)).
+		WithProjection(expression.NamesList(expression.Name("personId"), expression.Name("notificationId"))).
+		Build()
+	if err != nil {
+		return 0, err
+	}
+	var keys []map[string]types.AttributeValue
+	paginator := dynamodb.NewQueryPaginator(e.dynamo, &dynamodb.QueryInput{
+		TableName:                 aws.String(e.notificationsTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		keys = append(keys, page.Items...)
+	}
+
+	// BatchWriteItem takes up to 25 requests; unprocessed ones are sent again
+	for start := 0; start < len(keys); start += 25 {
+		var requests []types.WriteRequest
+		for _, key := range keys[start:min(start+25, len(keys))] {
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+		}
+		pending := map[string][]types.WriteRequest{e.notificationsTable: requests}
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt*50) * time.Millisecond)
+			}
+			output, err := e.dynamo.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				return 0, err
+			}
+			pending = output.UnprocessedItems
+		}
+	}
+	return len(keys), nil
+}
+
+// PublishErased sends the PersonErased event of a person. Hard deletes leave no image to carry
+// updatedBy, so the audit trail takes the actor from the event; an empty actor is left out.
+func (e *Eraser) PublishErased(ctx context.Context, personID, erasedAt, actor string) error {
+	detail := map[string]interface{}{
+		"schemaVersion": 1,
+		"personId":      personID,
+		"erasedAt":      erasedAt,
+	}
+	if correlationID := logger.CorrelationID(ctx); correlationID != "" {
+		detail["correlationId"] = correlationID
+	}
+	if actor != "" {
+		detail["actor"] = actor
+	}
+	detailJSON, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+
+	entry := ebtypes.PutEventsRequestEntry{
+		Source:       aws.String(personevents.SourceService),
+		DetailType:   aws.String(personevents.DetailTypeErased),
+		Detail:       aws.String(string(detailJSON)),
+		EventBusName: aws.String(e.eventBusName),
+	}
+	if traceHeader := tracing.Header(ctx); traceHeader != "" {
+		entry.TraceHeader = aws.String(traceHeader)
+	}
+	output, err := e.events.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []ebtypes.PutEventsRequestEntry{entry},
+	})
+	if err != nil {
+		return err
+	}
+	if output.FailedEntryCount > 0 {
+		return fmt.Errorf("event bus rejected PersonErased: %s", aws.ToString(output.Entries[0].ErrorMessage))
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Package errclass sorts errors into a few classes, so every lambda decides the same way
+// whether a failure is retried, backed off, or sent to a dead-letter queue. It understands
+// errors of both AWS SDKs, context and network errors, and errors marked with New or Mark.
+package errclass
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+)
+
+// Class is the kind of a failure
+type Class string
+
+const (
+	// Throttle: the service refused the call for now; retry with backoff
+	Throttle Class = "throttle"
+	// Timeout: the call did not finish in time; retry
+	Timeout Class = "timeout"
+	// Conflict: a conditional write lost against a concurrent one; retry after re-reading
+	Conflict Class = "conflict"
+	// Permanent: the input or setup is wrong (validation, access denied, not found); retrying
+	// cannot succeed, so the work goes to the dead-letter queue or is dropped
+	Permanent Class = "permanent"
+	// Transient: anything else, e.g. a 5xx or a dropped connection; retry
+	Transient Class = "transient"
+)
+
+// Retryable reports whether retrying may succeed
+func (c Class) Retryable() bool {
+	return c != Permanent
+}
+
+// Error codes of both SDKs, by class
+var (
+	throttleCodes = codes(
+		"ProvisionedThroughputExceededException", "ThrottlingException", "Throttling", "ThrottledException",
+		"RequestThrottledException", "TooManyRequestsException", "RequestLimitExceeded", "RequestThrottled",
+		"LimitExceededException", "BandwidthLimitExceeded", "SlowDown", "TransactionInProgressException",
+	)
+	timeoutCodes   = codes("RequestTimeout", "RequestTimeoutException", "RequestCanceled")
+	conflictCodes  = codes("ConditionalCheckFailedException", "TransactionConflictException", "TransactionCanceledException")
+	permanentCodes = codes(
+		"ValidationException", "SerializationException", "InvalidParameterException", "InvalidParameterValue",
+		"InvalidParameterValueException", "InvalidArgument", "InvalidRequestException", "MessageRejected",
+		"MailFromDomainNotVerifiedException", "AccessDeniedException", "AccessDenied", "UnauthorizedOperation",
+		"ResourceNotFoundException", "NotFoundException", "NoSuchKey", "NoSuchBucket", "NotFound",
+		"ItemCollectionSizeLimitExceededException", "KMSInvalidStateException", "InvalidCiphertextException",
+	)
+)
+
+func codes(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// classified carries an explicit class
+type classified struct {
+	class Class
+	err   error
+}
+
+func (e *classified) Error() string { return e.err.Error() }
+func (e *classified) Unwrap() error { return e.err }
+
+// New returns an error of the given class
+func New(class Class, message string) error {
+	return &classified{class: class, err: errors.New(message)}
+}
+
+// Mark sets the class of err, e.g. Mark(Permanent, err) for a validation failure
+func Mark(class Class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classified{class: class, err: err}
+}
+
+// Classify returns the class of err, "" for nil. Explicit classes win, then the error code and
+// HTTP status of AWS errors; unknown errors are Transient.
+func Classify(err error) Class {
+	if err == nil {
+		return ""
+	}
+	var explicit *classified
+	if errors.As(err, &explicit) {
+		return explicit.class
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Timeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return Timeout
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return Permanent
+	}
+
+	code := errorCode(err)
+	switch {
+	case throttleCodes[code]:
+		return Throttle
+	case timeoutCodes[code]:
+		return Timeout
+	case conflictCodes[code]:
+		return Conflict
+	case permanentCodes[code]:
+		return Permanent
+	}
+
+	status := statusCode(err)
+	switch {
+	case status == http.StatusTooManyRequests:
+		return Throttle
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return Timeout
+	case status == http.StatusConflict || status == http.StatusPreconditionFailed:
+		return Conflict
+	case status >= 400 && status < 500:
+		return Permanent
+	}
+	return Transient
+}
+
+// errorCode returns the service error code of an SDK v2 (ErrorCode) or v1 (Code) error
+func errorCode(err error) string {
+	var v2 interface{ ErrorCode() string }
+	if errors.As(err, &v2) {
+		return v2.ErrorCode()
+	}
+	var v1 interface{ Code() string }
+	if errors.As(err, &v1) {
+		return v1.Code()
+	}
+	return ""
+}
+
+// statusCode returns the HTTP status of an SDK v2 (HTTPStatusCode) or v1 (StatusCode) error
+func statusCode(err error) int {
+	var v2 interface{ HTTPStatusCode() int }
+	if errors.As(err, &v2) {
+		return v2.HTTPStatusCode()
+	}
+	var v1 interface{ StatusCode() int }
+	if errors.As(err, &v1) {
+		return v1.StatusCode()
+	}
+	return 0
+}
+
+// Retry returns err when retrying may succeed. Permanent errors are logged with msg and
+// swallowed, so Lambda does not redeliver work that can never succeed. Either way the error is
+// counted in the Errors metric by Class and Action.
+func Retry(ctx context.Context, err error, msg string, args ...any) error {
+	if err == nil {
+		return nil
+	}
+	class := Classify(err)
+	action := "retried"
+	if !class.Retryable() {
+		action = "dropped"
+	}
+	metrics.Emit(map[string]string{"Class": string(class), "Action": action}, nil, metrics.Count("Errors", 1))
+	if action == "dropped" {
+		logger.FromContext(ctx).Error(msg+", not retrying", append(args, "class", class, "error", err)...)
+		return nil
+	}
+	logger.FromContext(ctx).Warn(msg+", retrying", append(args, "class", class, "error", err)...)
+	return err
+}
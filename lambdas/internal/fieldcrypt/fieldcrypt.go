@@ -0,0 +1,243 @@
+// Package fieldcrypt envelope-encrypts individual PII attributes of a person item. Each write
+// gets a fresh KMS data key; every encrypted value carries its wrapped data key, so values can
+// be decrypted on their own (e.g. the before/after values of a change event).
+package fieldcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// prefix marks an encrypted value: enc:v1:<wrapped data key>:<nonce and ciphertext>, both base64
+const prefix = "enc:v1:"
+
+// defaultFields are the person attributes encrypted when PII_FIELDS is not set
+var defaultFields = []string{"address", "addressParts", "phoneNumber"}
+
+// maxCachedKeys bounds the unwrapped data keys kept to avoid repeated KMS Decrypt calls
+const maxCachedKeys = 256
+
+// encryptionContext binds wrapped data keys to this use, so KMS refuses to unwrap them elsewhere
+var encryptionContext = map[string]string{"purpose": "person-pii"}
+
+// Encryptor encrypts the configured fields of person items
+type Encryptor struct {
+	client *kms.Client
+	keyID  string
+	fields []string
+
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// New creates an Encryptor for a KMS key and the attributes to encrypt, by default the
+// address, its parts and the phone number (see internal/config). Without a key nothing is
+// encrypted, but existing encrypted values are still decrypted.
+func New(cfg aws.Config, keyID string, fields []string) *Encryptor {
+	if len(fields) == 0 {
+		fields = defaultFields
+	}
+	return &Encryptor{
+		client: kms.NewFromConfig(cfg),
+		keyID:  keyID,
+		fields: fields,
+		keys:   map[string][]byte{},
+	}
+}
+
+// Enabled reports whether new values are encrypted
+func (e *Encryptor) Enabled() bool {
+	return e != nil && e.keyID != ""
+}
+
+// IsEncrypted reports whether a value was produced by this package
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// EncryptItem replaces the configured string attributes of an item with encrypted values.
+// Empty and already encrypted values are left as they are.
+func (e *Encryptor) EncryptItem(ctx context.Context, personID string, item map[string]types.AttributeValue) error {
+	if !e.Enabled() {
+		return nil
+	}
+	var dataKey *kms.GenerateDataKeyOutput
+	for _, field := range e.fields {
+		value, ok := item[field].(*types.AttributeValueMemberS)
+		if !ok || value.Value == "" || IsEncrypted(value.Value) {
+			continue
+		}
+		if dataKey == nil {
+			var err error
+			dataKey, err = e.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+				KeyId:             aws.String(e.keyID),
+				KeySpec:           kmstypes.DataKeySpecAes256,
+				EncryptionContext: encryptionContext,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to generate data key: %w", err)
+			}
+		}
+		encrypted, err := seal(dataKey.Plaintext, dataKey.CiphertextBlob, personID, field, value.Value)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", field, err)
+		}
+		item[field] = &types.AttributeValueMemberS{Value: encrypted}
+	}
+	return nil
+}
+
+// Fields returns the attributes that are encrypted
+func (e *Encryptor) Fields() []string {
+	return e.fields
+}
+
+// KeepUnchanged replaces the configured attributes of an item whose plaintext equals the
+// stored value with the stored ciphertext. A fresh data key encrypts the same value
+// differently on every write, so without this a rewrite would change every encrypted
+// attribute, and the stream would report them as changed.
+func (e *Encryptor) KeepUnchanged(ctx context.Context, personID string, item map[string]types.AttributeValue, stored map[string]types.AttributeValue) error {
+	for _, field := range e.fields {
+		value, ok := item[field].(*types.AttributeValueMemberS)
+		if !ok || value.Value == "" || IsEncrypted(value.Value) {
+			continue
+		}
+		current, ok := stored[field].(*types.AttributeValueMemberS)
+		if !ok || !IsEncrypted(current.Value) {
+			continue
+		}
+		plaintext, err := e.Decrypt(ctx, personID, field, current.Value)
+		if err != nil {
+			return err
+		}
+		if plaintext == value.Value {
+			item[field] = current
+		}
+	}
+	return nil
+}
+
+// DecryptItem replaces every encrypted string attribute of an item with its plaintext
+func (e *Encryptor) DecryptItem(ctx context.Context, personID string, item map[string]types.AttributeValue) error {
+	for field, attribute := range item {
+		value, ok := attribute.(*types.AttributeValueMemberS)
+		if !ok || !IsEncrypted(value.Value) {
+			continue
+		}
+		plaintext, err := e.Decrypt(ctx, personID, field, value.Value)
+		if err != nil {
+			return err
+		}
+		item[field] = &types.AttributeValueMemberS{Value: plaintext}
+	}
+	return nil
+}
+
+// Decrypt returns the plaintext of one value. Values that are not encrypted are returned as is.
+func (e *Encryptor) Decrypt(ctx context.Context, personID string, field string, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	wrappedKey, sealed, ok := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted value in %s", field)
+	}
+	key, err := e.unwrap(ctx, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key for %s: %w", field, err)
+	}
+	plaintext, err := open(key, personID, field, sealed)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", field, err)
+	}
+	return plaintext, nil
+}
+
+// unwrap decrypts a wrapped data key with KMS, caching the result
+func (e *Encryptor) unwrap(ctx context.Context, wrappedKey string) ([]byte, error) {
+	e.mu.Lock()
+	key, ok := e.keys[wrappedKey]
+	e.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	output, err := e.client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    blob,
+		EncryptionContext: encryptionContext,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	if len(e.keys) >= maxCachedKeys {
+		e.keys = map[string][]byte{}
+	}
+	e.keys[wrappedKey] = output.Plaintext
+	e.mu.Unlock()
+	return output.Plaintext, nil
+}
+
+// additionalData binds a ciphertext to its person and attribute, so it cannot be moved to another
+func additionalData(personID string, field string) []byte {
+	return []byte(personID + "/" + field)
+}
+
+// seal encrypts a value with AES-256-GCM under the data key
+func seal(key []byte, wrappedKey []byte, personID string, field string, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), additionalData(personID, field))
+	return prefix + base64.StdEncoding.EncodeToString(wrappedKey) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open reverses seal
+func open(key []byte, personID string, field string, encoded string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData(personID, field))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
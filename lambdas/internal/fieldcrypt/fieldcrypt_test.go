@@ -0,0 +1,39 @@
+package fieldcrypt
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestKeepUnchanged(t *testing.T) {
+	key := make([]byte, 32)
+	wrappedKey := []byte("wrapped")
+	// The data key is cached, so no KMS call is made
+	e := &Encryptor{keyID: "key", fields: defaultFields, keys: map[string][]byte{base64.StdEncoding.EncodeToString(wrappedKey): key}}
+
+	stored := map[string]types.AttributeValue{}
+	for field, value := range map[string]string{"address": "1 Main St", "phoneNumber": "+15550100"} {
+		encrypted, err := seal(key, wrappedKey, "p-1", field, value)
+		if err != nil {
+			t.Fatalf("seal %s: %v", field, err)
+		}
+		stored[field] = &types.AttributeValueMemberS{Value: encrypted}
+	}
+	item := map[string]types.AttributeValue{
+		"address":     &types.AttributeValueMemberS{Value: "1 Main St"},
+		"phoneNumber": &types.AttributeValueMemberS{Value: "+15550199"},
+	}
+
+	if err := e.KeepUnchanged(context.Background(), "p-1", item, stored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if item["address"] != stored["address"] {
+		t.Errorf("address = %v, want the stored ciphertext", item["address"])
+	}
+	if phone := item["phoneNumber"].(*types.AttributeValueMemberS).Value; phone != "+15550199" {
+		t.Errorf("phoneNumber = %q, want the new plaintext", phone)
+	}
+}
@@ -0,0 +1,124 @@
+package fieldcrypt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// hashKeyMessage is MACed with the KMS key to derive the local hashing key. Changing it
+// changes every hash, so it is versioned like the encrypted values.
+const hashKeyMessage = "person-identity-hash-v1"
+
+// HashedFields maps the contact attributes that get a keyed hash to the attribute holding it
+var HashedFields = map[string]string{
+	"email":       "emailHash",
+	"phoneNumber": "phoneHash",
+}
+
+// Hasher computes stable keyed hashes (HMAC-SHA256) of contact details, so datasets can be
+// joined on a person's identity without sharing the details themselves. The hashing key is the
+// KMS MAC of a fixed message, so it never leaves memory and every lambda derives the same one.
+type Hasher struct {
+	client *kms.Client
+	keyID  string
+
+	mu  sync.Mutex
+	key []byte
+}
+
+// NewHasher creates a Hasher for a KMS HMAC key (IDENTITY_HASH_KMS_KEY_ID). Without a key
+// nothing is hashed.
+func NewHasher(cfg aws.Config, keyID string) *Hasher {
+	return &Hasher{client: kms.NewFromConfig(cfg), keyID: keyID}
+}
+
+// Enabled reports whether contact details are hashed
+func (h *Hasher) Enabled() bool {
+	return h != nil && h.keyID != ""
+}
+
+// HashItem sets the hash attribute of every plaintext contact attribute of an item, so it must
+// run before EncryptItem. Empty values get no hash.
+func (h *Hasher) HashItem(ctx context.Context, item map[string]types.AttributeValue) error {
+	if !h.Enabled() {
+		return nil
+	}
+	for field, hashField := range HashedFields {
+		value, ok := item[field].(*types.AttributeValueMemberS)
+		if !ok || value.Value == "" || IsEncrypted(value.Value) {
+			continue
+		}
+		hash, err := h.Hash(ctx, field, value.Value)
+		if err != nil {
+			return err
+		}
+		if hash != "" {
+			item[hashField] = &types.AttributeValueMemberS{Value: hash}
+		}
+	}
+	return nil
+}
+
+// Hash returns the hex-encoded keyed hash of a contact value, normalized first so formatting
+// differences hash alike. It returns "" for values that are empty once normalized.
+func (h *Hasher) Hash(ctx context.Context, field string, value string) (string, error) {
+	normalized := normalizeContact(field, value)
+	if normalized == "" {
+		return "", nil
+	}
+	key, err := h.hashKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(normalized))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// hashKey derives the hashing key with KMS on first use
+func (h *Hasher) hashKey(ctx context.Context) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.key != nil {
+		return h.key, nil
+	}
+	result, err := h.client.GenerateMac(ctx, &kms.GenerateMacInput{
+		KeyId:        aws.String(h.keyID),
+		Message:      []byte(hashKeyMessage),
+		MacAlgorithm: kmstypes.MacAlgorithmSpecHmacSha256,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive identity hash key: %w", err)
+	}
+	h.key = result.Mac
+	return h.key, nil
+}
+
+// normalizeContact lowercases and trims email addresses, and reduces phone numbers to their
+// digits and leading +
+func normalizeContact(field string, value string) string {
+	value = strings.TrimSpace(value)
+	if field != "phoneNumber" {
+		return strings.ToLower(value)
+	}
+	var digits strings.Builder
+	for i, r := range value {
+		if (r >= '0' && r <= '9') || (r == '+' && i == 0) {
+			digits.WriteRune(r)
+		}
+	}
+	if digits.String() == "+" {
+		return ""
+	}
+	return digits.String()
+}
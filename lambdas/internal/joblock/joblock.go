@@ -0,0 +1,218 @@
+// Package joblock makes sure only one instance of a heavyweight job, such as a purge, a
+// reindex or a migration, runs at a time per environment. A run holds a lock item in the job
+// lock table (JOB_LOCK_TABLE_NAME, required by every job's settings), keyed by job name,
+// and renews its lease with heartbeats while it runs. The lock of a run that crashed or was
+// frozen expires after one lease, so the next run can take over without manual cleanup.
+package joblock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+const (
+	// lease is how long a lock stays held without a heartbeat
+	lease = 2 * time.Minute
+	// heartbeatInterval leaves room for a few failed heartbeats before the lease runs out
+	heartbeatInterval = lease / 4
+)
+
+var (
+	// ErrLocked is returned by Run when another instance of the job holds the lock
+	ErrLocked = errclass.New(errclass.Conflict, "joblock: job is already running")
+	// ErrLockLost cancels the context of a job whose lock expired or was taken over, e.g.
+	// after heartbeats failed for a whole lease
+	ErrLockLost = errclass.New(errclass.Conflict, "joblock: lock lost while the job was running")
+)
+
+// dynamoAPI is the part of the DynamoDB client the locker uses
+type dynamoAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// Locker runs jobs under their lock
+type Locker struct {
+	dynamo    dynamoAPI
+	tableName string
+}
+
+// New returns a locker on the table
+func New(dynamo dynamoAPI, tableName string) *Locker {
+	return &Locker{dynamo: dynamo, tableName: tableName}
+}
+
+// Run runs fn while holding the lock of job. It returns ErrLocked without running fn when
+// another instance holds the lock. The context passed to fn is cancelled with ErrLockLost if
+// the lock is lost, and fn should stop then, as another instance may take over.
+func (l *Locker) Run(ctx context.Context, job string, fn func(ctx context.Context) error) error {
+	owner := uuid.NewString()
+	if err := l.acquire(ctx, job, owner); err != nil {
+		return err
+	}
+	ctx = logger.With(ctx, "job", job, "lockOwner", owner)
+	logger.FromContext(ctx).Info("Acquired job lock")
+
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		l.heartbeat(jobCtx, job, owner, cancel, stop)
+	}()
+
+	err := fn(jobCtx)
+	close(stop)
+	<-stopped
+	if lost := context.Cause(jobCtx); errors.Is(lost, ErrLockLost) && err == nil {
+		err = lost
+	}
+	// The lock is released even when the caller's context is done
+	if releaseErr := l.release(context.WithoutCancel(ctx), job, owner); releaseErr != nil {
+		logger.FromContext(ctx).Warn("Failed to release job lock; it expires after its lease", "error", releaseErr)
+	}
+	return err
+}
+
+// acquire puts the lock item unless an unexpired lock of another run exists
+func (l *Locker) acquire(ctx context.Context, job string, owner string) error {
+	now := time.Now().UTC()
+	expr, err := expression.NewBuilder().WithCondition(expression.
+		AttributeNotExists(expression.Name("jobName")).
+		Or(expression.Name("expiresAt").LessThan(expression.Value(now.Unix())))).
+		Build()
+	if err != nil {
+		return err
+	}
+	item := map[string]types.AttributeValue{
+		"jobName":     &types.AttributeValueMemberS{Value: job},
+		"owner":       &types.AttributeValueMemberS{Value: owner},
+		"holder":      &types.AttributeValueMemberS{Value: holder(ctx)},
+		"acquiredAt":  &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+		"heartbeatAt": &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+		"expiresAt":   &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(lease).Unix())},
+	}
+	_, err = l.dynamo.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                           aws.String(l.tableName),
+		Item:                                item,
+		ConditionExpression:                 expr.Condition(),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		current, _ := conditionErr.Item["holder"].(*types.AttributeValueMemberS)
+		args := []any{"job", job}
+		if current != nil {
+			args = append(args, "holder", current.Value)
+		}
+		logger.FromContext(ctx).Info("Job is already running, skipping", args...)
+		metrics.Emit(map[string]string{"Job": job}, nil, metrics.Count("JobLockContended", 1))
+		return ErrLocked
+	}
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock of job %s: %w", job, err)
+	}
+	return nil
+}
+
+// heartbeat extends the lease until stop is closed. It cancels the job when the lock was
+// taken over, or when heartbeats kept failing until the lease ran out.
+func (l *Locker) heartbeat(ctx context.Context, job string, owner string, cancel context.CancelCauseFunc, stop <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	expires := time.Now().Add(lease)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := l.extend(ctx, job, owner)
+		var conditionErr *types.ConditionalCheckFailedException
+		switch {
+		case err == nil:
+			expires = time.Now().Add(lease)
+			continue
+		case errors.As(err, &conditionErr):
+			logger.FromContext(ctx).Error("Job lock was taken over, stopping the job")
+		case time.Now().After(expires):
+			logger.FromContext(ctx).Error("Job lock expired after failed heartbeats, stopping the job", "error", err)
+		default:
+			logger.FromContext(ctx).Warn("Job lock heartbeat failed", "error", err)
+			continue
+		}
+		metrics.Emit(map[string]string{"Job": job}, nil, metrics.Count("JobLockLost", 1))
+		cancel(ErrLockLost)
+		return
+	}
+}
+
+// extend renews the lease of a lock the run still holds
+func (l *Locker) extend(ctx context.Context, job string, owner string) error {
+	now := time.Now().UTC()
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.
+			Set(expression.Name("heartbeatAt"), expression.Value(now.Format(time.RFC3339))).
+			Set(expression.Name("expiresAt"), expression.Value(now.Add(lease).Unix()))).
+		WithCondition(expression.Name("owner").Equal(expression.Value(owner))).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = l.dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(l.tableName),
+		Key:                       map[string]types.AttributeValue{"jobName": &types.AttributeValueMemberS{Value: job}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
+
+// release deletes the lock item if the run still holds it
+func (l *Locker) release(ctx context.Context, job string, owner string) error {
+	expr, err := expression.NewBuilder().WithCondition(expression.Name("owner").Equal(expression.Value(owner))).Build()
+	if err != nil {
+		return err
+	}
+	_, err = l.dynamo.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(l.tableName),
+		Key:                       map[string]types.AttributeValue{"jobName": &types.AttributeValueMemberS{Value: job}},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+	return err
+}
+
+// holder names the invocation holding a lock, for operators looking at the table
+func holder(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		return lambdacontext.FunctionName + "/" + lc.AwsRequestID
+	}
+	return lambdacontext.FunctionName
+}
@@ -0,0 +1,61 @@
+// Package legalhold answers whether a person is under an active legal hold. The HTTP API, the
+// anonymization and the purge all check it before they delete or overwrite person data, so a
+// hold protects a person the same way on every path.
+package legalhold
+
+import (
+	"context"
+
+	"aws-lambda-go/internal/ddbexpr"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// dynamoAPI is the part of the DynamoDB client the checker uses
+type dynamoAPI interface {
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+}
+
+// Checker looks up the holds of persons in the legal holds table. A nil *Checker finds no
+// holds.
+type Checker struct {
+	dynamo    dynamoAPI
+	tableName string
+}
+
+// New returns a checker on the table, nil when tableName is empty
+func New(dynamo dynamoAPI, tableName string) *Checker {
+	if tableName == "" {
+		return nil
+	}
+	return &Checker{dynamo: dynamo, tableName: tableName}
+}
+
+// Active reports whether a person has an active legal hold. Holds are read consistently, so a
+// hold placed just before is seen.
+func (c *Checker) Active(ctx context.Context, personID string) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(ddbexpr.KeyEquals("personId", personID)).
+		WithFilter(expression.Name("status").Equal(expression.Value("active"))).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	result, err := c.dynamo.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(c.tableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.Count > 0, nil
+}
@@ -0,0 +1,70 @@
+// Package logger sets up structured JSON logging (log/slog) shared by the lambdas and carries
+// the request-scoped logger and correlation ID through a context.Context.
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// CorrelationHeader is the HTTP header clients may set to correlate their own logs with ours
+const CorrelationHeader = "X-Correlation-Id"
+
+type loggerKey struct{}
+type correlationKey struct{}
+
+// Init installs a JSON logger tagged with the service name as the slog default. PII fields
+// are masked in every record it writes (see Sanitize).
+func Init(service string) {
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level(), ReplaceAttr: redactAttr})
+	slog.SetDefault(slog.New(handler).With("service", service))
+}
+
+// level reads LOG_LEVEL (debug, info, warn, error), defaulting to info
+func level() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// FromContext returns the request-scoped logger, or the default logger outside a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// With returns a context whose logger includes the given attributes
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, FromContext(ctx).With(args...))
+}
+
+// WithLambda adds the Lambda invocation fields (function name, AWS request ID) to the logger
+func WithLambda(ctx context.Context) context.Context {
+	lc, ok := lambdacontext.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return With(ctx, "functionName", lambdacontext.FunctionName, "awsRequestId", lc.AwsRequestID)
+}
+
+// WithCorrelationID stores the correlation ID and adds it to the logger
+func WithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	if correlationID == "" {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, correlationKey{}, correlationID)
+	return With(ctx, "correlationId", correlationID)
+}
+
+// CorrelationID returns the correlation ID stored in the context, if any
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
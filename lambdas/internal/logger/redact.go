@@ -0,0 +1,142 @@
+package logger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// defaultPIIFields are the person attributes never written to logs in clear text,
+// including the lookup keys derived from them
+var defaultPIIFields = []string{"firstName", "lastName", "address", "addressParts", "phoneNumber", "email", "emailKey", "lastNameKey"}
+
+// redacted replaces PII values when LOG_PII_MODE is not "hash"
+const redacted = "[REDACTED]"
+
+var (
+	// piiFields holds the lowercased PII field names, extended by LOG_PII_FIELDS (comma-separated)
+	piiFields = loadPIIFields()
+	// hashPII hashes PII values instead of redacting them (LOG_PII_MODE=hash), so log lines about
+	// the same person can still be matched up. LOG_PII_SALT keeps the hashes from being guessed
+	// from known values.
+	hashPII = os.Getenv("LOG_PII_MODE") == "hash"
+	piiSalt = os.Getenv("LOG_PII_SALT")
+)
+
+func loadPIIFields() map[string]bool {
+	fields := map[string]bool{}
+	for _, name := range defaultPIIFields {
+		fields[strings.ToLower(name)] = true
+	}
+	for _, name := range strings.Split(os.Getenv("LOG_PII_FIELDS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			fields[strings.ToLower(name)] = true
+		}
+	}
+	return fields
+}
+
+// IsPIIField reports whether an attribute or JSON key holds PII
+func IsPIIField(name string) bool {
+	return piiFields[strings.ToLower(name)]
+}
+
+// MaskString redacts or hashes a PII value. Empty values stay empty.
+func MaskString(value string) string {
+	if value == "" {
+		return ""
+	}
+	if !hashPII {
+		return redacted
+	}
+	sum := sha256.Sum256([]byte(piiSalt + value))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// Sanitize returns a copy of v, as generic JSON values, with every PII field masked. It knows
+// DynamoDB images ({"address": {"S": "..."}}) and changedFields entries ({"field": "address",
+// "before": "...", "after": "..."}). Values that cannot be encoded as JSON are replaced entirely.
+func Sanitize(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return redacted
+	}
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return redacted
+	}
+	return sanitizeValue(generic)
+}
+
+func sanitizeValue(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		if field, ok := value["field"].(string); ok && IsPIIField(field) {
+			for _, side := range []string{"before", "after"} {
+				if _, ok := value[side]; ok {
+					value[side] = mask(value[side])
+				}
+			}
+		}
+		for key, nested := range value {
+			if IsPIIField(key) {
+				value[key] = mask(nested)
+			} else {
+				value[key] = sanitizeValue(nested)
+			}
+		}
+		return value
+	case []any:
+		for i := range value {
+			value[i] = sanitizeValue(value[i])
+		}
+		return value
+	}
+	return v
+}
+
+// mask masks every leaf of a PII value, keeping the structure of attribute value maps
+func mask(v any) any {
+	switch value := v.(type) {
+	case string:
+		return MaskString(value)
+	case map[string]any:
+		for key, nested := range value {
+			value[key] = mask(nested)
+		}
+		return value
+	case []any:
+		for i := range value {
+			value[i] = mask(value[i])
+		}
+		return value
+	case nil:
+		return nil
+	}
+	data, _ := json.Marshal(v)
+	return MaskString(string(data))
+}
+
+// redactAttr is the slog ReplaceAttr hook: PII attributes are masked, and structured values
+// (maps, structs, slices) are sanitized before they are encoded
+func redactAttr(_ []string, attr slog.Attr) slog.Attr {
+	if IsPIIField(attr.Key) {
+		return slog.String(attr.Key, MaskString(attr.Value.Resolve().String()))
+	}
+	if attr.Value.Kind() != slog.KindAny {
+		return attr
+	}
+	value := attr.Value.Any()
+	if _, isError := value.(error); isError {
+		return attr
+	}
+	switch reflect.Indirect(reflect.ValueOf(value)).Kind() {
+	case reflect.Map, reflect.Struct, reflect.Slice, reflect.Array:
+		return slog.Any(attr.Key, Sanitize(value))
+	}
+	return attr
+}
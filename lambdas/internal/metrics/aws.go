@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// InstrumentDynamoDB records the duration of every DynamoDB call made with the config
+// as DynamoDBCallDuration, by operation and outcome. Successful reads are also recorded
+// by the table and index that served them, see indexReads.
+func InstrumentDynamoDB(cfg *aws.Config) {
+	cfg.APIOptions = append(cfg.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("EMFDuration", dynamoDBDuration), middleware.After)
+	})
+}
+
+func dynamoDBDuration(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	if awsmiddleware.GetServiceID(ctx) != "DynamoDB" {
+		return next.HandleInitialize(ctx, in)
+	}
+
+	start := time.Now()
+	out, metadata, err := next.HandleInitialize(ctx, in)
+	duration := time.Since(start)
+	operation := awsmiddleware.GetOperationName(ctx)
+	Emit(map[string]string{
+		"Operation": operation,
+		"Outcome":   ErrorOutcome(err),
+	}, nil, Duration("DynamoDBCallDuration", duration))
+	if err == nil {
+		for _, read := range indexReads(in.Parameters, out.Result) {
+			Emit(map[string]string{
+				"Operation":  operation,
+				"Table":      read.table,
+				"Index":      read.index,
+				"Projection": read.projection,
+			}, nil,
+				Count("IndexReads", 1),
+				Duration("IndexReadDuration", duration),
+				Count("IndexItemsReturned", read.returned),
+				Count("IndexItemsScanned", read.scanned),
+			)
+		}
+	}
+	return out, metadata, err
+}
+
+// baseTable is the Index dimension of reads served by the table itself
+const baseTable = "base"
+
+// Projection dimension values: every attribute, a subset of them, or only a count
+const (
+	projectionAll       = "all"
+	projectionAttribute = "attributes"
+	projectionCount     = "count"
+)
+
+// indexRead describes which table and index served a successful read and how much it read
+type indexRead struct {
+	table      string
+	index      string
+	projection string
+	returned   int
+	scanned    int
+}
+
+// indexReads returns the reads of a DynamoDB call, one per table for BatchGetItem and none
+// for writes
+func indexReads(params interface{}, result interface{}) []indexRead {
+	switch input := params.(type) {
+	case *dynamodb.GetItemInput:
+		read := indexRead{table: aws.ToString(input.TableName), index: baseTable, projection: projection(input.ProjectionExpression, "")}
+		if output, ok := result.(*dynamodb.GetItemOutput); ok && output.Item != nil {
+			read.returned, read.scanned = 1, 1
+		}
+		return []indexRead{read}
+	case *dynamodb.QueryInput:
+		read := indexRead{table: aws.ToString(input.TableName), index: indexName(input.IndexName), projection: projection(input.ProjectionExpression, input.Select)}
+		if output, ok := result.(*dynamodb.QueryOutput); ok {
+			read.returned, read.scanned = int(output.Count), int(output.ScannedCount)
+		}
+		return []indexRead{read}
+	case *dynamodb.ScanInput:
+		read := indexRead{table: aws.ToString(input.TableName), index: indexName(input.IndexName), projection: projection(input.ProjectionExpression, input.Select)}
+		if output, ok := result.(*dynamodb.ScanOutput); ok {
+			read.returned, read.scanned = int(output.Count), int(output.ScannedCount)
+		}
+		return []indexRead{read}
+	case *dynamodb.BatchGetItemInput:
+		output, _ := result.(*dynamodb.BatchGetItemOutput)
+		reads := make([]indexRead, 0, len(input.RequestItems))
+		for table, keys := range input.RequestItems {
+			read := indexRead{table: table, index: baseTable, projection: projection(keys.ProjectionExpression, "")}
+			if output != nil {
+				read.returned = len(output.Responses[table])
+				read.scanned = read.returned
+			}
+			reads = append(reads, read)
+		}
+		return reads
+	}
+	return nil
+}
+
+// indexName returns the Index dimension of a query or scan
+func indexName(name *string) string {
+	if name == nil {
+		return baseTable
+	}
+	return *name
+}
+
+// projection returns the Projection dimension of a read
+func projection(expression *string, selected types.Select) string {
+	switch {
+	case selected == types.SelectCount:
+		return projectionCount
+	case expression != nil || selected == types.SelectSpecificAttributes || selected == types.SelectAllProjectedAttributes:
+		return projectionAttribute
+	}
+	return projectionAll
+}
@@ -0,0 +1,140 @@
+// Package metrics emits CloudWatch metrics in the Embedded Metric Format (EMF): one JSON line
+// per record on stdout, which CloudWatch Logs turns into metrics without any API calls.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Units used by the lambdas
+const (
+	UnitMilliseconds = "Milliseconds"
+	UnitCount        = "Count"
+)
+
+// Outcomes used as the Outcome dimension
+const (
+	OutcomeSuccess     = "success"
+	OutcomeClientError = "client_error"
+	OutcomeServerError = "server_error"
+	OutcomeError       = "error"
+)
+
+// Metric is one named value in a record
+type Metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+var (
+	namespace = "PersonService"
+	service   string
+
+	mu     sync.Mutex
+	output io.Writer = os.Stdout
+)
+
+// Init sets the Service dimension added to every record. METRICS_NAMESPACE overrides
+// the CloudWatch namespace (default PersonService).
+func Init(serviceName string) {
+	service = serviceName
+	if value := os.Getenv("METRICS_NAMESPACE"); value != "" {
+		namespace = value
+	}
+}
+
+type metricDefinition struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type directive struct {
+	Namespace  string             `json:"Namespace"`
+	Dimensions [][]string         `json:"Dimensions"`
+	Metrics    []metricDefinition `json:"Metrics"`
+}
+
+type metadata struct {
+	Timestamp         int64       `json:"Timestamp"`
+	CloudWatchMetrics []directive `json:"CloudWatchMetrics"`
+}
+
+// Emit writes one EMF record. Dimensions become CloudWatch dimensions; properties are
+// searchable in Logs Insights but do not create metrics.
+func Emit(dimensions map[string]string, properties map[string]interface{}, values ...Metric) {
+	record := make(map[string]interface{}, len(dimensions)+len(properties)+len(values)+2)
+	for name, value := range properties {
+		record[name] = value
+	}
+
+	names := make([]string, 0, len(dimensions)+1)
+	for name, value := range dimensions {
+		record[name] = value
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if service != "" {
+		record["Service"] = service
+		names = append([]string{"Service"}, names...)
+	}
+
+	definitions := make([]metricDefinition, 0, len(values))
+	for _, metric := range values {
+		record[metric.Name] = metric.Value
+		definitions = append(definitions, metricDefinition{Name: metric.Name, Unit: metric.Unit})
+	}
+
+	record["_aws"] = metadata{
+		Timestamp: time.Now().UnixMilli(),
+		CloudWatchMetrics: []directive{{
+			Namespace:  namespace,
+			Dimensions: [][]string{names},
+			Metrics:    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Fprintln(output, string(line))
+}
+
+// Duration converts a duration into a millisecond metric
+func Duration(name string, duration time.Duration) Metric {
+	return Metric{Name: name, Unit: UnitMilliseconds, Value: float64(duration.Microseconds()) / 1000}
+}
+
+// Count creates a count metric
+func Count(name string, value int) Metric {
+	return Metric{Name: name, Unit: UnitCount, Value: float64(value)}
+}
+
+// HTTPOutcome maps a status code to an Outcome dimension value
+func HTTPOutcome(statusCode int) string {
+	switch {
+	case statusCode >= 500:
+		return OutcomeServerError
+	case statusCode >= 400:
+		return OutcomeClientError
+	default:
+		return OutcomeSuccess
+	}
+}
+
+// ErrorOutcome maps an error to an Outcome dimension value
+func ErrorOutcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeSuccess
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// diffIgnoredFields are bookkeeping attributes that change on every write, and lookup keys
+// and address components and identity hashes derived from other fields
+var diffIgnoredFields = map[string]bool{
+	"version":       true,
+	"updatedAt":     true,
+	"createdAt":     true,
+	"correlationId": true,
+	"traceHeader":   true,
+	"updatedBy":     true,
+	"deleted":       true,
+	"deletedAt":     true,
+	"emailKey":      true,
+	"lastNameKey":   true,
+	"addressParts":  true,
+	"emailHash":     true,
+	"phoneHash":     true,
+}
+
+// ChangedFields compares the old and new image of a record, ordered by field name.
+// Added and removed attributes show up with an empty before or after value.
+func ChangedFields(oldImage, newImage map[string]events.DynamoDBAttributeValue) []FieldChange {
+	names := map[string]bool{}
+	for name := range oldImage {
+		names[name] = true
+	}
+	for name := range newImage {
+		names[name] = true
+	}
+
+	var changes []FieldChange
+	for name := range names {
+		if diffIgnoredFields[name] {
+			continue
+		}
+		before, after := displayValue(oldImage[name]), displayValue(newImage[name])
+		if before != after {
+			changes = append(changes, FieldChange{Field: name, Before: before, After: after})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// displayValue renders an attribute value for people; missing attributes render as ""
+func displayValue(value events.DynamoDBAttributeValue) string {
+	if value.IsNull() {
+		return ""
+	}
+	switch value.DataType() {
+	case events.DataTypeString:
+		return value.String()
+	case events.DataTypeNumber:
+		return value.Number()
+	case events.DataTypeBoolean:
+		if value.Boolean() {
+			return "true"
+		}
+		return "false"
+	case events.DataTypeNull:
+		return ""
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
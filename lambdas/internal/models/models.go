@@ -0,0 +1,261 @@
+// Package models holds the person schema shared by every lambda: the DynamoDB item of a
+// person, the person event the stream lambda publishes, and the conversions between them. A
+// schema change is made here, in the struct tags, and picked up by all lambdas.
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Person represents the data model for a person
+type Person struct {
+	PersonID    string `json:"personId,omitempty" dynamodbav:"personId"`
+	FirstName   string `json:"firstName,omitempty" dynamodbav:"firstName"`
+	LastName    string `json:"lastName,omitempty" dynamodbav:"lastName"`
+	Address     string `json:"address,omitempty" dynamodbav:"address"`
+	PhoneNumber string `json:"phoneNumber,omitempty" dynamodbav:"phoneNumber"`
+	Email       string `json:"email,omitempty" dynamodbav:"email"`
+	// NotificationChannel optionally overrides how the person is notified ("email" or "sms")
+	NotificationChannel string `json:"notificationChannel,omitempty" dynamodbav:"notificationChannel"`
+	Version             int64  `json:"version,omitempty" dynamodbav:"version"`
+	CreatedAt           string `json:"createdAt,omitempty" dynamodbav:"createdAt"`
+	UpdatedAt           string `json:"updatedAt,omitempty" dynamodbav:"updatedAt"`
+	// OwnerID is the Cognito subject of the user who created the person
+	OwnerID string `json:"ownerId,omitempty" dynamodbav:"ownerId"`
+	// TenantID is the tenant of the caller who created the person (custom:tenantId)
+	TenantID string `json:"tenantId,omitempty" dynamodbav:"tenantId,omitempty"`
+	// AddressParts holds the JSON-encoded structured address written through the v2 API
+	AddressParts string `json:"-" dynamodbav:"addressParts,omitempty"`
+	// Preferences are set through PUT /persons/{personId}/preferences; nil allows every channel
+	Preferences *NotificationPreferences `json:"preferences,omitempty" dynamodbav:"preferences,omitempty"`
+	// Locale is a language tag like "es" or "fr-CA" choosing the language of notifications
+	Locale string `json:"locale,omitempty" dynamodbav:"locale,omitempty"`
+	// EmailUndeliverable is set by the email lambda when SES reports a permanent bounce
+	// ("bounce") or a complaint ("complaint") for the address UndeliverableEmailKey; it only
+	// applies while the person's email is that address
+	EmailUndeliverable    string `json:"emailUndeliverable,omitempty" dynamodbav:"emailUndeliverable,omitempty"`
+	UndeliverableEmailKey string `json:"-" dynamodbav:"undeliverableEmailKey,omitempty"`
+	UndeliverableAt       string `json:"undeliverableAt,omitempty" dynamodbav:"undeliverableAt,omitempty"`
+}
+
+// NotificationPreferences records which channels a person wants to be notified through
+type NotificationPreferences struct {
+	Email bool `json:"email" dynamodbav:"email"`
+	SMS   bool `json:"sms" dynamodbav:"sms"`
+}
+
+// EmailKey normalizes an email address like the emailKey lookup attribute
+func EmailKey(email string) string {
+	return strings.ToLower(strings.Join(strings.Fields(email), " "))
+}
+
+// EmailDeliverable reports whether the person's email address can be mailed, i.e. SES has not
+// reported it as bouncing permanently or complaining
+func (p Person) EmailDeliverable() bool {
+	return p.EmailUndeliverable == "" || p.UndeliverableEmailKey != EmailKey(p.Email)
+}
+
+// Allows reports whether a person accepts notifications through a channel ("email" or "sms").
+// Persons without preferences accept every channel.
+func (p Person) Allows(channel string) bool {
+	if p.Preferences == nil {
+		return true
+	}
+	switch channel {
+	case "email":
+		return p.Preferences.Email
+	case "sms":
+		return p.Preferences.SMS
+	}
+	return true
+}
+
+// MaskedValue replaces the values of the attributes the stream lambda masks in events
+// (STREAM_MASKED_CHANGED_FIELDS)
+const MaskedValue = "[MASKED]"
+
+// FieldChange is one changed attribute of a MODIFY event, with display values
+type FieldChange struct {
+	Field  string `json:"field" dynamodbav:"field"`
+	Before string `json:"before" dynamodbav:"before"`
+	After  string `json:"after" dynamodbav:"after"`
+}
+
+// EventSchemaVersion is bumped on incompatible changes to PersonChangedEvent, see pkg/personevents
+const EventSchemaVersion = 1
+
+// PersonChangedEvent is the detail of the "DynamoDBStreamEvent" events the stream lambda
+// publishes for every change to a person. It is plain JSON, so EventBridge rules can match on
+// its fields, e.g. {"detail": {"eventName": ["INSERT"], "person": {"tenantId": ["acme"]}}}.
+type PersonChangedEvent struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	EventID       string `json:"eventID"`
+	// PersonID is set for every event, including hard deletes
+	PersonID string `json:"personId"`
+	// EventName is INSERT, MODIFY, REMOVE or RESTORE
+	EventName     string `json:"eventName"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	// Current is the new image unmarshalled into a person; it is nil for hard deletes
+	Current *Person `json:"person,omitempty"`
+	// Image is the new stream image of the person; it is empty for hard deletes. It is kept
+	// next to Current for consumers and templates written against the attribute values.
+	Image map[string]events.DynamoDBAttributeValue `json:"dynamodbData"`
+	// ChangedFields lists the changed attributes of MODIFY events
+	ChangedFields []FieldChange `json:"changedFields,omitempty"`
+	// Synthetic marks events emitted through POST /admin/events/emit for backfills rather than
+	// by a change; notifications are not sent for them
+	Synthetic bool `json:"synthetic,omitempty"`
+}
+
+// Person returns the person of the event. Events published before Current was added are
+// decoded from their image.
+func (e PersonChangedEvent) Person() (Person, error) {
+	if e.Current != nil {
+		return *e.Current, nil
+	}
+	return PersonFromImage(e.Image)
+}
+
+// MarshalPerson converts a person into a DynamoDB item
+func MarshalPerson(person Person) (map[string]types.AttributeValue, error) {
+	return attributevalue.MarshalMap(person)
+}
+
+// UnmarshalPerson converts a DynamoDB item into a person
+func UnmarshalPerson(item map[string]types.AttributeValue) (Person, error) {
+	var person Person
+	err := attributevalue.UnmarshalMap(item, &person)
+	return person, err
+}
+
+// UnmarshalPersons converts DynamoDB items, e.g. a page of a Scan or Query, into persons
+func UnmarshalPersons(items []map[string]types.AttributeValue) ([]Person, error) {
+	var persons []Person
+	err := attributevalue.UnmarshalListOfMaps(items, &persons)
+	return persons, err
+}
+
+// PersonFromImage converts a DynamoDB stream image, as received by a stream-triggered lambda
+// or carried in a PersonChangedEvent, into a person
+func PersonFromImage(image map[string]events.DynamoDBAttributeValue) (Person, error) {
+	item, err := ItemFromImage(image)
+	if err != nil {
+		return Person{}, err
+	}
+	return UnmarshalPerson(item)
+}
+
+// ItemFromImage converts a DynamoDB stream image into the attribute values of the SDK, so
+// stream images are unmarshalled with the same dynamodbav tags as items
+func ItemFromImage(image map[string]events.DynamoDBAttributeValue) (map[string]types.AttributeValue, error) {
+	item := make(map[string]types.AttributeValue, len(image))
+	for name, value := range image {
+		converted, err := attributeFromStream(value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", name, err)
+		}
+		item[name] = converted
+	}
+	return item, nil
+}
+
+// ImageFromItem converts a DynamoDB item into a stream image, so events built from a stored
+// item carry the same image as those of the stream lambda
+func ImageFromItem(item map[string]types.AttributeValue) (map[string]events.DynamoDBAttributeValue, error) {
+	image := make(map[string]events.DynamoDBAttributeValue, len(item))
+	for name, value := range item {
+		converted, err := attributeToStream(value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", name, err)
+		}
+		image[name] = converted
+	}
+	return image, nil
+}
+
+// attributeToStream converts one attribute value of the SDK into a stream attribute value
+func attributeToStream(value types.AttributeValue) (events.DynamoDBAttributeValue, error) {
+	switch v := value.(type) {
+	case *types.AttributeValueMemberS:
+		return events.NewStringAttribute(v.Value), nil
+	case *types.AttributeValueMemberN:
+		return events.NewNumberAttribute(v.Value), nil
+	case *types.AttributeValueMemberBOOL:
+		return events.NewBooleanAttribute(v.Value), nil
+	case *types.AttributeValueMemberNULL:
+		return events.NewNullAttribute(), nil
+	case *types.AttributeValueMemberB:
+		return events.NewBinaryAttribute(v.Value), nil
+	case *types.AttributeValueMemberSS:
+		return events.NewStringSetAttribute(v.Value), nil
+	case *types.AttributeValueMemberNS:
+		return events.NewNumberSetAttribute(v.Value), nil
+	case *types.AttributeValueMemberBS:
+		return events.NewBinarySetAttribute(v.Value), nil
+	case *types.AttributeValueMemberL:
+		list := make([]events.DynamoDBAttributeValue, 0, len(v.Value))
+		for _, element := range v.Value {
+			converted, err := attributeToStream(element)
+			if err != nil {
+				return events.DynamoDBAttributeValue{}, err
+			}
+			list = append(list, converted)
+		}
+		return events.NewListAttribute(list), nil
+	case *types.AttributeValueMemberM:
+		members, err := ImageFromItem(v.Value)
+		if err != nil {
+			return events.DynamoDBAttributeValue{}, err
+		}
+		return events.NewMapAttribute(members), nil
+	}
+	return events.DynamoDBAttributeValue{}, fmt.Errorf("unsupported attribute type %T", value)
+}
+
+// attributeFromStream converts one stream attribute value
+func attributeFromStream(value events.DynamoDBAttributeValue) (types.AttributeValue, error) {
+	switch value.DataType() {
+	case events.DataTypeString:
+		return &types.AttributeValueMemberS{Value: value.String()}, nil
+	case events.DataTypeNumber:
+		if _, err := strconv.ParseFloat(value.Number(), 64); err != nil {
+			return nil, fmt.Errorf("invalid number %q", value.Number())
+		}
+		return &types.AttributeValueMemberN{Value: value.Number()}, nil
+	case events.DataTypeBoolean:
+		return &types.AttributeValueMemberBOOL{Value: value.Boolean()}, nil
+	case events.DataTypeNull:
+		return &types.AttributeValueMemberNULL{Value: true}, nil
+	case events.DataTypeBinary:
+		return &types.AttributeValueMemberB{Value: value.Binary()}, nil
+	case events.DataTypeStringSet:
+		return &types.AttributeValueMemberSS{Value: value.StringSet()}, nil
+	case events.DataTypeNumberSet:
+		return &types.AttributeValueMemberNS{Value: value.NumberSet()}, nil
+	case events.DataTypeBinarySet:
+		return &types.AttributeValueMemberBS{Value: value.BinarySet()}, nil
+	case events.DataTypeList:
+		list := make([]types.AttributeValue, 0, len(value.List()))
+		for _, element := range value.List() {
+			converted, err := attributeFromStream(element)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, converted)
+		}
+		return &types.AttributeValueMemberL{Value: list}, nil
+	case events.DataTypeMap:
+		members, err := ItemFromImage(value.Map())
+		if err != nil {
+			return nil, err
+		}
+		return &types.AttributeValueMemberM{Value: members}, nil
+	}
+	return nil, fmt.Errorf("unsupported data type %d", value.DataType())
+}
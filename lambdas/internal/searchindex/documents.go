@@ -0,0 +1,189 @@
+package searchindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// Document is a person as stored in the index, keyed by personId. PII is stored in clear
+// text, as it is searched.
+type Document struct {
+	PersonID            string `json:"personId"`
+	FirstName           string `json:"firstName,omitempty"`
+	LastName            string `json:"lastName,omitempty"`
+	Address             string `json:"address,omitempty"`
+	Email               string `json:"email,omitempty"`
+	PhoneNumber         string `json:"phoneNumber,omitempty"`
+	NotificationChannel string `json:"notificationChannel,omitempty"`
+	TenantID            string `json:"tenantId,omitempty"`
+	OwnerID             string `json:"ownerId,omitempty"`
+	Version             int64  `json:"version"`
+	CreatedAt           string `json:"createdAt,omitempty"`
+	UpdatedAt           string `json:"updatedAt,omitempty"`
+	Deleted             bool   `json:"deleted"`
+}
+
+// Put writes a document to WriteAlias with its version as external version, so an event that
+// arrives after a newer one leaves the newer document in place; Put then returns false. Copies
+// that earlier write indices of the same mapping version still hold are deleted, so a
+// person is found once after a rollover.
+func (c *Client) Put(ctx context.Context, document Document) (bool, error) {
+	path := fmt.Sprintf("/%s/_doc/%s?version=%d&version_type=external_gte&require_alias=true",
+		WriteAlias, url.PathEscape(document.PersonID), document.Version)
+	var written struct {
+		Index string `json:"_index"`
+	}
+	err := c.do(ctx, http.MethodPut, path, document, &written)
+	var responseErr *ResponseError
+	if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusConflict {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to index person %s: %w", document.PersonID, err)
+	}
+
+	copies, err := c.copies(ctx, document.PersonID)
+	if err != nil {
+		return true, err
+	}
+	for _, index := range copies {
+		// Indices of an older mapping version are replaced as a whole when a migration finishes
+		if index == written.Index || indexVersion(index) != indexVersion(written.Index) {
+			continue
+		}
+		if err := c.deleteCopy(ctx, index, document.PersonID); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Delete removes every copy of a person's document, e.g. after an erasure
+func (c *Client) Delete(ctx context.Context, personID string) error {
+	copies, err := c.copies(ctx, personID)
+	if err != nil {
+		return err
+	}
+	for _, index := range copies {
+		if err := c.deleteCopy(ctx, index, personID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copies returns the indices behind either alias that hold a document of the person
+func (c *Client) copies(ctx context.Context, personID string) ([]string, error) {
+	var response struct {
+		Hits struct {
+			Hits []struct {
+				Index string `json:"_index"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err := c.do(ctx, http.MethodPost, "/"+ReadAlias+","+WriteAlias+"/_search?ignore_unavailable=true", map[string]interface{}{
+		"query":   map[string]interface{}{"ids": map[string]interface{}{"values": []string{personID}}},
+		"_source": false,
+		"size":    100,
+	}, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the documents of person %s: %w", personID, err)
+	}
+	var indices []string
+	for _, hit := range response.Hits.Hits {
+		indices = append(indices, hit.Index)
+	}
+	return indices, nil
+}
+
+// deleteCopy deletes the document of a person from one index; a missing document is not an error
+func (c *Client) deleteCopy(ctx context.Context, index string, personID string) error {
+	err := c.do(ctx, http.MethodDelete, "/"+index+"/_doc/"+url.PathEscape(personID), nil, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete person %s from %s: %w", personID, index, err)
+	}
+	return nil
+}
+
+// Query is a full-text search over persons
+type Query struct {
+	// Text is matched fuzzily against the name, the address and the phone number, and exactly
+	// against the email address
+	Text string
+	// OwnerID limits the search to the persons of one owner; empty searches all
+	OwnerID        string
+	IncludeDeleted bool
+	From           int
+	Size           int
+}
+
+// Hit is a person found by a search
+type Hit struct {
+	PersonID string
+	Score    float64
+}
+
+// minPhoneDigits is how many digits a query needs to be compared with phone numbers
+const minPhoneDigits = 4
+
+// Search runs a query against ReadAlias and returns the hits, best first
+func (c *Client) Search(ctx context.Context, query Query) ([]Hit, error) {
+	fuzzy := func(field string, boost float64) map[string]interface{} {
+		return map[string]interface{}{"match": map[string]interface{}{field: map[string]interface{}{
+			"query": query.Text, "fuzziness": "AUTO", "operator": "and", "boost": boost,
+		}}}
+	}
+	should := []interface{}{fuzzy("name", 3), fuzzy("address", 1)}
+	if countDigits(query.Text) >= minPhoneDigits {
+		should = append(should, fuzzy("phoneNumber.digits", 2))
+	}
+	if strings.Contains(query.Text, "@") {
+		should = append(should, map[string]interface{}{"term": map[string]interface{}{"email": map[string]interface{}{"value": strings.TrimSpace(query.Text), "boost": 4}}})
+	}
+	boolQuery := map[string]interface{}{"should": should, "minimum_should_match": 1}
+	if query.OwnerID != "" {
+		boolQuery["filter"] = []interface{}{map[string]interface{}{"term": map[string]interface{}{"ownerId": query.OwnerID}}}
+	}
+	if !query.IncludeDeleted {
+		boolQuery["must_not"] = []interface{}{map[string]interface{}{"term": map[string]interface{}{"deleted": true}}}
+	}
+
+	var response struct {
+		Hits struct {
+			Hits []struct {
+				ID    string  `json:"_id"`
+				Score float64 `json:"_score"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err := c.do(ctx, http.MethodPost, "/"+ReadAlias+"/_search", map[string]interface{}{
+		"query":   map[string]interface{}{"bool": boolQuery},
+		"from":    query.From,
+		"size":    query.Size,
+		"_source": false,
+	}, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search persons: %w", err)
+	}
+	hits := make([]Hit, 0, len(response.Hits.Hits))
+	for _, hit := range response.Hits.Hits {
+		hits = append(hits, Hit{PersonID: hit.ID, Score: hit.Score})
+	}
+	return hits, nil
+}
+
+// countDigits returns how many digits a text has
+func countDigits(text string) int {
+	count := 0
+	for _, r := range text {
+		if unicode.IsDigit(r) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,369 @@
+package searchindex
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"aws-lambda-go/internal/errclass"
+)
+
+// Aliases of the person index. Searches go to ReadAlias and writes to WriteAlias; both
+// point at indices named persons-v<MappingVersion>-<NNNNNN>, which rollover increments.
+const (
+	ReadAlias  = "persons"
+	WriteAlias = "persons-write"
+)
+
+// MappingVersion is the version of mappings. Bump it with every mapping change: Ensure then
+// migrates to new indices of the new version with a reindex.
+const MappingVersion = 2
+
+// nameField is a full-text name part that can also be sorted and matched exactly. Both parts
+// are copied into "name", so a search for a full name matches across them.
+var nameField = map[string]interface{}{
+	"type":    "text",
+	"copy_to": "name",
+	"fields":  map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}},
+}
+
+// phoneField is matched exactly as stored, and fuzzily on its digits ("phoneNumber.digits")
+var phoneField = map[string]interface{}{
+	"type":   "keyword",
+	"fields": map[string]interface{}{"digits": map[string]interface{}{"type": "text", "analyzer": "phone_digits"}},
+}
+
+// settings and mappings of the person index. Attributes not listed are stored but not
+// indexed ("dynamic": false), so new person attributes never break indexing.
+var (
+	settings = map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"normalizer": map[string]interface{}{
+				"lowercase": map[string]interface{}{"type": "custom", "filter": []string{"lowercase"}},
+			},
+			// phone_digits reduces a phone number to one token of its digits, whatever its format
+			"char_filter": map[string]interface{}{
+				"digits_only": map[string]interface{}{"type": "pattern_replace", "pattern": "[^0-9]", "replacement": ""},
+			},
+			"analyzer": map[string]interface{}{
+				"phone_digits": map[string]interface{}{"type": "custom", "tokenizer": "keyword", "char_filter": []string{"digits_only"}},
+			},
+		},
+	}
+	mappings = map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"personId":            map[string]interface{}{"type": "keyword"},
+			"firstName":           nameField,
+			"lastName":            nameField,
+			"name":                map[string]interface{}{"type": "text"},
+			"address":             map[string]interface{}{"type": "text"},
+			"email":               map[string]interface{}{"type": "keyword", "normalizer": "lowercase"},
+			"phoneNumber":         phoneField,
+			"notificationChannel": map[string]interface{}{"type": "keyword"},
+			"tenantId":            map[string]interface{}{"type": "keyword"},
+			"ownerId":             map[string]interface{}{"type": "keyword"},
+			"version":             map[string]interface{}{"type": "long"},
+			"createdAt":           map[string]interface{}{"type": "date"},
+			"updatedAt":           map[string]interface{}{"type": "date"},
+			"deleted":             map[string]interface{}{"type": "boolean"},
+		},
+	}
+)
+
+// Conditions roll the write index over to a new index when any of them is reached
+type Conditions struct {
+	MaxDocs int
+	// MaxSize is an OpenSearch byte size, e.g. "30gb"
+	MaxSize string
+	// MaxAge is an OpenSearch duration, e.g. "30d"; empty means no age limit
+	MaxAge string
+}
+
+// DefaultConditions roll over at 10,000,000 documents or 30gb, whichever comes first
+var DefaultConditions = Conditions{MaxDocs: 10_000_000, MaxSize: "30gb"}
+
+func (c Conditions) body() map[string]interface{} {
+	body := map[string]interface{}{}
+	if c.MaxDocs > 0 {
+		body["max_docs"] = c.MaxDocs
+	}
+	if c.MaxSize != "" {
+		body["max_size"] = c.MaxSize
+	}
+	if c.MaxAge != "" {
+		body["max_age"] = c.MaxAge
+	}
+	return body
+}
+
+// Action is what a run of Ensure did
+type Action string
+
+const (
+	// ActionCreated: the first index was created with both aliases
+	ActionCreated Action = "created"
+	// ActionMigrating: a reindex into indices of a new MappingVersion was started or is running;
+	// writes already go to the new index, searches still to the old ones
+	ActionMigrating Action = "migrating"
+	// ActionMigrated: the reindex finished and ReadAlias moved to the new indices
+	ActionMigrated Action = "migrated"
+	// ActionRolledOver: the write index reached a rollover condition and a new one was created
+	ActionRolledOver Action = "rolledOver"
+	// ActionNone: nothing to do
+	ActionNone Action = "none"
+)
+
+// Result describes a run of Ensure
+type Result struct {
+	Action     Action
+	WriteIndex string
+	// Task is the reindex task of a migration
+	Task string
+	// Replaced lists the indices a migration took out of ReadAlias. They are kept, so a
+	// migration can be rolled back; delete them once the new indices are verified.
+	Replaced []string
+}
+
+// Ensure brings the index to the state the code expects, one step per call: it puts the
+// index template, creates the first index on demand, migrates to a new MappingVersion with
+// a reindex, and rolls the write index over. Calling it again continues a started migration.
+func (c *Client) Ensure(ctx context.Context) (Result, error) {
+	if err := c.putTemplate(ctx); err != nil {
+		return Result{}, fmt.Errorf("failed to put index template: %w", err)
+	}
+	writeIndices, err := c.aliasIndices(ctx, WriteAlias)
+	if err != nil {
+		return Result{}, err
+	}
+	readIndices, err := c.aliasIndices(ctx, ReadAlias)
+	if err != nil {
+		return Result{}, err
+	}
+
+	writeIndex := writeIndexOf(writeIndices)
+	switch version := indexVersion(writeIndex); {
+	case writeIndex == "":
+		index := firstIndex(MappingVersion)
+		body := map[string]interface{}{"aliases": map[string]interface{}{
+			WriteAlias: map[string]interface{}{"is_write_index": true},
+			ReadAlias:  map[string]interface{}{},
+		}}
+		if err := c.do(ctx, http.MethodPut, "/"+index, body, nil); err != nil {
+			return Result{}, fmt.Errorf("failed to create index %s: %w", index, err)
+		}
+		return Result{Action: ActionCreated, WriteIndex: index}, nil
+	case version < MappingVersion:
+		return c.startMigration(ctx, writeIndex)
+	case version > MappingVersion:
+		return Result{WriteIndex: writeIndex}, errclass.Mark(errclass.Permanent,
+			fmt.Errorf("index %s has a newer mapping than version %d of this code", writeIndex, MappingVersion))
+	case !readIndices[writeIndex]:
+		return c.finishMigration(ctx, writeIndex, readIndices)
+	}
+	return c.rollOver(ctx, writeIndex)
+}
+
+// putTemplate creates or updates the template of the current MappingVersion, which applies
+// to the first index of the version and every index rollover creates
+func (c *Client) putTemplate(ctx context.Context) error {
+	pattern := indexPrefix(MappingVersion) + "-*"
+	return c.do(ctx, http.MethodPut, "/_index_template/"+indexPrefix(MappingVersion), map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"priority":       MappingVersion,
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": withMeta(mappings, ""),
+		},
+		"_meta": map[string]interface{}{"mappingVersion": MappingVersion},
+	}, nil)
+}
+
+// startMigration creates the first index of the current MappingVersion, moves WriteAlias to
+// it and starts copying the documents of ReadAlias into it
+func (c *Client) startMigration(ctx context.Context, oldIndex string) (Result, error) {
+	index := firstIndex(MappingVersion)
+	err := c.do(ctx, http.MethodPut, "/"+index, map[string]interface{}{}, nil)
+	// A previous run may have created the index before failing
+	if err != nil && !strings.Contains(err.Error(), "resource_already_exists_exception") {
+		return Result{}, fmt.Errorf("failed to create index %s: %w", index, err)
+	}
+	err = c.do(ctx, http.MethodPost, "/_aliases", map[string]interface{}{"actions": []interface{}{
+		map[string]interface{}{"remove": map[string]interface{}{"index": oldIndex, "alias": WriteAlias}},
+		map[string]interface{}{"add": map[string]interface{}{"index": index, "alias": WriteAlias, "is_write_index": true}},
+	}}, nil)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to move %s to %s: %w", WriteAlias, index, err)
+	}
+	return c.reindex(ctx, index)
+}
+
+// reindex starts copying the documents of ReadAlias into index and records the task in the
+// index's mapping metadata. Documents written to index since WriteAlias moved are newer and
+// are not overwritten.
+func (c *Client) reindex(ctx context.Context, index string) (Result, error) {
+	var started struct {
+		Task string `json:"task"`
+	}
+	err := c.do(ctx, http.MethodPost, "/_reindex?wait_for_completion=false", map[string]interface{}{
+		"conflicts": "proceed",
+		"source":    map[string]interface{}{"index": ReadAlias},
+		"dest":      map[string]interface{}{"index": index, "op_type": "create"},
+	}, &started)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to start reindex into %s: %w", index, err)
+	}
+	if err := c.do(ctx, http.MethodPut, "/"+index+"/_mapping", withMeta(map[string]interface{}{}, started.Task), nil); err != nil {
+		return Result{}, fmt.Errorf("failed to record reindex task %s: %w", started.Task, err)
+	}
+	return Result{Action: ActionMigrating, WriteIndex: index, Task: started.Task}, nil
+}
+
+// finishMigration moves ReadAlias to the indices of the current MappingVersion once the
+// reindex into index has completed
+func (c *Client) finishMigration(ctx context.Context, index string, readIndices map[string]bool) (Result, error) {
+	var mapping map[string]struct {
+		Mappings struct {
+			Meta struct {
+				ReindexTask string `json:"reindexTask"`
+			} `json:"_meta"`
+		} `json:"mappings"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/"+index+"/_mapping", nil, &mapping); err != nil {
+		return Result{}, fmt.Errorf("failed to read the mapping of %s: %w", index, err)
+	}
+	task := mapping[index].Mappings.Meta.ReindexTask
+	if task == "" {
+		// A previous run moved WriteAlias but failed before starting the reindex
+		return c.reindex(ctx, index)
+	}
+
+	var status struct {
+		Completed bool `json:"completed"`
+		Response  struct {
+			Failures []interface{} `json:"failures"`
+		} `json:"response"`
+		Error map[string]interface{} `json:"error"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/_tasks/"+task, nil, &status); err != nil {
+		return Result{}, fmt.Errorf("failed to read reindex task %s: %w", task, err)
+	}
+	if !status.Completed {
+		return Result{Action: ActionMigrating, WriteIndex: index, Task: task}, nil
+	}
+	if status.Error != nil || len(status.Response.Failures) > 0 {
+		// Copying again is safe, documents already in index are skipped
+		result, err := c.reindex(ctx, index)
+		if err != nil {
+			return result, err
+		}
+		return result, fmt.Errorf("reindex task %s failed (error %v, %d failures), restarted as %s",
+			task, status.Error, len(status.Response.Failures), result.Task)
+	}
+
+	actions := []interface{}{
+		map[string]interface{}{"add": map[string]interface{}{"index": indexPrefix(MappingVersion) + "-*", "alias": ReadAlias}},
+	}
+	var replaced []string
+	for name := range readIndices {
+		actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": name, "alias": ReadAlias}})
+		replaced = append(replaced, name)
+	}
+	if err := c.do(ctx, http.MethodPost, "/_aliases", map[string]interface{}{"actions": actions}, nil); err != nil {
+		return Result{}, fmt.Errorf("failed to move %s to %s: %w", ReadAlias, index, err)
+	}
+	return Result{Action: ActionMigrated, WriteIndex: index, Task: task, Replaced: replaced}, nil
+}
+
+// rollOver creates a new write index when the current one reached a rollover condition
+func (c *Client) rollOver(ctx context.Context, writeIndex string) (Result, error) {
+	var response struct {
+		RolledOver bool   `json:"rolled_over"`
+		NewIndex   string `json:"new_index"`
+	}
+	err := c.do(ctx, http.MethodPost, "/"+WriteAlias+"/_rollover", map[string]interface{}{
+		"conditions": c.rollover.body(),
+		// The new index is searchable right away; WriteAlias moves by itself
+		"aliases": map[string]interface{}{ReadAlias: map[string]interface{}{}},
+	}, &response)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to roll over %s: %w", writeIndex, err)
+	}
+	if !response.RolledOver {
+		return Result{Action: ActionNone, WriteIndex: writeIndex}, nil
+	}
+	return Result{Action: ActionRolledOver, WriteIndex: response.NewIndex}, nil
+}
+
+// aliasIndices returns the indices an alias points at, with whether each is the write index
+func (c *Client) aliasIndices(ctx context.Context, alias string) (map[string]bool, error) {
+	var response map[string]struct {
+		Aliases map[string]struct {
+			IsWriteIndex *bool `json:"is_write_index"`
+		} `json:"aliases"`
+	}
+	err := c.do(ctx, http.MethodGet, "/_alias/"+alias, nil, &response)
+	if isNotFound(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alias %s: %w", alias, err)
+	}
+	indices := make(map[string]bool, len(response))
+	for index, info := range response {
+		isWrite := info.Aliases[alias].IsWriteIndex
+		indices[index] = isWrite != nil && *isWrite
+	}
+	return indices, nil
+}
+
+// writeIndexOf returns the write index among the indices of WriteAlias: the one flagged as
+// write index, or the only one
+func writeIndexOf(indices map[string]bool) string {
+	for index, isWrite := range indices {
+		if isWrite || len(indices) == 1 {
+			return index
+		}
+	}
+	return ""
+}
+
+// indexPrefix is the name prefix of the indices of a mapping version
+func indexPrefix(version int) string {
+	return fmt.Sprintf("persons-v%d", version)
+}
+
+// firstIndex is the first index of a mapping version; rollover numbers the next ones
+func firstIndex(version int) string {
+	return indexPrefix(version) + "-000001"
+}
+
+// indexVersion returns the mapping version in an index name, 0 for indices named otherwise
+func indexVersion(index string) int {
+	rest, ok := strings.CutPrefix(index, "persons-v")
+	if !ok {
+		return 0
+	}
+	digits, _, _ := strings.Cut(rest, "-")
+	version, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// withMeta returns mapping with _meta recording the mapping version and reindex task
+func withMeta(mapping map[string]interface{}, reindexTask string) map[string]interface{} {
+	meta := map[string]interface{}{"mappingVersion": MappingVersion}
+	if reindexTask != "" {
+		meta["reindexTask"] = reindexTask
+	}
+	result := make(map[string]interface{}, len(mapping)+1)
+	for key, value := range mapping {
+		result[key] = value
+	}
+	result["_meta"] = meta
+	return result
+}
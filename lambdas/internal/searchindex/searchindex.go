@@ -0,0 +1,138 @@
+// Package searchindex manages the person search index in OpenSearch from code: the index
+// template, the read and write aliases, rollover, and the reindex that migrates the index
+// when its mapping changes. Every step is idempotent, so Ensure can run on a schedule, on
+// deploy, or before the first write.
+package searchindex
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// Client calls the OpenSearch REST API with SigV4-signed requests. A nil *Client is
+// disabled; its Enabled method reports false.
+type Client struct {
+	endpoint    string
+	region      string
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+	http        *http.Client
+	rollover    Conditions
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithRollover sets the conditions Ensure rolls the write index over at, instead of
+// DefaultConditions
+func WithRollover(conditions Conditions) Option {
+	return func(c *Client) {
+		c.rollover = conditions
+	}
+}
+
+// New creates a client for the domain at endpoint (OPENSEARCH_ENDPOINT), or returns nil when
+// it is empty
+func New(cfg aws.Config, endpoint string, options ...Option) *Client {
+	if endpoint == "" {
+		return nil
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	c := &Client{
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		region:      cfg.Region,
+		credentials: cfg.Credentials,
+		signer:      v4.NewSigner(),
+		http:        &http.Client{Timeout: 30 * time.Second},
+		rollover:    DefaultConditions,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Enabled reports whether a search domain is configured
+func (c *Client) Enabled() bool {
+	return c != nil
+}
+
+// ResponseError is a non-2xx response of OpenSearch. It exposes the status code, so
+// internal/errclass classifies it like an AWS error.
+type ResponseError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("opensearch %s %s: status %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+// HTTPStatusCode returns the status code of the response
+func (e *ResponseError) HTTPStatusCode() int { return e.StatusCode }
+
+// isNotFound reports whether err is a 404 response
+func isNotFound(err error) bool {
+	var responseErr *ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound
+}
+
+// do sends a request with an optional JSON body and decodes a JSON response into out
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	credentials, err := c.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve credentials: %w", err)
+	}
+	hash := sha256.Sum256(payload)
+	if err := c.signer.SignHTTP(ctx, credentials, request, hex.EncodeToString(hash[:]), "es", c.region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &ResponseError{Method: method, Path: path, StatusCode: response.StatusCode, Body: string(responseBody)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBody, out)
+}
@@ -0,0 +1,155 @@
+// Package slack posts operational alerts from the lambdas to a Slack incoming webhook.
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+)
+
+// Alert severities, shown as the attachment color in Slack
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+var severityColors = map[string]string{
+	SeverityInfo:     "#439FE0",
+	SeverityWarning:  "warning",
+	SeverityCritical: "danger",
+}
+
+// Alert is a single operational message
+type Alert struct {
+	Title    string
+	Text     string
+	Severity string
+	Fields   map[string]string
+}
+
+// Notifier posts alerts for one lambda. It is a no-op when no webhook is configured,
+// so environments without an ops channel need no special handling.
+type Notifier struct {
+	webhookURL  string
+	environment string
+	source      string
+	client      *http.Client
+}
+
+// New creates a notifier for a webhook (SLACK_WEBHOOK_URL) that tags alerts with the
+// environment (ENVIRONMENT_NAME). source identifies the lambda posting the alert, e.g. "stream".
+func New(webhookURL string, environment string, source string) *Notifier {
+	return &Notifier{
+		webhookURL:  webhookURL,
+		environment: environment,
+		source:      source,
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Enabled reports whether alerts are delivered anywhere
+func (n *Notifier) Enabled() bool {
+	return n.webhookURL != ""
+}
+
+type attachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type attachment struct {
+	Color  string            `json:"color"`
+	Title  string            `json:"title"`
+	Text   string            `json:"text,omitempty"`
+	Fields []attachmentField `json:"fields,omitempty"`
+	Footer string            `json:"footer"`
+	Ts     int64             `json:"ts"`
+}
+
+type message struct {
+	Text        string       `json:"text"`
+	Attachments []attachment `json:"attachments"`
+}
+
+// Notify posts an alert to the webhook
+func (n *Notifier) Notify(ctx context.Context, alert Alert) error {
+	if !n.Enabled() {
+		return nil
+	}
+
+	color, ok := severityColors[alert.Severity]
+	if !ok {
+		color = severityColors[SeverityWarning]
+	}
+
+	// Sort fields so the same alert always renders the same way
+	names := make([]string, 0, len(alert.Fields))
+	for name := range alert.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]attachmentField, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, attachmentField{Title: name, Value: alert.Fields[name], Short: true})
+	}
+
+	environment := n.environment
+	if environment == "" {
+		environment = "unknown"
+	}
+	body, err := json.Marshal(message{
+		Text: fmt.Sprintf("[%s] %s", environment, alert.Title),
+		Attachments: []attachment{{
+			Color:  color,
+			Title:  alert.Title,
+			Text:   alert.Text,
+			Fields: fields,
+			Footer: fmt.Sprintf("person-service %s lambda", n.source),
+			Ts:     time.Now().Unix(),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to post Slack alert: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack webhook returned %s", response.Status)
+	}
+	return nil
+}
+
+// bestEffortTimeout bounds NotifyBestEffort, which runs inline on paths that are already
+// failing and must not be held up by a slow webhook
+const bestEffortTimeout = time.Second
+
+// NotifyBestEffort posts an alert within bestEffortTimeout and only logs failures; alerting must
+// never fail the caller. It blocks until the post is done or timed out.
+func (n *Notifier) NotifyBestEffort(ctx context.Context, alert Alert) {
+	if !n.Enabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, bestEffortTimeout)
+	defer cancel()
+	if err := n.Notify(ctx, alert); err != nil {
+		logger.FromContext(ctx).Error("Failed to send ops alert", "alert", alert.Title, "error", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Package tracing sets up OpenTelemetry tracing for the lambdas. Spans are exported over
+// OTLP/HTTP, which the ADOT Lambda layer's collector accepts on localhost:4318, with X-Ray
+// compatible trace IDs and X-Ray trace header propagation.
+package tracing
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceHeader is the X-Ray trace header used by API Gateway, EventBridge and SQS
+const TraceHeader = "X-Amzn-Trace-Id"
+
+// TraceParentHeader is the W3C Trace Context header sent by OpenTelemetry instrumented callers,
+// e.g. pkg/personclient; TraceStateHeader carries their vendor-specific state
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// provider is set when tracing is enabled, so spans can be flushed before Lambda freezes
+var provider *sdktrace.TracerProvider
+
+// propagator reads and writes X-Ray trace headers
+var propagator = xray.Propagator{}
+
+// Init enables tracing when OTEL_EXPORTER_OTLP_ENDPOINT (or the traces-specific variant) is set.
+// Otherwise the global no-op tracer stays in place and instrumentation costs nothing.
+func Init(ctx context.Context, service string) error {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil
+	}
+
+	// The exporter reads its endpoint, headers and protocol options from the OTEL_* variables
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithIDGenerator(xray.NewIDGenerator()),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", service),
+			attribute.String("cloud.provider", "aws"),
+			attribute.String("faas.name", lambdacontext.FunctionName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagator, propagation.TraceContext{}))
+	return nil
+}
+
+// Flush exports buffered spans; call it before returning from an invocation
+func Flush(ctx context.Context) {
+	if provider != nil {
+		_ = provider.ForceFlush(ctx)
+	}
+}
+
+// Tracer returns the tracer used for spans created by the lambdas
+func Tracer() trace.Tracer {
+	return otel.Tracer("person-service")
+}
+
+// Extract returns a context whose parent span is the one described by an X-Ray trace header,
+// e.g. "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+func Extract(ctx context.Context, header string) context.Context {
+	if header == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{TraceHeader: header})
+}
+
+// ExtractTraceParent returns a context whose parent span is the one described by a W3C
+// traceparent header, e.g. "00-5759e988bd862e3fe1be46a994272793-53995c3f42cd8ad8-01", and
+// its optional tracestate
+func ExtractTraceParent(ctx context.Context, traceParent string, traceState string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{TraceParentHeader: traceParent}
+	if traceState != "" {
+		carrier[TraceStateHeader] = traceState
+	}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
+
+// ExtractLambda continues the trace Lambda started for the current invocation
+func ExtractLambda(ctx context.Context) context.Context {
+	if header, ok := ctx.Value("x-amzn-trace-id").(string); ok && header != "" {
+		return Extract(ctx, header)
+	}
+	return Extract(ctx, os.Getenv("_X_AMZN_TRACE_ID"))
+}
+
+// Header renders the current span as an X-Ray trace header, or "" without an active span
+func Header(ctx context.Context) string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ""
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(TraceHeader)
+}
+
+// End records err on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, firstLine(err.Error()))
+	}
+	span.End()
+}
+
+func firstLine(message string) string {
+	line, _, _ := strings.Cut(message, "\n")
+	return line
+}
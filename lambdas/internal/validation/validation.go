@@ -0,0 +1,65 @@
+// Package validation checks person documents. It is shared by the HTTP API and the bulk
+// import, so a person is accepted or rejected the same way on either path.
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"aws-lambda-go/internal/models"
+)
+
+// localePattern matches language tags like en, es-MX or zh-Hant-TW
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8}){0,3}$`)
+
+// FieldError describes why one field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidNotificationChannel checks the optional channel preference of a person
+func ValidNotificationChannel(channel string) bool {
+	return channel == "" || channel == "email" || channel == "sms"
+}
+
+// ValidLocale checks the optional language tag of a person
+func ValidLocale(locale string) bool {
+	return locale == "" || localePattern.MatchString(locale)
+}
+
+// Validate checks the user-supplied fields of a complete person document: the fields POST
+// /persons requires are present, the email is a single address, and the notification channel and
+// locale are known. It returns every problem found, in field order.
+func Validate(person models.Person) []FieldError {
+	var errs []FieldError
+	required := []struct{ field, value string }{
+		{"firstName", person.FirstName},
+		{"lastName", person.LastName},
+		{"address", person.Address},
+		{"phoneNumber", person.PhoneNumber},
+	}
+	for _, r := range required {
+		if strings.TrimSpace(r.value) == "" {
+			errs = append(errs, FieldError{Field: r.field, Message: "is required"})
+		}
+	}
+	if person.Email != "" {
+		if address, err := mail.ParseAddress(person.Email); err != nil || address.Address != person.Email {
+			errs = append(errs, FieldError{Field: "email", Message: "is not a valid email address"})
+		}
+	}
+	if !ValidNotificationChannel(person.NotificationChannel) {
+		errs = append(errs, FieldError{Field: "notificationChannel", Message: "must be email or sms"})
+	}
+	if !ValidLocale(person.Locale) {
+		errs = append(errs, FieldError{Field: "locale", Message: "must be a language tag like en or fr-CA"})
+	}
+	return errs
+}
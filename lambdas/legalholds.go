@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/legalhold"
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// Legal holds: the hold record lives in DynamoDB, the frozen export in an object-locked,
+// KMS-encrypted bucket. Held persons cannot be deleted.
+var (
+	legalHoldsTableName = settings.LegalHoldsTableName
+	legalHoldBucket     = settings.LegalHoldBucket
+	legalHoldKMSKeyID   = settings.LegalHoldKMSKeyID
+	// legalHoldChecker protects held persons from deletion and erasure
+	legalHoldChecker *legalhold.Checker
+)
+
+// defaultLegalHoldRetentionDays applies when a hold request has no retainUntil (about 7 years)
+const defaultLegalHoldRetentionDays = 7 * 365
+
+// errCodeLegalHold is returned when an operation would remove data under legal hold
+const errCodeLegalHold = "LEGAL_HOLD"
+
+// LegalHoldRequest is the body of POST /admin/legal-holds
+type LegalHoldRequest struct {
+	PersonID    string `json:"personId"`
+	CaseID      string `json:"caseId"`
+	Reason      string `json:"reason"`
+	RetainUntil string `json:"retainUntil,omitempty"`
+}
+
+// LegalHold describes a placed hold and where its export is stored
+type LegalHold struct {
+	PersonID    string `json:"personId" dynamodbav:"personId"`
+	HoldID      string `json:"holdId" dynamodbav:"holdId"`
+	CaseID      string `json:"caseId" dynamodbav:"caseId"`
+	Reason      string `json:"reason" dynamodbav:"reason"`
+	Status      string `json:"status" dynamodbav:"status"`
+	ExportKey   string `json:"exportKey" dynamodbav:"exportKey"`
+	RetainUntil string `json:"retainUntil" dynamodbav:"retainUntil"`
+	CreatedBy   string `json:"createdBy" dynamodbav:"createdBy"`
+	CreatedAt   string `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// LegalHoldExport is the frozen document written to S3
+type LegalHoldExport struct {
+	Hold          LegalHold                `json:"hold"`
+	Person        map[string]interface{}   `json:"person"`
+	Notifications []map[string]interface{} `json:"notifications"`
+}
+
+// legalHoldObjectKey returns the S3 key of a hold export
+func legalHoldObjectKey(personID string, holdID string) string {
+	return fmt.Sprintf("legal-holds/%s/%s.json", personID, holdID)
+}
+
+// handleCreateLegalHold freezes a person's record and notification history into an
+// immutable export and records the hold
+func handleCreateLegalHold(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if legalHoldsTableName == "" || legalHoldBucket == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Legal holds are not enabled"), nil
+	}
+
+	var holdRequest LegalHoldRequest
+	if err := json.Unmarshal([]byte(request.Body), &holdRequest); err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid legal hold request"), nil
+	}
+	if holdRequest.PersonID == "" || holdRequest.CaseID == "" {
+		return errorResponse(request, http.StatusBadRequest, errCodeMissingParameter, "personId and caseId are required"), nil
+	}
+
+	now := time.Now().UTC()
+	retainUntil := now.AddDate(0, 0, defaultLegalHoldRetentionDays)
+	if holdRequest.RetainUntil != "" {
+		parsed, err := time.Parse(time.RFC3339, holdRequest.RetainUntil)
+		if err != nil || !parsed.After(now) {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "retainUntil must be a future RFC 3339 timestamp"), nil
+		}
+		retainUntil = parsed.UTC()
+	}
+
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: holdRequest.PersonID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "get item for legal hold", err), nil
+	}
+	if result.Item == nil {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
+	}
+
+	holdID, err := uuid.NewV7()
+	if err != nil {
+		return internalErrorResponse(ctx, request, "generate hold id", err), nil
+	}
+	hold := LegalHold{
+		PersonID:    holdRequest.PersonID,
+		HoldID:      holdID.String(),
+		CaseID:      holdRequest.CaseID,
+		Reason:      holdRequest.Reason,
+		Status:      "active",
+		ExportKey:   legalHoldObjectKey(holdRequest.PersonID, holdID.String()),
+		RetainUntil: retainUntil.Format(time.RFC3339),
+		CreatedBy:   request.RequestContext.Identity.UserArn,
+		CreatedAt:   now.Format(time.RFC3339),
+	}
+
+	export := LegalHoldExport{Hold: hold}
+	if err := fieldEncryptor.DecryptItem(ctx, holdRequest.PersonID, result.Item); err != nil {
+		return internalErrorResponse(ctx, request, "decrypt person for legal hold", err), nil
+	}
+	if err := attributevalue.UnmarshalMap(result.Item, &export.Person); err != nil {
+		return internalErrorResponse(ctx, request, "unmarshal person for legal hold", err), nil
+	}
+	if export.Notifications, err = notificationHistory(ctx, holdRequest.PersonID); err != nil {
+		return internalErrorResponse(ctx, request, "query notifications for legal hold", err), nil
+	}
+
+	body, err := json.Marshal(export)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal legal hold export", err), nil
+	}
+
+	// Compliance mode: nobody, including the root user, can delete or overwrite the
+	// export before retainUntil
+	input := &s3.PutObjectInput{
+		Bucket:                    aws.String(legalHoldBucket),
+		Key:                       aws.String(hold.ExportKey),
+		Body:                      bytes.NewReader(body),
+		ContentType:               aws.String("application/json"),
+		ChecksumAlgorithm:         s3types.ChecksumAlgorithmSha256,
+		ObjectLockMode:            s3types.ObjectLockModeCompliance,
+		ObjectLockRetainUntilDate: aws.Time(retainUntil),
+		ObjectLockLegalHoldStatus: s3types.ObjectLockLegalHoldStatusOn,
+		ServerSideEncryption:      s3types.ServerSideEncryptionAwsKms,
+	}
+	if legalHoldKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(legalHoldKMSKeyID)
+	}
+	if _, err := s3Client.PutObject(ctx, input); err != nil {
+		return internalErrorResponse(ctx, request, "store legal hold export", err), nil
+	}
+
+	item, err := attributevalue.MarshalMap(hold)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal legal hold", err), nil
+	}
+	if _, err := svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(legalHoldsTableName),
+		Item:      item,
+	}); err != nil {
+		return internalErrorResponse(ctx, request, "record legal hold", err), nil
+	}
+
+	logger.FromContext(ctx).Info("Placed legal hold", "personId", hold.PersonID, "holdId", hold.HoldID, "caseId", hold.CaseID)
+	return jsonResponse(ctx, request, http.StatusCreated, hold)
+}
+
+// notificationHistory returns every notification recorded for a person, oldest first
+func notificationHistory(ctx context.Context, personID string) ([]map[string]interface{}, error) {
+	history := []map[string]interface{}{}
+	if notificationsTableName == "" {
+		return history, nil
+	}
+
+	expr, err := expression.NewBuilder().WithKeyCondition(ddbexpr.KeyEquals("personId", personID)).Build()
+	if err != nil {
+		return nil, err
+	}
+	paginator := dynamodb.NewQueryPaginator(svc, &dynamodb.QueryInput{
+		TableName:                 aws.String(notificationsTableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var items []map[string]interface{}
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, err
+		}
+		history = append(history, items...)
+	}
+	return history, nil
+}
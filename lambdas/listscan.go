@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/models"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// apiGatewayTimeout is the integration timeout of API Gateway, which ends a request even when
+// the Lambda timeout is longer
+const apiGatewayTimeout = 29 * time.Second
+
+var (
+	// listScanSegments is the number of segments GET /persons scans in parallel when the list is
+	// not scoped to an owner (LIST_SCAN_SEGMENTS). Scoped lists, and all lists by default, scan
+	// a single segment.
+	listScanSegments = settings.ListScanSegments
+	// listDeadlineMargin is kept free before the request deadline to serialize and return a
+	// partial list (LIST_DEADLINE_MARGIN_MS)
+	listDeadlineMargin = settings.ListDeadlineMargin
+	// maxResponseBytes caps a list body (MAX_RESPONSE_BYTES, default 5 MiB), below the 6 MB
+	// Lambda response limit and the 10 MB API Gateway limit
+	maxResponseBytes = settings.MaxResponseBytes
+)
+
+// listTrailerBytes is kept free at the end of a list body for the closing bracket and the
+// v2 envelope meta with its nextToken
+const listTrailerBytes = 4 * 1024
+
+var (
+	errInvalidNextToken = errors.New("invalid nextToken")
+	// errListFull is returned by listWriter.add when the item would push the body past its limit
+	errListFull = errors.New("list response is full")
+)
+
+// listCursor is where a partial list continues, per segment. It is handed to clients as an
+// opaque nextToken.
+type listCursor struct {
+	Segments int `json:"segments"`
+	// After holds the personId after which each segment continues, "" for segments not started
+	After []string `json:"after"`
+	Done  []bool   `json:"done"`
+}
+
+func newListCursor(segments int) *listCursor {
+	return &listCursor{Segments: segments, After: make([]string, segments), Done: make([]bool, segments)}
+}
+
+// parseListCursor reads a nextToken. Tokens from a different segment configuration are rejected.
+func parseListCursor(token string, segments int) (*listCursor, error) {
+	if token == "" {
+		return newListCursor(segments), nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidNextToken
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(decoded, &cursor); err != nil || cursor.Segments != segments ||
+		len(cursor.After) != segments || len(cursor.Done) != segments {
+		return nil, errInvalidNextToken
+	}
+	return &cursor, nil
+}
+
+func (c *listCursor) complete() bool {
+	for _, done := range c.Done {
+		if !done {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *listCursor) token() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// listDeadline is when a list stops fetching pages: the margin before the Lambda or API Gateway
+// deadline, whichever comes first
+func listDeadline(ctx context.Context, start time.Time) time.Time {
+	deadline := start.Add(apiGatewayTimeout)
+	if lambdaDeadline, ok := ctx.Deadline(); ok && lambdaDeadline.Before(deadline) {
+		deadline = lambdaDeadline
+	}
+	return deadline.Add(-listDeadlineMargin)
+}
+
+// scanPage is one page of a segment, or the error that ended the segment
+type scanPage struct {
+	segment int
+	output  *dynamodb.ScanOutput
+	err     error
+}
+
+// parallelScan scans the unfinished segments of the cursor concurrently, one worker per segment,
+// and hands the pages to handle one at a time. At most one page per segment is buffered, so
+// memory stays bounded however large the table is. Workers stop fetching at the deadline; the
+// cursor then records where each segment has to continue. handle returns how many items of
+// the page it took; a page taken in part ends the scan after the last item taken. The first
+// error stops all workers.
+func parallelScan(ctx context.Context, input *dynamodb.ScanInput, cursor *listCursor, deadline time.Time, handle func(page *dynamodb.ScanOutput) (int, error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pages := make(chan scanPage, cursor.Segments)
+	var workers sync.WaitGroup
+	for segment := 0; segment < cursor.Segments; segment++ {
+		if cursor.Done[segment] {
+			continue
+		}
+		segmentInput := *input
+		if cursor.Segments > 1 {
+			segmentInput.Segment = aws.Int32(int32(segment))
+			segmentInput.TotalSegments = aws.Int32(int32(cursor.Segments))
+		}
+		if after := cursor.After[segment]; after != "" {
+			segmentInput.ExclusiveStartKey = map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: after}}
+		}
+		workers.Add(1)
+		go func(segment int) {
+			defer workers.Done()
+			paginator := dynamodb.NewScanPaginator(svc, &segmentInput)
+			for paginator.HasMorePages() && time.Now().Before(deadline) {
+				output, err := paginator.NextPage(ctx)
+				select {
+				case pages <- scanPage{segment: segment, output: output, err: err}:
+				case <-ctx.Done():
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(segment)
+	}
+	go func() {
+		workers.Wait()
+		close(pages)
+	}()
+
+	for page := range pages {
+		if page.err != nil {
+			return page.err
+		}
+		taken, err := handle(page.output)
+		if err != nil {
+			return err
+		}
+		if taken < len(page.output.Items) {
+			// The response is full: the segment continues after the last item that made it in
+			if taken > 0 {
+				if last, ok := page.output.Items[taken-1]["personId"].(*types.AttributeValueMemberS); ok {
+					cursor.After[page.segment] = last.Value
+				}
+			}
+			return nil
+		}
+		// The cursor only advances past pages that made it into the response
+		if next, ok := page.output.LastEvaluatedKey["personId"].(*types.AttributeValueMemberS); ok {
+			cursor.After[page.segment] = next.Value
+		} else {
+			cursor.Done[page.segment] = true
+		}
+	}
+	return ctx.Err()
+}
+
+// listWriter serializes a person list item by item, so the items themselves do not have to
+// be held until the end of the scan. The body stops growing at limit bytes.
+type listWriter struct {
+	body      bytes.Buffer
+	cleanJSON bool
+	v2        bool
+	envelope  bool
+	limit     int
+	count     int
+}
+
+func newListWriter(cleanJSON bool, v2 bool, envelope bool, limit int) *listWriter {
+	w := &listWriter{cleanJSON: cleanJSON, v2: v2, envelope: envelope, limit: limit}
+	if envelope {
+		w.body.WriteString(`{"data":`)
+	}
+	w.body.WriteByte('[')
+	return w
+}
+
+// add appends one (decrypted and filtered) person item, or returns errListFull when it does not
+// fit. The first item is always taken, so every response makes progress.
+func (w *listWriter) add(item map[string]types.AttributeValue) error {
+	var value interface{} = item
+	if w.v2 {
+		person, err := personV2FromItem(item)
+		if err != nil {
+			return err
+		}
+		value = person
+	} else if w.cleanJSON {
+		person, err := models.UnmarshalPerson(item)
+		if err != nil {
+			return err
+		}
+		value = person
+	}
+	itemJSON, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if w.count > 0 && w.body.Len()+1+len(itemJSON)+listTrailerBytes > w.limit {
+		return errListFull
+	}
+	if w.count > 0 {
+		w.body.WriteByte(',')
+	}
+	w.body.Write(itemJSON)
+	w.count++
+	return nil
+}
+
+// close terminates the list, adding the envelope meta when enveloped
+func (w *listWriter) close(meta EnvelopeMeta) (string, error) {
+	w.body.WriteByte(']')
+	if w.envelope {
+		meta.Count = &w.count
+		metaJSON, err := json.Marshal(meta)
+		if err != nil {
+			return "", err
+		}
+		w.body.WriteString(`,"meta":`)
+		w.body.Write(metaJSON)
+		w.body.WriteByte('}')
+	}
+	return w.body.String(), nil
+}
+
+// listPersons answers GET /persons. Pages are fetched until the table is exhausted, the request
+// deadline approaches or the body reaches MAX_RESPONSE_BYTES; in the latter cases the persons
+// gathered so far are returned as a partial list with a nextToken to continue from.
+func listPersons(ctx context.Context, request events.APIGatewayProxyRequest, input *dynamodb.ScanInput, segments int, cleanJSON bool, v2 bool) (events.APIGatewayProxyResponse, error) {
+	cursor, err := parseListCursor(request.QueryStringParameters["nextToken"], segments)
+	if err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid nextToken"), nil
+	}
+
+	filter := responseFilter(ctx)
+	writer := newListWriter(cleanJSON, v2, enveloped(ctx, request), maxResponseBytes)
+	scanned := 0
+	full := false
+	start := time.Now()
+	err = parallelScan(ctx, input, cursor, listDeadline(ctx, start), func(page *dynamodb.ScanOutput) (int, error) {
+		scanned += int(page.ScannedCount)
+		if err := decryptItems(ctx, page.Items); err != nil {
+			return 0, err
+		}
+		filter.applyAll(page.Items)
+		for i, item := range page.Items {
+			err := writer.add(item)
+			if errors.Is(err, errListFull) {
+				full = true
+				return i, nil
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		return len(page.Items), nil
+	})
+	partial := !cursor.complete()
+	// Lists across every owner are audited, as they expose the whole table
+	if ownerScope(ctx) == "" {
+		auditDataAccess(ctx, request, "list", listAuditFilter(request, segments, partial), writer.count, start, err)
+	}
+	if err != nil {
+		return internalErrorResponse(ctx, request, "scan items", err), nil
+	}
+
+	var dimensions map[string]string
+	if segments > 1 {
+		dimensions = map[string]string{"Scan": "parallel"}
+	}
+	metrics.Emit(dimensions, map[string]interface{}{"segments": segments, "partial": partial, "truncated": full},
+		metrics.Count("ScanItemCount", writer.count),
+		metrics.Count("ScannedItemCount", scanned),
+	)
+
+	meta := EnvelopeMeta{RequestID: request.RequestContext.RequestID}
+	headers := map[string]string{}
+	if partial {
+		if full {
+			logger.FromContext(ctx).Warn("Returning partial list at the response size limit", "items", writer.count, "bytes", writer.body.Len())
+		} else {
+			logger.FromContext(ctx).Warn("Returning partial list before the deadline", "items", writer.count)
+		}
+		meta.Partial = true
+		meta.NextToken = cursor.token()
+		headers["X-Partial"] = "true"
+		headers["X-Next-Token"] = meta.NextToken
+		headers["Link"] = "<" + nextPageLink(request, meta.NextToken) + `>; rel="next"`
+	}
+	body, err := writer.close(meta)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal items", err), nil
+	}
+	if v2 {
+		headers["Content-Type"] = "application/json"
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Headers: headers, Body: body}, nil
+}
+
+// nextPageLink is the request's path and query with nextToken set to token
+func nextPageLink(request events.APIGatewayProxyRequest, token string) string {
+	query := url.Values{}
+	for name, value := range request.QueryStringParameters {
+		query.Set(name, value)
+	}
+	query.Set("nextToken", token)
+	return request.Path + "?" + query.Encode()
+}
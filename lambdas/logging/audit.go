@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// erasedVersion orders an erasure after every change made in the same second; erasures carry
+// no version of their own
+const erasedVersion = 9999999999
+
+// anonymizeActor is the actor of the anonymization lambda's writes
+const anonymizeActor = "system:anonymize"
+
+// auditTrail keeps an immutable record of every change to a person in AUDIT_TABLE_NAME, the
+// backbone of the change history. Records are only ever put, never updated: a redelivered or
+// replayed event finds its record and leaves it alone. The exceptions are erasure, which
+// deletes a person's records, as they hold the person's data, and leaves only the erasure, and
+// anonymization, which strips the images and PII values from the records before it.
+type auditTrail struct {
+	tableName string
+	dynamo    *dynamodb.Client
+}
+
+// enabled reports whether the audit table is configured
+func (a *auditTrail) enabled() bool {
+	return a != nil && a.tableName != ""
+}
+
+// AuditEntry is one change in the audit table. Entries are keyed by person and auditId, which
+// sorts by time and then version, so a person's history reads in order with one query.
+type AuditEntry struct {
+	PersonID  string `dynamodbav:"personId"`
+	AuditID   string `dynamodbav:"auditId"`
+	EventID   string `dynamodbav:"eventId"`
+	Operation string `dynamodbav:"operation"`
+	// Diff lists the changed fields of the event, where encrypted fields stay encrypted and
+	// masked fields masked. Creations list every field of the new person instead.
+	Diff      []models.FieldChange `dynamodbav:"diff"`
+	Timestamp string               `dynamodbav:"timestamp"`
+	// Actor is who made the change: user:<sub>, iam:<arn> or ip:<address> for API calls,
+	// system:<lambda> for the service's own writes, e.g. system:import
+	Actor         string `dynamodbav:"actor"`
+	Version       int64  `dynamodbav:"version,omitempty"`
+	CorrelationID string `dynamodbav:"correlationId,omitempty"`
+	// Image is the person after the change as the event carried it; it is empty for erasures
+	Image map[string]types.AttributeValue `dynamodbav:"image,omitempty"`
+}
+
+// auditEntry builds the audit entry of an event. It returns nil for events that are not
+// changes to a person, including synthetic backfill events.
+func auditEntry(event eventEnvelope) (*AuditEntry, error) {
+	changed, err := personevents.Parse(event.CloudWatchEvent)
+	if errors.Is(err, personevents.ErrNotPersonEvent) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errclass.Mark(errclass.Permanent, err)
+	}
+	if changed.Synthetic {
+		return nil, nil
+	}
+
+	var detail struct {
+		models.PersonChangedEvent
+		// Actor is set on PersonErased events
+		Actor string `json:"actor"`
+	}
+	if err := json.Unmarshal(personevents.UnwrapCloudEvent(event.Detail), &detail); err != nil {
+		return nil, errclass.Mark(errclass.Permanent, err)
+	}
+	entry := &AuditEntry{
+		PersonID:      changed.PersonID,
+		EventID:       event.ID,
+		Operation:     changed.EventName,
+		Diff:          detail.ChangedFields,
+		Timestamp:     event.Time.UTC().Format(time.RFC3339),
+		Actor:         detail.Actor,
+		CorrelationID: changed.CorrelationID,
+	}
+	if changed.EventName == personevents.EventInsert {
+		entry.Diff = models.ChangedFields(nil, detail.Image)
+	}
+	if entry.Diff == nil {
+		entry.Diff = []models.FieldChange{}
+	}
+	if len(detail.Image) > 0 {
+		if entry.Image, err = models.ItemFromImage(detail.Image); err != nil {
+			return nil, errclass.Mark(errclass.Permanent, err)
+		}
+		if updatedBy, ok := entry.Image["updatedBy"].(*types.AttributeValueMemberS); ok {
+			entry.Actor = updatedBy.Value
+		}
+		if version, ok := entry.Image["version"].(*types.AttributeValueMemberN); ok {
+			entry.Version, _ = strconv.ParseInt(version.Value, 10, 64)
+		}
+	}
+	if entry.Actor == "" {
+		entry.Actor = "unknown"
+	}
+	version := entry.Version
+	if changed.EventName == personevents.EventErase {
+		version = erasedVersion
+	}
+	entry.AuditID = fmt.Sprintf("%s#%010d#%s", entry.Timestamp, version, entry.EventID)
+	return entry, nil
+}
+
+// record stores the audit entry of an event, if it has one
+func (a *auditTrail) record(ctx context.Context, event eventEnvelope) error {
+	entry, err := auditEntry(event)
+	if err != nil || entry == nil {
+		return err
+	}
+	if entry.Operation == personevents.EventErase {
+		if err := a.erase(ctx, entry.PersonID); err != nil {
+			return err
+		}
+	}
+	if anonymizes(entry) {
+		if err := a.anonymize(ctx, entry.PersonID, entry.AuditID); err != nil {
+			return err
+		}
+		// The pseudonyms may stay, the values they replaced may not
+		for i, change := range entry.Diff {
+			if logger.IsPIIField(change.Field) {
+				entry.Diff[i].Before = ""
+			}
+		}
+	}
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return err
+	}
+	expr, err := expression.NewBuilder().WithCondition(expression.AttributeNotExists(expression.Name("auditId"))).Build()
+	if err != nil {
+		return err
+	}
+	_, err = a.dynamo.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(a.tableName),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		logger.FromContext(ctx).Info("Audit entry already recorded", "personId", entry.PersonID, "auditId", entry.AuditID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry of event %s: %w", event.ID, err)
+	}
+	metrics.Emit(map[string]string{"Operation": entry.Operation}, nil, metrics.Count("AuditEntriesRecorded", 1))
+	return nil
+}
+
+// erase deletes the audit entries of an erased person
+func (a *auditTrail) erase(ctx context.Context, personID string) error {
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("personId").Equal(expression.Value(personID))).
+		WithProjection(expression.NamesList(expression.Name("personId"), expression.Name("auditId"))).
+		Build()
+	if err != nil {
+		return err
+	}
+	paginator := dynamodb.NewQueryPaginator(a.dynamo, &dynamodb.QueryInput{
+		TableName:                 aws.String(a.tableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var erased int
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read audit entries for erasure: %w", err)
+		}
+		for _, key := range page.Items {
+			_, err := a.dynamo.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: aws.String(a.tableName), Key: key})
+			if err != nil {
+				return fmt.Errorf("failed to erase audit entry: %w", err)
+			}
+			erased++
+		}
+	}
+	logger.FromContext(ctx).Info("Erased audit entries", "personId", personID, "count", erased)
+	return nil
+}
+
+// anonymizes reports whether an audit entry is the anonymization of a person: a write of the
+// anonymization lambda, or any other change that sets the anonymized flag. Later changes of an
+// anonymized person keep the flag but do not anonymize again.
+func anonymizes(entry *AuditEntry) bool {
+	if entry.Actor == anonymizeActor {
+		return true
+	}
+	if flag, ok := entry.Image["anonymized"].(*types.AttributeValueMemberBOOL); !ok || !flag.Value {
+		return false
+	}
+	for _, change := range entry.Diff {
+		if change.Field == "anonymized" {
+			return true
+		}
+	}
+	return false
+}
+
+// anonymize strips the image and the PII values of the diff from the audit entries of a person
+// that come before the anonymization, as they hold the person's real data. Encrypted values
+// are removed as well, since they can still be decrypted.
+func (a *auditTrail) anonymize(ctx context.Context, personID string, anonymizationID string) error {
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("personId").Equal(expression.Value(personID)).
+			And(expression.Key("auditId").LessThan(expression.Value(anonymizationID)))).
+		WithProjection(expression.NamesList(expression.Name("personId"), expression.Name("auditId"), expression.Name("diff"))).
+		Build()
+	if err != nil {
+		return err
+	}
+	paginator := dynamodb.NewQueryPaginator(a.dynamo, &dynamodb.QueryInput{
+		TableName:                 aws.String(a.tableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var scrubbed int
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read audit entries for anonymization: %w", err)
+		}
+		for _, item := range page.Items {
+			var entry AuditEntry
+			if err := attributevalue.UnmarshalMap(item, &entry); err != nil {
+				return fmt.Errorf("failed to unmarshal audit entry %s: %w", entry.AuditID, err)
+			}
+			for i, change := range entry.Diff {
+				if logger.IsPIIField(change.Field) {
+					entry.Diff[i].Before, entry.Diff[i].After = "", ""
+				}
+			}
+			if entry.Diff == nil {
+				entry.Diff = []models.FieldChange{}
+			}
+			update, err := expression.NewBuilder().
+				WithUpdate(expression.Remove(expression.Name("image")).Set(expression.Name("diff"), expression.Value(entry.Diff))).
+				Build()
+			if err != nil {
+				return err
+			}
+			_, err = a.dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:                 aws.String(a.tableName),
+				Key:                       map[string]types.AttributeValue{"personId": item["personId"], "auditId": item["auditId"]},
+				UpdateExpression:          update.Update(),
+				ExpressionAttributeNames:  update.Names(),
+				ExpressionAttributeValues: update.Values(),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to anonymize audit entry: %w", err)
+			}
+			scrubbed++
+		}
+	}
+	logger.FromContext(ctx).Info("Anonymized audit entries", "personId", personID, "count", scrubbed)
+	return nil
+}
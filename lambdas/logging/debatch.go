@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// The logging lambda is invoked directly by EventBridge, but events also reach it wrapped:
+// an SQS batch whose message bodies are EventBridge events, or a replay/archive export
+// holding a JSON array of events. Everything is flattened into individual events first.
+
+// eventEnvelope is an EventBridge event; replayed events also carry the replay name
+type eventEnvelope struct {
+	events.CloudWatchEvent
+	ReplayName string `json:"replay-name,omitempty"`
+}
+
+// sqsProbe recognizes an SQS batch
+type sqsProbe struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+		MessageID   string `json:"messageId"`
+		Body        string `json:"body"`
+	} `json:"Records"`
+}
+
+// debatch splits an invocation payload into the EventBridge events it carries
+func debatch(payload json.RawMessage) ([]eventEnvelope, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+
+	if trimmed[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, fmt.Errorf("invalid event batch: %w", err)
+		}
+		var batch []eventEnvelope
+		for _, item := range raw {
+			inner, err := debatch(item)
+			if err != nil {
+				return nil, err
+			}
+			batch = append(batch, inner...)
+		}
+		return batch, nil
+	}
+
+	var probe sqsProbe
+	if err := json.Unmarshal(trimmed, &probe); err == nil && len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs" {
+		var batch []eventEnvelope
+		for _, record := range probe.Records {
+			inner, err := debatch(json.RawMessage(record.Body))
+			if err != nil {
+				return nil, fmt.Errorf("message %s: %w", record.MessageID, err)
+			}
+			batch = append(batch, inner...)
+		}
+		return batch, nil
+	}
+
+	var event eventEnvelope
+	if err := json.Unmarshal(trimmed, &event); err != nil {
+		return nil, fmt.Errorf("invalid event: %w", err)
+	}
+	return []eventEnvelope{event}, nil
+}
+
+// AuditRecord is the log line written for each individual event
+type AuditRecord struct {
+	ID            string          `json:"id"`
+	Source        string          `json:"source"`
+	DetailType    string          `json:"detailType"`
+	Time          string          `json:"time"`
+	ReplayName    string          `json:"replayName,omitempty"`
+	CorrelationID string          `json:"correlationId,omitempty"`
+	EventName     string          `json:"eventName,omitempty"`
+	PersonID      string          `json:"personId,omitempty"`
+	Detail        json.RawMessage `json:"detail"`
+}
+
+// auditRecord summarizes an event for the log, including the correlation ID the
+// stream lambda copied into person events and, for those, the event name and person
+func auditRecord(event eventEnvelope) AuditRecord {
+	// Other details decode partially; only the fields they share are used
+	// CloudEvents are logged by their data, so audit records keep one shape during the migration
+	event.Detail = personevents.UnwrapCloudEvent(event.Detail)
+	var detail models.PersonChangedEvent
+	_ = json.Unmarshal(event.Detail, &detail)
+
+	record := AuditRecord{
+		ID:            event.ID,
+		Source:        event.Source,
+		DetailType:    event.DetailType,
+		Time:          event.Time.UTC().Format(time.RFC3339),
+		ReplayName:    event.ReplayName,
+		CorrelationID: detail.CorrelationID,
+		EventName:     detail.EventName,
+		Detail:        event.Detail,
+	}
+	if person, err := detail.Person(); err == nil {
+		record.PersonID = person.PersonID
+	}
+	return record
+}
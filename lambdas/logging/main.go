@@ -2,21 +2,149 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/consumer"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/slack"
+	"aws-lambda-go/internal/tracing"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func handler(ctx context.Context, event events.CloudWatchEvent) error {
-	fmt.Printf("Received event: %s\n", event.Detail)
+var settings, settingsErr = config.LoadLogging()
+
+// processEvent handles one event at most once when EVENT_IDEMPOTENCY_TABLE_NAME is set; the
+// store is created in main
+var processEvent consumer.Handler[eventEnvelope, struct{}]
+
+// audit records every person change in AUDIT_TABLE_NAME; it is created in main
+var audit *auditTrail
 
-	// Log the DynamoDB Stream event
-	fmt.Println("Logging DynamoDB stream event...")
+// opsAlerts forwards CloudWatch alarms (e.g. DLQ growth) to the ops channel
+var opsAlerts = slack.New(settings.SlackWebhookURL, settings.Environment, "logging")
+
+// AlarmStateChange is the detail of a "CloudWatch Alarm State Change" event
+type AlarmStateChange struct {
+	AlarmName string `json:"alarmName"`
+	State     struct {
+		Value  string `json:"value"`
+		Reason string `json:"reason"`
+	} `json:"state"`
+	PreviousState struct {
+		Value string `json:"value"`
+	} `json:"previousState"`
+}
+
+// handleAlarm posts alarm transitions; leaving ALARM is reported as a recovery
+func handleAlarm(ctx context.Context, event events.CloudWatchEvent) error {
+	var change AlarmStateChange
+	if err := json.Unmarshal(event.Detail, &change); err != nil {
+		return fmt.Errorf("invalid alarm state change: %w", err)
+	}
+
+	severity := slack.SeverityCritical
+	if change.State.Value != "ALARM" {
+		if change.PreviousState.Value != "ALARM" {
+			return nil
+		}
+		severity = slack.SeverityInfo
+	}
+
+	return opsAlerts.Notify(ctx, slack.Alert{
+		Title:    fmt.Sprintf("%s is %s", change.AlarmName, change.State.Value),
+		Text:     change.State.Reason,
+		Severity: severity,
+		Fields:   map[string]string{"previousState": change.PreviousState.Value, "region": event.Region},
+	})
+}
 
+// eventKey identifies a delivery of an event; a replayed event is logged again under its replay
+func eventKey(event eventEnvelope) string {
+	if event.ReplayName != "" {
+		return event.ID + "/" + event.ReplayName
+	}
+	return event.ID
+}
+
+// handleEvent processes a single EventBridge event
+func handleEvent(ctx context.Context, event eventEnvelope) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "handle "+event.DetailType,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("event.id", event.ID), attribute.String("event.source", event.Source)),
+	)
+	defer func() {
+		tracing.End(span, err)
+		metrics.Emit(map[string]string{"DetailType": event.DetailType, "Outcome": metrics.ErrorOutcome(err)}, nil, metrics.Count("EventsProcessed", 1))
+	}()
+
+	if event.DetailType == "CloudWatch Alarm State Change" {
+		return handleAlarm(ctx, event.CloudWatchEvent)
+	}
+
+	// Log the DynamoDB Stream event as one audit record per event
+	record := auditRecord(event)
+	ctx = logger.WithCorrelationID(ctx, record.CorrelationID)
+	logger.FromContext(ctx).Info("Audit record", "audit", record)
+	if audit.enabled() {
+		return audit.record(ctx, event)
+	}
 	return nil
 }
 
+func handler(ctx context.Context, payload json.RawMessage) (struct{}, error) {
+	batch, err := debatch(payload)
+	if err != nil {
+		// A payload that cannot be parsed never will be
+		return struct{}{}, errclass.Retry(ctx, errclass.Mark(errclass.Permanent, err), "Failed to read events")
+	}
+	logger.FromContext(ctx).Info("Received events", "count", len(batch))
+
+	for _, event := range batch {
+		_, err := processEvent(ctx, event)
+		if err := errclass.Retry(ctx, err, "Failed to handle event", "eventId", event.ID); err != nil {
+			return struct{}{}, err
+		}
+	}
+	return struct{}{}, nil
+}
+
 func main() {
-	lambda.Start(handler)
+	config.Check(settingsErr)
+	logger.Init("logging")
+	metrics.Init("logging")
+	if err := tracing.Init(context.Background(), "logging"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+
+	var idempotency *consumer.IdempotencyStore
+	if settings.EventIdempotencyTableName != "" || settings.AuditTableName != "" {
+		cfg, err := awsconfig.LoadDefaultConfig(context.Background(), settings.AWSOptions()...)
+		if err != nil {
+			log.Fatalf("unable to load SDK config, %v", err)
+		}
+		tracing.InstrumentAWS(&cfg)
+		dynamo := ddbclient.New(cfg, settings.DynamoDB)
+		if settings.EventIdempotencyTableName != "" {
+			idempotency = consumer.NewIdempotencyStore(dynamo, settings.EventIdempotencyTableName,
+				time.Duration(settings.EventIdempotencyTTLHours)*time.Hour)
+		}
+		audit = &auditTrail{tableName: settings.AuditTableName, dynamo: dynamo}
+	}
+	processEvent = consumer.Wrap(func(ctx context.Context, event eventEnvelope) (struct{}, error) {
+		return struct{}{}, handleEvent(ctx, event)
+	}, consumer.Idempotent[eventEnvelope, struct{}](idempotency, eventKey))
+	lambda.Start(consumer.Invocation(handler))
 }
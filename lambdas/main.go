@@ -3,44 +3,93 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"aws-lambda-go/internal/accessaudit"
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/erasure"
+	"aws-lambda-go/internal/fieldcrypt"
+	"aws-lambda-go/internal/legalhold"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/internal/searchindex"
+	"aws-lambda-go/internal/tracing"
+	"aws-lambda-go/internal/validation"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/google/uuid"
 )
 
+var settings, settingsErr = config.LoadAPI()
+
 var (
 	tableName string
 	svc       *dynamodb.Client
+	s3Client  *s3.Client
+	sqsClient *sqs.Client
+	// eventsClient publishes to and manages the person event bus
+	eventsClient *eventbridge.Client
+	// logsClient reads a person's audit records from the Logging Lambda's log group
+	logsClient *cloudwatchlogs.Client
+	// fieldEncryptor encrypts PII attributes before they are written and decrypts them on read
+	fieldEncryptor *fieldcrypt.Encryptor
+	// identityHasher stores keyed hashes of contact details next to them, for analytics joins
+	identityHasher *fieldcrypt.Hasher
+	// searchIndex answers GET /persons/search when OPENSEARCH_ENDPOINT is set
+	searchIndex *searchindex.Client
 )
 
 func init() {
-	tableName = os.Getenv("TABLE_NAME") // TableName is set via Lambda environment variable
+	logger.Init("http")
+	tableName = settings.TableName
 
 	// Load AWS configuration
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
 	if err != nil {
 		log.Fatalf("unable to load SDK config, %v", err)
 	}
+	if err := tracing.Init(context.TODO(), "http"); err != nil {
+		log.Printf("Tracing disabled: %v", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	metrics.Init("http")
+	metrics.InstrumentDynamoDB(&cfg)
 
-	// Create DynamoDB client
-	svc = dynamodb.NewFromConfig(cfg)
-}
+	// Create DynamoDB client, with the retries, deadlines and circuit breaker from DYNAMODB_* (see ddbclient)
+	svc = ddbclient.New(cfg, settings.DynamoDB)
+
+	// Create S3 client (debug captures and notification templates)
+	s3Client = s3.NewFromConfig(cfg)
+	// SQS hands export and anonymization jobs to their lambdas
+	sqsClient = sqs.NewFromConfig(cfg)
+	eventsClient = eventbridge.NewFromConfig(cfg)
+	logsClient = cloudwatchlogs.NewFromConfig(cfg)
 
-// Person represents the data model for a person
-type Person struct {
-	FirstName   string `json:"firstName"`
-	LastName    string `json:"lastName"`
-	Address     string `json:"address"`
-	PhoneNumber string `json:"phoneNumber"`
+	fieldEncryptor = fieldcrypt.New(cfg, settings.PII.KMSKeyID, settings.PII.Fields)
+	identityHasher = fieldcrypt.NewHasher(cfg, settings.IdentityHashKMSKeyID)
+	searchIndex = searchindex.New(cfg, settings.OpenSearchEndpoint)
+	accessAuditor = accessaudit.New(svc, settings.AccessAuditTableName)
+	legalHoldChecker = legalhold.New(svc, legalHoldsTableName)
+	eraser = erasure.New(svc, eventsClient, notificationsTableName, eventBusName)
 }
 
 // ResponseBody defines the structure of the response sent back to the client
@@ -48,25 +97,93 @@ type ResponseBody struct {
 	PersonID string `json:"personId"`
 }
 
+// headerValue returns a request header by name, ignoring case
+func headerValue(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// numberAttribute reads a numeric attribute, returning 0 when absent
+func numberAttribute(item map[string]types.AttributeValue, name string) int64 {
+	v, ok := item[name].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(v.Value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// jsonResponse marshals a body into a JSON response
+func jsonResponse(ctx context.Context, request events.APIGatewayProxyRequest, statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal response body", err), nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(bodyJSON),
+	}, nil
+}
+
 func handlePost(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	// Parse the request body
-	var person Person
-	err := json.Unmarshal([]byte(request.Body), &person)
+	person, addressParts, err := decodePerson(ctx, request.Body)
 	if err != nil {
-		log.Printf("Failed to parse request body: %v", err)
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Invalid input for POST"}, nil
+		logger.FromContext(ctx).Warn("Failed to parse request body", "error", err)
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid input for POST"), nil
+	}
+	if errs := validation.Validate(person); len(errs) > 0 {
+		return invalidPersonResponse(request, errs), nil
+	}
+	if person.TenantID, err = writeTenant(ctx, request); err != nil {
+		return errorResponse(request, http.StatusForbidden, errCodeForbidden, err.Error()), nil
 	}
 
 	// Generate a new UUID for the personId
 	personID := uuid.New().String()
 
-	// Map the Person struct and generated personId to DynamoDB attribute values
-	item := map[string]types.AttributeValue{
-		"personId":    &types.AttributeValueMemberS{Value: personID}, // Partition Key
-		"firstName":   &types.AttributeValueMemberS{Value: person.FirstName},
-		"phoneNumber": &types.AttributeValueMemberS{Value: person.PhoneNumber},
-		"lastName":    &types.AttributeValueMemberS{Value: person.LastName},
-		"address":     &types.AttributeValueMemberS{Value: person.Address},
+	// Replayed requests with the same Idempotency-Key return the originally created person
+	idempotencyKey := headerValue(request, "Idempotency-Key")
+	if idempotencyKey != "" && idempotencyTableName != "" {
+		original, err := claimIdempotencyKey(ctx, idempotencyKey, personID, request.Body)
+		if errors.Is(err, errIdempotencyKeyReused) {
+			return errorResponse(request, http.StatusUnprocessableEntity, errCodeIdempotencyKeyReused, "Idempotency-Key was already used with a different request body"), nil
+		}
+		if err != nil {
+			return internalErrorResponse(ctx, request, "claim idempotency key", err), nil
+		}
+		// The original request has not inserted its person yet, and may still fail
+		if original != nil && original.Pending {
+			return errorResponse(request, http.StatusConflict, errCodeConflict, "A request with this Idempotency-Key is still in progress"), nil
+		}
+		if original != nil {
+			logger.FromContext(ctx).Info("Replaying POST for Idempotency-Key", "personId", original.PersonID)
+			if apiVersion(ctx) == apiV2 {
+				return personWritten(ctx, request, "", original.PersonID, 0, map[string]string{"Idempotent-Replayed": "true"})
+			}
+			responseJSON, err := json.Marshal(ResponseBody{PersonID: original.PersonID})
+			if err != nil {
+				return internalErrorResponse(ctx, request, "marshal response body", err), nil
+			}
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusOK,
+				Headers:    map[string]string{"Idempotent-Replayed": "true"},
+				Body:       string(responseJSON),
+			}, nil
+		}
+	}
+
+	item, err := newPersonItem(ctx, personID, person, addressParts)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "encrypt item", err), nil
 	}
 
 	// Put the item into DynamoDB
@@ -75,8 +192,18 @@ func handlePost(ctx context.Context, request events.APIGatewayProxyRequest) (eve
 		Item:      item,
 	})
 	if err != nil {
-		log.Printf("Failed to insert item into DynamoDB: %v", err)
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: fmt.Sprintf("Failed to insert item: %v", err)}, nil
+		if idempotencyKey != "" && idempotencyTableName != "" {
+			if releaseErr := releaseIdempotencyKey(ctx, idempotencyKey, personID); releaseErr != nil {
+				logger.FromContext(ctx).Error("Failed to release idempotency key", "error", releaseErr)
+			}
+		}
+		return internalErrorResponse(ctx, request, "insert item into DynamoDB", err), nil
+	}
+	if idempotencyKey != "" && idempotencyTableName != "" {
+		// Replays find the person anyway, so a failure here is not the client's
+		if err := completeIdempotencyKey(ctx, idempotencyKey, personID); err != nil {
+			logger.FromContext(ctx).Error("Failed to complete idempotency key", "error", err)
+		}
 	}
 
 	// Prepare the response body
@@ -86,148 +213,376 @@ func handlePost(ctx context.Context, request events.APIGatewayProxyRequest) (eve
 
 	responseJSON, err := json.Marshal(responseBody)
 	if err != nil {
-		log.Printf("Failed to marshal response body: %v", err)
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error generating response"}, nil
+		return internalErrorResponse(ctx, request, "marshal response body", err), nil
 	}
 
 	// Return success response with the generated personId
-	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusOK,
-		Body:       string(responseJSON),
-	}, nil
+	return personWritten(ctx, request, string(responseJSON), personID, 1, nil)
+}
+
+// newPersonItem builds the DynamoDB item of a newly created person, with its PII attributes encrypted
+func newPersonItem(ctx context.Context, personID string, person models.Person, addressParts string) (map[string]types.AttributeValue, error) {
+	// Audit timestamps are server-managed; any values in the request body are ignored
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	// Map the Person struct and generated personId to DynamoDB attribute values
+	item := map[string]types.AttributeValue{
+		"personId":    &types.AttributeValueMemberS{Value: personID}, // Partition Key
+		"firstName":   &types.AttributeValueMemberS{Value: person.FirstName},
+		"phoneNumber": &types.AttributeValueMemberS{Value: person.PhoneNumber},
+		"lastName":    &types.AttributeValueMemberS{Value: person.LastName},
+		"address":     &types.AttributeValueMemberS{Value: person.Address},
+		"version":     &types.AttributeValueMemberN{Value: "1"},
+		"createdAt":   &types.AttributeValueMemberS{Value: now},
+		"updatedAt":   &types.AttributeValueMemberS{Value: now},
+	}
+	if person.Email != "" {
+		item["email"] = &types.AttributeValueMemberS{Value: person.Email}
+	}
+	if person.NotificationChannel != "" {
+		item["notificationChannel"] = &types.AttributeValueMemberS{Value: person.NotificationChannel}
+	}
+	if person.Locale != "" {
+		item["locale"] = &types.AttributeValueMemberS{Value: person.Locale}
+	}
+	if addressParts != "" {
+		item["addressParts"] = &types.AttributeValueMemberS{Value: addressParts}
+	}
+	if person.TenantID != "" {
+		item["tenantId"] = &types.AttributeValueMemberS{Value: person.TenantID}
+	}
+	if caller := callerFromContext(ctx); caller != nil {
+		item["ownerId"] = &types.AttributeValueMemberS{Value: caller.Subject}
+	}
+	// Normalized lookup keys for POST /persons/match
+	for attribute, value := range matchKeys(person) {
+		if value != "" {
+			item[attribute] = &types.AttributeValueMemberS{Value: value}
+		}
+	}
+	// Stored with the item so the stream lambda can carry it into downstream events
+	if correlationID := logger.CorrelationID(ctx); correlationID != "" {
+		item["correlationId"] = &types.AttributeValueMemberS{Value: correlationID}
+	}
+	// Likewise the trace header, as DynamoDB streams do not propagate trace context
+	if traceHeader := tracing.Header(ctx); traceHeader != "" {
+		item["traceHeader"] = &types.AttributeValueMemberS{Value: traceHeader}
+	}
+	// And who made the change, for the audit trail
+	if actor := actorFromContext(ctx); actor != "" {
+		item["updatedBy"] = &types.AttributeValueMemberS{Value: actor}
+	}
+
+	// Hashed before encryption, which would hide the phone number
+	if err := identityHasher.HashItem(ctx, item); err != nil {
+		return nil, err
+	}
+	if err := fieldEncryptor.EncryptItem(ctx, personID, item); err != nil {
+		return nil, err
+	}
+	return item, nil
 }
 
-func handlePut(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func handlePut(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	personId := request.PathParameters["personId"]
 	if personId == "" {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Missing personId"}, nil
+		return errorResponse(request, http.StatusBadRequest, errCodeMissingParameter, "Missing personId"), nil
 	}
 
-	var person Person
-	if err := json.Unmarshal([]byte(request.Body), &person); err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Invalid input"}, nil
+	person, addressParts, err := decodePerson(ctx, request.Body)
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to parse request body", "error", err)
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid input"), nil
+	}
+	if errs := validation.Validate(person); len(errs) > 0 {
+		return invalidPersonResponse(request, errs), nil
 	}
 
-	updateExpression := "SET firstName = :firstName, phoneNumber = :phoneNumber, lastName = :lastName, address = :address"
-	expressionAttributeValues := map[string]types.AttributeValue{
-		":firstName":   &types.AttributeValueMemberS{Value: person.FirstName},
-		":phoneNumber": &types.AttributeValueMemberS{Value: person.PhoneNumber},
-		":lastName":    &types.AttributeValueMemberS{Value: person.LastName},
-		":address":     &types.AttributeValueMemberS{Value: person.Address},
+	expectedVersion, checkVersion, err := parseIfMatch(headerValue(request, "If-Match"))
+	if err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid If-Match header"), nil
 	}
 
-	_, err := svc.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
-		TableName:                 aws.String(tableName),
-		Key:                       map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personId}},
-		UpdateExpression:          aws.String(updateExpression),
-		ExpressionAttributeValues: expressionAttributeValues,
+	fields := newPersonUpdate(person, addressParts)
+	item, err := attributevalue.MarshalMap(fields)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal item", err), nil
+	}
+	if err := identityHasher.HashItem(ctx, item); err != nil {
+		return internalErrorResponse(ctx, request, "hash contact details", err), nil
+	}
+	if err := keepStoredPII(ctx, personId, item); err != nil {
+		return internalErrorResponse(ctx, request, "read stored PII", err), nil
+	}
+	if err := fieldEncryptor.EncryptItem(ctx, personId, item); err != nil {
+		return internalErrorResponse(ctx, request, "encrypt item", err), nil
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	update := setAttributes(expression.UpdateBuilder{}, fields, item)
+	update = touch(ctx, update, now).
+		Set(expression.Name("createdAt"), expression.IfNotExists(expression.Name("createdAt"), expression.Value(now)))
+	// Persons created through PUT belong to the caller; the owner of existing persons never changes
+	if caller := callerFromContext(ctx); caller != nil {
+		update = update.Set(expression.Name("ownerId"), expression.IfNotExists(expression.Name("ownerId"), expression.Value(caller.Subject)))
+	}
+
+	// With If-Match, only update when the stored version is the one the client last read
+	// Soft-deleted persons must be restored before they can be updated
+	condition := ddbexpr.NotDeleted()
+	if checkVersion {
+		versionMatches := expression.Name("version").Equal(expression.Value(expectedVersion))
+		if expectedVersion == 0 {
+			versionMatches = expression.AttributeNotExists(expression.Name("version")).Or(versionMatches)
+		}
+		condition = condition.And(versionMatches)
+	}
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+	if err != nil {
+		return internalErrorResponse(ctx, request, "build update", err), nil
+	}
+
+	result, err := svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(tableName),
+		Key:                                 map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personId}},
+		UpdateExpression:                    expr.Update(),
+		ConditionExpression:                 expr.Condition(),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		ReturnValues:                        types.ReturnValueUpdatedNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		if isDeleted(conditionErr.Item) {
+			return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
+		}
+		return errorResponse(request, http.StatusPreconditionFailed, errCodePreconditionFailed, "The person was modified since it was last read"), nil
+	}
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+		return internalErrorResponse(ctx, request, "update item", err), nil
 	}
 
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: "Item updated successfully"}, nil
+	version := versionOf(result.Attributes)
+	return personWritten(ctx, request, "Item updated successfully", personId, version, map[string]string{"ETag": etag(version)})
 }
 
 func handleGet(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	// Using SCAN for development purpose.
-	// GET all call can be optimised using pagination(by reading lastEvaluatedKey flag from ddb)
-	// https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/Query.Pagination.html
+	// The list follows the Scan pages until the deadline approaches, see listPersons
 	personId := request.PathParameters["personId"]
 
+	// The clean JSON format is soft-launched; everyone else keeps the raw AttributeValue output.
+	// v2 always answers with clean JSON, in an Envelope as far as that is rolled out.
+	v2 := apiVersion(ctx) == apiV2
+	cleanJSON := v2 || rolloutEnabled(featureCleanJSONGet, rolloutKey(ctx, request))
+	switch {
+	case v2:
+	case cleanJSON:
+		useFormat(ctx, formatCleanJSON)
+	default:
+		useFormat(ctx, formatLegacy)
+		useDeprecated(ctx, formatLegacyGet)
+	}
+
+	// Soft-deleted persons are hidden unless an admin asks for them
+	withDeleted, allowed := includeDeleted(ctx, request)
+	if !allowed {
+		return errorResponse(request, http.StatusForbidden, errCodeForbidden, "Only admins can include deleted persons"), nil
+	}
+
 	if personId != "" {
-		// Retrieve a single item by personId
+		if asOf, ok := request.QueryStringParameters["asOf"]; ok {
+			// A past state is part of the person's history, so it takes person:ReadHistory too
+			return authorize(actionReadHistory)(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+				return handleGetAsOf(ctx, request, asOf, withDeleted, cleanJSON)
+			})(ctx, request)
+		}
+
+		// Retrieve a single item by personId. Reads are eventually consistent unless the caller
+		// asks for ?consistent=true, e.g. to read back a write it just made.
+		consistent := request.QueryStringParameters["consistent"] == "true"
 		result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
 			TableName: aws.String(tableName),
 			Key: map[string]types.AttributeValue{
 				"personId": &types.AttributeValueMemberS{Value: personId},
 			},
+			ConsistentRead: aws.Bool(consistent),
 		})
 		if err != nil {
-			return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+			return internalErrorResponse(ctx, request, "get item", err), nil
 		}
-		if result.Item == nil {
-			return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Item not found"}, nil
+		if result.Item == nil || (isDeleted(result.Item) && !withDeleted) {
+			return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
 		}
+		return personResponse(ctx, request, personId, result.Item, cleanJSON)
+	}
 
-		itemJSON, err := json.Marshal(result.Item)
+	// Retrieve all items if personId is not provided
+	// Callers other than admins only list the persons they own
+	scanInput := &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+	var filters []expression.ConditionBuilder
+	if owner := ownerScope(ctx); owner != "" {
+		filters = append(filters, expression.Name("ownerId").Equal(expression.Value(owner)))
+	}
+	if !withDeleted {
+		filters = append(filters, ddbexpr.NotDeleted())
+	}
+	if filter, ok := ddbexpr.All(filters...); ok {
+		expr, err := expression.NewBuilder().WithFilter(filter).Build()
 		if err != nil {
-			return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+			return internalErrorResponse(ctx, request, "build list filter", err), nil
 		}
+		scanInput.FilterExpression = expr.Filter()
+		scanInput.ExpressionAttributeNames = expr.Names()
+		scanInput.ExpressionAttributeValues = expr.Values()
+	}
+	// Unscoped lists of large tables are scanned in parallel segments when configured
+	segments := 1
+	if ownerScope(ctx) == "" {
+		segments = listScanSegments
+	}
+	return listPersons(ctx, request, scanInput, segments, cleanJSON, v2)
+}
 
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(itemJSON)}, nil
+// decryptItems decrypts the PII attributes of person items
+func decryptItems(ctx context.Context, items []map[string]types.AttributeValue) error {
+	for _, item := range items {
+		personID, _ := item["personId"].(*types.AttributeValueMemberS)
+		if personID == nil {
+			continue
+		}
+		if err := fieldEncryptor.DecryptItem(ctx, personID.Value, item); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Retrieve all items if personId is not provided
-	result, err := svc.Scan(ctx, &dynamodb.ScanInput{
-		TableName: aws.String(tableName),
-	})
-	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+// personResponse answers with a single person item, decrypted and filtered for the caller, in
+// the format the request asked for: the v2 envelope, clean JSON or the legacy raw format. The
+// ETag carries the item's version.
+func personResponse(ctx context.Context, request events.APIGatewayProxyRequest, personID string, item map[string]types.AttributeValue, cleanJSON bool) (events.APIGatewayProxyResponse, error) {
+	if err := fieldEncryptor.DecryptItem(ctx, personID, item); err != nil {
+		return internalErrorResponse(ctx, request, "decrypt item", err), nil
+	}
+	// The ETag is taken before filtering, which may remove the version
+	itemETag := etag(versionOf(item))
+	responseFilter(ctx).apply(item)
+	if apiVersion(ctx) == apiV2 {
+		person, err := personV2FromItem(item)
+		if err != nil {
+			return internalErrorResponse(ctx, request, "convert item", err), nil
+		}
+		return envelopeResponse(ctx, request, http.StatusOK, person, map[string]string{"ETag": itemETag})
 	}
 
-	itemsJSON, err := json.Marshal(result.Items)
+	itemJSON, err := marshalItem(item, cleanJSON)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+		return internalErrorResponse(ctx, request, "marshal item", err), nil
 	}
 
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(itemsJSON)}, nil
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"ETag": itemETag},
+		Body:       string(itemJSON),
+	}, nil
 }
 
-func handleDelete(personId string, tableName string) events.APIGatewayProxyResponse {
-	// Load the AWS SDK configuration
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-1"))
+// marshalItem serializes a DynamoDB item either as plain person JSON or in the legacy raw AttributeValue format
+func marshalItem(item map[string]types.AttributeValue, cleanJSON bool) ([]byte, error) {
+	if !cleanJSON {
+		return json.Marshal(item)
+	}
+	person, err := models.UnmarshalPerson(item)
 	if err != nil {
-		log.Printf("unable to load SDK config, %v", err)
-		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
-			Body:       fmt.Sprintf("Failed to load AWS config: %v", err),
-		}
+		return nil, err
 	}
-	// Create a DynamoDB client
-	svc := dynamodb.NewFromConfig(cfg)
-	// Define the input for the delete operation
-	input := &dynamodb.DeleteItemInput{
-		TableName: aws.String(tableName),
-		Key: map[string]types.AttributeValue{
-			"personId": &types.AttributeValueMemberS{
-				Value: personId,
-			},
-		},
+	return json.Marshal(person)
+}
+
+func handleDelete(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	personId := request.PathParameters["personId"]
+	if personId == "" {
+		return errorResponse(request, http.StatusBadRequest, errCodeMissingParameter, "Missing personId"), nil
 	}
-	// Perform the delete operation
-	_, err = svc.DeleteItem(context.TODO(), input)
+
+	// Persons under legal hold must be kept
+	held, err := legalHoldChecker.Active(ctx, personId)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
-			Body:       fmt.Sprintf("Failed to delete item: %v", err),
-		}
+		return internalErrorResponse(ctx, request, "check legal hold", err), nil
 	}
-	return events.APIGatewayProxyResponse{
-		StatusCode: 200,
-		Body:       "Person deleted successfully",
+	if held {
+		return errorResponse(request, http.StatusConflict, errCodeLegalHold, "The person is under legal hold and cannot be deleted"), nil
+	}
+
+	// Persons are only marked as deleted, so they can be restored within the restore window
+	if err := softDelete(ctx, personId); err != nil {
+		return internalErrorResponse(ctx, request, "delete item", err), nil
 	}
+	return personWritten(ctx, request, "Person deleted successfully", personId, 0, nil)
 }
 
+// newAPIRouter registers every API route. Admin routes additionally require an IAM caller.
+func newAPIRouter() *router {
+	r := newRouter()
+	r.use(tracingMiddleware, loggingMiddleware, actorMiddleware, metricsMiddleware, captureMiddleware, recoveryMiddleware, regionMiddleware, maintenanceMiddleware, rateLimitMiddleware, deprecationMiddleware)
+
+	// Person routes are served unversioned (as v1), under /v1 and under /v2
+	registerPersonRoutes(r, "", apiV1)
+	registerPersonRoutes(r, "/v1", apiV1)
+	registerPersonRoutes(r, "/v2", apiV2)
+
+	r.handle("GET", "/admin/diagnostics", handleDiagnostics, requireIAMCaller)
+	r.handle("GET", "/admin/pipeline/status", handlePipelineStatus, requireIAMCaller)
+	r.handle("POST", "/admin/events/emit", handleEmitEvents, requireIAMCaller)
+	r.handle("GET", "/admin/templates/{templateName}", templateRoute(handleGetTemplate), requireIAMCaller)
+	r.handle("PUT", "/admin/templates/{templateName}", templateRoute(handleUploadTemplate), requireIAMCaller)
+	r.handle("POST", "/admin/templates/{templateName}/activate", templateRoute(handleActivateTemplate), requireIAMCaller)
+	r.handle("POST", "/admin/legal-holds", handleCreateLegalHold, requireIAMCaller)
+	r.handle("POST", "/admin/anonymize", handleCreateAnonymization, requireIAMCaller)
+	r.handle("GET", "/admin/anonymize/{jobId}", handleGetAnonymization, requireIAMCaller)
+	r.handle("POST", "/admin/replays", handleCreateReplay, requireIAMCaller)
+	r.handle("GET", "/admin/replays/{replayName}", handleGetReplay, requireIAMCaller)
+	r.handle("GET", "/imports/{importId}", handleGetImport, requireIAMCaller)
+	r.handle("POST", "/exports", handleCreateExport, requireIAMCaller)
+	r.handle("GET", "/exports/{exportId}", handleGetExport, requireIAMCaller)
+	r.handle("GET", "/tenants/{tenantId}/stats", handleTenantStats, authMiddleware, requireRole)
+	return r
+}
+
+// registerPersonRoutes registers the person routes of one API version under a path prefix.
+// Person routes are authenticated with Cognito and authorized per action; single-person routes
+// are scoped to the owner.
+func registerPersonRoutes(r *router, prefix string, version string) {
+	versioned := withAPIVersion(version)
+	r.handle("GET", prefix+"/persons", handleGet, versioned, authMiddleware, authorize(actionList))
+	r.handle("POST", prefix+"/persons", handlePost, versioned, authMiddleware, authorize(actionCreate))
+	r.handle("POST", prefix+"/persons/match", handleMatch, versioned, authMiddleware, authorize(actionMatch))
+	r.handle("POST", prefix+"/persons/validate", handleValidate, versioned, authMiddleware, authorize(actionValidate))
+	r.handle("POST", prefix+"/persons/batch", handleBatchCreate, versioned, authMiddleware, authorize(actionCreate))
+	r.handle("GET", prefix+"/persons/search", handleSearch, versioned, authMiddleware, authorize(actionSearch))
+	r.handle("GET", prefix+"/persons/{personId}", handleGet, versioned, authMiddleware, authorize(actionRead), requireOwner)
+	r.handle("PUT", prefix+"/persons/{personId}", handlePut, versioned, authMiddleware, authorize(actionUpdate), requireOwner)
+	r.handle("DELETE", prefix+"/persons/{personId}", handleDelete, versioned, authMiddleware, authorize(actionDelete), requireOwner)
+	r.handle("GET", prefix+"/persons/{personId}/notifications", handleListNotifications, versioned, authMiddleware, authorize(actionReadNotifications), requireOwner)
+	r.handle("GET", prefix+"/persons/{personId}/timeline", handleTimeline, versioned, authMiddleware, authorize(actionReadTimeline), requireOwner)
+	r.handle("GET", prefix+"/persons/{personId}/history", handleHistory, versioned, authMiddleware, authorize(actionReadHistory), requireOwner)
+	r.handle("GET", prefix+"/persons/{personId}/export", handleExportPerson, versioned, authMiddleware, authorize(actionExport), requireOwner)
+	r.handle("PUT", prefix+"/persons/{personId}/preferences", handlePutPreferences, versioned, authMiddleware, authorize(actionUpdatePreferences), requireOwner)
+	r.handle("POST", prefix+"/persons/{personId}/restore", handleRestore, versioned, authMiddleware, authorize(actionRestore), requireOwner)
+	r.handle("DELETE", prefix+"/persons/{personId}/erase", handleErasePerson, versioned, authMiddleware, authorize(actionErase), requireOwner)
+}
+
+var apiRouter = newAPIRouter()
+
 func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	switch request.HTTPMethod {
-	case "POST":
-		return handlePost(ctx, request)
-	case "PUT":
-		return handlePut(request)
-	case "GET":
-		return handleGet(ctx, request)
-	case "DELETE":
-		personId := request.PathParameters["personId"]
-		return handleDelete(personId, tableName), nil
-	default:
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusMethodNotAllowed,
-			Body:       "Method not allowed",
-		}, nil
-	}
+	return apiRouter.serve(ctx, request)
 }
 
 func main() {
-	lambda.Start(handler)
+	config.Check(settingsErr)
+	logSelfCheck()
+	lambda.Start(dispatch)
 }
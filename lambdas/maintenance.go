@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Maintenance mode (MAINTENANCE_MODE=true) makes the API read-only during migrations and
+// regional failovers. Requests that would change data are rejected with 503 and Retry-After
+// (MAINTENANCE_RETRY_AFTER_SECONDS); reads keep working.
+var (
+	maintenanceMode       = settings.MaintenanceMode
+	maintenanceMessage    = settings.MaintenanceMessage
+	maintenanceRetryAfter = settings.MaintenanceRetryAfter
+)
+
+// errCodeMaintenance is returned with 503 for writes while maintenance mode is on
+const errCodeMaintenance = "MAINTENANCE"
+
+// readOnlyRoutes are routes that use POST to carry a query but change nothing, so they stay
+// available during maintenance
+var readOnlyRoutes = map[string]bool{
+	"POST /persons/match":    true,
+	"POST /persons/validate": true,
+}
+
+// mutatingRequest reports whether a request may change data. Routes are compared without
+// their version prefix.
+func mutatingRequest(request events.APIGatewayProxyRequest) bool {
+	switch request.HTTPMethod {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	resource := request.Resource
+	for _, version := range []string{apiV1, apiV2} {
+		resource = strings.TrimPrefix(resource, "/"+version+"/")
+	}
+	if !strings.HasPrefix(resource, "/") {
+		resource = "/" + resource
+	}
+	return !readOnlyRoutes[request.HTTPMethod+" "+resource]
+}
+
+// maintenanceMiddleware rejects mutating requests while maintenance mode is on
+func maintenanceMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if !maintenanceMode || !mutatingRequest(request) {
+			return next(ctx, request)
+		}
+
+		retryAfter := int(maintenanceRetryAfter.Seconds())
+		message := maintenanceMessage
+		if message == "" {
+			message = "The service is in read-only maintenance"
+		}
+		message = fmt.Sprintf("%s. Reads keep working; retry %s requests after %d seconds", strings.TrimSuffix(message, "."), request.HTTPMethod, retryAfter)
+
+		logger.FromContext(ctx).Info("Rejected write during maintenance", "method", request.HTTPMethod, "route", request.Resource)
+		response := errorResponse(request, http.StatusServiceUnavailable, errCodeMaintenance, message)
+		response.Headers["Retry-After"] = strconv.Itoa(retryAfter)
+		return response, nil
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/models"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	defaultMatchLimit = 10
+	maxMatchLimit     = 50
+	// minFuzzyScore is the least average similarity of the compared fields for a fuzzy candidate
+	minFuzzyScore = 0.75
+	// exactMatchBoost makes index hits more relevant than every fuzzy-only candidate
+	exactMatchBoost = 1.0
+	// phoneMatchBoost is added when the phone number of a candidate matches exactly
+	phoneMatchBoost = 0.5
+)
+
+// Lookup attributes written alongside a person for duplicate detection. They are normalized
+// copies of email and lastName, and only present when the source field is not empty, as
+// DynamoDB does not allow empty index keys.
+const (
+	emailKeyAttribute    = "emailKey"
+	lastNameKeyAttribute = "lastNameKey"
+	emailKeyIndex        = "EmailKeyIndex"
+	lastNameKeyIndex     = "LastNameKeyIndex"
+)
+
+// MatchCandidate is a person that may be a duplicate of the submitted document. Score blends
+// the text relevance with how recently the person was updated (see matchRanking).
+type MatchCandidate struct {
+	Person    models.Person `json:"person"`
+	Score     float64       `json:"score"`
+	Relevance float64       `json:"relevance"`
+	Match     string        `json:"match"`
+	MatchedOn []string      `json:"matchedOn"`
+
+	updatedAt string
+}
+
+// ranking weighs the text relevance of a candidate against the recency of its last update
+type ranking struct {
+	relevanceWeight float64
+	recencyWeight   float64
+	// halfLife is the age at which the recency of an update has halved
+	halfLife time.Duration
+}
+
+// matchRanking is read from MATCH_RELEVANCE_WEIGHT, MATCH_RECENCY_WEIGHT and
+// MATCH_RECENCY_HALF_LIFE_DAYS; by default candidates are ranked by relevance alone
+var matchRanking = ranking{
+	relevanceWeight: settings.MatchRelevanceWeight,
+	recencyWeight:   settings.MatchRecencyWeight,
+	halfLife:        settings.MatchRecencyHalfLife,
+}
+
+// score is the weighted sum of a candidate's relevance and recency
+func (r ranking) score(relevance float64, updatedAt string, now time.Time) float64 {
+	return r.relevanceWeight*relevance + r.recencyWeight*r.recency(updatedAt, now)
+}
+
+// recency is 1 for a person updated just now and halves with every halfLife of age. Persons
+// without a valid updatedAt have a recency of 0.
+func (r ranking) recency(updatedAt string, now time.Time) float64 {
+	updated, err := time.Parse(time.RFC3339, updatedAt)
+	if err != nil {
+		return 0
+	}
+	age := max(now.Sub(updated), 0)
+	return math.Pow(0.5, float64(age)/float64(r.halfLife))
+}
+
+// rank sets the relevance and score of a candidate from the relevance it collected
+func (r ranking) rank(candidate *MatchCandidate, relevance float64, now time.Time) {
+	candidate.Relevance = relevance
+	candidate.Score = r.score(relevance, candidate.updatedAt, now)
+}
+
+// MatchResponse is the body of POST /persons/match, best candidates first
+type MatchResponse struct {
+	Candidates []MatchCandidate `json:"candidates"`
+}
+
+// normalizeKey lowercases a value and collapses whitespace, so lookups ignore formatting
+func normalizeKey(value string) string {
+	return strings.ToLower(strings.Join(strings.Fields(value), " "))
+}
+
+// matchKeys returns the lookup attributes for a person, keyed by attribute name.
+// Attributes whose source field is empty are returned with an empty value.
+func matchKeys(person models.Person) map[string]string {
+	return map[string]string{
+		emailKeyAttribute:    normalizeKey(person.Email),
+		lastNameKeyAttribute: normalizeKey(person.LastName),
+	}
+}
+
+// handleMatch looks for persons resembling a partial person document. Exact hits on the
+// email or last name index are more relevant than fuzzy hits from a scan of names and emails;
+// with a recency weight, recently updated persons move up.
+func handleMatch(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var probe models.Person
+	if err := json.Unmarshal([]byte(request.Body), &probe); err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid person document"), nil
+	}
+	if probe.FirstName == "" && probe.LastName == "" && probe.Email == "" {
+		return errorResponse(request, http.StatusBadRequest, errCodeMissingParameter, "At least one of firstName, lastName, or email is required"), nil
+	}
+
+	limit := defaultMatchLimit
+	if value := request.QueryStringParameters["limit"]; value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxMatchLimit {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "limit must be between 1 and 50"), nil
+		}
+		limit = parsed
+	}
+
+	owner := ownerScope(ctx)
+	start := time.Now()
+	candidates := map[string]*MatchCandidate{}
+
+	keys := matchKeys(probe)
+	exactLookups := []struct {
+		index, attribute, field string
+	}{
+		{emailKeyIndex, emailKeyAttribute, "email"},
+		{lastNameKeyIndex, lastNameKeyAttribute, "lastName"},
+	}
+	for _, lookup := range exactLookups {
+		if keys[lookup.attribute] == "" {
+			continue
+		}
+		ids, err := queryMatchIndex(ctx, lookup.index, lookup.attribute, keys[lookup.attribute], owner)
+		if err != nil {
+			return internalErrorResponse(ctx, request, "query "+lookup.index, err), nil
+		}
+		for _, id := range ids {
+			candidate := candidateFor(candidates, id)
+			if candidate.Match != "exact" {
+				candidate.Match = "exact"
+				candidate.Score += exactMatchBoost
+			}
+			candidate.MatchedOn = append(candidate.MatchedOn, lookup.field)
+		}
+	}
+
+	err := scanFuzzyMatches(ctx, probe, owner, candidates)
+	// Match scans across every owner are audited like unscoped lists
+	if owner == "" {
+		auditDataAccess(ctx, request, "match", matchAuditFilter(probe, limit), len(candidates), start, err)
+	}
+	if err != nil {
+		return internalErrorResponse(ctx, request, "scan for fuzzy matches", err), nil
+	}
+
+	// Until the full records are loaded, Score holds the collected relevance
+	now := time.Now()
+	ranked := make([]*MatchCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Match == "" {
+			continue
+		}
+		matchRanking.rank(candidate, candidate.Score, now)
+		ranked = append(ranked, candidate)
+	}
+	sortCandidates(ranked)
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	// Load the full records of the best candidates, which also gives the phone number to compare
+	response := MatchResponse{Candidates: []MatchCandidate{}}
+	filter := responseFilter(ctx)
+	for _, candidate := range ranked {
+		result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(tableName),
+			Key:       map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: candidate.Person.PersonID}},
+		})
+		if err != nil {
+			return internalErrorResponse(ctx, request, "get match candidate", err), nil
+		}
+		// Soft-deleted persons are not offered as candidates; the indexes do not know about deletion
+		if result.Item == nil || isDeleted(result.Item) {
+			continue
+		}
+		if err := fieldEncryptor.DecryptItem(ctx, candidate.Person.PersonID, result.Item); err != nil {
+			return internalErrorResponse(ctx, request, "decrypt match candidate", err), nil
+		}
+		stored, err := models.UnmarshalPerson(result.Item)
+		if err != nil {
+			return internalErrorResponse(ctx, request, "unmarshal match candidate", err), nil
+		}
+		relevance := candidate.Relevance
+		if probe.PhoneNumber != "" && digits(probe.PhoneNumber) == digits(stored.PhoneNumber) {
+			relevance += phoneMatchBoost
+			candidate.MatchedOn = append(candidate.MatchedOn, "phoneNumber")
+		}
+		candidate.updatedAt = stored.UpdatedAt
+		matchRanking.rank(candidate, relevance, now)
+		// Candidates are scored on the full record but only returned with the caller's fields
+		filter.apply(result.Item)
+		if candidate.Person, err = models.UnmarshalPerson(result.Item); err != nil {
+			return internalErrorResponse(ctx, request, "unmarshal match candidate", err), nil
+		}
+		response.Candidates = append(response.Candidates, *candidate)
+	}
+	sort.SliceStable(response.Candidates, func(i, j int) bool {
+		return response.Candidates[i].Score > response.Candidates[j].Score
+	})
+
+	return jsonResponse(ctx, request, http.StatusOK, response)
+}
+
+// matchAuditFilter names the probe fields a match searched by, without their values
+func matchAuditFilter(probe models.Person, limit int) map[string]string {
+	var fields []string
+	for field, value := range map[string]string{"firstName": probe.FirstName, "lastName": probe.LastName, "email": probe.Email, "phoneNumber": probe.PhoneNumber} {
+		if value != "" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return map[string]string{"fields": strings.Join(fields, ","), "limit": strconv.Itoa(limit)}
+}
+
+// candidateFor returns the candidate for a person, adding it when it is new
+func candidateFor(candidates map[string]*MatchCandidate, personID string) *MatchCandidate {
+	candidate, ok := candidates[personID]
+	if !ok {
+		candidate = &MatchCandidate{Person: models.Person{PersonID: personID}, MatchedOn: []string{}}
+		candidates[personID] = candidate
+	}
+	return candidate
+}
+
+// sortCandidates orders candidates by score, breaking ties by personId for stable output
+func sortCandidates(candidates []*MatchCandidate) {
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Person.PersonID < candidates[j].Person.PersonID
+	})
+}
+
+// queryMatchIndex returns the IDs of the persons whose lookup attribute equals value
+func queryMatchIndex(ctx context.Context, index string, attribute string, value string, owner string) ([]string, error) {
+	builder := expression.NewBuilder().WithKeyCondition(ddbexpr.KeyEquals(attribute, value))
+	if owner != "" {
+		builder = builder.WithFilter(expression.Name("ownerId").Equal(expression.Value(owner)))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		IndexName:                 aws.String(index),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+
+	var ids []string
+	paginator := dynamodb.NewQueryPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			if id, ok := item["personId"].(*types.AttributeValueMemberS); ok {
+				ids = append(ids, id.Value)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// scanFuzzyMatches scores every person by the similarity of their names and email to the
+// probe. Candidates scoring at least minFuzzyScore are added; exact hits get the score added
+// to their boost. Every candidate seen gets its updatedAt for ranking.
+func scanFuzzyMatches(ctx context.Context, probe models.Person, owner string, candidates map[string]*MatchCandidate) error {
+	filter := ddbexpr.NotDeleted()
+	if owner != "" {
+		filter = filter.And(expression.Name("ownerId").Equal(expression.Value(owner)))
+	}
+	expr, err := expression.NewBuilder().
+		WithProjection(expression.NamesList(expression.Name("personId"), expression.Name("firstName"), expression.Name("lastName"), expression.Name("email"), expression.Name("updatedAt"))).
+		WithFilter(filter).
+		Build()
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(tableName),
+		ProjectionExpression:      expr.Projection(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+
+	paginator := dynamodb.NewScanPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		persons, err := models.UnmarshalPersons(page.Items)
+		if err != nil {
+			return err
+		}
+		for _, person := range persons {
+			candidate := candidates[person.PersonID]
+			if score := fuzzyScore(probe, person); score >= minFuzzyScore {
+				candidate = candidateFor(candidates, person.PersonID)
+				candidate.Score += score
+				if candidate.Match == "" {
+					candidate.Match = "fuzzy"
+				}
+			}
+			if candidate != nil {
+				candidate.updatedAt = person.UpdatedAt
+			}
+		}
+	}
+	return nil
+}
+
+// fuzzyScore is the mean similarity of the fields set on the probe
+func fuzzyScore(probe models.Person, person models.Person) float64 {
+	pairs := [][2]string{
+		{probe.FirstName, person.FirstName},
+		{probe.LastName, person.LastName},
+		{probe.Email, person.Email},
+	}
+	total, compared := 0.0, 0
+	for _, pair := range pairs {
+		if pair[0] == "" {
+			continue
+		}
+		total += similarity(normalizeKey(pair[0]), normalizeKey(pair[1]))
+		compared++
+	}
+	if compared == 0 {
+		return 0
+	}
+	return total / float64(compared)
+}
+
+// similarity is 1 minus the edit distance relative to the longer string
+func similarity(a string, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein counts the single-rune insertions, deletions and substitutions between a and b
+func levenshtein(a []rune, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// digits keeps only the digits of a phone number, so formatting does not matter
+func digits(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, value)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingMiddleware wraps the request in a server span. It continues the caller's trace when
+// the request carries a W3C traceparent header, e.g. from pkg/personclient, and otherwise the
+// trace started by API Gateway (Lambda invocation context or X-Amzn-Trace-Id header). It
+// flushes the spans before the invocation returns, as the Lambda environment may be frozen
+// afterwards.
+func tracingMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		ctx = tracing.ExtractTraceParent(ctx, headerValue(request, tracing.TraceParentHeader), headerValue(request, tracing.TraceStateHeader))
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			ctx = tracing.ExtractLambda(ctx)
+		}
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			ctx = tracing.Extract(ctx, headerValue(request, tracing.TraceHeader))
+		}
+		ctx, span := tracing.Tracer().Start(ctx, request.HTTPMethod+" "+request.Resource,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.HTTPMethod),
+				attribute.String("http.route", request.Resource),
+				attribute.String("url.path", request.Path),
+			),
+		)
+		defer tracing.Flush(ctx)
+
+		response, err := next(ctx, request)
+		span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+		if err == nil && response.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(response.StatusCode))
+		}
+		tracing.End(span, err)
+		return response, err
+	}
+}
+
+// loggingMiddleware attaches a request-scoped logger to the context and logs one line per
+// request with its outcome and duration. The correlation ID comes from the X-Correlation-Id
+// header or, when absent, the API Gateway request ID, and is echoed back in the response.
+func loggingMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+
+		correlationID := headerValue(request, logger.CorrelationHeader)
+		if correlationID == "" {
+			correlationID = request.RequestContext.RequestID
+		}
+		ctx = logger.WithLambda(ctx)
+		ctx = logger.WithCorrelationID(ctx, correlationID)
+		ctx = logger.With(ctx, "requestId", request.RequestContext.RequestID, "method", request.HTTPMethod, "resource", request.Resource)
+		if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+			ctx = logger.With(ctx, "traceId", spanContext.TraceID().String())
+		}
+		if personID := request.PathParameters["personId"]; personID != "" {
+			ctx = logger.With(ctx, "personId", personID)
+		}
+
+		response, err := next(ctx, request)
+		if correlationID != "" {
+			if response.Headers == nil {
+				response.Headers = map[string]string{}
+			}
+			response.Headers[logger.CorrelationHeader] = correlationID
+		}
+		logger.FromContext(ctx).Info("Request completed", "status", response.StatusCode, "durationMs", time.Since(start).Milliseconds())
+		return response, err
+	}
+}
+
+// metricsMiddleware emits request latency and error counts by method, outcome and the
+// response format the handler served (see useFormat)
+func metricsMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+		ctx, format := withServedFormat(ctx)
+		response, err := next(ctx, request)
+
+		outcome := metrics.HTTPOutcome(response.StatusCode)
+		if err != nil {
+			outcome = metrics.OutcomeServerError
+		}
+		serverErrors := 0
+		if outcome == metrics.OutcomeServerError {
+			serverErrors = 1
+		}
+		metrics.Emit(
+			map[string]string{"Method": request.HTTPMethod, "Outcome": outcome, "Format": format()},
+			map[string]interface{}{"route": request.Resource, "statusCode": response.StatusCode, "requestId": request.RequestContext.RequestID},
+			metrics.Duration("RequestLatency", time.Since(start)),
+			metrics.Count("Requests", 1),
+			metrics.Count("Errors", serverErrors),
+		)
+		return response, err
+	}
+}
+
+// captureMiddleware stores failing exchanges in the debug capture bucket when enabled
+func captureMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		response, err := next(ctx, request)
+		if err == nil {
+			captureFailure(ctx, request, response)
+		}
+		return response, err
+	}
+}
+
+// recoveryMiddleware turns a panic in a handler into a structured 500 instead of crashing
+// the invocation. It runs inside the logging and capture middlewares so they see the 500.
+func recoveryMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logger.FromContext(ctx).Error("Recovered from panic", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+				response = errorResponse(request, http.StatusInternalServerError, errCodeInternal, "Internal server error")
+				err = nil
+			}
+		}()
+		return next(ctx, request)
+	}
+}
+
+// requireIAMCaller is an auth hook for admin routes. API Gateway enforces IAM authorization
+// for them, but the same function can also be reached through an ALB or Function URL,
+// so the handler refuses requests that were not signed by an IAM principal.
+func requireIAMCaller(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if request.RequestContext.Identity.UserArn == "" && request.RequestContext.Identity.Caller == "" {
+			return errorResponse(request, http.StatusForbidden, errCodeForbidden, "This route requires IAM authorization"), nil
+		}
+		return next(ctx, request)
+	}
+}
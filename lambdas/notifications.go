@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"aws-lambda-go/internal/ddbexpr"
+)
+
+// notificationsTableName holds the delivery status written by the email lambda (NOTIFICATIONS_TABLE_NAME)
+var notificationsTableName = settings.NotificationsTableName
+
+const (
+	defaultNotificationsLimit = 25
+	maxNotificationsLimit     = 100
+)
+
+// Notification is one message sent (or attempted) to a person
+type Notification struct {
+	NotificationID string `json:"notificationId" dynamodbav:"notificationId"`
+	Channel        string `json:"channel" dynamodbav:"channel"`
+	TemplateName   string `json:"templateName,omitempty" dynamodbav:"templateName"`
+	Status         string `json:"status" dynamodbav:"status"`
+	StatusReason   string `json:"statusReason,omitempty" dynamodbav:"statusReason"`
+	CreatedAt      string `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt      string `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// NotificationsPage is the response of GET /persons/{personId}/notifications
+type NotificationsPage struct {
+	Notifications []Notification `json:"notifications"`
+	NextToken     string         `json:"nextToken,omitempty"`
+}
+
+// handleListNotifications returns a person's notifications, newest first
+func handleListNotifications(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if notificationsTableName == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Notification tracking is not enabled"), nil
+	}
+
+	personId := request.PathParameters["personId"]
+	if personId == "" {
+		return errorResponse(request, http.StatusBadRequest, errCodeMissingParameter, "Missing personId"), nil
+	}
+
+	limit := defaultNotificationsLimit
+	if value := request.QueryStringParameters["limit"]; value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxNotificationsLimit {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "limit must be between 1 and 100"), nil
+		}
+		limit = parsed
+	}
+
+	expr, err := expression.NewBuilder().WithKeyCondition(ddbexpr.KeyEquals("personId", personId)).Build()
+	if err != nil {
+		return internalErrorResponse(ctx, request, "build notifications query", err), nil
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(notificationsTableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(int32(limit)),
+	}
+
+	// The continuation token is the last notificationId of the previous page
+	if token := request.QueryStringParameters["nextToken"]; token != "" {
+		lastID, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid nextToken"), nil
+		}
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"personId":       &types.AttributeValueMemberS{Value: personId},
+			"notificationId": &types.AttributeValueMemberS{Value: string(lastID)},
+		}
+	}
+
+	result, err := svc.Query(ctx, input)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "query notifications", err), nil
+	}
+
+	page := NotificationsPage{Notifications: []Notification{}}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &page.Notifications); err != nil {
+		return internalErrorResponse(ctx, request, "unmarshal notifications", err), nil
+	}
+	if last, ok := result.LastEvaluatedKey["notificationId"].(*types.AttributeValueMemberS); ok {
+		page.NextToken = base64.RawURLEncoding.EncodeToString([]byte(last.Value))
+	}
+
+	return jsonResponse(ctx, request, http.StatusOK, page)
+}
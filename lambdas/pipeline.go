@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// maxIteratorAge is the stream lag above which the pipeline is reported as lagging
+	maxIteratorAge = time.Minute
+	// maxCanaryAge is how long ago the last successful canary run may be
+	maxCanaryAge = time.Hour
+)
+
+// pipelineStatusTableName holds the progress the pipeline's components record, one item per
+// component (PIPELINE_STATUS_TABLE_NAME)
+var pipelineStatusTableName = settings.PipelineStatusTableName
+
+// PipelineStatus is the body of GET /admin/pipeline/status. Sections of components that are
+// not configured are left out; Warnings names everything that needs attention.
+type PipelineStatus struct {
+	CheckedAt string       `json:"checkedAt"`
+	Healthy   bool         `json:"healthy"`
+	Warnings  []string     `json:"warnings"`
+	Stream    *StreamLag   `json:"stream,omitempty"`
+	Queues    []QueueDepth `json:"queues"`
+	// PendingNotifications are the messages of the email queue not sent yet
+	PendingNotifications *int          `json:"pendingNotifications,omitempty"`
+	Canary               *CanaryStatus `json:"canary,omitempty"`
+}
+
+// StreamLag is the progress the stream lambda last recorded
+type StreamLag struct {
+	LastBatchAt   string `json:"lastBatchAt" dynamodbav:"lastBatchAt"`
+	IteratorAgeMs int64  `json:"iteratorAgeMs" dynamodbav:"iteratorAgeMs"`
+	Records       int    `json:"records" dynamodbav:"records"`
+	Retried       int    `json:"retried" dynamodbav:"retried"`
+}
+
+// QueueDepth is the approximate message count of a queue
+type QueueDepth struct {
+	Name       string `json:"name"`
+	DeadLetter bool   `json:"deadLetter"`
+	Visible    int    `json:"visible"`
+	InFlight   int    `json:"inFlight"`
+	Delayed    int    `json:"delayed"`
+	Error      string `json:"error,omitempty"`
+}
+
+// CanaryStatus is the "canary" item a canary writes after each successful run
+type CanaryStatus struct {
+	LastSuccessAt string `json:"lastSuccessAt,omitempty" dynamodbav:"lastSuccessAt"`
+	Detail        string `json:"detail,omitempty" dynamodbav:"detail"`
+}
+
+// pipelineQueue is a queue whose depth is reported
+type pipelineQueue struct {
+	name       string
+	url        string
+	deadLetter bool
+}
+
+// pipelineQueues are the queues of the pipeline, in the order they are reported
+func pipelineQueues() []pipelineQueue {
+	return []pipelineQueue{
+		{"emailQueue", settings.EmailQueueURL, false},
+		{"emailDeadLetterQueue", settings.EmailDeadLetterQueueURL, true},
+		{"streamDeadLetterQueue", settings.StreamDLQURL, true},
+		{"exportQueue", settings.ExportQueueURL, false},
+		{"anonymizeQueue", settings.AnonymizeQueueURL, false},
+	}
+}
+
+// queueDepth reads the approximate message counts of a queue
+func queueDepth(ctx context.Context, queue pipelineQueue) QueueDepth {
+	depth := QueueDepth{Name: queue.name, DeadLetter: queue.deadLetter}
+	output, err := sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(queue.url),
+		AttributeNames: []sqstypes.QueueAttributeName{
+			sqstypes.QueueAttributeNameApproximateNumberOfMessages,
+			sqstypes.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			sqstypes.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+		},
+	})
+	if err != nil {
+		depth.Error = err.Error()
+		return depth
+	}
+	count := func(attribute sqstypes.QueueAttributeName) int {
+		value, _ := strconv.Atoi(output.Attributes[string(attribute)])
+		return value
+	}
+	depth.Visible = count(sqstypes.QueueAttributeNameApproximateNumberOfMessages)
+	depth.InFlight = count(sqstypes.QueueAttributeNameApproximateNumberOfMessagesNotVisible)
+	depth.Delayed = count(sqstypes.QueueAttributeNameApproximateNumberOfMessagesDelayed)
+	return depth
+}
+
+// componentStatus reads the item a component recorded in the pipeline status table into out.
+// It reports false when the component recorded nothing yet.
+func componentStatus(ctx context.Context, component string, out interface{}) (bool, error) {
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(pipelineStatusTableName),
+		Key:       map[string]types.AttributeValue{"component": &types.AttributeValueMemberS{Value: component}},
+	})
+	if err != nil || result.Item == nil {
+		return false, err
+	}
+	return true, attributevalue.UnmarshalMap(result.Item, out)
+}
+
+// handlePipelineStatus aggregates the stream lag, the queue depths, the pending notifications
+// and the last canary run into one document. Every source is read at once, each with its own
+// timeout; a source that fails is reported as a warning rather than failing the request.
+func handlePipelineStatus(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	now := time.Now().UTC()
+	status := PipelineStatus{CheckedAt: now.Format(time.RFC3339), Warnings: []string{}, Queues: []QueueDepth{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	warn := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		status.Warnings = append(status.Warnings, fmt.Sprintf(format, args...))
+	}
+	run := func(read func(ctx context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+			defer cancel()
+			read(ctx)
+		}()
+	}
+
+	var queues []QueueDepth
+	for _, q := range pipelineQueues() {
+		if q.url == "" {
+			continue
+		}
+		run(func(ctx context.Context) {
+			depth := queueDepth(ctx, q)
+			mu.Lock()
+			queues = append(queues, depth)
+			mu.Unlock()
+		})
+	}
+	if pipelineStatusTableName != "" {
+		run(func(ctx context.Context) {
+			var lag StreamLag
+			found, err := componentStatus(ctx, "stream", &lag)
+			switch {
+			case err != nil:
+				warn("stream status unavailable: %v", err)
+			case found:
+				mu.Lock()
+				status.Stream = &lag
+				mu.Unlock()
+			}
+		})
+		run(func(ctx context.Context) {
+			var canary CanaryStatus
+			found, err := componentStatus(ctx, "canary", &canary)
+			switch {
+			case err != nil:
+				warn("canary status unavailable: %v", err)
+			case !found:
+				warn("no canary run recorded")
+			default:
+				mu.Lock()
+				status.Canary = &canary
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	// Queues are listed in the order of pipelineQueues, whatever order they were read in
+	for _, q := range pipelineQueues() {
+		for _, depth := range queues {
+			if depth.Name == q.name {
+				status.Queues = append(status.Queues, depth)
+			}
+		}
+	}
+	for _, depth := range status.Queues {
+		switch {
+		case depth.Error != "":
+			status.Warnings = append(status.Warnings, fmt.Sprintf("%s unavailable: %s", depth.Name, depth.Error))
+		case depth.DeadLetter && depth.Visible+depth.InFlight+depth.Delayed > 0:
+			status.Warnings = append(status.Warnings, fmt.Sprintf("%s holds %d messages", depth.Name, depth.Visible+depth.InFlight+depth.Delayed))
+		case depth.Name == "emailQueue":
+			pending := depth.Visible + depth.InFlight + depth.Delayed
+			status.PendingNotifications = &pending
+		}
+	}
+	if status.Stream != nil && time.Duration(status.Stream.IteratorAgeMs)*time.Millisecond > maxIteratorAge {
+		status.Warnings = append(status.Warnings, fmt.Sprintf("stream is lagging by %s", time.Duration(status.Stream.IteratorAgeMs)*time.Millisecond))
+	}
+	if status.Canary != nil {
+		lastSuccess, err := time.Parse(time.RFC3339, status.Canary.LastSuccessAt)
+		if err != nil || now.Sub(lastSuccess) > maxCanaryAge {
+			status.Warnings = append(status.Warnings, fmt.Sprintf("no successful canary run since %s", status.Canary.LastSuccessAt))
+		}
+	}
+	sort.Strings(status.Warnings)
+	status.Healthy = len(status.Warnings) == 0
+	return jsonResponse(ctx, request, http.StatusOK, status)
+}
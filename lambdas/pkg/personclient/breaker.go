@@ -0,0 +1,150 @@
+package personclient
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit breaker
+type State string
+
+const (
+	// StateClosed lets every call through
+	StateClosed State = "closed"
+	// StateOpen rejects calls with ErrCircuitOpen until the cooldown has passed
+	StateOpen State = "open"
+	// StateHalfOpen lets a single trial call through; its outcome closes or reopens the breaker
+	StateHalfOpen State = "half-open"
+)
+
+// BreakerSettings configures a circuit breaker
+type BreakerSettings struct {
+	// FailureThreshold is the number of consecutive failures that opens the breaker; 0 disables it
+	FailureThreshold int
+	// Cooldown is how long the breaker stays open before a trial call
+	Cooldown time.Duration
+}
+
+// DefaultBreakerSettings opens after 5 consecutive failures for 30 seconds
+var DefaultBreakerSettings = BreakerSettings{
+	FailureThreshold: 5,
+	Cooldown:         30 * time.Second,
+}
+
+// CircuitBreaker stops calls to a failing service for a while, so callers fail fast instead
+// of piling up on timeouts. It is safe for concurrent use.
+type CircuitBreaker struct {
+	settings BreakerSettings
+	hooks    *Hooks
+	// label names the breaker's region in OnStateChange
+	label func() string
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(settings BreakerSettings) *CircuitBreaker {
+	return &CircuitBreaker{settings: settings, state: StateClosed}
+}
+
+// State returns the current state
+func (b *CircuitBreaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow returns ErrCircuitOpen when a call must not be made. trial is set for the single call
+// let through while the breaker is half-open, whose outcome decides how it goes on.
+func (b *CircuitBreaker) allow() (trial bool, err error) {
+	if b.settings.FailureThreshold <= 0 {
+		return false, nil
+	}
+	var change *stateChange
+	b.mu.Lock()
+	defer func() {
+		b.mu.Unlock()
+		b.report(change)
+	}()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < b.settings.Cooldown {
+			return false, ErrCircuitOpen
+		}
+		change = b.transition(StateHalfOpen)
+		b.trial = true
+		return true, nil
+	case StateHalfOpen:
+		if b.trial {
+			return false, ErrCircuitOpen
+		}
+		b.trial = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// record feeds the outcome of a call into the breaker. While the breaker is open or half-open
+// only the trial call counts: calls let through before it opened may still finish, and must
+// neither end the trial nor close the breaker.
+func (b *CircuitBreaker) record(failure bool, trial bool) {
+	if b.settings.FailureThreshold <= 0 {
+		return
+	}
+	var change *stateChange
+	b.mu.Lock()
+	defer func() {
+		b.mu.Unlock()
+		b.report(change)
+	}()
+
+	if b.state != StateClosed && !trial {
+		return
+	}
+	b.trial = false
+	if !failure {
+		b.failures = 0
+		if b.state != StateClosed {
+			change = b.transition(StateClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == StateHalfOpen || b.failures >= b.settings.FailureThreshold {
+		b.openedAt = time.Now()
+		if b.state != StateOpen {
+			change = b.transition(StateOpen)
+		}
+	}
+}
+
+// stateChange is a transition waiting to be reported
+type stateChange struct {
+	from State
+	to   State
+}
+
+// transition changes the state and returns the change to report; b.mu must be held
+func (b *CircuitBreaker) transition(to State) *stateChange {
+	change := &stateChange{from: b.state, to: to}
+	b.state = to
+	return change
+}
+
+// report passes a change to OnStateChange. b.mu must not be held, so the hook may call State.
+func (b *CircuitBreaker) report(change *stateChange) {
+	if change == nil || b.hooks == nil || b.hooks.OnStateChange == nil {
+		return
+	}
+	region := ""
+	if b.label != nil {
+		region = b.label()
+	}
+	b.hooks.OnStateChange(region, change.from, change.to)
+}
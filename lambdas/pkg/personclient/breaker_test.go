@@ -0,0 +1,117 @@
+package personclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// openBreaker returns a breaker that was opened by failures and whose cooldown has passed
+func openBreaker(t *testing.T, hooks *Hooks) *CircuitBreaker {
+	t.Helper()
+	b := NewCircuitBreaker(BreakerSettings{FailureThreshold: 2, Cooldown: time.Millisecond})
+	b.hooks = hooks
+	b.record(true, false)
+	if b.State() != StateClosed {
+		t.Fatalf("state after 1 failure = %s, want %s", b.State(), StateClosed)
+	}
+	b.record(true, false)
+	if b.State() != StateOpen {
+		t.Fatalf("state after 2 failures = %s, want %s", b.State(), StateOpen)
+	}
+	if _, err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow during cooldown = %v, want ErrCircuitOpen", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	return b
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	type outcome struct {
+		failure bool
+		trial   bool
+	}
+	tests := []struct {
+		name     string
+		outcomes []outcome
+		want     State
+	}{
+		{"trial success closes", []outcome{{false, true}}, StateClosed},
+		{"trial failure reopens", []outcome{{true, true}}, StateOpen},
+		{"late success keeps the trial", []outcome{{false, false}}, StateHalfOpen},
+		{"late failure keeps the trial", []outcome{{true, false}}, StateHalfOpen},
+		{"trial decides after late calls", []outcome{{false, false}, {true, false}, {false, true}}, StateClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := openBreaker(t, nil)
+			trial, err := b.allow()
+			if err != nil || !trial {
+				t.Fatalf("allow after cooldown = %v, %v, want a trial", trial, err)
+			}
+			if b.State() != StateHalfOpen {
+				t.Fatalf("state = %s, want %s", b.State(), StateHalfOpen)
+			}
+			if _, err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+				t.Fatalf("second allow while half-open = %v, want ErrCircuitOpen", err)
+			}
+			for _, o := range tt.outcomes {
+				b.record(o.failure, o.trial)
+			}
+			if b.State() != tt.want {
+				t.Errorf("state = %s, want %s", b.State(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerLateCallsWhileOpen(t *testing.T) {
+	b := NewCircuitBreaker(BreakerSettings{FailureThreshold: 1, Cooldown: time.Hour})
+	b.record(true, false)
+	b.record(false, false)
+	if b.State() != StateOpen {
+		t.Errorf("state after a late success = %s, want %s", b.State(), StateOpen)
+	}
+}
+
+func TestCircuitBreakerStateChangeHook(t *testing.T) {
+	type change struct {
+		region string
+		from   State
+		to     State
+	}
+	var (
+		b       *CircuitBreaker
+		changes []change
+	)
+	hooks := &Hooks{OnStateChange: func(region string, from State, to State) {
+		// The hook runs outside the lock, so it can read the state
+		if state := b.State(); state != to {
+			t.Errorf("State() in hook = %s, want %s", state, to)
+		}
+		changes = append(changes, change{region, from, to})
+	}}
+	b = NewCircuitBreaker(BreakerSettings{FailureThreshold: 1, Cooldown: time.Millisecond})
+	b.hooks = hooks
+	b.label = func() string { return "eu-west-1" }
+
+	b.record(true, false)
+	time.Sleep(2 * time.Millisecond)
+	trial, _ := b.allow()
+	b.record(false, trial)
+
+	want := []change{
+		{"eu-west-1", StateClosed, StateOpen},
+		{"eu-west-1", StateOpen, StateHalfOpen},
+		{"eu-west-1", StateHalfOpen, StateClosed},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d = %v, want %v", i, changes[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,387 @@
+// Package personclient is the Go client for the person service API. Every call goes through
+// the same resilience layer: a per-attempt timeout, retries with exponential backoff for
+// idempotent requests, and a circuit breaker that stops calling an unhealthy service. With
+// failover regions, calls move to the next healthy region (see WithFailoverRegions).
+// Hooks report attempts, retries, breaker transitions and region changes, e.g. to metrics.
+// Requests carry the W3C traceparent of the caller's span (see WithTracer).
+package personclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Person is a person record as returned by the API
+type Person struct {
+	PersonID            string `json:"personId,omitempty"`
+	FirstName           string `json:"firstName"`
+	LastName            string `json:"lastName"`
+	Address             string `json:"address"`
+	PhoneNumber         string `json:"phoneNumber"`
+	Email               string `json:"email,omitempty"`
+	NotificationChannel string `json:"notificationChannel,omitempty"`
+	Version             int64  `json:"version,omitempty"`
+	CreatedAt           string `json:"createdAt,omitempty"`
+	UpdatedAt           string `json:"updatedAt,omitempty"`
+	OwnerID             string `json:"ownerId,omitempty"`
+	Locale              string `json:"locale,omitempty"`
+}
+
+// Client calls the person service API
+type Client struct {
+	// regions are the deployments of the service in order of preference; the first is the
+	// one passed to New
+	regions         []*region
+	current         atomic.Pointer[region]
+	httpClient      *http.Client
+	timeout         time.Duration
+	retry           RetryPolicy
+	breakerSettings BreakerSettings
+	hooks           Hooks
+	headers         http.Header
+	tracer          trace.Tracer
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// New creates a client for the API at baseURL, e.g. https://<id>.execute-api.<region>.amazonaws.com/prod.
+// Without options it uses DefaultTimeout, DefaultRetryPolicy and a circuit breaker with
+// DefaultBreakerSettings.
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		regions:         []*region{newRegion(Region{BaseURL: baseURL})},
+		httpClient:      http.DefaultClient,
+		timeout:         DefaultTimeout,
+		retry:           DefaultRetryPolicy,
+		breakerSettings: DefaultBreakerSettings,
+		headers:         http.Header{},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	for _, r := range c.regions {
+		r.breaker = NewCircuitBreaker(c.breakerSettings)
+		r.breaker.hooks = &c.hooks
+		r.breaker.label = r.label
+	}
+	return c
+}
+
+// DefaultTimeout bounds a single attempt, not the whole call including retries.
+// Use the context to bound the whole call.
+const DefaultTimeout = 5 * time.Second
+
+// WithHTTPClient sets the underlying HTTP client, e.g. one that signs requests
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithTimeout sets the timeout of a single attempt; 0 disables it
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) { c.timeout = timeout }
+}
+
+// WithRetry sets the retry policy
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *Client) { c.retry = policy }
+}
+
+// WithCircuitBreaker sets the circuit breaker settings; every region has its own breaker
+func WithCircuitBreaker(settings BreakerSettings) Option {
+	return func(c *Client) { c.breakerSettings = settings }
+}
+
+// WithHooks sets the callbacks for attempts, retries and breaker transitions
+func WithHooks(hooks Hooks) Option {
+	return func(c *Client) { c.hooks = hooks }
+}
+
+// WithHeader adds a header to every request, e.g. Authorization or X-Tenant-Id
+func WithHeader(name string, value string) Option {
+	return func(c *Client) { c.headers.Set(name, value) }
+}
+
+// GetPerson fetches a person by ID
+func (c *Client) GetPerson(ctx context.Context, personID string) (*Person, error) {
+	response, err := c.do(ctx, request{method: http.MethodGet, path: "/persons/" + url.PathEscape(personID)})
+	if err != nil {
+		return nil, err
+	}
+	var person Person
+	if err := decodePerson(response.body, &person); err != nil {
+		return nil, err
+	}
+	return &person, nil
+}
+
+// ListPersons fetches all persons visible to the caller. The service returns large lists in
+// pages, with the token of the next page in X-Next-Token; they are followed until the list is
+// complete.
+func (c *Client) ListPersons(ctx context.Context) ([]Person, error) {
+	persons := []Person{}
+	for token := ""; ; {
+		req := request{method: http.MethodGet, path: "/persons"}
+		if token != "" {
+			req.query = url.Values{"nextToken": {token}}
+		}
+		response, err := c.do(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(response.body, &items); err != nil {
+			return nil, fmt.Errorf("personclient: invalid list response: %w", err)
+		}
+		for _, item := range items {
+			var person Person
+			if err := decodePerson(item, &person); err != nil {
+				return nil, err
+			}
+			persons = append(persons, person)
+		}
+		if token = response.header.Get(headerNextToken); token == "" {
+			return persons, nil
+		}
+	}
+}
+
+// headerNextToken carries the token of the next page of a partial list
+const headerNextToken = "X-Next-Token"
+
+// CreatePerson creates a person and returns its ID. With an idempotency key the request
+// is safe to retry, so it is retried like the idempotent methods.
+func (c *Client) CreatePerson(ctx context.Context, person Person, idempotencyKey string) (string, error) {
+	body, err := json.Marshal(person)
+	if err != nil {
+		return "", err
+	}
+	req := request{method: http.MethodPost, path: "/persons", body: body, header: http.Header{}}
+	if idempotencyKey != "" {
+		req.header.Set("Idempotency-Key", idempotencyKey)
+	}
+	response, err := c.do(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		PersonID string `json:"personId"`
+	}
+	if err := json.Unmarshal(response.body, &created); err != nil {
+		return "", fmt.Errorf("personclient: invalid create response: %w", err)
+	}
+	return created.PersonID, nil
+}
+
+// UpdatePerson replaces a person's fields. A non-zero expectedVersion is sent as If-Match,
+// so the update fails with 412 when the person changed since it was read. It returns the
+// new version.
+func (c *Client) UpdatePerson(ctx context.Context, personID string, person Person, expectedVersion int64) (int64, error) {
+	body, err := json.Marshal(person)
+	if err != nil {
+		return 0, err
+	}
+	req := request{method: http.MethodPut, path: "/persons/" + url.PathEscape(personID), body: body, header: http.Header{}}
+	if expectedVersion > 0 {
+		req.header.Set("If-Match", strconv.Quote(strconv.FormatInt(expectedVersion, 10)))
+	}
+	response, err := c.do(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	version, _ := strconv.ParseInt(strings.Trim(response.header.Get("ETag"), `"`), 10, 64)
+	return version, nil
+}
+
+// DeletePerson deletes a person
+func (c *Client) DeletePerson(ctx context.Context, personID string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/persons/" + url.PathEscape(personID)})
+	return err
+}
+
+// request is one API call, independent of its attempts
+type request struct {
+	method string
+	path   string
+	// query is left out of the path reported to hooks, as it may carry tokens
+	query  url.Values
+	body   []byte
+	header http.Header
+}
+
+// idempotent reports whether the request may be repeated without changing the outcome
+func (r request) idempotent() bool {
+	switch r.method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return r.header.Get("Idempotency-Key") != ""
+}
+
+// mutating reports whether the request may change data, so it must go to the active region
+func (r request) mutating() bool {
+	switch r.method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// response is the successful outcome of a call
+type response struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// do runs a request through the region selection, circuit breaker and retry policy
+func (c *Client) do(ctx context.Context, req request) (*response, error) {
+	retryable := req.idempotent() || c.retry.RetryNonIdempotent
+	// standbyHops counts the writes sent on from a standby region, which cost no attempt
+	standbyHops := 0
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		target, trial, err := c.selectRegion(req)
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		resp, err := c.attempt(ctx, target, req)
+		failure := isFailure(resp, err)
+		target.breaker.record(failure, trial)
+		if resp != nil {
+			c.observeRegion(target, resp)
+		}
+		if c.hooks.OnAttempt != nil {
+			status := 0
+			if resp != nil {
+				status = resp.statusCode
+			}
+			c.hooks.OnAttempt(AttemptInfo{Method: req.method, Path: req.path, Region: target.label(), Attempt: attempt, StatusCode: status, Duration: time.Since(start), Err: err})
+		}
+
+		if err == nil && resp.statusCode < 400 {
+			return resp, nil
+		}
+		if err == nil {
+			err = newAPIError(resp)
+		}
+		// A standby region rejects writes without applying them, so even non-idempotent
+		// writes are sent on to a writable region at once, without using up an attempt. Regions
+		// that each name another as active would pass a write around forever, so it visits
+		// every region at most once this way.
+		if IsRegionStandby(err) && c.writableRegion() && standbyHops < len(c.regions) {
+			standbyHops++
+			attempt--
+			continue
+		}
+		if !retryable || attempt >= c.retry.MaxAttempts || !isRetryable(resp, err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := c.retry.backoff(attempt, resp)
+		if c.hooks.OnRetry != nil {
+			c.hooks.OnRetry(RetryInfo{Method: req.method, Path: req.path, Attempt: attempt, Delay: delay, Err: err})
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// attempt sends a request once. Error statuses are returned as a response, not an error.
+func (c *Client) attempt(ctx context.Context, target *region, req request) (resp *response, err error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	address := target.baseURL + req.path
+	if len(req.query) > 0 {
+		address += "?" + req.query.Encode()
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, req.method, address, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.headers {
+		httpRequest.Header[name] = values
+	}
+	for name, values := range req.header {
+		httpRequest.Header[name] = values
+	}
+	if req.body != nil {
+		httpRequest.Header.Set("Content-Type", "application/json")
+	}
+	ctx, span := c.startSpan(ctx, target, httpRequest)
+	defer func() { endSpan(span, resp, err) }()
+	httpRequest = httpRequest.WithContext(ctx)
+	injectTrace(ctx, httpRequest.Header)
+
+	httpResponse, err := c.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	data, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &response{statusCode: httpResponse.StatusCode, header: httpResponse.Header, body: data}, nil
+}
+
+// decodePerson reads a person in either response format: plain JSON, or the legacy format
+// that wraps every attribute as {"Value": "..."}
+func decodePerson(data []byte, person *Person) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("personclient: invalid person: %w", err)
+	}
+	plain := map[string]json.RawMessage{}
+	for name, raw := range fields {
+		var wrapped struct {
+			Value *json.RawMessage `json:"Value"`
+		}
+		if len(raw) > 0 && raw[0] == '{' && json.Unmarshal(raw, &wrapped) == nil && wrapped.Value != nil {
+			raw = *wrapped.Value
+		}
+		plain[name] = raw
+	}
+	// Numbers are strings in the legacy format
+	if version, ok := plain["version"]; ok {
+		var text string
+		if json.Unmarshal(version, &text) == nil {
+			plain["version"] = json.RawMessage(text)
+		}
+	}
+
+	normalized, err := json.Marshal(plain)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(normalized, person); err != nil {
+		return fmt.Errorf("personclient: invalid person: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package personclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fastRetry keeps the tests quick; the breaker is disabled unless a test sets it
+var fastRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+// scriptedServer answers with the given statuses in turn, repeating the last one, and counts
+// the requests
+func scriptedServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		status := statuses[min(n, len(statuses))-1]
+		if status >= 400 {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"code": "ERROR_%d", "message": "failed", "requestId": "r%d"}`, status, n)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"personId": "p1", "firstName": "Ada"}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		call       func(*Client) error
+		attempts   int32
+		wantStatus int // 0 for success
+	}{
+		{"get retried until it succeeds", []int{503, 502, 200}, getPerson, 3, 0},
+		{"get retries exhausted", []int{503}, getPerson, 3, 503},
+		{"throttling retried", []int{429, 200}, getPerson, 2, 0},
+		{"client error not retried", []int{400}, getPerson, 1, 400},
+		{"server error not retried", []int{500}, getPerson, 1, 500},
+		{"post without key not retried", []int{503, 201}, createPerson(""), 1, 503},
+		{"post with key retried", []int{503, 201}, createPerson("key-1"), 2, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := scriptedServer(t, tt.statuses...)
+			client := New(server.URL, WithRetry(fastRetry), WithCircuitBreaker(BreakerSettings{}))
+
+			err := tt.call(client)
+			if got := requests.Load(); got != tt.attempts {
+				t.Errorf("attempts = %d, want %d", got, tt.attempts)
+			}
+			var apiErr *APIError
+			switch {
+			case tt.wantStatus == 0 && err != nil:
+				t.Errorf("err = %v, want success", err)
+			case tt.wantStatus != 0 && (!errors.As(err, &apiErr) || apiErr.StatusCode != tt.wantStatus):
+				t.Errorf("err = %v, want status %d", err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func getPerson(c *Client) error {
+	_, err := c.GetPerson(context.Background(), "p1")
+	return err
+}
+
+func createPerson(idempotencyKey string) func(*Client) error {
+	return func(c *Client) error {
+		_, err := c.CreatePerson(context.Background(), Person{FirstName: "Ada"}, idempotencyKey)
+		return err
+	}
+}
+
+func TestRetryHooks(t *testing.T) {
+	server, _ := scriptedServer(t, 503, 200)
+	var attempts, retries int
+	client := New(server.URL, WithRetry(fastRetry), WithHooks(Hooks{
+		OnAttempt: func(info AttemptInfo) { attempts++ },
+		OnRetry: func(info RetryInfo) {
+			retries++
+			if info.Attempt != 1 || info.Delay > fastRetry.BaseDelay {
+				t.Errorf("retry = %+v, want attempt 1 with at most %s delay", info, fastRetry.BaseDelay)
+			}
+		},
+	}))
+	if err := getPerson(client); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 || retries != 1 {
+		t.Errorf("attempts, retries = %d, %d, want 2, 1", attempts, retries)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	tests := []struct {
+		name       string
+		attempt    int
+		retryAfter string
+		max        time.Duration
+		exact      bool
+	}{
+		{"first retry", 1, "", 10 * time.Millisecond, false},
+		{"doubles", 3, "", 40 * time.Millisecond, false},
+		{"capped", 10, "", 50 * time.Millisecond, false},
+		{"retry-after", 1, "0", 0, true},
+		{"retry-after capped", 1, "60", 50 * time.Millisecond, true},
+		{"invalid retry-after ignored", 1, "soon", 10 * time.Millisecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &response{header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.header.Set("Retry-After", tt.retryAfter)
+			}
+			for range 20 {
+				delay := policy.backoff(tt.attempt, resp)
+				if delay < 0 || delay > tt.max || (tt.exact && delay != tt.max) {
+					t.Fatalf("backoff = %s, want at most %s (exact %v)", delay, tt.max, tt.exact)
+				}
+			}
+		})
+	}
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"personId": "p1"}`)
+	}))
+	defer server.Close()
+
+	var states []State
+	client := New(server.URL, WithRetry(NoRetry),
+		WithCircuitBreaker(BreakerSettings{FailureThreshold: 2, Cooldown: 20 * time.Millisecond}),
+		WithHooks(Hooks{OnStateChange: func(region string, from State, to State) { states = append(states, to) }}))
+
+	for range 2 {
+		if err := getPerson(client); err == nil {
+			t.Fatal("call to a failing service succeeded")
+		}
+	}
+	if err := getPerson(client); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("requests = %d, want 2: the open breaker must not call the service", got)
+	}
+
+	// A failed trial reopens the breaker
+	time.Sleep(25 * time.Millisecond)
+	if err := getPerson(client); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("trial err = %v, want the service's error", err)
+	}
+	if err := getPerson(client); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err after failed trial = %v, want ErrCircuitOpen", err)
+	}
+
+	// A successful trial closes it
+	healthy.Store(true)
+	time.Sleep(25 * time.Millisecond)
+	if err := getPerson(client); err != nil {
+		t.Fatalf("trial err = %v, want success", err)
+	}
+	if err := getPerson(client); err != nil {
+		t.Fatalf("err after successful trial = %v, want success", err)
+	}
+
+	want := []State{StateOpen, StateHalfOpen, StateOpen, StateHalfOpen, StateClosed}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Errorf("transitions = %v, want %v", states, want)
+	}
+}
+
+func TestClientStandbyRegionsNamingEachOther(t *testing.T) {
+	var requests atomic.Int32
+	standby := func(name, active string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Set(headerRegion, name)
+			w.Header().Set(headerRegionRole, "standby")
+			w.Header().Set(headerActiveRegion, active)
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			fmt.Fprint(w, `{"code": "REGION_STANDBY", "message": "standby"}`)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	a, b := standby("eu-west-1", "eu-central-1"), standby("eu-central-1", "eu-west-1")
+	client := New(a.URL, WithRetry(fastRetry),
+		WithFailoverRegions(Region{Name: "eu-central-1", BaseURL: b.URL}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.UpdatePerson(ctx, "p1", Person{FirstName: "Ada"}, 0)
+	if !IsRegionStandby(err) {
+		t.Fatalf("err = %v, want REGION_STANDBY", err)
+	}
+	if got := requests.Load(); got > 3 {
+		t.Errorf("requests = %d, want at most 3: the first and one redirect per region", got)
+	}
+}
+
+func TestClientStopsOnCancelledContext(t *testing.T) {
+	server, requests := scriptedServer(t, 200)
+	client := New(server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.GetPerson(ctx, "p1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("requests = %d, want 0", got)
+	}
+}
+
+func TestListPersonsFollowsPages(t *testing.T) {
+	pages := map[string]struct {
+		body string
+		next string
+	}{
+		"":   {`[{"personId": "p1"}, {"personId": "p2"}]`, "t1"},
+		"t1": {`[{"personId": {"Value": "p3"}}]`, "t2"},
+		"t2": {`[]`, ""},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Query().Get("nextToken")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if page.next != "" {
+			w.Header().Set("X-Next-Token", page.next)
+		}
+		fmt.Fprint(w, page.body)
+	}))
+	defer server.Close()
+
+	persons, err := New(server.URL).ListPersons(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, person := range persons {
+		ids = append(ids, person.PersonID)
+	}
+	if fmt.Sprint(ids) != "[p1 p2 p3]" {
+		t.Errorf("persons = %v, want [p1 p2 p3]", ids)
+	}
+}
@@ -0,0 +1,59 @@
+package personclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrCircuitOpen is returned without calling the service while the circuit breaker is open
+var ErrCircuitOpen = errors.New("personclient: circuit breaker is open")
+
+// APIError is an error response from the service
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("personclient: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("personclient: %d %s: %s (request %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+}
+
+// newAPIError reads the structured error body the service returns; other bodies (e.g. from
+// API Gateway itself) only keep the status code
+func newAPIError(resp *response) *APIError {
+	apiErr := &APIError{StatusCode: resp.statusCode}
+	var body struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"requestId"`
+	}
+	if json.Unmarshal(resp.body, &body) == nil {
+		apiErr.Code, apiErr.Message, apiErr.RequestID = body.Code, body.Message, body.RequestID
+	}
+	return apiErr
+}
+
+// IsNotFound reports whether err is a 404 from the service
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsRegionStandby reports whether err is a write rejected by a standby region
+func IsRegionStandby(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == codeRegionStandby
+}
+
+// IsConflict reports whether err means the person was modified concurrently (409 or 412)
+func IsConflict(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusConflict || apiErr.StatusCode == http.StatusPreconditionFailed)
+}
@@ -0,0 +1,37 @@
+package personclient
+
+import "time"
+
+// Hooks are optional callbacks for observing the client, e.g. to emit metrics. They are
+// called synchronously and must not block.
+type Hooks struct {
+	// OnAttempt is called after every HTTP attempt
+	OnAttempt func(AttemptInfo)
+	// OnRetry is called before the client pauses for a retry
+	OnRetry func(RetryInfo)
+	// OnStateChange is called when the circuit breaker of a region changes state, with the
+	// region's name, or its base URL when the name is not known
+	OnStateChange func(region string, from State, to State)
+	// OnRegionChange is called when calls move to another region, e.g. on failover
+	OnRegionChange func(from string, to string)
+}
+
+// AttemptInfo describes one HTTP attempt
+type AttemptInfo struct {
+	Method     string
+	Path       string
+	Region     string // the region's name, or its base URL when the name is not known
+	Attempt    int
+	StatusCode int // 0 when no response was received
+	Duration   time.Duration
+	Err        error // transport error, if any
+}
+
+// RetryInfo describes a scheduled retry
+type RetryInfo struct {
+	Method  string
+	Path    string
+	Attempt int // the attempt that failed
+	Delay   time.Duration
+	Err     error
+}
@@ -0,0 +1,139 @@
+package personclient
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Headers the service sets on every response to name the region that served it
+const (
+	headerRegion       = "X-Region"
+	headerRegionRole   = "X-Region-Role"
+	headerActiveRegion = "X-Active-Region"
+)
+
+// codeRegionStandby is the error code of writes rejected by a standby region
+const codeRegionStandby = "REGION_STANDBY"
+
+// Region is a deployment of the service in one AWS region. Deployments share their data
+// through DynamoDB global tables; one is active, the others are standby and serve reads only.
+type Region struct {
+	// Name is the AWS region, e.g. "eu-west-1", as reported in the X-Region header
+	Name    string
+	BaseURL string
+}
+
+// WithFailoverRegions adds deployments in other regions, in order of preference after the one
+// passed to New. Each call goes to the first region whose circuit breaker lets it through, so
+// calls move on when a region becomes unhealthy and come back once its breaker closes again.
+// Writes skip regions that reported themselves as standby; a write rejected by a standby
+// region is sent on to the next writable region right away.
+func WithFailoverRegions(regions ...Region) Option {
+	return func(c *Client) {
+		for _, r := range regions {
+			c.regions = append(c.regions, newRegion(r))
+		}
+	}
+}
+
+// region is the client's view of one deployment
+type region struct {
+	baseURL string
+	breaker *CircuitBreaker
+
+	mu      sync.Mutex
+	name    string
+	standby bool
+}
+
+func newRegion(r Region) *region {
+	return &region{name: r.Name, baseURL: strings.TrimSuffix(r.BaseURL, "/")}
+}
+
+// label names the region in hooks; until the service reported the name, the host is used
+func (r *region) label() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.name != "" {
+		return r.name
+	}
+	if parsed, err := url.Parse(r.baseURL); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return r.baseURL
+}
+
+func (r *region) isStandby() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.standby
+}
+
+// selectRegion picks the region for an attempt: the first one in order of preference whose
+// breaker allows a call, and whether the attempt is that breaker's trial call. Writes only consider regions not known to be standby, unless every
+// region is, in which case the service's answer is passed on.
+func (c *Client) selectRegion(req request) (target *region, trial bool, err error) {
+	candidates := c.regions
+	if req.mutating() {
+		var writable []*region
+		for _, r := range c.regions {
+			if !r.isStandby() {
+				writable = append(writable, r)
+			}
+		}
+		if len(writable) > 0 {
+			candidates = writable
+		}
+	}
+
+	for _, r := range candidates {
+		trial, err := r.breaker.allow()
+		if err != nil {
+			continue
+		}
+		if previous := c.current.Swap(r); previous != nil && previous != r && c.hooks.OnRegionChange != nil {
+			c.hooks.OnRegionChange(previous.label(), r.label())
+		}
+		return r, trial, nil
+	}
+	return nil, false, ErrCircuitOpen
+}
+
+// writableRegion reports whether any region is not known to be standby
+func (c *Client) writableRegion() bool {
+	for _, r := range c.regions {
+		if !r.isStandby() {
+			return true
+		}
+	}
+	return false
+}
+
+// observeRegion records the name and role a region reported. A standby region also names the
+// active one, which is then known to take writes again, e.g. after a failback.
+func (c *Client) observeRegion(target *region, resp *response) {
+	name := resp.header.Get(headerRegion)
+	role := resp.header.Get(headerRegionRole)
+	if name == "" && role == "" {
+		return
+	}
+	target.mu.Lock()
+	if name != "" {
+		target.name = name
+	}
+	target.standby = role == "standby"
+	target.mu.Unlock()
+
+	active := resp.header.Get(headerActiveRegion)
+	if active == "" || active == name {
+		return
+	}
+	for _, r := range c.regions {
+		r.mu.Lock()
+		if r.name == active {
+			r.standby = false
+		}
+		r.mu.Unlock()
+	}
+}
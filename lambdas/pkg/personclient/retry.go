@@ -0,0 +1,73 @@
+package personclient
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed calls are repeated
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first; 1 disables retries
+	MaxAttempts int
+	// BaseDelay is the pause before the first retry; it doubles with every further retry
+	BaseDelay time.Duration
+	// MaxDelay caps the pause, including one requested with Retry-After
+	MaxDelay time.Duration
+	// RetryNonIdempotent also retries POSTs without an Idempotency-Key, which may create
+	// duplicates when a request succeeded but its response was lost
+	RetryNonIdempotent bool
+}
+
+// DefaultRetryPolicy retries idempotent calls twice
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+// NoRetry makes every call a single attempt
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// backoff returns the pause before the next attempt: the server's Retry-After when given,
+// otherwise exponential backoff with full jitter
+func (p RetryPolicy) backoff(attempt int, resp *response) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, p.MaxDelay)
+		}
+	}
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(delay) + 1))
+}
+
+// isRetryable reports whether a failed attempt may succeed when repeated: transport errors,
+// per-attempt timeouts, throttling and temporary server errors
+func isRetryable(resp *response, err error) bool {
+	if resp == nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	switch resp.statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isFailure reports whether an attempt counts against the circuit breaker. Client errors
+// (4xx other than 429) say nothing about the health of the service.
+func isFailure(resp *response, err error) bool {
+	if resp == nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return resp.statusCode >= http.StatusInternalServerError || resp.statusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,64 @@
+package personclient
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceContext writes W3C traceparent and tracestate headers. It is used instead of the global
+// propagator, so the API sees the trace whatever propagators the calling service configured.
+var traceContext = propagation.TraceContext{}
+
+// WithTracer creates a client span for every HTTP attempt, so retries and failovers show up in
+// the caller's trace. Without a tracer the client still passes on the span of the call's
+// context, if any, in the traceparent header.
+func WithTracer(tracer trace.Tracer) Option {
+	return func(c *Client) { c.tracer = tracer }
+}
+
+// startSpan starts the client span of an attempt, when the client has a tracer
+func (c *Client) startSpan(ctx context.Context, target *region, httpRequest *http.Request) (context.Context, trace.Span) {
+	if c.tracer == nil {
+		return ctx, nil
+	}
+	return c.tracer.Start(ctx, httpRequest.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", httpRequest.Method),
+			attribute.String("url.full", httpRequest.URL.String()),
+			attribute.String("server.address", httpRequest.URL.Hostname()),
+			attribute.String("person_service.region", target.label()),
+		),
+	)
+}
+
+// injectTrace adds the traceparent header of the context's span, if any, to a request
+func injectTrace(ctx context.Context, header http.Header) {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		traceContext.Inject(ctx, propagation.HeaderCarrier(header))
+	}
+}
+
+// endSpan records the outcome of an attempt on its span. Error statuses count as errors, as
+// for any HTTP client span.
+func endSpan(span trace.Span, resp *response, err error) {
+	if span == nil {
+		return
+	}
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case resp.statusCode >= 400:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.statusCode))
+		span.SetStatus(codes.Error, http.StatusText(resp.statusCode))
+	default:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.statusCode))
+	}
+	span.End()
+}
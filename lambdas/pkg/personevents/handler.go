@@ -0,0 +1,150 @@
+package personevents
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ErrNotPersonEvent is returned by Parse for events outside the catalog
+var ErrNotPersonEvent = errors.New("personevents: not a person event")
+
+// permanentError marks an error that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not retryable. A callback returns it for events it can never
+// process, e.g. ones failing validation; the handler then drops the event instead of having
+// it redelivered.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err, or an error it wraps, was marked with Permanent
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// Decrypter decrypts a PII attribute of a person, e.g. a *fieldcrypt.Encryptor
+type Decrypter interface {
+	Decrypt(ctx context.Context, personID string, field string, value string) (string, error)
+}
+
+// HandlerOption configures a handler
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	decrypter Decrypter
+	logger    *slog.Logger
+	eventsOf  map[string]bool
+}
+
+// WithDecrypter decrypts the PII attributes and changed fields before the callback runs
+func WithDecrypter(decrypter Decrypter) HandlerOption {
+	return func(c *handlerConfig) { c.decrypter = decrypter }
+}
+
+// WithLogger sets the logger for dropped events; the default is slog.Default()
+func WithLogger(logger *slog.Logger) HandlerOption {
+	return func(c *handlerConfig) { c.logger = logger }
+}
+
+// WithEventNames only passes events with the given names to the callback, e.g. EventInsert;
+// other events are acknowledged without calling it
+func WithEventNames(names ...string) HandlerOption {
+	return func(c *handlerConfig) {
+		c.eventsOf = map[string]bool{}
+		for _, name := range names {
+			c.eventsOf[name] = true
+		}
+	}
+}
+
+// NewEventBridgeHandler wraps a typed callback into a Lambda handler for an EventBridge rule
+// target, e.g. lambda.Start(personevents.NewEventBridgeHandler(onChange)).
+//
+// Events outside the catalog are skipped. Malformed events, events of a newer schema version
+// and callback errors marked with Permanent are logged and dropped, as a redelivery would fail
+// the same way. Any other callback error is returned, so Lambda retries the event and finally
+// hands it to the function's dead-letter queue or on-failure destination.
+func NewEventBridgeHandler(fn func(ctx context.Context, event PersonChanged) error, options ...HandlerOption) func(ctx context.Context, event events.CloudWatchEvent) error {
+	config := handlerConfig{logger: slog.Default()}
+	for _, option := range options {
+		option(&config)
+	}
+
+	return func(ctx context.Context, event events.CloudWatchEvent) error {
+		logger := config.logger.With("eventId", event.ID, "detailType", event.DetailType)
+		changed, err := Parse(event)
+		if errors.Is(err, ErrNotPersonEvent) {
+			logger.DebugContext(ctx, "Skipping event outside the person event catalog", "source", event.Source)
+			return nil
+		}
+		if err == nil && config.eventsOf != nil && !config.eventsOf[changed.EventName] {
+			return nil
+		}
+		if err == nil && config.decrypter != nil {
+			err = decrypt(ctx, config.decrypter, &changed)
+		}
+		if err == nil {
+			err = fn(ctx, changed)
+		}
+		if err == nil {
+			return nil
+		}
+
+		logger = logger.With("personId", changed.PersonID, "eventName", changed.EventName, "correlationId", changed.CorrelationID)
+		if IsPermanent(err) {
+			logger.ErrorContext(ctx, "Dropping person event that cannot be processed", "error", err)
+			return nil
+		}
+		logger.WarnContext(ctx, "Person event failed, returning it for retry", "error", err)
+		return err
+	}
+}
+
+// decrypt replaces the encrypted PII attributes and changed field values with their plaintext.
+// Values that were never encrypted are passed through by the Decrypter.
+func decrypt(ctx context.Context, decrypter Decrypter, changed *PersonChanged) error {
+	fields := map[string]*string{
+		"firstName":   &changed.Person.FirstName,
+		"lastName":    &changed.Person.LastName,
+		"address":     &changed.Person.Address,
+		"phoneNumber": &changed.Person.PhoneNumber,
+		"email":       &changed.Person.Email,
+	}
+	for name, value := range fields {
+		if *value == "" {
+			continue
+		}
+		plaintext, err := decrypter.Decrypt(ctx, changed.PersonID, name, *value)
+		if err != nil {
+			return err
+		}
+		*value = plaintext
+	}
+	for i := range changed.ChangedFields {
+		change := &changed.ChangedFields[i]
+		for _, value := range []*string{&change.Before, &change.After} {
+			if *value == "" {
+				continue
+			}
+			plaintext, err := decrypter.Decrypt(ctx, changed.PersonID, change.Field, *value)
+			if err != nil {
+				return err
+			}
+			*value = plaintext
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+// Package personevents parses the person change events the service publishes to its event
+// bus, so internal consumers work with typed values instead of raw event details.
+//
+// The catalog:
+//
+//   - source "ddb.source", detail-type "DynamoDBStreamEvent": a person was created (INSERT),
+//     updated (MODIFY), soft-deleted (REMOVE) or restored (RESTORE). The detail carries the
+//     new DynamoDB image and, for updates, the changed fields.
+//   - source "person.service", detail-type "PersonErased": a person was erased for GDPR (ERASE).
+//
+// Details carry a schemaVersion; events without one are version 1. When the stream lambda
+// publishes CloudEvents, the detail of a DynamoDBStreamEvent is a CloudEvent whose data is
+// the detail described above; Parse reads both.
+package personevents
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Event sources and detail types of the catalog
+const (
+	SourceStream          = "ddb.source"
+	SourceService         = "person.service"
+	DetailTypeStreamEvent = "DynamoDBStreamEvent"
+	DetailTypeErased      = "PersonErased"
+)
+
+// Event names of a PersonChanged
+const (
+	EventInsert  = "INSERT"
+	EventModify  = "MODIFY"
+	EventRemove  = "REMOVE"
+	EventRestore = "RESTORE"
+	EventErase   = "ERASE"
+)
+
+// SchemaVersion is the newest detail schema this package understands
+const SchemaVersion = 1
+
+// CloudEvents attributes of the events the stream lambda publishes in the CloudEvents format
+const (
+	CloudEventsSpecVersion = "1.0"
+	CloudEventSource       = "person.service/persons"
+	CloudEventType         = "person.service.PersonChanged"
+)
+
+// CloudEvent is the CloudEvents 1.0 JSON envelope. Its subject is the personId and its data
+// the detail of a DynamoDBStreamEvent.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// UnwrapCloudEvent returns the data of a detail that is a CloudEvent, and any other detail
+// unchanged, so consumers read both event formats while producers migrate
+func UnwrapCloudEvent(detail json.RawMessage) json.RawMessage {
+	var event CloudEvent
+	if err := json.Unmarshal(detail, &event); err != nil || event.SpecVersion == "" || event.Data == nil {
+		return detail
+	}
+	return event.Data
+}
+
+// Person is the person image carried by a change event. PII attributes are encrypted
+// ("enc:v1:...") when field encryption is enabled, unless a Decrypter is configured.
+type Person struct {
+	PersonID            string `json:"personId"`
+	FirstName           string `json:"firstName,omitempty"`
+	LastName            string `json:"lastName,omitempty"`
+	Address             string `json:"address,omitempty"`
+	PhoneNumber         string `json:"phoneNumber,omitempty"`
+	Email               string `json:"email,omitempty"`
+	NotificationChannel string `json:"notificationChannel,omitempty"`
+	TenantID            string `json:"tenantId,omitempty"`
+	OwnerID             string `json:"ownerId,omitempty"`
+	Version             int64  `json:"version,omitempty"`
+	CreatedAt           string `json:"createdAt,omitempty"`
+	UpdatedAt           string `json:"updatedAt,omitempty"`
+	Deleted             bool   `json:"deleted,omitempty"`
+	Locale              string `json:"locale,omitempty"`
+}
+
+// FieldChange is one changed attribute of a MODIFY event
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// PersonChanged is a parsed person event
+type PersonChanged struct {
+	// ID is the EventBridge event ID
+	ID            string
+	Time          time.Time
+	SchemaVersion int
+	// EventName is one of EventInsert, EventModify, EventRemove, EventRestore or EventErase
+	EventName     string
+	PersonID      string
+	CorrelationID string
+	// Person is the new image; it is empty for ERASE events
+	Person        Person
+	ChangedFields []FieldChange
+	// Synthetic is set for events emitted for backfills (POST /admin/events/emit) rather than
+	// by a change to the person
+	Synthetic bool
+}
+
+// streamDetail is the detail of a DynamoDBStreamEvent
+type streamDetail struct {
+	SchemaVersion int                                      `json:"schemaVersion"`
+	EventID       string                                   `json:"eventID"`
+	EventName     string                                   `json:"eventName"`
+	CorrelationID string                                   `json:"correlationId"`
+	Image         map[string]events.DynamoDBAttributeValue `json:"dynamodbData"`
+	ChangedFields []FieldChange                            `json:"changedFields"`
+	Synthetic     bool                                     `json:"synthetic"`
+}
+
+// erasedDetail is the detail of a PersonErased event
+type erasedDetail struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	PersonID      string `json:"personId"`
+	CorrelationID string `json:"correlationId"`
+}
+
+// Parse reads a person event. Events of other detail types return ErrNotPersonEvent; events
+// that are malformed or newer than SchemaVersion return permanent errors, as retrying them
+// cannot succeed.
+func Parse(event events.CloudWatchEvent) (PersonChanged, error) {
+	changed := PersonChanged{ID: event.ID, Time: event.Time}
+	switch {
+	case event.Source == SourceStream && event.DetailType == DetailTypeStreamEvent:
+		var detail streamDetail
+		if err := json.Unmarshal(UnwrapCloudEvent(event.Detail), &detail); err != nil {
+			return changed, Permanent(fmt.Errorf("personevents: invalid %s detail: %w", event.DetailType, err))
+		}
+		// Hard deletes carry no image; they only happen on erasure, which has its own PersonErased event
+		if detail.EventName == EventRemove && len(detail.Image) == 0 {
+			return changed, ErrNotPersonEvent
+		}
+		person, err := personFromImage(detail.Image)
+		if err != nil {
+			return changed, Permanent(err)
+		}
+		changed.SchemaVersion = detail.SchemaVersion
+		changed.EventName = detail.EventName
+		changed.PersonID = person.PersonID
+		changed.CorrelationID = detail.CorrelationID
+		changed.Person = person
+		changed.ChangedFields = detail.ChangedFields
+		changed.Synthetic = detail.Synthetic
+	case event.Source == SourceService && event.DetailType == DetailTypeErased:
+		var detail erasedDetail
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return changed, Permanent(fmt.Errorf("personevents: invalid %s detail: %w", event.DetailType, err))
+		}
+		changed.SchemaVersion = detail.SchemaVersion
+		changed.EventName = EventErase
+		changed.PersonID = detail.PersonID
+		changed.CorrelationID = detail.CorrelationID
+		changed.Person = Person{PersonID: detail.PersonID}
+	default:
+		return changed, ErrNotPersonEvent
+	}
+
+	if changed.SchemaVersion == 0 {
+		changed.SchemaVersion = 1
+	}
+	if changed.SchemaVersion > SchemaVersion {
+		return changed, Permanent(fmt.Errorf("personevents: schema version %d is newer than %d", changed.SchemaVersion, SchemaVersion))
+	}
+	if changed.PersonID == "" {
+		return changed, Permanent(fmt.Errorf("personevents: %s event %s has no personId", event.DetailType, event.ID))
+	}
+	return changed, nil
+}
+
+// personFromImage converts a DynamoDB stream image into a Person
+func personFromImage(image map[string]events.DynamoDBAttributeValue) (Person, error) {
+	str := func(name string) string {
+		if value, ok := image[name]; ok && value.DataType() == events.DataTypeString {
+			return value.String()
+		}
+		return ""
+	}
+	person := Person{
+		PersonID:            str("personId"),
+		FirstName:           str("firstName"),
+		LastName:            str("lastName"),
+		Address:             str("address"),
+		PhoneNumber:         str("phoneNumber"),
+		Email:               str("email"),
+		NotificationChannel: str("notificationChannel"),
+		TenantID:            str("tenantId"),
+		OwnerID:             str("ownerId"),
+		CreatedAt:           str("createdAt"),
+		UpdatedAt:           str("updatedAt"),
+		Locale:              str("locale"),
+	}
+	if value, ok := image["version"]; ok && value.DataType() == events.DataTypeNumber {
+		version, err := strconv.ParseInt(value.Number(), 10, 64)
+		if err != nil {
+			return person, fmt.Errorf("personevents: invalid version %q: %w", value.Number(), err)
+		}
+		person.Version = version
+	}
+	if value, ok := image["deleted"]; ok && value.DataType() == events.DataTypeBoolean {
+		person.Deleted = value.Boolean()
+	}
+	return person, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Policy actions, one per person route
+const (
+	actionList              = "person:List"
+	actionRead              = "person:Read"
+	actionCreate            = "person:Create"
+	actionUpdate            = "person:Update"
+	actionDelete            = "person:Delete"
+	actionMatch             = "person:Match"
+	actionSearch            = "person:Search"
+	actionValidate          = "person:Validate"
+	actionReadNotifications = "person:ReadNotifications"
+	actionReadTimeline      = "person:ReadTimeline"
+	actionReadHistory       = "person:ReadHistory"
+	actionExport            = "person:Export"
+	actionRestore           = "person:Restore"
+	actionErase             = "person:Erase"
+	actionUpdatePreferences = "person:UpdatePreferences"
+)
+
+// Statement effects
+const (
+	effectAllow = "allow"
+	effectDeny  = "deny"
+)
+
+// AccessPolicy is the document in ACCESS_POLICY, e.g.
+//
+//	{"statements": [
+//	  {"sid": "readers", "effect": "allow", "actions": ["person:Read*", "person:List"]},
+//	  {"sid": "editors", "effect": "allow", "roles": ["editor", "admin"], "actions": ["person:*"]},
+//	  {"sid": "own-tenant-only", "effect": "deny", "actions": ["*"], "condition": {"tenantMatch": false}},
+//	  {"sid": "email-by-admins", "effect": "deny", "roles": ["editor"], "actions": ["person:Update"], "condition": {"fields": ["email"]}}]}
+type AccessPolicy struct {
+	Statements []PolicyStatement `json:"statements"`
+}
+
+// PolicyStatement allows or denies actions to the callers it matches. A statement matches when
+// the caller has one of its roles (any role when empty) and every condition holds.
+type PolicyStatement struct {
+	// Sid names the statement in logs and metrics
+	Sid    string `json:"sid,omitempty"`
+	Effect string `json:"effect"`
+	// Actions are action names, or patterns ending in "*" such as "person:*" or "*"
+	Actions   []string        `json:"actions"`
+	Roles     []string        `json:"roles,omitempty"`
+	Condition PolicyCondition `json:"condition,omitempty"`
+}
+
+// PolicyCondition narrows a statement to some requests
+type PolicyCondition struct {
+	// TenantMatch: true matches requests for the caller's tenant (custom:tenantId), false requests
+	// for another tenant. The tenant of a /persons/{personId} request is the stored tenantId of
+	// the person; other requests are for the caller's tenant.
+	TenantMatch *bool `json:"tenantMatch,omitempty"`
+	// Tenants matches requests for one of these tenants, determined as for TenantMatch
+	Tenants []string `json:"tenants,omitempty"`
+	// Fields matches requests whose body sets one of these person fields
+	Fields []string `json:"fields,omitempty"`
+}
+
+// accessPolicy is read from ACCESS_POLICY; nil leaves authorization to the roles alone
+var accessPolicy = loadAccessPolicy(settings.AccessPolicy)
+
+// loadAccessPolicy parses and checks ACCESS_POLICY. An invalid policy is logged and ignored,
+// so the role checks apply as without a policy.
+func loadAccessPolicy(config string) *AccessPolicy {
+	if config == "" {
+		return nil
+	}
+	var policy AccessPolicy
+	err := json.Unmarshal([]byte(config), &policy)
+	if err == nil {
+		err = policy.validate()
+	}
+	if err != nil {
+		logger.FromContext(context.Background()).Error("Ignoring invalid ACCESS_POLICY", "error", err)
+		return nil
+	}
+	return &policy
+}
+
+// validate rejects statements with an unknown effect or no actions
+func (p *AccessPolicy) validate() error {
+	if len(p.Statements) == 0 {
+		return errors.New("no statements")
+	}
+	for i, statement := range p.Statements {
+		if statement.Effect != effectAllow && statement.Effect != effectDeny {
+			return fmt.Errorf("statement %d: effect must be %s or %s", i, effectAllow, effectDeny)
+		}
+		if len(statement.Actions) == 0 {
+			return fmt.Errorf("statement %d: no actions", i)
+		}
+	}
+	return nil
+}
+
+// policyRequest is what a statement is matched against
+type policyRequest struct {
+	action       string
+	role         string
+	callerTenant string
+	tenant       string
+	fields       []string
+}
+
+// policyDecision is the outcome of evaluating a request; statement is the sid (or index) of
+// the deciding statement, "" for the implicit deny
+type policyDecision struct {
+	allowed   bool
+	statement string
+}
+
+// evaluate decides a request like IAM: an explicit deny wins over any allow, and a request no
+// statement allows is denied
+func (p *AccessPolicy) evaluate(request policyRequest) policyDecision {
+	var allow *policyDecision
+	for i, statement := range p.Statements {
+		if !statement.matches(request) {
+			continue
+		}
+		name := statement.Sid
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if statement.Effect == effectDeny {
+			return policyDecision{allowed: false, statement: name}
+		}
+		if allow == nil {
+			allow = &policyDecision{allowed: true, statement: name}
+		}
+	}
+	if allow != nil {
+		return *allow
+	}
+	return policyDecision{}
+}
+
+// matches reports whether a statement applies to a request
+func (s PolicyStatement) matches(request policyRequest) bool {
+	if !slices.ContainsFunc(s.Actions, func(pattern string) bool { return actionMatches(pattern, request.action) }) {
+		return false
+	}
+	if len(s.Roles) > 0 && !slices.Contains(s.Roles, request.role) {
+		return false
+	}
+	condition := s.Condition
+	if condition.TenantMatch != nil {
+		sameTenant := request.callerTenant != "" && request.callerTenant == request.tenant
+		if sameTenant != *condition.TenantMatch {
+			return false
+		}
+	}
+	if len(condition.Tenants) > 0 && !slices.Contains(condition.Tenants, request.tenant) {
+		return false
+	}
+	if len(condition.Fields) > 0 && !slices.ContainsFunc(condition.Fields, func(field string) bool { return slices.Contains(request.fields, field) }) {
+		return false
+	}
+	return true
+}
+
+// actionMatches compares an action with a pattern, case-insensitively like IAM. A pattern
+// ending in "*" matches every action with its prefix.
+func actionMatches(pattern string, action string) bool {
+	pattern, action = strings.ToLower(pattern), strings.ToLower(action)
+	if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard {
+		return strings.HasPrefix(action, prefix)
+	}
+	return pattern == action
+}
+
+// bodyFields returns the top-level fields a request body sets, including those of the persons
+// of a batch. Bodies that are not JSON objects set none; their handler rejects them.
+func bodyFields(body string) []string {
+	var fields map[string]json.RawMessage
+	if body == "" || json.Unmarshal([]byte(body), &fields) != nil {
+		return nil
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	var batch struct {
+		Persons []map[string]json.RawMessage `json:"persons"`
+	}
+	if _, ok := fields["persons"]; ok && json.Unmarshal([]byte(body), &batch) == nil {
+		for _, person := range batch.Persons {
+			for name := range person {
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// requestTenant returns the tenant a request acts on: the stored tenantId of the person for
+// /persons/{personId} routes, else the caller's tenant. It is never taken from the client's
+// X-Tenant-Id header. A person that does not exist yet (PUT creates it) is in the caller's tenant.
+func requestTenant(ctx context.Context, request events.APIGatewayProxyRequest, caller *Caller) (string, error) {
+	personID := request.PathParameters["personId"]
+	if personID == "" {
+		return caller.Tenant, nil
+	}
+	expr, err := expression.NewBuilder().WithProjection(expression.NamesList(expression.Name("tenantId"))).Build()
+	if err != nil {
+		return "", err
+	}
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                aws.String(tableName),
+		Key:                      map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		ProjectionExpression:     expr.Projection(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if result.Item == nil {
+		return caller.Tenant, nil
+	}
+	tenant, _ := result.Item["tenantId"].(*types.AttributeValueMemberS)
+	if tenant == nil {
+		return "", nil
+	}
+	return tenant.Value, nil
+}
+
+// authorize checks the caller may perform the route's action. Without an ACCESS_POLICY the
+// caller's role decides, as in requireRole. Anonymous requests (when authentication is not
+// required) are not restricted. Every policy decision is logged with the deciding statement
+// and counted in the PolicyDecisions metric.
+func authorize(action string) middleware {
+	return func(next handlerFunc) handlerFunc {
+		byRole := requireRole(next)
+		return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+			caller := callerFromContext(ctx)
+			if accessPolicy == nil || caller == nil {
+				return byRole(ctx, request)
+			}
+			tenant, err := requestTenant(ctx, request, caller)
+			if err != nil {
+				return internalErrorResponse(ctx, request, "look up tenant", err), nil
+			}
+			decision := accessPolicy.evaluate(policyRequest{
+				action:       action,
+				role:         caller.Role,
+				callerTenant: caller.Tenant,
+				tenant:       tenant,
+				fields:       bodyFields(request.Body),
+			})
+			outcome := effectAllow
+			if !decision.allowed {
+				outcome = effectDeny
+			}
+			metrics.Emit(map[string]string{"Action": action, "Decision": outcome}, map[string]interface{}{"statement": decision.statement}, metrics.Count("PolicyDecisions", 1))
+			if !decision.allowed {
+				logger.FromContext(ctx).Warn("Policy denied request", "action", action, "statement", decision.statement)
+				return errorResponse(request, http.StatusForbidden, errCodeForbidden,
+					fmt.Sprintf("The access policy does not allow %s", action)), nil
+			}
+			logger.FromContext(ctx).Info("Policy allowed request", "action", action, "statement", decision.statement)
+			return next(ctx, request)
+		}
+	}
+}
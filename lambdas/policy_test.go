@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestAccessPolicyEvaluate(t *testing.T) {
+	policy := loadAccessPolicy(`{"statements": [
+		{"sid": "read", "effect": "allow", "actions": ["person:Read*", "person:List"]},
+		{"sid": "write", "effect": "allow", "roles": ["editor", "admin"], "actions": ["person:*"]},
+		{"sid": "own-tenant", "effect": "deny", "actions": ["*"], "condition": {"tenantMatch": false}},
+		{"sid": "email", "effect": "deny", "roles": ["editor"], "actions": ["person:Update"], "condition": {"fields": ["email"]}}
+	]}`)
+	if policy == nil {
+		t.Fatal("policy did not load")
+	}
+
+	tests := []struct {
+		name      string
+		request   policyRequest
+		allowed   bool
+		statement string
+	}{
+		{"reader reads", policyRequest{action: actionRead, role: roleReader, callerTenant: "a", tenant: "a"}, true, "read"},
+		{"reader reads timeline", policyRequest{action: actionReadTimeline, role: roleReader, callerTenant: "a", tenant: "a"}, true, "read"},
+		{"reader cannot delete", policyRequest{action: actionDelete, role: roleReader, callerTenant: "a", tenant: "a"}, false, ""},
+		{"editor deletes", policyRequest{action: actionDelete, role: roleEditor, callerTenant: "a", tenant: "a"}, true, "write"},
+		{"other tenant denied", policyRequest{action: actionRead, role: roleAdmin, callerTenant: "a", tenant: "b"}, false, "own-tenant"},
+		{"no tenant claim denied", policyRequest{action: actionRead, role: roleAdmin, tenant: "a"}, false, "own-tenant"},
+		{"editor cannot change email", policyRequest{action: actionUpdate, role: roleEditor, callerTenant: "a", tenant: "a", fields: []string{"firstName", "email"}}, false, "email"},
+		{"editor changes name", policyRequest{action: actionUpdate, role: roleEditor, callerTenant: "a", tenant: "a", fields: []string{"firstName"}}, true, "write"},
+		{"admin changes email", policyRequest{action: actionUpdate, role: roleAdmin, callerTenant: "a", tenant: "a", fields: []string{"email"}}, true, "write"},
+		{"actions are case-insensitive", policyRequest{action: "PERSON:read", role: roleReader, callerTenant: "a", tenant: "a"}, true, "read"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := policy.evaluate(tt.request)
+			if decision.allowed != tt.allowed || decision.statement != tt.statement {
+				t.Errorf("decision = %+v, want allowed=%v statement=%q", decision, tt.allowed, tt.statement)
+			}
+		})
+	}
+}
+
+func TestLoadAccessPolicyInvalid(t *testing.T) {
+	for _, config := range []string{
+		`not json`,
+		`{"statements": []}`,
+		`{"statements": [{"effect": "permit", "actions": ["*"]}]}`,
+		`{"statements": [{"effect": "allow"}]}`,
+	} {
+		if policy := loadAccessPolicy(config); policy != nil {
+			t.Errorf("loadAccessPolicy(%s) = %+v, want nil", config, policy)
+		}
+	}
+}
+
+func TestBodyFields(t *testing.T) {
+	fields := bodyFields(`{"persons": [{"firstName": "Ada"}, {"email": "ada@example.com"}]}`)
+	for _, want := range []string{"persons", "firstName", "email"} {
+		if !slices.Contains(fields, want) {
+			t.Errorf("bodyFields = %v, missing %s", fields, want)
+		}
+	}
+	if fields := bodyFields(`[1, 2]`); fields != nil {
+		t.Errorf("bodyFields of an array = %v, want nil", fields)
+	}
+}
+
+func TestAuthorizeUsesStoredTenant(t *testing.T) {
+	previous := accessPolicy
+	accessPolicy = loadAccessPolicy(`{"statements": [
+		{"sid": "all", "effect": "allow", "actions": ["*"]},
+		{"sid": "own-tenant", "effect": "deny", "actions": ["*"], "condition": {"tenantMatch": false}}
+	]}`)
+	t.Cleanup(func() { accessPolicy = previous })
+
+	tests := []struct {
+		name       string
+		action     string
+		personID   string
+		header     string
+		itemTenant string
+		allowed    bool
+	}{
+		{"header names the caller's tenant, person in another", actionRead, "p-1", "a", "b", false},
+		{"header names another tenant, person in the caller's", actionRead, "p-1", "b", "a", true},
+		{"person without a tenant", actionDelete, "p-1", "a", "", false},
+		{"list with another tenant's header", actionList, "", "b", "", true},
+		{"create with another tenant's header", actionCreate, "", "b", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeDynamoDB(t, func(operation string, input map[string]interface{}) interface{} {
+				if tt.itemTenant == "" {
+					return stringItem(map[string]string{"personId": tt.personID})
+				}
+				return stringItem(map[string]string{"personId": tt.personID, "tenantId": tt.itemTenant})
+			})
+			called := false
+			next := func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+				called = true
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+			}
+			ctx := context.WithValue(context.Background(), callerKey{}, &Caller{Subject: "user-1", Role: roleAdmin, Tenant: "a"})
+			request := events.APIGatewayProxyRequest{
+				Headers:        map[string]string{"X-Tenant-Id": tt.header},
+				PathParameters: map[string]string{},
+			}
+			if tt.personID != "" {
+				request.PathParameters["personId"] = tt.personID
+			}
+
+			response, err := authorize(tt.action)(next)(ctx, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if called != tt.allowed {
+				t.Errorf("handler called = %v, want %v (status %d)", called, tt.allowed, response.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/models"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// preferencesRequest is the body of PUT /persons/{personId}/preferences. A channel left out
+// stays allowed, so {"sms": false} opts out of SMS only.
+type preferencesRequest struct {
+	Email *bool `json:"email"`
+	SMS   *bool `json:"sms"`
+}
+
+// handlePutPreferences replaces the notification preferences of a person. They are stored on
+// the person item, so the email lambda reads them from the person event without a lookup.
+func handlePutPreferences(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	personID := request.PathParameters["personId"]
+	var body preferencesRequest
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		logger.FromContext(ctx).Warn("Failed to parse request body", "error", err)
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid input"), nil
+	}
+	preferences := models.NotificationPreferences{
+		Email: body.Email == nil || *body.Email,
+		SMS:   body.SMS == nil || *body.SMS,
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	update := touch(ctx, expression.Set(expression.Name("preferences"), expression.Value(preferences)), now)
+	condition := expression.AttributeExists(expression.Name("personId")).And(ddbexpr.NotDeleted())
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+	if err != nil {
+		return internalErrorResponse(ctx, request, "build preferences update", err), nil
+	}
+	result, err := svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
+	}
+	if err != nil {
+		return internalErrorResponse(ctx, request, "update preferences", err), nil
+	}
+
+	logger.FromContext(ctx).Info("Updated notification preferences", "personId", personID, "email", preferences.Email, "sms", preferences.SMS)
+	response, err := jsonResponse(ctx, request, http.StatusOK, preferences)
+	response.Headers["ETag"] = etag(versionOf(result.Attributes))
+	return response, err
+}
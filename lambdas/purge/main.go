@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"time"
+
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/erasure"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/joblock"
+	"aws-lambda-go/internal/legalhold"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// purgeActor is recorded as the actor of the erasures, in the events and the audit trail
+const purgeActor = "system:purge"
+
+// Outcomes of a person in a run's report
+const (
+	outcomePurged     = "purged"
+	outcomeWouldPurge = "wouldPurge"
+	outcomeHeld       = "held"
+	outcomeConflict   = "conflict"
+	outcomeFailed     = "failed"
+)
+
+var settings, settingsErr = config.LoadPurge()
+
+var (
+	dynamo       *dynamodb.Client
+	s3Client     *s3.Client
+	eventsClient *eventbridge.Client
+	// jobs keeps runs from overlapping, e.g. a manual run during the scheduled one
+	jobs *joblock.Locker
+	// legalHolds keeps held persons from being purged
+	legalHolds *legalhold.Checker
+	// eraser removes the notifications of purged persons and announces their erasure, like
+	// DELETE /persons/{personId}/erase
+	eraser *erasure.Eraser
+)
+
+func init() {
+	logger.Init("purge")
+	metrics.Init("purge")
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	if err := tracing.Init(context.TODO(), "purge"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	metrics.InstrumentDynamoDB(&cfg)
+	dynamo = ddbclient.New(cfg, settings.DynamoDB)
+	s3Client = s3.NewFromConfig(cfg)
+	eventsClient = eventbridge.NewFromConfig(cfg)
+	jobs = joblock.New(dynamo, settings.JobLockTableName)
+	legalHolds = legalhold.New(dynamo, settings.LegalHoldsTableName)
+	eraser = erasure.New(dynamo, eventsClient, settings.NotificationsTableName, settings.EventBusName)
+}
+
+// Invocation is the payload of a run. The schedule sends an EventBridge event, which sets
+// nothing; a manual invocation with {"dryRun": true} or {"dryRun": false} overrides PURGE_DRY_RUN.
+type Invocation struct {
+	DryRun *bool `json:"dryRun"`
+}
+
+// PurgedPerson is the outcome of one person in a run. Reports only carry person IDs, never PII.
+type PurgedPerson struct {
+	PersonID      string `json:"personId"`
+	DeletedAt     string `json:"deletedAt"`
+	Outcome       string `json:"outcome"`
+	Notifications int    `json:"notifications,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Report is the report of one run, written to S3
+type Report struct {
+	RunID         string `json:"runId"`
+	DryRun        bool   `json:"dryRun"`
+	StartedAt     string `json:"startedAt"`
+	FinishedAt    string `json:"finishedAt"`
+	RetentionDays int    `json:"retentionDays"`
+	// DeletedBefore is the cutoff: persons soft-deleted before it are purged
+	DeletedBefore        string         `json:"deletedBefore"`
+	Matched              int            `json:"matched"`
+	Outcomes             map[string]int `json:"outcomes"`
+	NotificationsDeleted int            `json:"notificationsDeleted"`
+	Persons              []PurgedPerson `json:"persons"`
+}
+
+// expired selects the persons soft-deleted before the cutoff
+func expired(cutoff string) expression.ConditionBuilder {
+	return expression.Name("deleted").Equal(expression.Value(true)).
+		And(expression.Name("deletedAt").LessThan(expression.Value(cutoff)))
+}
+
+// expiredPersons scans for the persons soft-deleted before the cutoff
+func expiredPersons(ctx context.Context, cutoff string) ([]PurgedPerson, error) {
+	expr, err := expression.NewBuilder().
+		WithFilter(expired(cutoff)).
+		WithProjection(expression.NamesList(expression.Name("personId"), expression.Name("deletedAt"))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	var persons []PurgedPerson
+	paginator := dynamodb.NewScanPaginator(dynamo, &dynamodb.ScanInput{
+		TableName:                 aws.String(settings.TableName),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan persons: %w", err)
+		}
+		for _, item := range page.Items {
+			personID, _ := item["personId"].(*types.AttributeValueMemberS)
+			deletedAt, _ := item["deletedAt"].(*types.AttributeValueMemberS)
+			if personID == nil || deletedAt == nil {
+				continue
+			}
+			persons = append(persons, PurgedPerson{PersonID: personID.Value, DeletedAt: deletedAt.Value})
+		}
+	}
+	return persons, nil
+}
+
+// deletePerson hard-deletes a person unless it was restored or deleted again since the scan.
+// It returns false when the person no longer qualifies.
+func deletePerson(ctx context.Context, personID string, cutoff string) (bool, error) {
+	expr, err := expression.NewBuilder().WithCondition(expired(cutoff)).Build()
+	if err != nil {
+		return false, err
+	}
+	_, err = dynamo.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(settings.TableName),
+		Key:                       map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// purgePerson settles one expired person. Held persons are kept; in a dry run the others are
+// only reported. A purge deletes the person, then their notifications, then announces the
+// erasure, like DELETE /persons/{personId}/erase.
+func purgePerson(ctx context.Context, person *PurgedPerson, cutoff string, dryRun bool) error {
+	held, err := legalHolds.Active(ctx, person.PersonID)
+	if err != nil {
+		return fmt.Errorf("failed to check legal hold: %w", err)
+	}
+	switch {
+	case held:
+		person.Outcome = outcomeHeld
+		return nil
+	case dryRun:
+		person.Outcome = outcomeWouldPurge
+		return nil
+	}
+
+	deleted, err := deletePerson(ctx, person.PersonID, cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to delete person: %w", err)
+	}
+	if !deleted {
+		person.Outcome = outcomeConflict
+		return nil
+	}
+	// From here on the person is gone, so a failure is not retried by a later run; the report
+	// lists it for an operator
+	if person.Notifications, err = eraser.DeleteNotifications(ctx, person.PersonID); err != nil {
+		return fmt.Errorf("failed to delete notifications: %w", err)
+	}
+	if err := eraser.PublishErased(ctx, person.PersonID, time.Now().UTC().Format(time.RFC3339), purgeActor); err != nil {
+		return fmt.Errorf("failed to publish PersonErased: %w", err)
+	}
+	person.Outcome = outcomePurged
+	return nil
+}
+
+// writeReport stores the report of a run as reports/<date>/<runId>.json
+func writeReport(ctx context.Context, report *Report, now time.Time) error {
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("reports/%s/%s.json", now.Format("2006-01-02"), report.RunID)
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(settings.ReportBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write report %s: %w", key, err)
+	}
+	logger.FromContext(ctx).Info("Wrote purge report", "key", key)
+	return nil
+}
+
+// runPurge purges the persons whose soft delete is older than the retention window and
+// writes the run's report. Persons that could not be purged fail the run once the report is written.
+func runPurge(ctx context.Context, dryRun bool) error {
+	start := time.Now()
+	now := start.UTC()
+	report := &Report{
+		RunID:         uuid.NewString(),
+		DryRun:        dryRun,
+		StartedAt:     now.Format(time.RFC3339),
+		RetentionDays: settings.RetentionDays,
+		DeletedBefore: now.AddDate(0, 0, -settings.RetentionDays).Format(time.RFC3339),
+		Outcomes:      map[string]int{},
+	}
+	// The run ID is the correlation ID of its erasures, so they can be traced back to the report
+	ctx = logger.WithCorrelationID(logger.With(ctx, "runId", report.RunID, "dryRun", dryRun), report.RunID)
+
+	persons, err := expiredPersons(ctx, report.DeletedBefore)
+	if err != nil {
+		return err
+	}
+	sort.Slice(persons, func(i, j int) bool { return persons[i].PersonID < persons[j].PersonID })
+	report.Matched = len(persons)
+
+	var failures int
+	for i := range persons {
+		person := &persons[i]
+		if err := purgePerson(ctx, person, report.DeletedBefore, dryRun); err != nil {
+			person.Outcome = outcomeFailed
+			person.Error = err.Error()
+			failures++
+			logger.FromContext(ctx).Error("Failed to purge person", "personId", person.PersonID, "error", err)
+		}
+		report.Outcomes[person.Outcome]++
+		report.NotificationsDeleted += person.Notifications
+		if ctx.Err() != nil {
+			// The lock was lost or the invocation is timing out; report what was done so far
+			persons = persons[:i+1]
+			break
+		}
+	}
+	report.Persons = persons
+	if report.Persons == nil {
+		report.Persons = []PurgedPerson{}
+	}
+	report.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := writeReport(context.WithoutCancel(ctx), report, now); err != nil {
+		return err
+	}
+
+	metrics.Emit(map[string]string{"DryRun": fmt.Sprint(dryRun)}, nil,
+		metrics.Count("SoftDeletesExpired", report.Matched),
+		metrics.Count("PersonsPurged", report.Outcomes[outcomePurged]),
+		metrics.Count("PurgeSkippedHeld", report.Outcomes[outcomeHeld]),
+		metrics.Count("PurgeFailures", failures),
+		metrics.Duration("PurgeDuration", time.Since(start)))
+	logger.FromContext(ctx).Info("Purge run complete", "matched", report.Matched, "outcomes", report.Outcomes, "notificationsDeleted", report.NotificationsDeleted)
+
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d of %d persons could not be purged", failures, report.Matched)
+	}
+	return nil
+}
+
+// handler runs the purge on a schedule or when invoked by an operator
+func handler(ctx context.Context, invocation Invocation) error {
+	ctx = logger.WithLambda(ctx)
+	ctx = tracing.ExtractLambda(ctx)
+	defer tracing.Flush(ctx)
+	dryRun := settings.DryRun
+	if invocation.DryRun != nil {
+		dryRun = *invocation.DryRun
+	}
+	err := jobs.Run(ctx, "soft-delete-purge", func(ctx context.Context) error {
+		return runPurge(ctx, dryRun)
+	})
+	if errors.Is(err, joblock.ErrLocked) {
+		return nil
+	}
+	// A run that fails permanently (e.g. missing permissions) would fail the same way on retry
+	return errclass.Retry(ctx, err, "Purge run failed")
+}
+
+func main() {
+	config.Check(settingsErr)
+	lambda.Start(handler)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Data-quality issues, used in the report and as the Issue metric dimension
+const (
+	issueMissingPhone       = "missingPhone"
+	issueUnparseableAddress = "unparseableAddress"
+	issueBlankName          = "blankName"
+	issueUnverifiedEmail    = "unverifiedEmail"
+)
+
+// unverifiedEmailThreshold is how long an email may go without a confirmed delivery
+const unverifiedEmailThreshold = 30 * 24 * time.Hour
+
+// personRecord is the subset of a person item the checks look at, with PII decrypted
+type personRecord struct {
+	PersonID     string `dynamodbav:"personId"`
+	TenantID     string `dynamodbav:"tenantId"`
+	FirstName    string `dynamodbav:"firstName"`
+	LastName     string `dynamodbav:"lastName"`
+	Address      string `dynamodbav:"address"`
+	AddressParts string `dynamodbav:"addressParts"`
+	PhoneNumber  string `dynamodbav:"phoneNumber"`
+	Email        string `dynamodbav:"email"`
+	CreatedAt    string `dynamodbav:"createdAt"`
+}
+
+// checkPerson returns the issues of one person. verified reports whether an email was
+// ever delivered to the person; nil disables the unverified email check.
+func checkPerson(person personRecord, verified map[string]bool, now time.Time) []string {
+	var issues []string
+	if strings.TrimSpace(person.PhoneNumber) == "" {
+		issues = append(issues, issueMissingPhone)
+	}
+	if !parseableAddress(person) {
+		issues = append(issues, issueUnparseableAddress)
+	}
+	if strings.TrimSpace(person.FirstName) == "" || strings.TrimSpace(person.LastName) == "" {
+		issues = append(issues, issueBlankName)
+	}
+	if verified != nil && person.Email != "" && !verified[person.PersonID] {
+		created, err := time.Parse(time.RFC3339, person.CreatedAt)
+		// Persons from before audit timestamps count as old
+		if err != nil || now.Sub(created) > unverifiedEmailThreshold {
+			issues = append(issues, issueUnverifiedEmail)
+		}
+	}
+	return issues
+}
+
+// parseableAddress accepts structured (v2) addresses, and single-line addresses with at least
+// two comma-separated parts of which one contains a digit (house number or postal code)
+func parseableAddress(person personRecord) bool {
+	if person.AddressParts != "" {
+		return true
+	}
+	var parts int
+	var hasDigit bool
+	for _, part := range strings.Split(person.Address, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		parts++
+		if strings.IndexFunc(part, unicode.IsDigit) >= 0 {
+			hasDigit = true
+		}
+	}
+	return parts >= 2 && hasDigit
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"time"
+
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/fieldcrypt"
+	"aws-lambda-go/internal/joblock"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// noTenant groups persons created by callers without a tenant
+const noTenant = "_none"
+
+var settings, settingsErr = config.LoadQuality()
+
+var (
+	tableName              string
+	notificationsTableName string
+	reportBucket           string
+	dynamo                 *dynamodb.Client
+	s3Client               *s3.Client
+	pii                    *fieldcrypt.Encryptor
+	// jobs keeps runs from overlapping, e.g. a manual run during the scheduled one
+	jobs *joblock.Locker
+)
+
+func init() {
+	logger.Init("quality")
+	metrics.Init("quality")
+	tableName = settings.TableName
+	notificationsTableName = settings.NotificationsTableName
+	reportBucket = settings.ReportBucket
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	if err := tracing.Init(context.TODO(), "quality"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	metrics.InstrumentDynamoDB(&cfg)
+	dynamo = ddbclient.New(cfg, settings.DynamoDB)
+	s3Client = s3.NewFromConfig(cfg)
+	pii = fieldcrypt.New(cfg, settings.PII.KMSKeyID, settings.PII.Fields)
+	jobs = joblock.New(dynamo, settings.JobLockTableName)
+}
+
+// PersonIssues lists the issues of one person. Reports only carry person IDs, never PII.
+type PersonIssues struct {
+	PersonID string   `json:"personId"`
+	Issues   []string `json:"issues"`
+}
+
+// TenantReport is the data-quality report of one tenant, written to S3
+type TenantReport struct {
+	TenantID       string         `json:"tenantId"`
+	GeneratedAt    string         `json:"generatedAt"`
+	PersonsChecked int            `json:"personsChecked"`
+	IssueCounts    map[string]int `json:"issueCounts"`
+	Persons        []PersonIssues `json:"persons"`
+}
+
+// deliveredPersons returns the IDs of persons that were delivered at least one notification,
+// which is what verifies their email address. It returns nil without a notifications table.
+func deliveredPersons(ctx context.Context) (map[string]bool, error) {
+	if notificationsTableName == "" {
+		return nil, nil
+	}
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Name("status").Equal(expression.Value("delivered"))).
+		WithProjection(expression.NamesList(expression.Name("personId"))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	delivered := map[string]bool{}
+	paginator := dynamodb.NewScanPaginator(dynamo, &dynamodb.ScanInput{
+		TableName:                 aws.String(notificationsTableName),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notifications: %w", err)
+		}
+		for _, item := range page.Items {
+			if personID, ok := item["personId"].(*types.AttributeValueMemberS); ok {
+				delivered[personID.Value] = true
+			}
+		}
+	}
+	return delivered, nil
+}
+
+// buildReports scans every person that is not soft-deleted and groups the issues by tenant
+func buildReports(ctx context.Context, verified map[string]bool, now time.Time) (map[string]*TenantReport, error) {
+	expr, err := expression.NewBuilder().WithFilter(ddbexpr.NotDeleted()).Build()
+	if err != nil {
+		return nil, err
+	}
+	reports := map[string]*TenantReport{}
+	paginator := dynamodb.NewScanPaginator(dynamo, &dynamodb.ScanInput{
+		TableName:                 aws.String(tableName),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan persons: %w", err)
+		}
+		for _, item := range page.Items {
+			personID, _ := item["personId"].(*types.AttributeValueMemberS)
+			if personID == nil {
+				continue
+			}
+			if err := pii.DecryptItem(ctx, personID.Value, item); err != nil {
+				return nil, err
+			}
+			var person personRecord
+			if err := attributevalue.UnmarshalMap(item, &person); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal person %s: %w", personID.Value, err)
+			}
+
+			tenant := person.TenantID
+			if tenant == "" {
+				tenant = noTenant
+			}
+			report, ok := reports[tenant]
+			if !ok {
+				report = &TenantReport{TenantID: tenant, GeneratedAt: now.Format(time.RFC3339), IssueCounts: map[string]int{}, Persons: []PersonIssues{}}
+				reports[tenant] = report
+			}
+			report.PersonsChecked++
+			issues := checkPerson(person, verified, now)
+			if len(issues) == 0 {
+				continue
+			}
+			for _, issue := range issues {
+				report.IssueCounts[issue]++
+			}
+			report.Persons = append(report.Persons, PersonIssues{PersonID: person.PersonID, Issues: issues})
+		}
+	}
+	return reports, nil
+}
+
+// writeReport stores a tenant report as reports/<date>/<tenant>.json
+func writeReport(ctx context.Context, report *TenantReport, now time.Time) error {
+	sort.Slice(report.Persons, func(i, j int) bool { return report.Persons[i].PersonID < report.Persons[j].PersonID })
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("reports/%s/%s.json", now.Format("2006-01-02"), report.TenantID)
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(reportBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write report %s: %w", key, err)
+	}
+	return nil
+}
+
+// handler runs the data-quality checks on a schedule
+func handler(ctx context.Context, event events.CloudWatchEvent) error {
+	ctx = logger.WithLambda(ctx)
+	ctx = tracing.ExtractLambda(ctx)
+	defer tracing.Flush(ctx)
+	err := jobs.Run(ctx, "data-quality", runChecks)
+	if errors.Is(err, joblock.ErrLocked) {
+		return nil
+	}
+	// A run that fails permanently (e.g. missing permissions) would fail the same way on retry
+	return errclass.Retry(ctx, err, "Data-quality run failed")
+}
+
+// runChecks writes the reports of one run
+func runChecks(ctx context.Context) error {
+	start := time.Now()
+	now := start.UTC()
+
+	verified, err := deliveredPersons(ctx)
+	if err != nil {
+		return err
+	}
+	reports, err := buildReports(ctx, verified, now)
+	if err != nil {
+		return err
+	}
+
+	totals := map[string]int{}
+	checked := 0
+	for _, report := range reports {
+		if err := writeReport(ctx, report, now); err != nil {
+			return err
+		}
+		checked += report.PersonsChecked
+		for issue, count := range report.IssueCounts {
+			totals[issue] += count
+		}
+		logger.FromContext(ctx).Info("Wrote data-quality report", "tenantId", report.TenantID, "personsChecked", report.PersonsChecked, "personsWithIssues", len(report.Persons))
+	}
+
+	metrics.Emit(nil, nil, metrics.Count("PersonsChecked", checked), metrics.Duration("ReportDuration", time.Since(start)))
+	for _, issue := range []string{issueMissingPhone, issueUnparseableAddress, issueBlankName, issueUnverifiedEmail} {
+		metrics.Emit(map[string]string{"Issue": issue}, nil, metrics.Count("DataQualityIssues", totals[issue]))
+	}
+	logger.FromContext(ctx).Info("Data-quality run complete", "tenants", len(reports), "personsChecked", checked, "issues", totals)
+	return nil
+}
+
+func main() {
+	config.Check(settingsErr)
+	lambda.Start(handler)
+}
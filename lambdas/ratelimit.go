@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Rate limiting counts requests per client in fixed one-minute windows in DynamoDB.
+// It is enabled when RATE_LIMIT_TABLE_NAME is set.
+var (
+	rateLimitTableName = settings.RateLimitTableName
+	rateLimitPerWindow = settings.RateLimitPerMinute
+)
+
+const (
+	rateLimitWindow = time.Minute
+	// errCodeRateLimited is returned with 429 once a client used up its window
+	errCodeRateLimited = "RATE_LIMITED"
+)
+
+// Headers describing the caller's rate limit, set on every response
+const (
+	headerRateLimitLimit     = "X-RateLimit-Limit"
+	headerRateLimitRemaining = "X-RateLimit-Remaining"
+	headerRateLimitReset     = "X-RateLimit-Reset"
+)
+
+// rateLimitState is a client's usage of the current window
+type rateLimitState struct {
+	limit int
+	used  int
+	reset time.Time
+}
+
+func (s rateLimitState) remaining() int {
+	return max(s.limit-s.used, 0)
+}
+
+// apply sets the rate limit headers on a response; X-RateLimit-Reset is the Unix time at which the window resets
+func (s rateLimitState) apply(response *events.APIGatewayProxyResponse) {
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	response.Headers[headerRateLimitLimit] = strconv.Itoa(s.limit)
+	response.Headers[headerRateLimitRemaining] = strconv.Itoa(s.remaining())
+	response.Headers[headerRateLimitReset] = strconv.FormatInt(s.reset.Unix(), 10)
+}
+
+// rateLimitClient identifies who a request is counted against: the authenticated user,
+// the IAM principal, or the source IP
+func rateLimitClient(request events.APIGatewayProxyRequest) string {
+	if caller := callerFromRequest(request); caller != nil {
+		return "user:" + caller.Subject
+	}
+	if arn := request.RequestContext.Identity.UserArn; arn != "" {
+		return "iam:" + arn
+	}
+	return "ip:" + request.RequestContext.Identity.SourceIP
+}
+
+// consumeRateLimit counts one request for the client and returns the window state after it
+func consumeRateLimit(ctx context.Context, client string, now time.Time) (rateLimitState, error) {
+	windowStart := now.Truncate(rateLimitWindow)
+	reset := windowStart.Add(rateLimitWindow)
+
+	// DynamoDB TTL removes finished windows
+	update := expression.Add(expression.Name("requestCount"), expression.Value(1)).
+		Set(expression.Name("expiresAt"), expression.IfNotExists(expression.Name("expiresAt"), expression.Value(reset.Add(rateLimitWindow).Unix())))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return rateLimitState{}, err
+	}
+	result, err := svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(rateLimitTableName),
+		Key: map[string]types.AttributeValue{
+			"clientId":    &types.AttributeValueMemberS{Value: client},
+			"windowStart": &types.AttributeValueMemberN{Value: strconv.FormatInt(windowStart.Unix(), 10)},
+		},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return rateLimitState{}, err
+	}
+	return rateLimitState{limit: rateLimitPerWindow, used: int(numberAttribute(result.Attributes, "requestCount")), reset: reset}, nil
+}
+
+// rateLimitMiddleware rejects clients over their per-minute limit with 429 and reports the
+// limit state in the X-RateLimit-* headers of every response, so clients can pace themselves.
+// When the counter cannot be updated the request is let through without the headers.
+func rateLimitMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if rateLimitTableName == "" {
+			return next(ctx, request)
+		}
+
+		now := time.Now()
+		state, err := consumeRateLimit(ctx, rateLimitClient(request), now)
+		if err != nil {
+			logger.FromContext(ctx).Warn("Rate limiter unavailable, letting request through", "error", err)
+			return next(ctx, request)
+		}
+
+		if state.used > state.limit {
+			response := errorResponse(request, http.StatusTooManyRequests, errCodeRateLimited, "Rate limit exceeded, retry after the window resets")
+			state.apply(&response)
+			response.Headers["Retry-After"] = strconv.Itoa(int(state.reset.Sub(now).Seconds()) + 1)
+			return response, nil
+		}
+
+		response, err := next(ctx, request)
+		state.apply(&response)
+		return response, err
+	}
+}
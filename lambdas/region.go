@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// The service runs active/passive across regions on DynamoDB global tables. Every response
+// names the region that served it and its role (REGION_ROLE), so clients can tell where they
+// landed. The standby region serves reads but rejects writes, so no data is written on both
+// sides while traffic fails over.
+var (
+	servingRegion = settings.AWSRegion
+	regionRole    = settings.RegionRole
+	// activeRegion is named in the responses of the standby region (ACTIVE_REGION)
+	activeRegion = settings.ActiveRegion
+)
+
+// regionStandby is the role of a region that serves reads only
+const regionStandby = "standby"
+
+// Headers describing the region that served a request
+const (
+	headerRegion       = "X-Region"
+	headerRegionRole   = "X-Region-Role"
+	headerActiveRegion = "X-Active-Region"
+)
+
+// errCodeRegionStandby is returned with 421 for writes sent to the standby region
+const errCodeRegionStandby = "REGION_STANDBY"
+
+// regionMiddleware sets the region headers on every response and rejects mutating requests
+// in the standby region with 421 Misdirected Request. The write was not applied, so clients
+// may send it to the active region right away.
+func regionMiddleware(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		var response events.APIGatewayProxyResponse
+		var err error
+		if regionRole == regionStandby && mutatingRequest(request) {
+			logger.FromContext(ctx).Info("Rejected write in standby region", "method", request.HTTPMethod, "route", request.Resource)
+			message := "This region is standby and serves reads only"
+			if activeRegion != "" {
+				message += "; send writes to " + activeRegion
+			}
+			response = errorResponse(request, http.StatusMisdirectedRequest, errCodeRegionStandby, message)
+		} else {
+			response, err = next(ctx, request)
+		}
+
+		if response.Headers == nil {
+			response.Headers = map[string]string{}
+		}
+		if servingRegion != "" {
+			response.Headers[headerRegion] = servingRegion
+		}
+		response.Headers[headerRegionRole] = regionRole
+		if regionRole == regionStandby && activeRegion != "" {
+			response.Headers[headerActiveRegion] = activeRegion
+		}
+		return response, err
+	}
+}
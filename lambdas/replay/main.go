@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/consumer"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/tracing"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	lambdasvc "github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+var settings, settingsErr = config.LoadReplay()
+
+var (
+	dynamo    *dynamodb.Client
+	sqsClient *sqs.Client
+	// lambdaClient invokes the audit and search consumers asynchronously
+	lambdaClient *lambdasvc.Client
+)
+
+func init() {
+	logger.Init("replay")
+	metrics.Init("replay")
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	if err := tracing.Init(context.TODO(), "replay"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	metrics.InstrumentDynamoDB(&cfg)
+	dynamo = ddbclient.New(cfg, settings.DynamoDB)
+	sqsClient = sqs.NewFromConfig(cfg)
+	lambdaClient = lambdasvc.NewFromConfig(cfg)
+}
+
+// replayedEvent is an archived event replayed by EventBridge, which adds the replay's name
+type replayedEvent struct {
+	events.CloudWatchEvent
+	ReplayName string `json:"replay-name"`
+}
+
+// replay is the part of a replay record (POST /admin/replays) the lambda needs
+type replay struct {
+	ReplayName string   `dynamodbav:"replayName"`
+	Consumer   string   `dynamodbav:"consumer"`
+	EventTypes []string `dynamodbav:"eventTypes"`
+}
+
+// replays caches the records of the replays seen by this instance; they never change
+var (
+	replaysMu sync.Mutex
+	replays   = map[string]*replay{}
+)
+
+// loadReplay returns the record of a replay, or nil when it was not started through the API
+func loadReplay(ctx context.Context, name string) (*replay, error) {
+	replaysMu.Lock()
+	cached, ok := replays[name]
+	replaysMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+	result, err := dynamo.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(settings.ReplaysTableName),
+		Key:       map[string]types.AttributeValue{"replayName": &types.AttributeValueMemberS{Value: name}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay %s: %w", name, err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	var record replay
+	if err := attributevalue.UnmarshalMap(result.Item, &record); err != nil {
+		return nil, errclass.Mark(errclass.Permanent, err)
+	}
+	replaysMu.Lock()
+	replays[name] = &record
+	replaysMu.Unlock()
+	return &record, nil
+}
+
+// wanted reports whether a replay passes an event on to its consumer. The email consumer
+// skips synthetic backfill events, like the live email rule.
+func (r *replay) wanted(changed personevents.PersonChanged) bool {
+	if len(r.EventTypes) > 0 && !slices.Contains(r.EventTypes, changed.EventName) {
+		return false
+	}
+	return r.Consumer != "email" || !changed.Synthetic
+}
+
+// forward delivers an event to a consumer the way its live rule does: the email queue gets
+// the event as the message body, the logging and indexer lambdas are invoked asynchronously
+// with it
+func forward(ctx context.Context, consumerName string, payload []byte) error {
+	functionName := map[string]string{"audit": settings.AuditFunctionName, "search": settings.SearchFunctionName}[consumerName]
+	switch {
+	case consumerName == "email" && settings.EmailQueueURL != "":
+		_, err := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(settings.EmailQueueURL),
+			MessageBody: aws.String(string(payload)),
+		})
+		return err
+	case functionName != "":
+		_, err := lambdaClient.Invoke(ctx, &lambdasvc.InvokeInput{
+			FunctionName:   aws.String(functionName),
+			InvocationType: lambdatypes.InvocationTypeEvent,
+			Payload:        payload,
+		})
+		return err
+	default:
+		return errclass.New(errclass.Permanent, fmt.Sprintf("consumer %q is not configured", consumerName))
+	}
+}
+
+// count adds an event to the forwarded or skipped count of a replay; failures only cost
+// progress visibility
+func count(ctx context.Context, replayName string, counter string) {
+	expr, err := expression.NewBuilder().WithUpdate(expression.Add(expression.Name(counter), expression.Value(1))).Build()
+	if err == nil {
+		_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(settings.ReplaysTableName),
+			Key:                       map[string]types.AttributeValue{"replayName": &types.AttributeValueMemberS{Value: replayName}},
+			UpdateExpression:          expr.Update(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+	}
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to count replayed event", "replayName", replayName, "error", err)
+	}
+}
+
+// replayEvent passes one replayed event on to the consumer of its replay, unless the
+// replay's filters exclude it
+func replayEvent(ctx context.Context, payload json.RawMessage) error {
+	var event replayedEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return errclass.Mark(errclass.Permanent, fmt.Errorf("invalid event: %w", err))
+	}
+	if event.ReplayName == "" {
+		logger.FromContext(ctx).Warn("Ignoring event that was not replayed", "eventId", event.ID)
+		return nil
+	}
+	ctx = logger.With(ctx, "replayName", event.ReplayName, "eventId", event.ID)
+	record, err := loadReplay(ctx, event.ReplayName)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		logger.FromContext(ctx).Warn("Ignoring event of a replay not started through POST /admin/replays")
+		return nil
+	}
+
+	changed, err := personevents.Parse(event.CloudWatchEvent)
+	if errors.Is(err, personevents.ErrNotPersonEvent) {
+		count(ctx, record.ReplayName, "skipped")
+		return nil
+	}
+	if err != nil {
+		return errclass.Mark(errclass.Permanent, err)
+	}
+	if !record.wanted(changed) {
+		count(ctx, record.ReplayName, "skipped")
+		return nil
+	}
+	if err := forward(ctx, record.Consumer, payload); err != nil {
+		return fmt.Errorf("failed to forward event to %s: %w", record.Consumer, err)
+	}
+	count(ctx, record.ReplayName, "forwarded")
+	metrics.Emit(map[string]string{"Consumer": record.Consumer, "EventName": changed.EventName}, nil, metrics.Count("EventsReplayed", 1))
+	return nil
+}
+
+// handler receives the events of the replay rule, which only matches replayed events. Events
+// that can never be forwarded are dropped; other failures are retried by EventBridge.
+func handler(ctx context.Context, payload json.RawMessage) (struct{}, error) {
+	return struct{}{}, errclass.Retry(ctx, replayEvent(ctx, payload), "Failed to replay event")
+}
+
+func main() {
+	config.Check(settingsErr)
+	lambda.Start(consumer.Invocation(handler))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/smithy-go"
+	"github.com/google/uuid"
+)
+
+var (
+	// replaysTableName tracks replays (REPLAYS_TABLE_NAME); they replay the event archive
+	// (EVENT_ARCHIVE_ARN) on the bus (EVENT_BUS_ARN) to the replay rule (REPLAY_RULE_ARN) only
+	replaysTableName = settings.ReplaysTableName
+	eventArchiveARN  = settings.EventArchiveARN
+	eventBusARN      = settings.EventBusARN
+	replayRuleARN    = settings.ReplayRuleARN
+)
+
+// replayConsumers are the consumers the replay lambda can feed
+var replayConsumers = []string{"email", "audit", "search"}
+
+// replayEventTypes are the event names a replay can be limited to
+var replayEventTypes = []string{personevents.EventInsert, personevents.EventModify, personevents.EventRemove, personevents.EventRestore, personevents.EventErase}
+
+// ReplayRequest is the body of POST /admin/replays
+type ReplayRequest struct {
+	// Consumer receives the replayed events: "email", "audit" or "search"
+	Consumer string `json:"consumer"`
+	// From and To bound the archived events by their time, as RFC 3339 timestamps
+	From string `json:"from"`
+	To   string `json:"to"`
+	// EventTypes limits the replay to some event names; every event when empty
+	EventTypes []string `json:"eventTypes,omitempty"`
+}
+
+// Replay is the response of POST /admin/replays and GET /admin/replays/{replayName}. The
+// replay lambda counts the events it forwarded and skipped; State and the times come from
+// EventBridge.
+type Replay struct {
+	ReplayName  string   `json:"replayName" dynamodbav:"replayName"`
+	Consumer    string   `json:"consumer" dynamodbav:"consumer"`
+	From        string   `json:"from" dynamodbav:"from"`
+	To          string   `json:"to" dynamodbav:"to"`
+	EventTypes  []string `json:"eventTypes,omitempty" dynamodbav:"eventTypes,omitempty"`
+	CreatedAt   string   `json:"createdAt" dynamodbav:"createdAt"`
+	RequestedBy string   `json:"requestedBy,omitempty" dynamodbav:"requestedBy,omitempty"`
+	Forwarded   int      `json:"forwarded" dynamodbav:"forwarded"`
+	Skipped     int      `json:"skipped" dynamodbav:"skipped"`
+
+	State            string `json:"state,omitempty" dynamodbav:"-"`
+	StateReason      string `json:"stateReason,omitempty" dynamodbav:"-"`
+	LastReplayedTime string `json:"lastReplayedTime,omitempty" dynamodbav:"-"`
+	EndedAt          string `json:"endedAt,omitempty" dynamodbav:"-"`
+}
+
+// handleCreateReplay replays the archived person events of a time range into one consumer and
+// answers 202 with the replay's name. The replay is recorded before it starts, so the replay
+// lambda finds its consumer and filters when the first event arrives.
+func handleCreateReplay(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if replaysTableName == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Replays are not enabled"), nil
+	}
+	var replayRequest ReplayRequest
+	if err := json.Unmarshal([]byte(request.Body), &replayRequest); err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid replay request"), nil
+	}
+	if !slices.Contains(replayConsumers, replayRequest.Consumer) {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "consumer must be email, audit or search"), nil
+	}
+	if replayRequest.Consumer == "search" && !searchIndex.Enabled() {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Search is not enabled"), nil
+	}
+	for _, eventType := range replayRequest.EventTypes {
+		if !slices.Contains(replayEventTypes, eventType) {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "eventTypes may hold INSERT, MODIFY, REMOVE, RESTORE and ERASE"), nil
+		}
+	}
+	from, fromErr := time.Parse(time.RFC3339, replayRequest.From)
+	to, toErr := time.Parse(time.RFC3339, replayRequest.To)
+	if fromErr != nil || toErr != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "from and to must be RFC 3339 timestamps"), nil
+	}
+	if !from.Before(to) || to.After(time.Now()) {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "from must be before to, and to may not be in the future"), nil
+	}
+
+	replay := Replay{
+		ReplayName:  "persons-" + uuid.New().String(),
+		Consumer:    replayRequest.Consumer,
+		From:        from.UTC().Format(time.RFC3339),
+		To:          to.UTC().Format(time.RFC3339),
+		EventTypes:  replayRequest.EventTypes,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+		RequestedBy: rateLimitClient(request),
+	}
+	item, err := attributevalue.MarshalMap(replay)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal replay", err), nil
+	}
+	if _, err := svc.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(replaysTableName), Item: item}); err != nil {
+		return internalErrorResponse(ctx, request, "record replay", err), nil
+	}
+
+	// Only the replay rule gets the replayed events, so the live consumers see none of them
+	started, err := eventsClient.StartReplay(ctx, &eventbridge.StartReplayInput{
+		ReplayName:     aws.String(replay.ReplayName),
+		Description:    aws.String(fmt.Sprintf("Person events for %s, requested by %s", replay.Consumer, replay.RequestedBy)),
+		EventSourceArn: aws.String(eventArchiveARN),
+		EventStartTime: aws.Time(from),
+		EventEndTime:   aws.Time(to),
+		Destination: &ebtypes.ReplayDestination{
+			Arn:        aws.String(eventBusARN),
+			FilterArns: []string{replayRuleARN},
+		},
+	})
+	if err != nil {
+		// Nothing was replayed, so the record would only mislead
+		if _, deleteErr := svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(replaysTableName),
+			Key:       map[string]types.AttributeValue{"replayName": &types.AttributeValueMemberS{Value: replay.ReplayName}},
+		}); deleteErr != nil {
+			logger.FromContext(ctx).Warn("Failed to delete the record of a replay that did not start", "replayName", replay.ReplayName, "error", deleteErr)
+		}
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ValidationException" {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, apiErr.ErrorMessage()), nil
+		}
+		return internalErrorResponse(ctx, request, "start replay", err), nil
+	}
+	replay.State = string(started.State)
+	logger.FromContext(ctx).Info("Replay started", "replayName", replay.ReplayName, "consumer", replay.Consumer, "from", replay.From, "to", replay.To, "eventTypes", replay.EventTypes)
+
+	response, err := jsonResponse(ctx, request, http.StatusAccepted, replay)
+	if err == nil && response.StatusCode == http.StatusAccepted {
+		response.Headers["Location"] = "/admin/replays/" + replay.ReplayName
+	}
+	return response, err
+}
+
+// handleGetReplay reports the progress of a replay
+func handleGetReplay(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if replaysTableName == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Replays are not enabled"), nil
+	}
+	replayName := request.PathParameters["replayName"]
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(replaysTableName),
+		Key:       map[string]types.AttributeValue{"replayName": &types.AttributeValueMemberS{Value: replayName}},
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "get replay", err), nil
+	}
+	if result.Item == nil {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Replay not found"), nil
+	}
+	var replay Replay
+	if err := attributevalue.UnmarshalMap(result.Item, &replay); err != nil {
+		return internalErrorResponse(ctx, request, "unmarshal replay", err), nil
+	}
+
+	described, err := eventsClient.DescribeReplay(ctx, &eventbridge.DescribeReplayInput{ReplayName: aws.String(replayName)})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "describe replay", err), nil
+	}
+	replay.State = string(described.State)
+	replay.StateReason = aws.ToString(described.StateReason)
+	if described.EventLastReplayedTime != nil {
+		replay.LastReplayedTime = described.EventLastReplayedTime.UTC().Format(time.RFC3339)
+	}
+	if described.ReplayEndTime != nil {
+		replay.EndedAt = described.ReplayEndTime.UTC().Format(time.RFC3339)
+	}
+	return jsonResponse(ctx, request, http.StatusOK, replay)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Roles, from least to most privileged
+const (
+	roleReader = "reader"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+// roleRank orders the roles so a higher role includes everything a lower one may do
+var roleRank = map[string]int{
+	roleReader: 1,
+	roleEditor: 2,
+	roleAdmin:  3,
+}
+
+// methodRoles is the least role each method on the person routes requires
+var methodRoles = map[string]string{
+	http.MethodGet:    roleReader,
+	http.MethodPost:   roleEditor,
+	http.MethodPut:    roleEditor,
+	http.MethodDelete: roleAdmin,
+}
+
+var (
+	// editorGroup and readerGroup are the Cognito groups that map to those roles (EDITOR_GROUP, READER_GROUP)
+	editorGroup = settings.EditorGroup
+	readerGroup = settings.ReaderGroup
+	// defaultRole applies to callers without a role claim, group, or roles table entry (DEFAULT_ROLE)
+	defaultRole = settings.DefaultRole
+	// rolesTableName optionally assigns roles per user sub; an entry overrides the token (ROLES_TABLE_NAME)
+	rolesTableName = settings.RolesTableName
+)
+
+// roleFromClaims picks the caller's role from the custom:role claim, else the most
+// privileged group they belong to, else the default role
+func roleFromClaims(claims map[string]interface{}, groups []string) string {
+	if role, _ := claims["custom:role"].(string); roleRank[role] > 0 {
+		return role
+	}
+	role := ""
+	for _, group := range groups {
+		var groupRole string
+		switch group {
+		case adminGroup:
+			groupRole = roleAdmin
+		case editorGroup:
+			groupRole = roleEditor
+		case readerGroup:
+			groupRole = roleReader
+		}
+		if roleRank[groupRole] > roleRank[role] {
+			role = groupRole
+		}
+	}
+	if role == "" {
+		return defaultRole
+	}
+	return role
+}
+
+// storedRole looks the caller up in the roles table. It returns "" when the table is not
+// configured or has no valid entry for the caller.
+func storedRole(ctx context.Context, subject string) (string, error) {
+	if rolesTableName == "" {
+		return "", nil
+	}
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(rolesTableName),
+		Key:       map[string]types.AttributeValue{"subject": &types.AttributeValueMemberS{Value: subject}},
+	})
+	if err != nil {
+		return "", err
+	}
+	role, _ := result.Item["role"].(*types.AttributeValueMemberS)
+	if role == nil || roleRank[role.Value] == 0 {
+		return "", nil
+	}
+	return role.Value, nil
+}
+
+// requireRole rejects callers whose role does not allow the request method. Anonymous
+// requests (when authentication is not required) are not restricted.
+func requireRole(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		caller := callerFromContext(ctx)
+		if caller == nil {
+			return next(ctx, request)
+		}
+		required, ok := methodRoles[request.HTTPMethod]
+		if !ok {
+			required = roleAdmin
+		}
+		if roleRank[caller.Role] < roleRank[required] {
+			return errorResponse(request, http.StatusForbidden, errCodeForbidden,
+				fmt.Sprintf("The %s role cannot %s this resource", caller.Role, request.HTTPMethod)), nil
+		}
+		return next(ctx, request)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// personRouteRequests are the person routes checked through the API router, by method
+var personRouteRequests = []events.APIGatewayProxyRequest{
+	{HTTPMethod: http.MethodGet, Path: "/persons/p-1"},
+	{HTTPMethod: http.MethodPost, Path: "/persons"},
+	{HTTPMethod: http.MethodPut, Path: "/persons/p-1"},
+	{HTTPMethod: http.MethodDelete, Path: "/persons/p-1"},
+	{HTTPMethod: http.MethodPost, Path: "/v2/persons"},
+	{HTTPMethod: http.MethodDelete, Path: "/v1/persons/p-1"},
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		role    string
+		method  string
+		allowed bool
+	}{
+		{roleReader, http.MethodGet, true},
+		{roleReader, http.MethodPost, false},
+		{roleReader, http.MethodPut, false},
+		{roleReader, http.MethodDelete, false},
+		{roleEditor, http.MethodGet, true},
+		{roleEditor, http.MethodPost, true},
+		{roleEditor, http.MethodPut, true},
+		{roleEditor, http.MethodDelete, false},
+		{roleAdmin, http.MethodGet, true},
+		{roleAdmin, http.MethodPost, true},
+		{roleAdmin, http.MethodPut, true},
+		{roleAdmin, http.MethodDelete, true},
+		{roleEditor, http.MethodPatch, false},
+		{"", http.MethodGet, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.method, func(t *testing.T) {
+			called := false
+			next := func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+				called = true
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+			}
+			ctx := context.WithValue(context.Background(), callerKey{}, &Caller{Subject: "user-1", Role: tt.role})
+
+			response, err := requireRole(next)(ctx, events.APIGatewayProxyRequest{HTTPMethod: tt.method})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if called != tt.allowed {
+				t.Errorf("handler called = %v, want %v", called, tt.allowed)
+			}
+			if !tt.allowed && response.StatusCode != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", response.StatusCode, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestRequireRoleAnonymous(t *testing.T) {
+	called := false
+	next := func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		called = true
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	}
+	if _, err := requireRole(next)(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: http.MethodDelete}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !called {
+		t.Error("anonymous request was rejected")
+	}
+}
+
+func TestRoleFromClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"role claim", map[string]interface{}{"custom:role": "editor", "cognito:groups": "[admin]"}, roleEditor},
+		{"unknown role claim", map[string]interface{}{"custom:role": "owner", "cognito:groups": "[editor]"}, roleEditor},
+		{"admin group", map[string]interface{}{"cognito:groups": "[reader admin]"}, roleAdmin},
+		{"editor group", map[string]interface{}{"cognito:groups": "reader,editor"}, roleEditor},
+		{"reader group", map[string]interface{}{"cognito:groups": []interface{}{"reader"}}, roleReader},
+		{"no role", map[string]interface{}{"cognito:groups": "[other]"}, defaultRole},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roleFromClaims(tt.claims, parseGroups(tt.claims["cognito:groups"])); got != tt.want {
+				t.Errorf("role = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPersonRoutesAuthorizeRoles(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		// allowed lists the methods each role may use
+		allowed map[string][]string
+	}{
+		{
+			name: "roles without a policy",
+			allowed: map[string][]string{
+				roleReader: {http.MethodGet},
+				roleEditor: {http.MethodGet, http.MethodPost, http.MethodPut},
+				roleAdmin:  {http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			},
+		},
+		{
+			name: "access policy",
+			policy: `{"statements": [
+				{"sid": "read", "effect": "allow", "actions": ["person:Read*", "person:List"]},
+				{"sid": "write", "effect": "allow", "roles": ["editor", "admin"], "actions": ["person:*"]},
+				{"sid": "own-tenant", "effect": "deny", "actions": ["*"], "condition": {"tenantMatch": false}}
+			]}`,
+			allowed: map[string][]string{
+				roleReader: {http.MethodGet},
+				roleEditor: {http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+				roleAdmin:  {http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := accessPolicy
+			accessPolicy = loadAccessPolicy(tt.policy)
+			t.Cleanup(func() { accessPolicy = previous })
+			fake := useFakeDynamoDB(t, func(operation string, input map[string]interface{}) interface{} {
+				return stringItem(map[string]string{"personId": "p-1", "ownerId": "user-1", "tenantId": "a"})
+			})
+
+			// The registered middlewares run as in production; the handlers only record the call
+			r := newAPIRouter()
+			var called bool
+			for _, rt := range r.routes {
+				rt.handler = func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+					called = true
+					return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+				}
+			}
+
+			for role, methods := range tt.allowed {
+				for _, request := range personRouteRequests {
+					called = false
+					request.RequestContext.Authorizer = map[string]interface{}{
+						"claims": map[string]interface{}{"sub": "user-1", "custom:role": role, "custom:tenantId": "a"},
+					}
+					response, err := r.serve(context.Background(), request)
+					if err != nil {
+						t.Fatalf("%s %s as %s: unexpected error: %v", request.HTTPMethod, request.Path, role, err)
+					}
+					want := false
+					for _, method := range methods {
+						want = want || method == request.HTTPMethod
+					}
+					if called != want {
+						t.Errorf("%s %s as %s: handler called = %v, want %v (status %d)", request.HTTPMethod, request.Path, role, called, want, response.StatusCode)
+					}
+					if !want && response.StatusCode != http.StatusForbidden {
+						t.Errorf("%s %s as %s: status = %d, want %d", request.HTTPMethod, request.Path, role, response.StatusCode, http.StatusForbidden)
+					}
+				}
+			}
+			if len(fake.operations()) == 0 {
+				t.Error("the person routes never checked the stored person")
+			}
+		})
+	}
+}
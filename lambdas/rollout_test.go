@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestRolloutKeyUsesTenantClaim(t *testing.T) {
+	request := events.APIGatewayProxyRequest{
+		Headers:        map[string]string{"X-Tenant-Id": "other"},
+		RequestContext: events.APIGatewayProxyRequestContext{RequestID: "request-1"},
+	}
+
+	if key := rolloutKey(context.Background(), request); key != "request-1" {
+		t.Errorf("anonymous key = %q, want the request ID", key)
+	}
+	ctx := context.WithValue(context.Background(), callerKey{}, &Caller{Subject: "user-1", Tenant: "acme"})
+	if key := rolloutKey(ctx, request); key != "acme" {
+		t.Errorf("key = %q, want the tenant claim", key)
+	}
+}
+
+func TestEnvelopeRollout(t *testing.T) {
+	previous := rolloutPercents[featureEnvelope]
+	t.Cleanup(func() { rolloutPercents[featureEnvelope] = previous })
+
+	ctx := context.WithValue(context.Background(), apiVersionKey{}, apiV2)
+	request := events.APIGatewayProxyRequest{RequestContext: events.APIGatewayProxyRequestContext{RequestID: "request-1"}}
+	for _, tt := range []struct {
+		percent int
+		format  string
+	}{
+		{100, formatEnvelope},
+		{0, formatCleanJSON},
+	} {
+		rolloutPercents[featureEnvelope] = tt.percent
+		ctx, format := withServedFormat(ctx)
+
+		response, err := envelopeResponse(ctx, request, http.StatusOK, map[string]string{"personId": "p-1"}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+			t.Fatalf("decode body: %v", err)
+		}
+		if _, wrapped := body["data"]; wrapped != (tt.percent == 100) {
+			t.Errorf("percent %d: body = %s", tt.percent, response.Body)
+		}
+		if got := format(); got != tt.format {
+			t.Errorf("percent %d: format = %q, want %q", tt.percent, got, tt.format)
+		}
+	}
+}
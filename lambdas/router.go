@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// handlerFunc handles a routed API request
+type handlerFunc func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// middleware wraps a handlerFunc with cross-cutting behavior (logging, auth, ...)
+type middleware func(next handlerFunc) handlerFunc
+
+// route is a registered method + path pattern, e.g. GET /persons/{personId}
+type route struct {
+	method      string
+	pattern     string
+	segments    []string
+	handler     handlerFunc
+	middlewares []middleware
+}
+
+// router dispatches requests by method and path pattern through a middleware chain.
+// Global middlewares run for every request, including unmatched ones; route middlewares
+// run only for their route, inside the global ones.
+type router struct {
+	routes      []*route
+	middlewares []middleware
+}
+
+func newRouter() *router {
+	return &router{}
+}
+
+// use appends global middlewares. The first one registered is the outermost.
+func (r *router) use(middlewares ...middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// handle registers a handler for a method and path pattern. Path parameters are written
+// as {name} and made available in request.PathParameters.
+func (r *router) handle(method string, pattern string, handler handlerFunc, middlewares ...middleware) {
+	r.routes = append(r.routes, &route{
+		method:      method,
+		pattern:     pattern,
+		segments:    splitPath(pattern),
+		handler:     handler,
+		middlewares: middlewares,
+	})
+}
+
+// splitPath splits a path into its segments, ignoring leading and trailing slashes
+func splitPath(path string) []string {
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" {
+		return nil
+	}
+	return strings.Split(trimmed, "/")
+}
+
+// match compares the route pattern with a concrete path and extracts its parameters
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(rt.segments) != len(segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, pattern := range rt.segments {
+		if strings.HasPrefix(pattern, "{") && strings.HasSuffix(pattern, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[strings.Trim(pattern, "{}")] = segments[i]
+			continue
+		}
+		if pattern != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// matchRequest reports whether the route serves the request path. API Gateway REST and
+// named HTTP API routes already name the matched resource; the adapters of the other front
+// ends (ALB, Function URL, the $default HTTP API route) leave it empty, and the raw path is
+// matched against the pattern.
+func (rt *route) matchRequest(request events.APIGatewayProxyRequest, segments []string) (map[string]string, bool) {
+	if request.Resource == rt.pattern {
+		return request.PathParameters, true
+	}
+	return rt.match(segments)
+}
+
+// resolve finds the route for a request. pathFound reports whether the path exists
+// at all, to tell 404 from 405 when no route has the request method.
+func (r *router) resolve(request events.APIGatewayProxyRequest) (matched *route, params map[string]string, pathFound bool) {
+	segments := splitPath(request.Path)
+	for _, rt := range r.routes {
+		routeParams, ok := rt.matchRequest(request, segments)
+		if !ok {
+			continue
+		}
+		pathFound = true
+		if rt.method == request.HTTPMethod {
+			return rt, routeParams, true
+		}
+	}
+	return nil, nil, pathFound
+}
+
+// serve routes a request through the global middlewares and the matched route
+func (r *router) serve(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var handler handlerFunc
+	rt, params, pathFound := r.resolve(request)
+	switch {
+	case rt != nil:
+		request.Resource = rt.pattern
+		request.PathParameters = params
+		handler = chain(rt.handler, rt.middlewares)
+	case pathFound:
+		handler = func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+			return errorResponse(request, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed"), nil
+		}
+	default:
+		handler = func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+			return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Route not found"), nil
+		}
+	}
+	return chain(handler, r.middlewares)(ctx, request)
+}
+
+// chain wraps a handler so that middlewares[0] runs first
+func chain(handler handlerFunc, middlewares []middleware) handlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestRouterLiteralPatternPath(t *testing.T) {
+	var params map[string]string
+	r := newRouter()
+	r.handle("GET", "/persons/{personId}", func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		params = request.PathParameters
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+
+	// A client can send the pattern itself as the path; it must be matched like any other path
+	path := "/persons/{personId}"
+	alb, err := fromALBRequest(events.ALBTargetGroupRequest{HTTPMethod: "GET", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	functionURL, err := fromFunctionURLRequest(events.LambdaFunctionURLRequest{
+		RawPath:        path,
+		RequestContext: events.LambdaFunctionURLRequestContext{HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: "GET"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAPI, err := fromHTTPAPIRequest(events.APIGatewayV2HTTPRequest{
+		RouteKey:       "$default",
+		RawPath:        path,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{Method: "GET"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, request := range map[string]events.APIGatewayProxyRequest{"ALB": alb, "Function URL": functionURL, "HTTP API $default": httpAPI} {
+		t.Run(name, func(t *testing.T) {
+			params = nil
+			if request.Resource != "" {
+				t.Errorf("Resource = %q, want it left to the router", request.Resource)
+			}
+			response, err := r.serve(context.Background(), request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", response.StatusCode, http.StatusOK)
+			}
+			if params["personId"] == "" {
+				t.Errorf("PathParameters = %v, want the personId segment", params)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/internal/searchindex"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	defaultSearchLimit = 10
+	// maxSearchLimit keeps a page within the 100 keys of one BatchGetItem
+	maxSearchLimit = 50
+	maxSearchQuery = 200
+	// maxSearchResults is how deep pages may go; narrow the query to find more
+	maxSearchResults = 1000
+)
+
+// SearchResult is a person found by GET /persons/search, with its relevance
+type SearchResult struct {
+	Person models.Person `json:"person"`
+	Score  float64       `json:"score"`
+}
+
+// SearchResponse is the body of GET /persons/search, best results first
+type SearchResponse struct {
+	Results   []SearchResult `json:"results"`
+	NextToken string         `json:"nextToken,omitempty"`
+}
+
+// handleSearch answers GET /persons/search?q= from the OpenSearch index the Indexer Lambda
+// keeps. The index only finds the persons; their records are read from the table, so results
+// are as current, decrypted and filtered as any read.
+func handleSearch(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if !searchIndex.Enabled() {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Search is not enabled"), nil
+	}
+	text := strings.TrimSpace(request.QueryStringParameters["q"])
+	if text == "" {
+		return errorResponse(request, http.StatusBadRequest, errCodeMissingParameter, "q is required"), nil
+	}
+	if len(text) > maxSearchQuery {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, fmt.Sprintf("q may have at most %d characters", maxSearchQuery)), nil
+	}
+	limit := defaultSearchLimit
+	if value := request.QueryStringParameters["limit"]; value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxSearchLimit {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit)), nil
+		}
+		limit = parsed
+	}
+	// The continuation token is the offset of the next page
+	offset := 0
+	if token := request.QueryStringParameters["nextToken"]; token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err == nil {
+			offset, err = strconv.Atoi(string(decoded))
+		}
+		if err != nil || offset < 0 || offset >= maxSearchResults {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid nextToken"), nil
+		}
+	}
+	withDeleted, allowed := includeDeleted(ctx, request)
+	if !allowed {
+		return errorResponse(request, http.StatusForbidden, errCodeForbidden, "Only admins can include deleted persons"), nil
+	}
+
+	owner := ownerScope(ctx)
+	start := time.Now()
+	hits, err := searchIndex.Search(ctx, searchindex.Query{
+		Text:           text,
+		OwnerID:        owner,
+		IncludeDeleted: withDeleted,
+		From:           offset,
+		Size:           min(limit, maxSearchResults-offset),
+	})
+	// Searches across every owner are audited like unscoped lists, without the query itself
+	if owner == "" {
+		auditDataAccess(ctx, request, "search", map[string]string{"limit": strconv.Itoa(limit)}, len(hits), start, err)
+	}
+	if err != nil {
+		return internalErrorResponse(ctx, request, "search persons", err), nil
+	}
+
+	items, err := getSearchResults(ctx, hits)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "get search results", err), nil
+	}
+	response := SearchResponse{Results: []SearchResult{}}
+	filter := responseFilter(ctx)
+	// The items are listed in the order of the hits, best first
+	for _, hit := range hits {
+		item := items[hit.PersonID]
+		// Taken out, so a person found twice during a reindex is listed once
+		delete(items, hit.PersonID)
+		// The index trails the table by the event delivery, so its hits are checked again
+		if item == nil || (isDeleted(item) && !withDeleted) {
+			continue
+		}
+		if itemOwner, _ := item["ownerId"].(*types.AttributeValueMemberS); owner != "" && (itemOwner == nil || itemOwner.Value != owner) {
+			continue
+		}
+		if err := fieldEncryptor.DecryptItem(ctx, hit.PersonID, item); err != nil {
+			return internalErrorResponse(ctx, request, "decrypt search result", err), nil
+		}
+		filter.apply(item)
+		person, err := models.UnmarshalPerson(item)
+		if err != nil {
+			return internalErrorResponse(ctx, request, "unmarshal search result", err), nil
+		}
+		response.Results = append(response.Results, SearchResult{Person: person, Score: hit.Score})
+	}
+	if next := offset + len(hits); len(hits) == limit && next < maxSearchResults {
+		response.NextToken = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(next)))
+	}
+	return jsonResponse(ctx, request, http.StatusOK, response)
+}
+
+// getSearchResults reads the persons of the hits with BatchGetItem, keyed by personId.
+// Unprocessed keys are requested again with exponential backoff, like batch writes; persons
+// that are gone from the table are missing from the result.
+func getSearchResults(ctx context.Context, hits []searchindex.Hit) (map[string]map[string]types.AttributeValue, error) {
+	items := map[string]map[string]types.AttributeValue{}
+	// BatchGetItem rejects duplicate keys, which a reindex can briefly produce
+	var keys []map[string]types.AttributeValue
+	seen := map[string]bool{}
+	for _, hit := range hits {
+		if !seen[hit.PersonID] {
+			seen[hit.PersonID] = true
+			keys = append(keys, map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: hit.PersonID}})
+		}
+	}
+
+	backoff := batchRetryBackoff
+	for attempt := 1; len(keys) > 0; attempt++ {
+		result, err := svc.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]types.KeysAndAttributes{tableName: {Keys: keys}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range result.Responses[tableName] {
+			if personID, ok := item["personId"].(*types.AttributeValueMemberS); ok {
+				items[personID.Value] = item
+			}
+		}
+		keys = result.UnprocessedKeys[tableName].Keys
+		if len(keys) == 0 {
+			break
+		}
+		if attempt == maxBatchAttempts {
+			return nil, fmt.Errorf("%d search results still unprocessed after %d attempts", len(keys), attempt)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+	return items, nil
+}
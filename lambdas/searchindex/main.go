@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"time"
+
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/joblock"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/searchindex"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+var settings, settingsErr = config.LoadSearchIndex()
+
+var index *searchindex.Client
+
+// jobs keeps the scheduled and the post-deployment runs from migrating the index at once
+var jobs *joblock.Locker
+
+func init() {
+	logger.Init("searchindex")
+	metrics.Init("searchindex")
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	if err := tracing.Init(context.TODO(), "searchindex"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	index = searchindex.New(cfg, settings.OpenSearchEndpoint, searchindex.WithRollover(searchindex.Conditions{
+		MaxDocs: settings.RolloverMaxDocs,
+		MaxSize: settings.RolloverMaxSize,
+		MaxAge:  settings.RolloverMaxAge,
+	}))
+	jobs = joblock.New(ddbclient.New(cfg, settings.DynamoDB), settings.JobLockTableName)
+}
+
+// handler runs one lifecycle step of the person search index. It is invoked on a schedule
+// and after deployments that change it, so mapping changes are migrated without manual steps.
+func handler(ctx context.Context, _ json.RawMessage) error {
+	ctx = logger.WithLambda(ctx)
+	ctx = tracing.ExtractLambda(ctx)
+	defer tracing.Flush(ctx)
+	if !index.Enabled() {
+		logger.FromContext(ctx).Info("No search domain configured (OPENSEARCH_ENDPOINT), nothing to do")
+		return nil
+	}
+
+	start := time.Now()
+	var result searchindex.Result
+	err := jobs.Run(ctx, "searchindex", func(ctx context.Context) (err error) {
+		result, err = index.Ensure(ctx)
+		return err
+	})
+	if errors.Is(err, joblock.ErrLocked) {
+		return nil
+	}
+	metrics.Emit(
+		map[string]string{"Action": string(result.Action), "Outcome": metrics.ErrorOutcome(err)},
+		map[string]interface{}{"writeIndex": result.WriteIndex, "mappingVersion": searchindex.MappingVersion},
+		metrics.Count("SearchIndexLifecycle", 1),
+		metrics.Duration("SearchIndexLifecycleDuration", time.Since(start)),
+	)
+	if err != nil {
+		return errclass.Retry(ctx, err, "Search index lifecycle step failed", "writeIndex", result.WriteIndex)
+	}
+
+	indexLog := logger.FromContext(ctx).With("action", result.Action, "writeIndex", result.WriteIndex, "mappingVersion", searchindex.MappingVersion)
+	switch result.Action {
+	case searchindex.ActionMigrating:
+		indexLog.Info("Search index migration in progress", "task", result.Task)
+	case searchindex.ActionMigrated:
+		indexLog.Warn("Search index migrated; delete the replaced indices once the new ones are verified", "replaced", result.Replaced)
+	default:
+		indexLog.Info("Search index lifecycle step done")
+	}
+	return nil
+}
+
+func main() {
+	config.Check(settingsErr)
+	lambda.Start(handler)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"aws-lambda-go/internal/ddbexpr"
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// restoreWindowDays is how long a soft-deleted person can be restored (RESTORE_WINDOW_DAYS)
+var restoreWindowDays = settings.RestoreWindowDays
+
+// isDeleted reports whether an item is soft-deleted
+func isDeleted(item map[string]types.AttributeValue) bool {
+	deleted, ok := item["deleted"].(*types.AttributeValueMemberBOOL)
+	return ok && deleted.Value
+}
+
+// canSeeDeleted reports whether the caller may list and read soft-deleted persons
+func canSeeDeleted(ctx context.Context) bool {
+	caller := callerFromContext(ctx)
+	return caller == nil || caller.isAdmin()
+}
+
+// includeDeleted reads ?includeDeleted=true. ok is false when a caller other than an admin asks for it.
+func includeDeleted(ctx context.Context, request events.APIGatewayProxyRequest) (include bool, ok bool) {
+	if request.QueryStringParameters["includeDeleted"] != "true" {
+		return false, true
+	}
+	return true, canSeeDeleted(ctx)
+}
+
+// softDelete marks a person as deleted. Missing and already deleted persons are left unchanged.
+func softDelete(ctx context.Context, personID string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	update := touch(ctx, expression.Set(expression.Name("deleted"), expression.Value(true)), now).
+		Set(expression.Name("deletedAt"), expression.Value(now))
+	condition := expression.AttributeExists(expression.Name("personId")).And(ddbexpr.NotDeleted())
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+	if err != nil {
+		return err
+	}
+	_, err = svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+	return err
+}
+
+// handleRestore brings back a soft-deleted person within the restore window
+func handleRestore(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	personID := request.PathParameters["personId"]
+	now := time.Now().UTC()
+	cutoff := now.AddDate(0, 0, -restoreWindowDays).Format(time.RFC3339)
+
+	update := touch(ctx, expression.Remove(expression.Name("deleted")), now.Format(time.RFC3339)).
+		Remove(expression.Name("deletedAt"))
+	condition := expression.Name("deleted").Equal(expression.Value(true)).
+		And(expression.Name("deletedAt").GreaterThanEqual(expression.Value(cutoff)))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+	if err != nil {
+		return internalErrorResponse(ctx, request, "build restore", err), nil
+	}
+	result, err := svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(tableName),
+		Key:                                 map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		UpdateExpression:                    expr.Update(),
+		ConditionExpression:                 expr.Condition(),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		ReturnValues:                        types.ReturnValueUpdatedNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		switch {
+		case conditionErr.Item == nil:
+			return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Item not found"), nil
+		case !isDeleted(conditionErr.Item):
+			return errorResponse(request, http.StatusConflict, errCodeConflict, "The person is not deleted"), nil
+		default:
+			return errorResponse(request, http.StatusGone, errCodeRestoreExpired, "The restore window has passed"), nil
+		}
+	}
+	if err != nil {
+		return internalErrorResponse(ctx, request, "restore item", err), nil
+	}
+
+	logger.FromContext(ctx).Info("Restored person", "personId", personID)
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"ETag": etag(versionOf(result.Attributes))},
+		Body:       "Person restored successfully",
+	}, nil
+}
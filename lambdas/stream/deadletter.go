@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// messageSender is the part of the SQS client used to dead-letter records
+type messageSender interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+// DeadLetteredRecord is the message sent to the dead-letter queue for a record that failed
+// to publish. Sinks lists the sinks that rejected it; the redrive publishes it only to them.
+type DeadLetteredRecord struct {
+	Reason         string                     `json:"reason"`
+	ErrorClass     string                     `json:"errorClass"`
+	Sinks          []string                   `json:"sinks"`
+	Attempts       int                        `json:"attempts"`
+	EventID        string                     `json:"eventID"`
+	EventName      string                     `json:"eventName"`
+	EventSourceArn string                     `json:"eventSourceARN"`
+	SequenceNumber string                     `json:"sequenceNumber"`
+	FailedAt       string                     `json:"failedAt"`
+	Record         events.DynamoDBEventRecord `json:"record"`
+}
+
+// deliveryAttempts counts the failed deliveries of the records handed back to Lambda, by
+// event ID. The counts live in the Lambda instance: a new instance starts over, so a record
+// may be retried more often than STREAM_DLQ_AFTER_ATTEMPTS, never less.
+type deliveryAttempts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var attempts = &deliveryAttempts{counts: map[string]int{}}
+
+// failed counts a failed delivery of a record and returns how many it had
+func (a *deliveryAttempts) failed(eventID string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.counts[eventID]++
+	return a.counts[eventID]
+}
+
+// done forgets a record that was published or dead-lettered
+func (a *deliveryAttempts) done(eventID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.counts, eventID)
+}
+
+// failedSinks returns the names of the sinks behind a publish error
+func failedSinks(err error) []string {
+	var names []string
+	var walk func(error)
+	walk = func(err error) {
+		switch unwrapped := err.(type) {
+		case sinkError:
+			names = append(names, unwrapped.sink.name())
+		case interface{ Unwrap() []error }:
+			for _, e := range unwrapped.Unwrap() {
+				walk(e)
+			}
+		default:
+			if next := errors.Unwrap(err); next != nil {
+				walk(next)
+			}
+		}
+	}
+	walk(err)
+	return names
+}
+
+// deadLetter sends a record that failed attempts deliveries to the dead-letter queue, with
+// the error and the sinks that rejected it
+func deadLetter(ctx context.Context, client messageSender, record events.DynamoDBEventRecord, reason error, attempts int) error {
+	body, err := json.Marshal(DeadLetteredRecord{
+		Reason:         reason.Error(),
+		ErrorClass:     string(errclass.Classify(reason)),
+		Sinks:          failedSinks(reason),
+		Attempts:       attempts,
+		EventID:        record.EventID,
+		EventName:      record.EventName,
+		EventSourceArn: record.EventSourceArn,
+		SequenceNumber: record.Change.SequenceNumber,
+		FailedAt:       time.Now().UTC().Format(time.RFC3339),
+		Record:         record,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(settings.DeadLetterQueueURL),
+		MessageBody: aws.String(string(body)),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"eventID":    {DataType: aws.String("String"), StringValue: aws.String(record.EventID)},
+			"errorClass": {DataType: aws.String("String"), StringValue: aws.String(string(errclass.Classify(reason)))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter record %s: %w", record.EventID, err)
+	}
+	logger.FromContext(ctx).Warn("Dead-lettered record", "attempts", attempts, "reason", reason.Error())
+	return nil
+}
+
+// sinksNamed returns the configured sinks with the given names; all sinks when names is empty
+func sinksNamed(names []string) []sink {
+	if len(names) == 0 {
+		return sinks
+	}
+	var selected []sink
+	for _, s := range sinks {
+		for _, name := range names {
+			if s.name() == name {
+				selected = append(selected, s)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// redriveHandler publishes the records of the dead-letter queue again, each only to the sinks
+// that rejected it. Records that fail again are returned to the queue; records that can never
+// be published, and messages that are not dead-lettered records, are quarantined.
+func redriveHandler(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	start := time.Now()
+	counts := map[string]int{}
+	defer func() { emitRecordMetrics(counts, time.Since(start)) }()
+
+	response := events.SQSEventResponse{}
+	for _, message := range event.Records {
+		var dead DeadLetteredRecord
+		if err := json.Unmarshal([]byte(message.Body), &dead); err != nil {
+			if qErr := quarantineMessage(ctx, quarantineStore, message, err); qErr != nil {
+				logger.FromContext(ctx).Error("Failed to quarantine invalid dead-letter message, returning it to the queue", "messageId", message.MessageId, "error", qErr)
+				counts[outcomeRetried]++
+				response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+				continue
+			}
+			counts[outcomeQuarantined]++
+			continue
+		}
+		record := dead.Record
+		ctx := recordContext(ctx, record)
+		err := redrive(ctx, record, sinksNamed(dead.Sinks))
+		switch {
+		case err == nil:
+			counts[outcomeRedriven]++
+		case errclass.Classify(err) == errclass.Permanent:
+			if qErr := quarantine(ctx, quarantineStore, record, err); qErr != nil {
+				logger.FromContext(ctx).Error("Failed to quarantine record, returning it to the queue", "error", qErr)
+				counts[outcomeRetried]++
+				response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+				continue
+			}
+			counts[outcomeQuarantined]++
+		default:
+			logger.FromContext(ctx).Error("Failed to redrive record, returning it to the queue", "error", err)
+			counts[outcomeRetried]++
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+		}
+	}
+	logger.FromContext(ctx).Info("Redrive complete", "records", len(event.Records), "retried", len(response.BatchItemFailures))
+	return response, nil
+}
+
+// redrive builds the event of a dead-lettered record as the stream lambda does and publishes
+// it to the given sinks
+func redrive(ctx context.Context, record events.DynamoDBEventRecord, targets []sink) error {
+	if err := validateRecord(record); err != nil {
+		return errclass.Mark(errclass.Permanent, err)
+	}
+	detail, err := personChangedEvent(ctx, record)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return errclass.New(errclass.Permanent, "none of the failed sinks is configured")
+	}
+	pending := []pendingRecord{newPendingRecord(ctx, record, detail)}
+	err = publishRecords(ctx, targets, &backpressure{}, pending)[0]
+	tracing.End(pending[0].span, err)
+	return err
+}
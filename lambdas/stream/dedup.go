@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"aws-lambda-go/internal/consumer"
+	"aws-lambda-go/internal/logger"
+)
+
+// dedupStore remembers the records each sink took (STREAM_DEDUP_TABLE_NAME), so a batch that
+// Lambda delivers again does not publish its records twice; nil disables deduplication
+var dedupStore *consumer.IdempotencyStore
+
+// dedupKey identifies a record on a sink, e.g. "<eventID>/eventbridge"
+func dedupKey(item pendingRecord, sinkName string) string {
+	return item.record.EventID + "/" + sinkName
+}
+
+// claimSinks claims the record for every sink. Sinks that took it in an earlier delivery are
+// marked delivered, so publishRecords skips them. On an error, e.g. when an earlier delivery
+// is still publishing the record, the claims made so far are released.
+func claimSinks(ctx context.Context, item *pendingRecord) error {
+	if dedupStore == nil {
+		return nil
+	}
+	for _, s := range sinks {
+		claimed, err := dedupStore.Claim(ctx, dedupKey(*item, s.name()))
+		if err != nil {
+			releaseClaims(ctx, *item, item.claimed)
+			item.claimed = nil
+			return err
+		}
+		if claimed {
+			item.claimed = append(item.claimed, s.name())
+		} else {
+			item.delivered = append(item.delivered, s.name())
+		}
+	}
+	return nil
+}
+
+// duplicate reports whether every sink took the record in an earlier delivery
+func (r pendingRecord) duplicate() bool {
+	return dedupStore != nil && len(r.claimed) == 0
+}
+
+// settleClaims completes the claims of the sinks that took the record and releases those of
+// the sinks that failed, so a retry or redrive publishes it to them again. An error that names
+// no sink releases every claim.
+func settleClaims(ctx context.Context, item pendingRecord, publishErr error) {
+	failed := failedSinks(publishErr)
+	for _, name := range item.claimed {
+		published := publishErr == nil || (len(failed) > 0 && !slices.Contains(failed, name))
+		if !published {
+			releaseClaims(ctx, item, []string{name})
+			continue
+		}
+		if err := dedupStore.Complete(ctx, dedupKey(item, name)); err != nil {
+			// The claim expires after its lease; until then redeliveries are retried
+			logger.FromContext(ctx).Warn("Failed to record published record", "sink", name, "error", err)
+		}
+	}
+}
+
+// releaseClaims releases the claims of the record for the given sinks
+func releaseClaims(ctx context.Context, item pendingRecord, sinkNames []string) {
+	for _, name := range sinkNames {
+		if !slices.Contains(item.claimed, name) {
+			continue
+		}
+		if err := dedupStore.Release(ctx, dedupKey(item, name)); err != nil {
+			logger.FromContext(ctx).Warn("Failed to release record claim", "sink", name, "error", err)
+		}
+	}
+}
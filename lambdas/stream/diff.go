@@ -0,0 +1,54 @@
+package main
+
+import (
+	"aws-lambda-go/internal/models"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maskedFields are the attributes whose values are masked in the published events
+// (STREAM_MASKED_CHANGED_FIELDS): in changedFields, the person and the raw image. Consumers
+// still learn that they changed.
+var maskedFields = fieldSet(settings.MaskedChangedFields)
+
+// fieldSet returns a set of attribute names
+func fieldSet(fields []string) map[string]bool {
+	set := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		set[field] = true
+	}
+	return set
+}
+
+// maskChanges masks the values of masked fields in place. Empty values stay empty, so
+// consumers can still tell a field that was set or cleared.
+func maskChanges(changes []models.FieldChange) []models.FieldChange {
+	for i, change := range changes {
+		if !maskedFields[change.Field] {
+			continue
+		}
+		if change.Before != "" {
+			changes[i].Before = models.MaskedValue
+		}
+		if change.After != "" {
+			changes[i].After = models.MaskedValue
+		}
+	}
+	return changes
+}
+
+// maskImage returns a copy of a stream image with the non-empty string values of masked
+// fields masked; the person of the event is unmarshalled from it
+func maskImage(image map[string]events.DynamoDBAttributeValue) map[string]events.DynamoDBAttributeValue {
+	if len(maskedFields) == 0 || len(image) == 0 {
+		return image
+	}
+	masked := make(map[string]events.DynamoDBAttributeValue, len(image))
+	for name, value := range image {
+		if maskedFields[name] && !value.IsNull() && value.DataType() == events.DataTypeString && value.String() != "" {
+			value = events.NewStringAttribute(models.MaskedValue)
+		}
+		masked[name] = value
+	}
+	return masked
+}
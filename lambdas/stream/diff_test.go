@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"aws-lambda-go/internal/models"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestPersonChangedEventMasksDetail(t *testing.T) {
+	previous := maskedFields
+	maskedFields = fieldSet([]string{"email", "phoneNumber"})
+	t.Cleanup(func() { maskedFields = previous })
+
+	record := events.DynamoDBEventRecord{
+		EventID:   "event-1",
+		EventName: "MODIFY",
+		Change: events.DynamoDBStreamRecord{
+			Keys: map[string]events.DynamoDBAttributeValue{"personId": events.NewStringAttribute("p-1")},
+			OldImage: map[string]events.DynamoDBAttributeValue{
+				"personId":    events.NewStringAttribute("p-1"),
+				"firstName":   events.NewStringAttribute("Ada"),
+				"email":       events.NewStringAttribute("old@example.com"),
+				"phoneNumber": events.NewStringAttribute("+15550100"),
+			},
+			NewImage: map[string]events.DynamoDBAttributeValue{
+				"personId":    events.NewStringAttribute("p-1"),
+				"firstName":   events.NewStringAttribute("Ada"),
+				"email":       events.NewStringAttribute("new@example.com"),
+				"phoneNumber": events.NewStringAttribute("+15550199"),
+			},
+		},
+	}
+
+	detail, err := personChangedEvent(context.Background(), record)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	published, err := json.Marshal(detail)
+	if err != nil {
+		t.Fatalf("marshal detail: %v", err)
+	}
+	for _, value := range []string{"old@example.com", "new@example.com", "+15550100", "+15550199"} {
+		if strings.Contains(string(published), value) {
+			t.Errorf("published detail contains %q: %s", value, published)
+		}
+	}
+	if detail.Current == nil || detail.Current.FirstName != "Ada" || detail.Current.Email != models.MaskedValue {
+		t.Errorf("person = %+v, want the unmasked first name and a masked email", detail.Current)
+	}
+	if len(detail.ChangedFields) != 2 {
+		t.Errorf("changedFields = %+v, want email and phoneNumber", detail.ChangedFields)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"aws-lambda-go/internal/models"
+)
+
+// eventFilter decides which events are published (STREAM_EVENT_NAMES, STREAM_CHANGED_FIELDS).
+// Records it drops are acknowledged like published ones.
+type eventFilter struct {
+	eventNames    map[string]bool
+	changedFields map[string]bool
+}
+
+// filter is built once per cold start from the settings
+var filter = newEventFilter(settings.EventNames, settings.ChangedFields)
+
+func newEventFilter(eventNames []string, changedFields []string) eventFilter {
+	return eventFilter{eventNames: fieldSet(eventNames), changedFields: fieldSet(changedFields)}
+}
+
+// allows reports whether an event is published. Event names are the published ones, so
+// soft deletes and restores are matched as REMOVE and RESTORE. Only plain MODIFY events are
+// filtered by their changed fields; bookkeeping attributes never count as a change.
+func (f eventFilter) allows(detail models.PersonChangedEvent) bool {
+	if len(f.eventNames) > 0 && !f.eventNames[detail.EventName] {
+		return false
+	}
+	if len(f.changedFields) == 0 || detail.EventName != "MODIFY" {
+		return true
+	}
+	for _, change := range detail.ChangedFields {
+		if f.changedFields[change.Field] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// formatCloudEvents publishes every event as a CloudEvents 1.0 envelope (STREAM_EVENT_FORMAT).
+// The default "legacy" format stays available while consumers migrate.
+const formatCloudEvents = "cloudevents"
+
+var eventFormat = settings.EventFormat
+
+// marshalDetail returns the EventBridge detail of a record: the event itself, or a CloudEvent
+// carrying it. Source and detail type stay the same in both formats, so rules keep matching.
+func marshalDetail(record events.DynamoDBEventRecord, detail models.PersonChangedEvent) ([]byte, error) {
+	if eventFormat != formatCloudEvents {
+		return json.Marshal(detail)
+	}
+	return marshalCloudEvent(record, detail)
+}
+
+// marshalCloudEvent wraps the detail of a record into a CloudEvent. The stream event ID is
+// unique per change, so it is the CloudEvent ID.
+func marshalCloudEvent(record events.DynamoDBEventRecord, detail models.PersonChangedEvent) ([]byte, error) {
+	data, err := json.Marshal(detail)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(personevents.CloudEvent{
+		SpecVersion:     personevents.CloudEventsSpecVersion,
+		ID:              record.EventID,
+		Source:          personevents.CloudEventSource,
+		Type:            personevents.CloudEventType,
+		Subject:         detail.PersonID,
+		Time:            record.Change.ApproximateCreationDateTime.Time.UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// heartbeatInterval is the least time between two progress writes of one instance
+const heartbeatInterval = 30 * time.Second
+
+// progressWriter is the part of the DynamoDB client used to record progress
+type progressWriter interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// heartbeat records the stream lambda's progress in the pipeline status table
+// (PIPELINE_STATUS_TABLE_NAME) for GET /admin/pipeline/status; nil records nothing
+type heartbeat struct {
+	client    progressWriter
+	tableName string
+
+	mu        sync.Mutex
+	lastWrite time.Time
+}
+
+var progress *heartbeat
+
+// record writes the "stream" item: when the last batch was handled and its iterator age, the
+// time its last record waited in the stream, as Lambda's IteratorAge metric measures it.
+// Writes are skipped within heartbeatInterval of the previous one, and failures are only
+// logged, so the status never holds up publishing.
+func (h *heartbeat) record(ctx context.Context, records []events.DynamoDBEventRecord, retried int) {
+	if h == nil || len(records) == 0 {
+		return
+	}
+	now := time.Now()
+	h.mu.Lock()
+	if now.Sub(h.lastWrite) < heartbeatInterval {
+		h.mu.Unlock()
+		return
+	}
+	h.lastWrite = now
+	h.mu.Unlock()
+
+	iteratorAge := now.Sub(records[len(records)-1].Change.ApproximateCreationDateTime.Time)
+	_, err := h.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(h.tableName),
+		Item: map[string]types.AttributeValue{
+			"component":     &types.AttributeValueMemberS{Value: "stream"},
+			"lastBatchAt":   &types.AttributeValueMemberS{Value: now.UTC().Format(time.RFC3339)},
+			"iteratorAgeMs": &types.AttributeValueMemberN{Value: strconv.FormatInt(iteratorAge.Milliseconds(), 10)},
+			"records":       &types.AttributeValueMemberN{Value: strconv.Itoa(len(records))},
+			"retried":       &types.AttributeValueMemberN{Value: strconv.Itoa(retried)},
+		},
+	})
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to record stream progress", "error", err)
+	}
+}
@@ -2,73 +2,412 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"log"
+	"log/slog"
+	"time"
+
+	"aws-lambda-go/internal/config"
+	"aws-lambda-go/internal/consumer"
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/internal/slack"
+	"aws-lambda-go/internal/tracing"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/eventbridge"
-	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// initialBackoff is the pause before the first retry of rejected entries
+	initialBackoff = 100 * time.Millisecond
+	// maxBackoff caps the pause while the sinks keep rejecting entries
+	maxBackoff = 2 * time.Second
+	// maxPublishRetries is how often a record is retried on a sink before it is handed back to Lambda
+	maxPublishRetries = 3
+)
+
+var settings, settingsErr = config.LoadStream()
+
+// opsAlerts posts publish failures to the ops channel
+var opsAlerts = slack.New(settings.SlackWebhookURL, settings.Environment, "stream")
+
+var (
+	// sinks, quarantineStore and deadLetterQueue are created once per cold start in main
+	sinks           []sink
+	quarantineStore objectPutter
+	deadLetterQueue messageSender
 )
 
+// EventBridgeAPI is the part of the EventBridge client the stream lambda uses, so tests can
+// substitute a fake
+type EventBridgeAPI interface {
+	PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
+}
+
 type EventBridgeClient struct {
-	client eventbridgeiface.EventBridgeAPI
+	client EventBridgeAPI
 }
 
-func (e *EventBridgeClient) PutEvent(source string, detailType string, detail map[string]interface{}) error {
-	detailJSON, err := json.Marshal(detail)
-	if err != nil {
-		log.Printf("Error marshalling detail to JSON: %v", err)
-		return err
+// maxPutEventsEntries and maxPutEventsBytes are the limits of one PutEvents call
+const (
+	maxPutEventsEntries = 10
+	maxPutEventsBytes   = 256 * 1024
+)
+
+// PutEvents publishes the records in calls of up to maxPutEventsEntries entries and
+// maxPutEventsBytes bytes, and returns the error of each record. PutEvents accepts or rejects
+// every entry on its own, e.g. throttling only some of them, so each entry's result is read.
+// The span of each record is passed on as the entry's trace header, which EventBridge forwards
+// to its targets.
+func (e *EventBridgeClient) PutEvents(ctx context.Context, records []pendingRecord) []error {
+	errs := make([]error, len(records))
+	entries := make([]ebtypes.PutEventsRequestEntry, len(records))
+	sizes := make([]int, len(records))
+	for i, r := range records {
+		detailJSON, err := marshalDetail(r.record, r.detail)
+		if err != nil {
+			errs[i] = errclass.Mark(errclass.Permanent, fmt.Errorf("marshal detail: %w", err))
+			continue
+		}
+		entries[i] = ebtypes.PutEventsRequestEntry{
+			Source:       aws.String(eventSource),
+			DetailType:   aws.String(eventDetailType),
+			Detail:       aws.String(string(detailJSON)),
+			EventBusName: aws.String(settings.EventBusName),
+		}
+		if traceHeader := tracing.Header(r.ctx); traceHeader != "" {
+			entries[i].TraceHeader = aws.String(traceHeader)
+		}
+		// The size EventBridge counts against the limit
+		sizes[i] = len(eventSource) + len(eventDetailType) + len(detailJSON)
 	}
 
-	event := &eventbridge.PutEventsRequestEntry{
-		Source:       aws.String(source),
-		DetailType:   aws.String(detailType),
-		Detail:       aws.String(string(detailJSON)),
-		EventBusName: aws.String("DDBStreamCustomEventBus"),
+	for _, group := range batches(sizes, errs, maxPutEventsEntries, maxPutEventsBytes, maxPutEventsBytes) {
+		batch := make([]ebtypes.PutEventsRequestEntry, len(group))
+		for k, i := range group {
+			batch[k] = entries[i]
+		}
+		output, err := e.client.PutEvents(ctx, &eventbridge.PutEventsInput{Entries: batch})
+		if err != nil {
+			failGroup(errs, group, err)
+			continue
+		}
+		// Results are in the order of the entries; failed ones carry an error code
+		for k, result := range output.Entries {
+			if k < len(group) {
+				errs[group[k]] = newEntryError(result.ErrorCode, result.ErrorMessage)
+			}
+		}
 	}
+	return errs
+}
 
-	_, err = e.client.PutEvents(&eventbridge.PutEventsInput{
-		Entries: []*eventbridge.PutEventsRequestEntry{event},
-	})
+// backpressure tracks the pause applied between records while the bus is throttling
+type backpressure struct {
+	delay time.Duration
+}
 
-	if err != nil {
-		log.Printf("Error sending event to EventBridge: %v", err)
-		return err
+// throttled doubles the pause, up to maxBackoff
+func (b *backpressure) throttled() {
+	if b.delay == 0 {
+		b.delay = initialBackoff
+		return
+	}
+	b.delay *= 2
+	if b.delay > maxBackoff {
+		b.delay = maxBackoff
+	}
+}
+
+// recovered halves the pause after a successful publish so throughput ramps back up
+func (b *backpressure) recovered() {
+	b.delay /= 2
+	if b.delay < initialBackoff {
+		b.delay = 0
+	}
+}
+
+// wait sleeps for the current pause. It returns false when the context would expire first,
+// in which case the caller should hand the remaining records back to Lambda.
+func (b *backpressure) wait(ctx context.Context) bool {
+	if b.delay == 0 {
+		return true
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < b.delay {
+		return false
+	}
+	select {
+	case <-time.After(b.delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// personChangedEvent builds the event detail of a validated record. An image that cannot be
+// unmarshalled into a person is a permanent error, so the record is quarantined.
+func personChangedEvent(ctx context.Context, record events.DynamoDBEventRecord) (models.PersonChangedEvent, error) {
+	detail := models.PersonChangedEvent{
+		SchemaVersion: models.EventSchemaVersion,
+		EventID:       record.EventID,
+		PersonID:      record.Change.Keys["personId"].String(),
+		EventName:     eventName(record),
+		CorrelationID: logger.CorrelationID(ctx),
+		Image:         maskImage(record.Change.NewImage),
+	}
+	if len(detail.Image) > 0 {
+		person, err := models.PersonFromImage(detail.Image)
+		if err != nil {
+			return detail, errclass.Mark(errclass.Permanent, fmt.Errorf("unmarshal new image: %w", err))
+		}
+		detail.Current = &person
+	}
+	if record.EventName == "MODIFY" {
+		detail.ChangedFields = maskChanges(models.ChangedFields(record.Change.OldImage, record.Change.NewImage))
 	}
-	return nil
+	return detail, nil
 }
 
-func handler(ctx context.Context, dynamodbEvent events.DynamoDBEvent) error {
-	log.Print("Lambda handler invoked")
-	sess := session.Must(session.NewSession())
-	ebClient := &EventBridgeClient{
-		client: eventbridge.New(sess),
+// newPendingRecord starts the producer span of a record, which covers every sink
+func newPendingRecord(ctx context.Context, record events.DynamoDBEventRecord, detail models.PersonChangedEvent) pendingRecord {
+	ctx, span := tracing.Tracer().Start(ctx, "PublishRecord",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.Int("publish.sinks", len(sinks)),
+			attribute.String("event.id", record.EventID),
+			attribute.String("event.name", record.EventName),
+		),
+	)
+	return pendingRecord{ctx: ctx, span: span, record: record, detail: detail}
+}
+
+// eventName is the event name published for a record. Soft deletes and restores are MODIFY
+// records in the stream, but are published as REMOVE and RESTORE so consumers can treat them
+// like the lifecycle changes they are.
+func eventName(record events.DynamoDBEventRecord) string {
+	if record.EventName != "MODIFY" {
+		return record.EventName
+	}
+	wasDeleted, isDeleted := deletedFlag(record.Change.OldImage), deletedFlag(record.Change.NewImage)
+	switch {
+	case isDeleted && !wasDeleted:
+		return "REMOVE"
+	case wasDeleted && !isDeleted:
+		return "RESTORE"
+	}
+	return record.EventName
+}
+
+// deletedFlag reports whether an image is soft-deleted
+func deletedFlag(image map[string]events.DynamoDBAttributeValue) bool {
+	value, ok := image["deleted"]
+	return ok && value.DataType() == events.DataTypeBoolean && value.Boolean()
+}
+
+func handler(ctx context.Context, dynamodbEvent events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	logger.FromContext(ctx).Info("Lambda handler invoked", "records", len(dynamodbEvent.Records))
+
+	start := time.Now()
+	counts := map[string]int{}
+	defer func() { emitRecordMetrics(counts, time.Since(start)) }()
+
+	response := events.DynamoDBEventResponse{}
+	// retry hands a record back to Lambda by its sequence number. Only records that failed
+	// are reported, so Lambda does not retry the records before them.
+	retry := func(record events.DynamoDBEventRecord) {
+		counts[outcomeRetried]++
+		response.BatchItemFailures = append(response.BatchItemFailures, events.DynamoDBBatchItemFailure{
+			ItemIdentifier: record.Change.SequenceNumber,
+		})
+	}
+	// setAside quarantines a record that can never be published; if that fails too, the
+	// record is retried
+	setAside := func(ctx context.Context, record events.DynamoDBEventRecord, reason error) {
+		if err := quarantine(ctx, quarantineStore, record, reason); err != nil {
+			logger.FromContext(ctx).Error("Failed to quarantine record, returning it for retry", "error", err)
+			retry(record)
+			return
+		}
+		counts[outcomeQuarantined]++
 	}
 
-	for _, record := range dynamodbEvent.Records {
-		log.Printf("Processing record: %v", record)
-		detail := map[string]interface{}{
-			"eventID":      record.EventID,
-			"eventName":    record.EventName,
-			"dynamodbData": record.Change.NewImage, // Customize based on your needs
+	var pending []pendingRecord
+	for i, record := range dynamodbEvent.Records {
+		// Lambda resumes the shard at the first failed record and delivers every later one
+		// again, so publishing them now would only duplicate their events
+		if len(response.BatchItemFailures) > 0 {
+			logger.FromContext(ctx).Warn("Returning the rest of the batch unpublished", "records", len(dynamodbEvent.Records)-i)
+			for _, rest := range dynamodbEvent.Records[i:] {
+				retry(rest)
+			}
+			break
 		}
 
-		err := ebClient.PutEvent("ddb.source", "DynamoDBStreamEvent", detail)
+		ctx := recordContext(ctx, record)
+		logger.FromContext(ctx).Debug("Processing record", "eventName", record.EventName, "sequenceNumber", record.Change.SequenceNumber)
+
+		// Malformed records are set aside instead of failing the batch or publishing garbage
+		if reason := validateRecord(record); reason != nil {
+			setAside(ctx, record, reason)
+			continue
+		}
+		detail, err := personChangedEvent(ctx, record)
 		if err != nil {
-			log.Printf("Failed to put event: %v", err)
-			return err
+			setAside(ctx, record, err)
+			continue
+		}
+		if !filter.allows(detail) {
+			logger.FromContext(ctx).Debug("Record filtered out", "eventName", detail.EventName)
+			counts[outcomeFiltered]++
+			continue
 		}
+		item := newPendingRecord(ctx, record, detail)
+		if err := claimSinks(item.ctx, &item); err != nil {
+			tracing.End(item.span, err)
+			logger.FromContext(item.ctx).Error("Failed to claim record, returning it for retry", "error", err)
+			retry(record)
+			continue
+		}
+		if item.duplicate() {
+			tracing.End(item.span, nil)
+			logger.FromContext(item.ctx).Info("Skipping record every sink already took")
+			counts[outcomeDuplicate]++
+			continue
+		}
+		pending = append(pending, item)
 	}
 
-	log.Print("Processing complete")
-	return nil
+	var lastErr error
+	var failed []pendingRecord
+	for i, err := range publishRecords(ctx, sinks, &backpressure{}, pending) {
+		item := pending[i]
+		tracing.End(item.span, err)
+		settleClaims(item.ctx, item, err)
+		switch {
+		case err == nil:
+			attempts.done(item.record.EventID)
+			counts[outcomePublished]++
+		case errclass.Classify(err) == errclass.Permanent:
+			// Records every sink rejects for good would block the shard; they are set aside like malformed ones
+			attempts.done(item.record.EventID)
+			setAside(item.ctx, item.record, err)
+		default:
+			failed = append(failed, item)
+			lastErr = err
+			// Records that keep failing would block the shard until they expire; after
+			// STREAM_DLQ_AFTER_ATTEMPTS deliveries they go to the dead-letter queue instead
+			attempt := attempts.failed(item.record.EventID)
+			if settings.DeadLetterQueueURL != "" && attempt >= settings.DeadLetterAfterAttempts {
+				dlqErr := deadLetter(item.ctx, deadLetterQueue, item.record, err, attempt)
+				if dlqErr == nil {
+					attempts.done(item.record.EventID)
+					counts[outcomeDeadLettered]++
+					continue
+				}
+				logger.FromContext(item.ctx).Error("Failed to dead-letter record", "error", dlqErr)
+			}
+			logger.FromContext(item.ctx).Error("Failed to publish record, returning it for retry", "error", err, "attempt", attempt)
+			retry(item.record)
+		}
+	}
+	if len(failed) > 0 {
+		opsAlerts.NotifyBestEffort(ctx, slack.Alert{
+			Title:    "Stream publish failure",
+			Text:     fmt.Sprintf("Failed to publish: %v", lastErr),
+			Severity: slack.SeverityWarning,
+			Fields: map[string]string{
+				"firstEventID":   failed[0].record.EventID,
+				"recordsFailed":  fmt.Sprint(len(failed)),
+				"recordsRetried": fmt.Sprint(counts[outcomeRetried]),
+				"eventSourceARN": failed[0].record.EventSourceArn,
+			},
+		})
+	}
+
+	progress.record(ctx, dynamodbEvent.Records, len(response.BatchItemFailures))
+	logger.FromContext(ctx).Info("Processing complete", "retried", len(response.BatchItemFailures))
+	return response, nil
+}
+
+// Outcomes of a stream record, used as the Outcome metric dimension
+const (
+	outcomePublished   = "published"
+	outcomeQuarantined = "quarantined"
+	outcomeRetried     = "retried"
+	outcomeFiltered    = "filtered"
+	// outcomeDuplicate records were published in an earlier delivery of their batch
+	outcomeDuplicate = "duplicate"
+	// outcomeDeadLettered records were sent to the dead-letter queue, outcomeRedriven ones
+	// published from it
+	outcomeDeadLettered = "deadLettered"
+	outcomeRedriven     = "redriven"
+)
+
+// emitRecordMetrics reports how many records of a batch ended in each outcome
+func emitRecordMetrics(counts map[string]int, duration time.Duration) {
+	metrics.Emit(nil, nil, metrics.Duration("BatchDuration", duration))
+	for outcome, count := range counts {
+		metrics.Emit(map[string]string{"Outcome": outcome}, nil, metrics.Count("RecordsProcessed", count))
+	}
+}
+
+// recordContext scopes the logger to a record and restores the correlation ID and trace the
+// HTTP lambda stored on the item, so they can be carried into the published event. Records
+// without a stored trace stay in the stream invocation's trace.
+func recordContext(ctx context.Context, record events.DynamoDBEventRecord) context.Context {
+	if value, ok := record.Change.NewImage["correlationId"]; ok && value.DataType() == events.DataTypeString {
+		ctx = logger.WithCorrelationID(ctx, value.String())
+	}
+	if value, ok := record.Change.NewImage["traceHeader"]; ok && value.DataType() == events.DataTypeString {
+		ctx = tracing.Extract(ctx, value.String())
+	}
+	personID := record.Change.Keys["personId"]
+	if personID.DataType() == events.DataTypeString {
+		ctx = logger.With(ctx, "personId", personID.String())
+	}
+	return logger.With(ctx, "eventID", record.EventID)
 }
 
 func main() {
-	log.Print("Starting Lambda function")
-	lambda.Start(handler)
+	config.Check(settingsErr)
+	logger.Init("stream")
+	metrics.Init("stream")
+	if err := tracing.Init(context.Background(), "stream"); err != nil {
+		slog.Error("Tracing disabled", "error", err)
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), settings.AWSOptions()...)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	tracing.InstrumentAWS(&cfg)
+	sinks = newSinks(cfg)
+	quarantineStore = s3.NewFromConfig(cfg)
+	deadLetterQueue = sqs.NewFromConfig(cfg)
+	if settings.DedupTableName != "" {
+		dedupStore = consumer.NewIdempotencyStore(ddbclient.New(cfg, settings.DynamoDB), settings.DedupTableName,
+			time.Duration(settings.DedupTTLHours)*time.Hour)
+	}
+	if settings.PipelineStatusTableName != "" {
+		progress = &heartbeat{client: ddbclient.New(cfg, settings.DynamoDB), tableName: settings.PipelineStatusTableName}
+	}
+
+	slog.Info("Starting Lambda function", "mode", settings.Mode)
+	if settings.Mode == "redrive" {
+		lambda.Start(consumer.Invocation(redriveHandler))
+		return
+	}
+	lambda.Start(consumer.Invocation(handler))
 }
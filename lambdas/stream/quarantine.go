@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// quarantineBucket receives records that can't be turned into events (QUARANTINE_BUCKET)
+var quarantineBucket = settings.QuarantineBucket
+
+// objectPutter is the part of the S3 client used to quarantine records
+type objectPutter interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// stringAttributes are the person attributes that must be strings when present
+var stringAttributes = []string{"personId", "firstName", "lastName", "address", "phoneNumber", "email", "notificationChannel", "createdAt", "updatedAt", "deletedAt"}
+
+// QuarantinedRecord is the diagnostics document stored for a malformed record
+type QuarantinedRecord struct {
+	Reason         string                     `json:"reason"`
+	EventID        string                     `json:"eventID"`
+	EventName      string                     `json:"eventName"`
+	EventSourceArn string                     `json:"eventSourceARN"`
+	SequenceNumber string                     `json:"sequenceNumber"`
+	QuarantinedAt  string                     `json:"quarantinedAt"`
+	Record         events.DynamoDBEventRecord `json:"record"`
+}
+
+// QuarantinedMessage is the diagnostics document stored for a dead-letter message that is not
+// a DeadLetteredRecord
+type QuarantinedMessage struct {
+	Reason        string `json:"reason"`
+	MessageID     string `json:"messageId"`
+	QuarantinedAt string `json:"quarantinedAt"`
+	Body          string `json:"body"`
+}
+
+// validateRecord checks that a record can be published as a person event.
+// REMOVE records carry no new image, so only their key is checked.
+func validateRecord(record events.DynamoDBEventRecord) error {
+	switch record.EventName {
+	case "INSERT", "MODIFY":
+	case "REMOVE":
+		return requireString(record.Change.Keys, "personId")
+	default:
+		return fmt.Errorf("unexpected event name %q", record.EventName)
+	}
+
+	image := record.Change.NewImage
+	if len(image) == 0 {
+		return fmt.Errorf("%s record has no NewImage", record.EventName)
+	}
+	if err := requireString(image, "personId"); err != nil {
+		return err
+	}
+	for _, name := range stringAttributes {
+		if value, ok := image[name]; ok && value.DataType() != events.DataTypeString {
+			return fmt.Errorf("attribute %s has unexpected type %d", name, value.DataType())
+		}
+	}
+	if value, ok := image["version"]; ok && value.DataType() != events.DataTypeNumber {
+		return fmt.Errorf("attribute version has unexpected type %d", value.DataType())
+	}
+	if value, ok := image["deleted"]; ok && value.DataType() != events.DataTypeBoolean {
+		return fmt.Errorf("attribute deleted has unexpected type %d", value.DataType())
+	}
+	return nil
+}
+
+// requireString checks that an attribute is present as a non-empty string
+func requireString(attributes map[string]events.DynamoDBAttributeValue, name string) error {
+	value, ok := attributes[name]
+	if !ok {
+		return fmt.Errorf("missing %s", name)
+	}
+	if value.DataType() != events.DataTypeString {
+		return fmt.Errorf("attribute %s has unexpected type %d", name, value.DataType())
+	}
+	if value.String() == "" {
+		return fmt.Errorf("empty %s", name)
+	}
+	return nil
+}
+
+// quarantineKey groups quarantined records by day, e.g. quarantine/2024/05/01/<eventID>.json
+func quarantineKey(record events.DynamoDBEventRecord, now time.Time) string {
+	return fmt.Sprintf("quarantine/%s/%s.json", now.Format("2006/01/02"), record.EventID)
+}
+
+// quarantine stores a malformed record with the reason it was rejected. Without a bucket
+// the record is only logged and dropped.
+func quarantine(ctx context.Context, client objectPutter, record events.DynamoDBEventRecord, reason error) error {
+	now := time.Now().UTC()
+	if quarantineBucket == "" {
+		logger.FromContext(ctx).Warn("Dropping malformed record", "reason", reason.Error())
+		return nil
+	}
+
+	document, err := json.Marshal(QuarantinedRecord{
+		Reason:         reason.Error(),
+		EventID:        record.EventID,
+		EventName:      record.EventName,
+		EventSourceArn: record.EventSourceArn,
+		SequenceNumber: record.Change.SequenceNumber,
+		QuarantinedAt:  now.Format(time.RFC3339),
+		Record:         record,
+	})
+	if err != nil {
+		return err
+	}
+
+	key := quarantineKey(record, now)
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(quarantineBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(document),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to quarantine record %s: %w", record.EventID, err)
+	}
+	logger.FromContext(ctx).Warn("Quarantined malformed record", "location", "s3://"+quarantineBucket+"/"+key, "reason", reason.Error())
+	return nil
+}
+
+// quarantineMessage stores the raw body of a dead-letter message that can't be read, e.g.
+// quarantine/2024/05/01/message-<messageId>.json. Unlike a malformed record it is never
+// dropped: without a bucket an error is returned, so the message stays in the queue.
+func quarantineMessage(ctx context.Context, client objectPutter, message events.SQSMessage, reason error) error {
+	now := time.Now().UTC()
+	if quarantineBucket == "" {
+		return fmt.Errorf("no quarantine bucket for message %s", message.MessageId)
+	}
+
+	document, err := json.Marshal(QuarantinedMessage{
+		Reason:        reason.Error(),
+		MessageID:     message.MessageId,
+		QuarantinedAt: now.Format(time.RFC3339),
+		Body:          message.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("quarantine/%s/message-%s.json", now.Format("2006/01/02"), message.MessageId)
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(quarantineBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(document),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to quarantine message %s: %w", message.MessageId, err)
+	}
+	logger.FromContext(ctx).Warn("Quarantined invalid dead-letter message", "location", "s3://"+quarantineBucket+"/"+key, "reason", reason.Error())
+	return nil
+}
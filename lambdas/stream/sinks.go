@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"aws-lambda-go/internal/ddbclient"
+	"aws-lambda-go/internal/errclass"
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/metrics"
+	"aws-lambda-go/internal/models"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	firehosetypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	eventSource     = "ddb.source"
+	eventDetailType = "DynamoDBStreamEvent"
+)
+
+// Limits of one batch call per sink: entries per call, bytes per call and bytes per entry
+const (
+	maxSNSBatchEntries      = 10
+	maxSNSBatchBytes        = 256 * 1024
+	maxSQSBatchEntries      = 10
+	maxSQSBatchBytes        = 256 * 1024
+	maxKinesisBatchEntries  = 500
+	maxKinesisBatchBytes    = 5 * 1024 * 1024
+	maxKinesisRecordBytes   = 1024 * 1024
+	maxFirehoseBatchEntries = 500
+	maxFirehoseBatchBytes   = 4 * 1024 * 1024
+	maxFirehoseRecordBytes  = 1000 * 1024
+)
+
+// publishConcurrency bounds the sink calls in flight (STREAM_PUBLISH_CONCURRENCY)
+var publishConcurrency = settings.PublishConcurrency
+
+// pendingRecord is a validated record on its way to the sinks. Its context carries the
+// record's logger and the producer span that covers every sink.
+type pendingRecord struct {
+	ctx    context.Context
+	span   trace.Span
+	record events.DynamoDBEventRecord
+	detail models.PersonChangedEvent
+	// claimed are the sinks the record was claimed for in the dedup table, delivered those
+	// that took it in an earlier delivery of the batch
+	claimed   []string
+	delivered []string
+}
+
+// deliveredTo reports whether a sink took the record in an earlier delivery
+func (r pendingRecord) deliveredTo(sinkName string) bool {
+	return slices.Contains(r.delivered, sinkName)
+}
+
+// sink is a destination of the published person events, the stream lambda's publisher
+// interface. EventBridge, SNS, SQS, Kinesis and Firehose are each a sink when configured, so
+// deployments without EventBridge publish to another messaging backbone. The tenant counters
+// are kept by a sink too.
+type sink interface {
+	name() string
+	// publish sends the records in as few calls as the sink's limits allow and returns the
+	// error of each record, nil for those the sink accepted
+	publish(ctx context.Context, records []pendingRecord) []error
+}
+
+// newSinks returns the sinks configured in the environment
+func newSinks(cfg aws.Config) []sink {
+	var sinks []sink
+	if settings.EventBusName != "" {
+		sinks = append(sinks, &eventBridgeSink{client: &EventBridgeClient{client: eventbridge.NewFromConfig(cfg)}})
+	}
+	if topicARN := settings.SNSTopicARN; topicARN != "" {
+		sinks = append(sinks, &snsSink{client: sns.NewFromConfig(cfg), topicARN: topicARN})
+	}
+	if queueURL := settings.SQSQueueURL; queueURL != "" {
+		sinks = append(sinks, &sqsSink{client: sqs.NewFromConfig(cfg), queueURL: queueURL})
+	}
+	if streamName := settings.KinesisStreamName; streamName != "" {
+		sinks = append(sinks, &kinesisSink{client: kinesis.NewFromConfig(cfg), streamName: streamName})
+	}
+	if deliveryStream := settings.FirehoseStreamName; deliveryStream != "" {
+		sinks = append(sinks, &firehoseSink{client: firehose.NewFromConfig(cfg), deliveryStream: deliveryStream})
+	}
+	if tableName := settings.TenantStatsTableName; tableName != "" {
+		sinks = append(sinks, &tenantStatsSink{client: ddbclient.New(cfg, settings.DynamoDB), tableName: tableName})
+	}
+	return sinks
+}
+
+// The parts of the sink clients that are used, so tests can substitute fakes
+type (
+	snsAPI interface {
+		PublishBatch(ctx context.Context, params *sns.PublishBatchInput, optFns ...func(*sns.Options)) (*sns.PublishBatchOutput, error)
+	}
+	sqsAPI interface {
+		SendMessageBatch(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error)
+	}
+	kinesisAPI interface {
+		PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error)
+	}
+	firehoseAPI interface {
+		PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error)
+	}
+)
+
+// entryError is the rejection of one entry of a batch call. It carries the service's error
+// code, so errclass classifies it like a failed call, e.g. ThrottlingException as a throttle.
+type entryError struct {
+	code    string
+	message string
+}
+
+func (e *entryError) Error() string     { return e.code + ": " + e.message }
+func (e *entryError) ErrorCode() string { return e.code }
+
+// newEntryError returns the error of a batch entry, nil when it has no error code
+func newEntryError(code *string, message *string) error {
+	if aws.ToString(code) == "" {
+		return nil
+	}
+	return &entryError{code: aws.ToString(code), message: aws.ToString(message)}
+}
+
+// batches groups the entries that have no error yet into calls of at most maxEntries entries
+// and maxBytes bytes, keeping their order. Entries larger than maxEntryBytes can never be
+// sent and get a permanent error.
+func batches(sizes []int, errs []error, maxEntries int, maxBytes int, maxEntryBytes int) [][]int {
+	var groups [][]int
+	var group []int
+	groupBytes := 0
+	for i, size := range sizes {
+		if errs[i] != nil {
+			continue
+		}
+		if size > maxEntryBytes {
+			errs[i] = errclass.New(errclass.Permanent, fmt.Sprintf("entry of %d bytes exceeds the limit of %d bytes", size, maxEntryBytes))
+			continue
+		}
+		if len(group) == maxEntries || (len(group) > 0 && groupBytes+size > maxBytes) {
+			groups = append(groups, group)
+			group, groupBytes = nil, 0
+		}
+		group = append(group, i)
+		groupBytes += size
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// failGroup sets the error of a failed batch call on every entry of the call
+func failGroup(errs []error, group []int, err error) {
+	for _, i := range group {
+		errs[i] = err
+	}
+}
+
+// sinkMessage is the body written to the sinks other than EventBridge. It uses the field names
+// of an EventBridge event, so consumers parse events from every sink the same way.
+type sinkMessage struct {
+	ID         string                    `json:"id"`
+	Source     string                    `json:"source"`
+	DetailType string                    `json:"detail-type"`
+	Time       time.Time                 `json:"time"`
+	Detail     models.PersonChangedEvent `json:"detail"`
+}
+
+// marshalSinkMessage wraps the detail of a record into a sinkMessage, or into a CloudEvent in
+// the CloudEvents format
+func marshalSinkMessage(record events.DynamoDBEventRecord, detail models.PersonChangedEvent) ([]byte, error) {
+	if eventFormat == formatCloudEvents {
+		return marshalCloudEvent(record, detail)
+	}
+	return json.Marshal(sinkMessage{
+		ID:         record.EventID,
+		Source:     eventSource,
+		DetailType: eventDetailType,
+		Time:       record.Change.ApproximateCreationDateTime.Time,
+		Detail:     detail,
+	})
+}
+
+// marshalSinkMessages marshals the records for a sink; records that cannot be marshalled get
+// a permanent error
+func marshalSinkMessages(records []pendingRecord, errs []error) [][]byte {
+	messages := make([][]byte, len(records))
+	for i, r := range records {
+		message, err := marshalSinkMessage(r.record, r.detail)
+		if err != nil {
+			errs[i] = errclass.Mark(errclass.Permanent, err)
+			continue
+		}
+		messages[i] = message
+	}
+	return messages
+}
+
+// partitionKey keeps the events of a person in order on partitioned sinks
+func partitionKey(record events.DynamoDBEventRecord) string {
+	if personID := record.Change.Keys["personId"]; personID.DataType() == events.DataTypeString {
+		return personID.String()
+	}
+	return record.EventID
+}
+
+type eventBridgeSink struct {
+	client *EventBridgeClient
+}
+
+func (s *eventBridgeSink) name() string { return "eventbridge" }
+
+func (s *eventBridgeSink) publish(ctx context.Context, records []pendingRecord) []error {
+	return s.client.PutEvents(ctx, records)
+}
+
+type snsSink struct {
+	client   snsAPI
+	topicARN string
+}
+
+func (s *snsSink) name() string { return "sns" }
+
+func (s *snsSink) publish(ctx context.Context, records []pendingRecord) []error {
+	errs := make([]error, len(records))
+	messages := marshalSinkMessages(records, errs)
+	sizes := make([]int, len(records))
+	for i, message := range messages {
+		sizes[i] = len(message) + len("eventName") + len("String") + len(records[i].detail.EventName)
+	}
+
+	for _, group := range batches(sizes, errs, maxSNSBatchEntries, maxSNSBatchBytes, maxSNSBatchBytes) {
+		entries := make([]snstypes.PublishBatchRequestEntry, len(group))
+		for k, i := range group {
+			entries[k] = snstypes.PublishBatchRequestEntry{
+				Id:      aws.String(strconv.Itoa(i)),
+				Message: aws.String(string(messages[i])),
+				// Lets subscriptions filter by event name without parsing the body
+				MessageAttributes: map[string]snstypes.MessageAttributeValue{
+					"eventName": {DataType: aws.String("String"), StringValue: aws.String(records[i].detail.EventName)},
+				},
+			}
+		}
+		output, err := s.client.PublishBatch(ctx, &sns.PublishBatchInput{
+			TopicArn:                   aws.String(s.topicARN),
+			PublishBatchRequestEntries: entries,
+		})
+		if err != nil {
+			failGroup(errs, group, err)
+			continue
+		}
+		// Failed entries are named by their ID, the index of the record
+		for _, failed := range output.Failed {
+			i, convErr := strconv.Atoi(aws.ToString(failed.Id))
+			if convErr != nil || i < 0 || i >= len(errs) {
+				continue
+			}
+			errs[i] = newEntryError(failed.Code, failed.Message)
+			if failed.SenderFault {
+				errs[i] = errclass.Mark(errclass.Permanent, errs[i])
+			}
+		}
+	}
+	return errs
+}
+
+type sqsSink struct {
+	client   sqsAPI
+	queueURL string
+}
+
+func (s *sqsSink) name() string { return "sqs" }
+
+// publish sends the records as SQS messages. On a FIFO queue the messages of a person share
+// a message group, so they are received in order, and the event ID deduplicates them.
+func (s *sqsSink) publish(ctx context.Context, records []pendingRecord) []error {
+	errs := make([]error, len(records))
+	messages := marshalSinkMessages(records, errs)
+	sizes := make([]int, len(records))
+	for i, message := range messages {
+		sizes[i] = len(message) + len("eventName") + len("String") + len(records[i].detail.EventName)
+	}
+	fifo := strings.HasSuffix(s.queueURL, ".fifo")
+
+	for _, group := range batches(sizes, errs, maxSQSBatchEntries, maxSQSBatchBytes, maxSQSBatchBytes) {
+		entries := make([]sqstypes.SendMessageBatchRequestEntry, len(group))
+		for k, i := range group {
+			entries[k] = sqstypes.SendMessageBatchRequestEntry{
+				Id:          aws.String(strconv.Itoa(i)),
+				MessageBody: aws.String(string(messages[i])),
+				// Lets consumers route by event name without parsing the body
+				MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+					"eventName": {DataType: aws.String("String"), StringValue: aws.String(records[i].detail.EventName)},
+				},
+			}
+			if fifo {
+				entries[k].MessageGroupId = aws.String(partitionKey(records[i].record))
+				entries[k].MessageDeduplicationId = aws.String(records[i].record.EventID)
+			}
+		}
+		output, err := s.client.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(s.queueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			failGroup(errs, group, err)
+			continue
+		}
+		// Failed entries are named by their ID, the index of the record
+		for _, failed := range output.Failed {
+			i, convErr := strconv.Atoi(aws.ToString(failed.Id))
+			if convErr != nil || i < 0 || i >= len(errs) {
+				continue
+			}
+			errs[i] = newEntryError(failed.Code, failed.Message)
+			if failed.SenderFault {
+				errs[i] = errclass.Mark(errclass.Permanent, errs[i])
+			}
+		}
+	}
+	return errs
+}
+
+type kinesisSink struct {
+	client     kinesisAPI
+	streamName string
+}
+
+func (s *kinesisSink) name() string { return "kinesis" }
+
+func (s *kinesisSink) publish(ctx context.Context, records []pendingRecord) []error {
+	errs := make([]error, len(records))
+	messages := marshalSinkMessages(records, errs)
+	sizes := make([]int, len(records))
+	for i, message := range messages {
+		sizes[i] = len(message) + len(partitionKey(records[i].record))
+	}
+
+	for _, group := range batches(sizes, errs, maxKinesisBatchEntries, maxKinesisBatchBytes, maxKinesisRecordBytes) {
+		entries := make([]kinesistypes.PutRecordsRequestEntry, len(group))
+		for k, i := range group {
+			entries[k] = kinesistypes.PutRecordsRequestEntry{
+				PartitionKey: aws.String(partitionKey(records[i].record)),
+				Data:         messages[i],
+			}
+		}
+		output, err := s.client.PutRecords(ctx, &kinesis.PutRecordsInput{
+			StreamName: aws.String(s.streamName),
+			Records:    entries,
+		})
+		if err != nil {
+			failGroup(errs, group, err)
+			continue
+		}
+		// Results are in the order of the entries
+		for k, result := range output.Records {
+			if k < len(group) {
+				errs[group[k]] = newEntryError(result.ErrorCode, result.ErrorMessage)
+			}
+		}
+	}
+	return errs
+}
+
+type firehoseSink struct {
+	client         firehoseAPI
+	deliveryStream string
+}
+
+func (s *firehoseSink) name() string { return "firehose" }
+
+func (s *firehoseSink) publish(ctx context.Context, records []pendingRecord) []error {
+	errs := make([]error, len(records))
+	messages := marshalSinkMessages(records, errs)
+	sizes := make([]int, len(records))
+	for i, message := range messages {
+		// Newline-delimited, so the delivered S3 objects are JSON Lines
+		messages[i] = append(message, '\n')
+		sizes[i] = len(messages[i])
+	}
+
+	for _, group := range batches(sizes, errs, maxFirehoseBatchEntries, maxFirehoseBatchBytes, maxFirehoseRecordBytes) {
+		entries := make([]firehosetypes.Record, len(group))
+		for k, i := range group {
+			entries[k] = firehosetypes.Record{Data: messages[i]}
+		}
+		output, err := s.client.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(s.deliveryStream),
+			Records:            entries,
+		})
+		if err != nil {
+			failGroup(errs, group, err)
+			continue
+		}
+		// Results are in the order of the entries
+		for k, result := range output.RequestResponses {
+			if k < len(group) {
+				errs[group[k]] = newEntryError(result.ErrorCode, result.ErrorMessage)
+			}
+		}
+	}
+	return errs
+}
+
+// sinkError is the failure of one sink
+type sinkError struct {
+	sink sink
+	err  error
+}
+
+func (e sinkError) Error() string { return fmt.Sprintf("%s: %v", e.sink.name(), e.err) }
+func (e sinkError) Unwrap() error { return e.err }
+
+// fanOut sends each sink its pending records, with at most publishConcurrency sinks called at
+// once, and returns per sink the error of each of its pending records. Latency is that of the
+// slowest sink, not the sum of all.
+func fanOut(ctx context.Context, sinks []sink, pending [][]int, records []pendingRecord) [][]error {
+	results := make([][]error, len(sinks))
+	slots := make(chan struct{}, publishConcurrency)
+	var wg sync.WaitGroup
+	for s, target := range sinks {
+		if len(pending[s]) == 0 {
+			continue
+		}
+		batch := make([]pendingRecord, len(pending[s]))
+		for k, i := range pending[s] {
+			batch[k] = records[i]
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			start := time.Now()
+			results[s] = target.publish(ctx, batch)
+			metrics.Emit(map[string]string{"Sink": target.name(), "Outcome": metrics.ErrorOutcome(errors.Join(results[s]...))}, nil,
+				metrics.Duration("SinkPublishDuration", time.Since(start)))
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// publishRecords sends the records to every sink and returns the error of each record, nil
+// for records every sink accepted. Records a sink rejected with a retryable error are sent to
+// that sink again after a backoff, up to maxPublishRetries times; sinks that already took a
+// record do not receive it again, nor do sinks that took it in an earlier delivery. A record
+// that every failing sink rejected for good gets a permanent error.
+func publishRecords(ctx context.Context, sinks []sink, bp *backpressure, records []pendingRecord) []error {
+	failures := make([][]error, len(records))
+	pending := make([][]int, len(sinks))
+	for s := range sinks {
+		for i := range records {
+			if !records[i].deliveredTo(sinks[s].name()) {
+				pending[s] = append(pending[s], i)
+			}
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if !bp.wait(ctx) {
+			for s, indices := range pending {
+				for _, i := range indices {
+					failures[i] = append(failures[i], sinkError{sink: sinks[s], err: context.DeadlineExceeded})
+				}
+			}
+			break
+		}
+
+		results := fanOut(ctx, sinks, pending, records)
+		retries := 0
+		for s := range sinks {
+			var next []int
+			for k, i := range pending[s] {
+				err := results[s][k]
+				if err == nil {
+					continue
+				}
+				if errclass.Classify(err).Retryable() && attempt < maxPublishRetries {
+					next = append(next, i)
+					continue
+				}
+				failures[i] = append(failures[i], sinkError{sink: sinks[s], err: err})
+			}
+			pending[s] = next
+			retries += len(next)
+		}
+		if retries == 0 {
+			bp.recovered()
+			break
+		}
+
+		bp.throttled()
+		logger.FromContext(ctx).Warn("Sinks rejected records, backing off", "attempt", attempt+1, "records", retries, "backoff", bp.delay.String())
+		for s, indices := range pending {
+			for _, i := range indices {
+				records[i].span.AddEvent("retried", trace.WithAttributes(attribute.String("sink", sinks[s].name()), attribute.Int("attempt", attempt+1)))
+			}
+		}
+	}
+
+	errs := make([]error, len(records))
+	for i, failed := range failures {
+		if len(failed) == 0 {
+			continue
+		}
+		permanent := true
+		for _, err := range failed {
+			permanent = permanent && errclass.Classify(err) == errclass.Permanent
+		}
+		errs[i] = errors.Join(failed...)
+		if permanent {
+			// e.g. an oversized or rejected event: no retry will get it through
+			errs[i] = errclass.Mark(errclass.Permanent, errs[i])
+		}
+	}
+	return errs
+}
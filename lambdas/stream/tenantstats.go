@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// tenantTotalPeriod is the sort key of a tenant's running totals; the daily items are
+	// keyed by their UTC date, e.g. 2026-10-17
+	tenantTotalPeriod = "total"
+	// tenantDayRetention is how long the daily items are kept
+	tenantDayRetention = 90 * 24 * time.Hour
+)
+
+// tenantStatsAPI is the part of the DynamoDB client the counters use
+type tenantStatsAPI interface {
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+// tenantStatsSink keeps per-tenant counters (TENANT_STATS_TABLE_NAME) for GET
+// /tenants/{tenantId}/stats. It is a sink, so the counters get the dedup, retries and
+// dead-lettering of the published events, and a redelivered record is counted once.
+type tenantStatsSink struct {
+	client    tenantStatsAPI
+	tableName string
+}
+
+func (s *tenantStatsSink) name() string { return "tenantStats" }
+
+// publish counts the records one by one
+func (s *tenantStatsSink) publish(ctx context.Context, records []pendingRecord) []error {
+	errs := make([]error, len(records))
+	for i, r := range records {
+		errs[i] = s.count(ctx, r)
+	}
+	return errs
+}
+
+// tenantDelta is what a record changes in its tenant's counters
+type tenantDelta struct {
+	tenant  string
+	active  int
+	created bool
+}
+
+// deltaOf returns the change a record makes to the counters: creations and restores add an
+// active person, soft deletes remove one. Hard deletes only remove one when the person was
+// not soft-deleted before, which already did.
+func deltaOf(r pendingRecord) tenantDelta {
+	var delta tenantDelta
+	// Read from the record, as the published person may have its tenant masked
+	if tenant, ok := r.record.Change.NewImage["tenantId"]; ok && tenant.DataType() == events.DataTypeString {
+		delta.tenant = tenant.String()
+	}
+	switch r.detail.EventName {
+	case "INSERT":
+		delta.active, delta.created = 1, true
+	case "RESTORE":
+		delta.active = 1
+	case "REMOVE":
+		if r.record.EventName == "REMOVE" {
+			if tenant, ok := r.record.Change.OldImage["tenantId"]; ok && tenant.DataType() == events.DataTypeString {
+				delta.tenant = tenant.String()
+			}
+			if deletedFlag(r.record.Change.OldImage) {
+				return tenantDelta{}
+			}
+		}
+		delta.active = -1
+	}
+	return delta
+}
+
+// count applies a record to its tenant's total and to the day it happened in one transaction.
+// The stream event ID is the transaction's client request token, so a retried call within
+// DynamoDB's ten-minute window is not applied twice. Persons without a tenant are not counted.
+func (s *tenantStatsSink) count(ctx context.Context, r pendingRecord) error {
+	delta := deltaOf(r)
+	if delta.tenant == "" || (delta.active == 0 && !delta.created) {
+		return nil
+	}
+	happened := r.record.Change.ApproximateCreationDateTime.Time.UTC()
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	var items []types.TransactWriteItem
+	if delta.active != 0 {
+		update := expression.Add(expression.Name("activePersons"), expression.Value(delta.active)).
+			Set(expression.Name("updatedAt"), expression.Value(now))
+		item, err := s.update(delta.tenant, tenantTotalPeriod, update)
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+	if delta.created {
+		update := expression.Add(expression.Name("created"), expression.Value(1)).
+			Set(expression.Name("updatedAt"), expression.Value(now)).
+			Set(expression.Name("expiresAt"), expression.Value(happened.Add(tenantDayRetention).Unix()))
+		item, err := s.update(delta.tenant, happened.Format(time.DateOnly), update)
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+
+	_, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems:      items,
+		ClientRequestToken: aws.String(requestToken(r.record.EventID)),
+	})
+	return err
+}
+
+// update builds the transaction item updating one counter item
+func (s *tenantStatsSink) update(tenant string, period string, update expression.UpdateBuilder) (types.TransactWriteItem, error) {
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	return types.TransactWriteItem{Update: &types.Update{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"tenantId": &types.AttributeValueMemberS{Value: tenant},
+			"period":   &types.AttributeValueMemberS{Value: period},
+		},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}}, nil
+}
+
+// requestToken derives a client request token, at most 36 characters, from a stream event ID
+func requestToken(eventID string) string {
+	if len(eventID) <= 36 {
+		return eventID
+	}
+	sum := sha256.Sum256([]byte(eventID))
+	return hex.EncodeToString(sum[:16])
+}
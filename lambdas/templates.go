@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"regexp"
+	texttemplate "text/template"
+	"time"
+
+	"aws-lambda-go/internal/logger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Notification templates: bodies are versioned objects in S3, the table keeps the
+// latest and active version per template name. The email lambda renders the active version.
+var (
+	templatesTableName = settings.TemplatesTableName
+	templatesBucket    = settings.TemplatesBucket
+)
+
+// templateNamePattern keeps template names safe to use as S3 key segments
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// NotificationTemplate is the content of one template version
+type NotificationTemplate struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// TemplateInfo describes the versions of a template
+type TemplateInfo struct {
+	TemplateName  string `json:"templateName"`
+	LatestVersion int64  `json:"latestVersion"`
+	ActiveVersion int64  `json:"activeVersion,omitempty"`
+	UpdatedAt     string `json:"updatedAt,omitempty"`
+}
+
+// ActivateRequest selects the template version used for rendering
+type ActivateRequest struct {
+	Version int64 `json:"version"`
+}
+
+// templateObjectKey returns the S3 key of a template version
+func templateObjectKey(name string, version int64) string {
+	return fmt.Sprintf("templates/%s/v%d.json", name, version)
+}
+
+// templateRoute checks that template management is enabled and validates the template
+// name before calling a template handler
+func templateRoute(next func(ctx context.Context, request events.APIGatewayProxyRequest, name string) (events.APIGatewayProxyResponse, error)) handlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if templatesTableName == "" || templatesBucket == "" {
+			return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Template management is not enabled"), nil
+		}
+
+		name := request.PathParameters["templateName"]
+		if name == "" {
+			return errorResponse(request, http.StatusBadRequest, errCodeMissingParameter, "Missing templateName"), nil
+		}
+		if !templateNamePattern.MatchString(name) {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Template names may only contain lowercase letters, digits and dashes"), nil
+		}
+		return next(ctx, request, name)
+	}
+}
+
+// parse checks the template syntax the way the email lambda renders it: the subject as a text
+// template, the body as an HTML template
+func (t NotificationTemplate) parse(name string) error {
+	if _, err := texttemplate.New(name + "-subject").Parse(t.Subject); err != nil {
+		return err
+	}
+	_, err := htmltemplate.New(name + "-body").Parse(t.Body)
+	return err
+}
+
+// handleUploadTemplate stores the body as a new version; it does not change the active version.
+// Templates that do not parse are rejected, so a broken version can never be activated.
+func handleUploadTemplate(ctx context.Context, request events.APIGatewayProxyRequest, name string) (events.APIGatewayProxyResponse, error) {
+	var template NotificationTemplate
+	if err := json.Unmarshal([]byte(request.Body), &template); err != nil || template.Subject == "" || template.Body == "" {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Template requires a subject and body"), nil
+	}
+	if err := template.parse(name); err != nil {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid template: "+err.Error()), nil
+	}
+
+	// Reserve the next version number atomically
+	expr, err := expression.NewBuilder().WithUpdate(expression.
+		Add(expression.Name("latestVersion"), expression.Value(1)).
+		Set(expression.Name("updatedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339)))).
+		Build()
+	if err != nil {
+		return internalErrorResponse(ctx, request, "build template version update", err), nil
+	}
+	result, err := svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(templatesTableName),
+		Key:                       map[string]types.AttributeValue{"templateName": &types.AttributeValueMemberS{Value: name}},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "reserve template version", err), nil
+	}
+	version := numberAttribute(result.Attributes, "latestVersion")
+
+	content, err := json.Marshal(template)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "marshal template", err), nil
+	}
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(templatesBucket),
+		Key:         aws.String(templateObjectKey(name, version)),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "store template", err), nil
+	}
+
+	logger.FromContext(ctx).Info("Uploaded template", "templateName", name, "version", version)
+	return jsonResponse(ctx, request, http.StatusCreated, TemplateInfo{TemplateName: name, LatestVersion: version})
+}
+
+func handleGetTemplate(ctx context.Context, request events.APIGatewayProxyRequest, name string) (events.APIGatewayProxyResponse, error) {
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(templatesTableName),
+		Key:       map[string]types.AttributeValue{"templateName": &types.AttributeValueMemberS{Value: name}},
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "get template", err), nil
+	}
+	if result.Item == nil {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Template not found"), nil
+	}
+
+	info := TemplateInfo{
+		TemplateName:  name,
+		LatestVersion: numberAttribute(result.Item, "latestVersion"),
+		ActiveVersion: numberAttribute(result.Item, "activeVersion"),
+	}
+	if v, ok := result.Item["updatedAt"].(*types.AttributeValueMemberS); ok {
+		info.UpdatedAt = v.Value
+	}
+	return jsonResponse(ctx, request, http.StatusOK, info)
+}
+
+func handleActivateTemplate(ctx context.Context, request events.APIGatewayProxyRequest, name string) (events.APIGatewayProxyResponse, error) {
+	var activate ActivateRequest
+	if err := json.Unmarshal([]byte(request.Body), &activate); err != nil || activate.Version < 1 {
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Activation requires a positive version"), nil
+	}
+
+	// Refuse to activate a version whose upload never completed
+	_, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(templatesBucket),
+		Key:    aws.String(templateObjectKey(name, activate.Version)),
+	})
+	var notFound *s3types.NotFound
+	if errors.As(err, &notFound) {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Template version not found"), nil
+	}
+	if err != nil {
+		return internalErrorResponse(ctx, request, "check template version", err), nil
+	}
+
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.
+			Set(expression.Name("activeVersion"), expression.Value(activate.Version)).
+			Set(expression.Name("updatedAt"), expression.Value(time.Now().UTC().Format(time.RFC3339)))).
+		WithCondition(expression.AttributeExists(expression.Name("templateName"))).
+		Build()
+	if err != nil {
+		return internalErrorResponse(ctx, request, "build template activation", err), nil
+	}
+	_, err = svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(templatesTableName),
+		Key:                       map[string]types.AttributeValue{"templateName": &types.AttributeValueMemberS{Value: name}},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "activate template", err), nil
+	}
+
+	logger.FromContext(ctx).Info("Activated template", "templateName", name, "version", activate.Version)
+	return jsonResponse(ctx, request, http.StatusOK, TemplateInfo{TemplateName: name, ActiveVersion: activate.Version})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// tenantStatsDays is how many days of creations GET /tenants/{tenantId}/stats lists
+const tenantStatsDays = 7
+
+// tenantStatsTableName holds the counters the stream lambda keeps per tenant
+// (TENANT_STATS_TABLE_NAME): a "total" item and one item per UTC day
+var tenantStatsTableName = settings.TenantStatsTableName
+
+// TenantStats is the body of GET /tenants/{tenantId}/stats
+type TenantStats struct {
+	TenantID      string `json:"tenantId"`
+	ActivePersons int64  `json:"activePersons"`
+	CreatedToday  int64  `json:"createdToday"`
+	// Created lists the persons created per day of the last week, oldest first; days
+	// without creations are left out
+	Created   []DailyCount `json:"created"`
+	UpdatedAt string       `json:"updatedAt,omitempty"`
+}
+
+// DailyCount is the persons created on one UTC day
+type DailyCount struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// tenantCounter is a counter item of the tenant stats table
+type tenantCounter struct {
+	Period        string `dynamodbav:"period"`
+	ActivePersons int64  `dynamodbav:"activePersons"`
+	Created       int64  `dynamodbav:"created"`
+	UpdatedAt     string `dynamodbav:"updatedAt"`
+}
+
+// handleTenantStats returns a tenant's counters with a single query, so dashboards need no
+// count scans. Callers other than admins only see the stats of their own tenant
+// (custom:tenantId).
+func handleTenantStats(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if tenantStatsTableName == "" {
+		return errorResponse(request, http.StatusNotFound, errCodeNotFound, "Tenant stats are not enabled"), nil
+	}
+	tenantID := request.PathParameters["tenantId"]
+	if caller := callerFromContext(ctx); caller != nil && !caller.isAdmin() && caller.Tenant != tenantID {
+		return errorResponse(request, http.StatusForbidden, errCodeForbidden, "Callers can only read the stats of their own tenant"), nil
+	}
+
+	// Day items sort by date, and "total" after every date
+	today := time.Now().UTC()
+	from := today.AddDate(0, 0, -(tenantStatsDays - 1)).Format(time.DateOnly)
+	keyCondition := expression.Key("tenantId").Equal(expression.Value(tenantID)).
+		And(expression.Key("period").GreaterThanEqual(expression.Value(from)))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCondition).Build()
+	if err != nil {
+		return internalErrorResponse(ctx, request, "build tenant stats query", err), nil
+	}
+	result, err := svc.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(tenantStatsTableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		return internalErrorResponse(ctx, request, "query tenant stats", err), nil
+	}
+	var counters []tenantCounter
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &counters); err != nil {
+		return internalErrorResponse(ctx, request, "unmarshal tenant stats", err), nil
+	}
+
+	stats := TenantStats{TenantID: tenantID, Created: []DailyCount{}}
+	for _, counter := range counters {
+		switch counter.Period {
+		case "total":
+			stats.ActivePersons = counter.ActivePersons
+		default:
+			stats.Created = append(stats.Created, DailyCount{Date: counter.Period, Count: counter.Created})
+			if counter.Period == today.Format(time.DateOnly) {
+				stats.CreatedToday = counter.Created
+			}
+		}
+		stats.UpdatedAt = max(stats.UpdatedAt, counter.UpdatedAt)
+	}
+	return jsonResponse(ctx, request, http.StatusOK, stats)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/pkg/personevents"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultTimelineLimit = 25
+	maxTimelineLimit     = 100
+)
+
+// Types of timeline entries
+const (
+	timelineRevision     = "revision"
+	timelineNotification = "notification"
+	timelineLegalHold    = "legalHold"
+	timelineEvent        = "event"
+)
+
+// TimelineEntry is one thing that happened to a person
+type TimelineEntry struct {
+	Time string `json:"time"`
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	// Summary is a one-line description for support agents
+	Summary string      `json:"summary"`
+	Details interface{} `json:"details"`
+
+	at time.Time
+}
+
+// TimelineRevision are the details of a revision entry. Changed values are masked like in
+// the audit log they come from.
+type TimelineRevision struct {
+	EventName     string               `json:"eventName"`
+	Version       int64                `json:"version,omitempty"`
+	CorrelationID string               `json:"correlationId,omitempty"`
+	ChangedFields []models.FieldChange `json:"changedFields,omitempty"`
+}
+
+// TimelinePage is the response of GET /persons/{personId}/timeline
+type TimelinePage struct {
+	Entries   []TimelineEntry `json:"entries"`
+	NextToken string          `json:"nextToken,omitempty"`
+}
+
+// auditLogLine is the part of a Logging Lambda log line the timeline reads
+type auditLogLine struct {
+	Audit struct {
+		ID            string          `json:"id"`
+		DetailType    string          `json:"detailType"`
+		Time          string          `json:"time"`
+		CorrelationID string          `json:"correlationId"`
+		EventName     string          `json:"eventName"`
+		Detail        json.RawMessage `json:"detail"`
+	} `json:"audit"`
+}
+
+// handleTimeline merges a person's revisions and other audit events, notifications and legal
+// holds into one feed, newest first. Every page reads all sources again, so pages stay
+// consistent while new entries arrive: they only appear on the first page.
+func handleTimeline(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	personID := request.PathParameters["personId"]
+
+	limit := defaultTimelineLimit
+	if value := request.QueryStringParameters["limit"]; value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxTimelineLimit {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, fmt.Sprintf("limit must be between 1 and %d", maxTimelineLimit)), nil
+		}
+		limit = parsed
+	}
+	var after *TimelineEntry
+	if token := request.QueryStringParameters["nextToken"]; token != "" {
+		entry, err := decodeTimelineToken(token)
+		if err != nil {
+			return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid nextToken"), nil
+		}
+		after = &entry
+	}
+
+	var entries []TimelineEntry
+	audit, err := auditHistory(ctx, personID)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "search audit log for timeline", err), nil
+	}
+	entries = append(entries, auditEntries(audit)...)
+	notifications, err := notificationHistory(ctx, personID)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "query notifications for timeline", err), nil
+	}
+	for _, n := range notifications {
+		entries = append(entries, newTimelineEntry(timelineNotification, stringField(n, "notificationId"), stringField(n, "createdAt"),
+			fmt.Sprintf("%s notification %s", stringField(n, "channel"), stringField(n, "status")), n))
+	}
+	holds, err := legalHolds(ctx, personID)
+	if err != nil {
+		return internalErrorResponse(ctx, request, "query legal holds for timeline", err), nil
+	}
+	for _, h := range holds {
+		entries = append(entries, newTimelineEntry(timelineLegalHold, stringField(h, "holdId"), stringField(h, "createdAt"),
+			fmt.Sprintf("Legal hold placed for case %s", stringField(h, "caseId")), h))
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return timelineBefore(entries[i], entries[j]) })
+	start := 0
+	if after != nil {
+		start = sort.Search(len(entries), func(i int) bool { return timelineBefore(*after, entries[i]) })
+	}
+	page := TimelinePage{Entries: entries[start:min(start+limit, len(entries))]}
+	if start+limit < len(entries) {
+		page.NextToken = encodeTimelineToken(page.Entries[len(page.Entries)-1])
+	}
+	if page.Entries == nil {
+		page.Entries = []TimelineEntry{}
+	}
+	return jsonResponse(ctx, request, http.StatusOK, page)
+}
+
+// auditEntries converts the Logging Lambda's audit records into revision entries, and
+// records of other event types (e.g. PersonErased) into event entries
+func auditEntries(records []json.RawMessage) []TimelineEntry {
+	var entries []TimelineEntry
+	for _, raw := range records {
+		var line auditLogLine
+		if err := json.Unmarshal(raw, &line); err != nil || line.Audit.ID == "" {
+			continue
+		}
+		audit := line.Audit
+		if audit.DetailType != personevents.DetailTypeStreamEvent {
+			entries = append(entries, newTimelineEntry(timelineEvent, audit.ID, audit.Time, audit.DetailType, audit))
+			continue
+		}
+
+		var detail models.PersonChangedEvent
+		_ = json.Unmarshal(audit.Detail, &detail)
+		revision := TimelineRevision{EventName: audit.EventName, CorrelationID: audit.CorrelationID, ChangedFields: detail.ChangedFields}
+		if person, err := detail.Person(); err == nil {
+			revision.Version = person.Version
+		}
+		summary := fmt.Sprintf("%s, version %d", audit.EventName, revision.Version)
+		if len(detail.ChangedFields) > 0 {
+			fields := make([]string, len(detail.ChangedFields))
+			for i, change := range detail.ChangedFields {
+				fields[i] = change.Field
+			}
+			summary += ": " + strings.Join(fields, ", ")
+		}
+		entries = append(entries, newTimelineEntry(timelineRevision, audit.ID, audit.Time, summary, revision))
+	}
+	return entries
+}
+
+func newTimelineEntry(entryType string, id string, at string, summary string, details interface{}) TimelineEntry {
+	entry := TimelineEntry{Time: at, Type: entryType, ID: id, Summary: summary, Details: details}
+	entry.at, _ = time.Parse(time.RFC3339, at)
+	return entry
+}
+
+// timelineBefore orders entries newest first; entries of the same time by type and ID
+func timelineBefore(a TimelineEntry, b TimelineEntry) bool {
+	if !a.at.Equal(b.at) {
+		return a.at.After(b.at)
+	}
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	return a.ID < b.ID
+}
+
+// The continuation token names the last entry of the previous page
+func encodeTimelineToken(entry TimelineEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join([]string{entry.Time, entry.Type, entry.ID}, "\n")))
+}
+
+func decodeTimelineToken(token string) (TimelineEntry, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return TimelineEntry{}, err
+	}
+	parts := strings.SplitN(string(raw), "\n", 3)
+	if len(parts) != 3 {
+		return TimelineEntry{}, fmt.Errorf("malformed timeline token")
+	}
+	return newTimelineEntry(parts[1], parts[2], parts[0], "", nil), nil
+}
+
+// stringField reads a string attribute of an unmarshalled item
+func stringField(item map[string]interface{}, name string) string {
+	value, _ := item[name].(string)
+	return value
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/internal/tracing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Person updates are built with the expression package, which refers to every attribute through
+// ExpressionAttributeNames, so reserved words such as "name" or "status" can be attributes too.
+
+// personUpdate holds the attributes PUT /persons/{personId} replaces, named by their dynamodbav
+// tags. Attributes tagged omitempty are removed when empty: the lookup keys because index keys
+// cannot be empty, and the structured address because a single-line address replaces it.
+type personUpdate struct {
+	FirstName           string `dynamodbav:"firstName"`
+	LastName            string `dynamodbav:"lastName"`
+	Address             string `dynamodbav:"address"`
+	PhoneNumber         string `dynamodbav:"phoneNumber"`
+	Email               string `dynamodbav:"email"`
+	NotificationChannel string `dynamodbav:"notificationChannel"`
+	Locale              string `dynamodbav:"locale,omitempty"`
+	AddressParts        string `dynamodbav:"addressParts,omitempty"`
+	EmailKey            string `dynamodbav:"emailKey,omitempty"`
+	LastNameKey         string `dynamodbav:"lastNameKey,omitempty"`
+	// The identity hashes are set on the marshalled item by identityHasher, and removed along
+	// with the contact detail they hash
+	EmailHash string `dynamodbav:"emailHash,omitempty"`
+	PhoneHash string `dynamodbav:"phoneHash,omitempty"`
+}
+
+// newPersonUpdate returns the replaced attributes of a person
+func newPersonUpdate(person models.Person, addressParts string) personUpdate {
+	keys := matchKeys(person)
+	return personUpdate{
+		FirstName:           person.FirstName,
+		LastName:            person.LastName,
+		Address:             person.Address,
+		PhoneNumber:         person.PhoneNumber,
+		Email:               person.Email,
+		NotificationChannel: person.NotificationChannel,
+		Locale:              person.Locale,
+		AddressParts:        addressParts,
+		EmailKey:            keys[emailKeyAttribute],
+		LastNameKey:         keys[lastNameKeyAttribute],
+	}
+}
+
+// attributeNames lists the dynamodbav names of a struct's fields in declaration order, and
+// whether each is tagged omitempty
+func attributeNames(v interface{}) ([]string, map[string]bool) {
+	t := reflect.TypeOf(v)
+	var names []string
+	omitEmpty := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		name, options, _ := strings.Cut(t.Field(i).Tag.Get("dynamodbav"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		names = append(names, name)
+		omitEmpty[name] = strings.Contains(options, "omitempty")
+	}
+	return names, omitEmpty
+}
+
+// setAttributes adds the attributes of a struct to an update, taking their values from item,
+// the struct marshalled (and possibly encrypted). Omitempty attributes missing from item are
+// removed.
+func setAttributes(update expression.UpdateBuilder, v interface{}, item map[string]types.AttributeValue) expression.UpdateBuilder {
+	names, omitEmpty := attributeNames(v)
+	for _, name := range names {
+		if value, ok := item[name]; ok {
+			update = update.Set(expression.Name(name), expression.Value(value))
+		} else if omitEmpty[name] {
+			update = update.Remove(expression.Name(name))
+		}
+	}
+	return update
+}
+
+// touch adds the bookkeeping every person write does: bump the version (items created before
+// versioning start from 0), refresh updatedAt, and store the correlation ID, trace header and
+// actor for the stream lambda
+func touch(ctx context.Context, update expression.UpdateBuilder, now string) expression.UpdateBuilder {
+	return update.
+		Set(expression.Name("version"), expression.Plus(expression.IfNotExists(expression.Name("version"), expression.Value(0)), expression.Value(1))).
+		Set(expression.Name("updatedAt"), expression.Value(now)).
+		Set(expression.Name("correlationId"), expression.Value(logger.CorrelationID(ctx))).
+		Set(expression.Name("traceHeader"), expression.Value(tracing.Header(ctx))).
+		Set(expression.Name("updatedBy"), expression.Value(actorFromContext(ctx)))
+}
+
+// keepStoredPII keeps the stored ciphertext of the PII attributes a PUT does not change (see
+// fieldcrypt.KeepUnchanged), so only the attributes that did change appear in the stream's
+// changedFields. Persons that do not exist yet have nothing to keep.
+func keepStoredPII(ctx context.Context, personID string, item map[string]types.AttributeValue) error {
+	if !fieldEncryptor.Enabled() {
+		return nil
+	}
+	var names expression.ProjectionBuilder
+	for _, field := range fieldEncryptor.Fields() {
+		names = names.AddNames(expression.Name(field))
+	}
+	expr, err := expression.NewBuilder().WithProjection(names).Build()
+	if err != nil {
+		return err
+	}
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                aws.String(tableName),
+		Key:                      map[string]types.AttributeValue{"personId": &types.AttributeValueMemberS{Value: personID}},
+		ProjectionExpression:     expr.Projection(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	if err != nil {
+		return err
+	}
+	return fieldEncryptor.KeepUnchanged(ctx, personID, item, result.Item)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"aws-lambda-go/internal/logger"
+	"aws-lambda-go/internal/models"
+	"aws-lambda-go/internal/validation"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ValidationReport is the body of POST /persons/validate: the document as it would be
+// stored, the problems that would reject it and warnings about what would be dropped or
+// changed. Nothing is written.
+type ValidationReport struct {
+	Valid bool `json:"valid"`
+	// Person is the normalized document, a PersonV2 for v2 requests
+	Person     interface{}             `json:"person"`
+	LookupKeys map[string]string       `json:"lookupKeys,omitempty"`
+	Errors     []validation.FieldError `json:"errors"`
+	Warnings   []validation.FieldError `json:"warnings"`
+}
+
+// serverManagedFields are accepted in a person document but replaced by the service
+var serverManagedFields = map[string]bool{
+	"personId":  true,
+	"version":   true,
+	"createdAt": true,
+	"updatedAt": true,
+	"ownerId":   true,
+	"tenantId":  true,
+}
+
+// personDocumentFields are the fields a client may set, in both API versions
+var personDocumentFields = map[string]bool{
+	"firstName":           true,
+	"lastName":            true,
+	"address":             true,
+	"phoneNumber":         true,
+	"email":               true,
+	"notificationChannel": true,
+	"locale":              true,
+}
+
+// handleValidate runs a person document through the same decoding, normalization and
+// validation as POST /persons/batch and reports the outcome without persisting anything,
+// so partner integrations can pre-flight their data
+func handleValidate(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(request.Body), &fields); err != nil {
+		logger.FromContext(ctx).Warn("Failed to parse request body", "error", err)
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid person document"), nil
+	}
+	person, addressParts, err := decodePerson(ctx, request.Body)
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to parse request body", "error", err)
+		return errorResponse(request, http.StatusBadRequest, errCodeInvalidInput, "Invalid person document"), nil
+	}
+	if person.TenantID, err = writeTenant(ctx, request); err != nil {
+		return errorResponse(request, http.StatusForbidden, errCodeForbidden, err.Error()), nil
+	}
+
+	report := ValidationReport{
+		Errors:     validation.Validate(person),
+		Warnings:   validationWarnings(ctx, fields, person),
+		LookupKeys: map[string]string{},
+	}
+	report.Valid = len(report.Errors) == 0
+	if report.Errors == nil {
+		report.Errors = []validation.FieldError{}
+	}
+	for attribute, value := range matchKeys(person) {
+		if value != "" {
+			report.LookupKeys[attribute] = value
+		}
+	}
+
+	report.Person = person
+	if apiVersion(ctx) == apiV2 {
+		normalized, err := normalizedPersonV2(person, addressParts)
+		if err != nil {
+			return internalErrorResponse(ctx, request, "normalize address", err), nil
+		}
+		report.Person = normalized
+		return envelopeResponse(ctx, request, http.StatusOK, report, nil)
+	}
+	return jsonResponse(ctx, request, http.StatusOK, report)
+}
+
+// validationWarnings lists what a write would silently drop or change. fields is the raw
+// document, person the decoded one.
+func validationWarnings(ctx context.Context, fields map[string]json.RawMessage, person models.Person) []validation.FieldError {
+	warnings := []validation.FieldError{}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case serverManagedFields[name]:
+			warnings = append(warnings, validation.FieldError{Field: name, Message: "is set by the service and ignored"})
+		case !personDocumentFields[name]:
+			warnings = append(warnings, validation.FieldError{Field: name, Message: "is not a person field and ignored"})
+		}
+	}
+
+	for _, f := range []struct{ field, value string }{
+		{"firstName", person.FirstName},
+		{"lastName", person.LastName},
+		{"address", person.Address},
+		{"phoneNumber", person.PhoneNumber},
+		{"email", person.Email},
+	} {
+		if f.value != strings.TrimSpace(f.value) {
+			warnings = append(warnings, validation.FieldError{Field: f.field, Message: "has leading or trailing whitespace, which is stored as sent"})
+		}
+	}
+	if person.NotificationChannel == "email" && person.Email == "" {
+		warnings = append(warnings, validation.FieldError{Field: "notificationChannel", Message: "is email but no email address is set"})
+	}
+
+	// v2 derives the formatted address from its components, replacing the one sent
+	if apiVersion(ctx) == apiV2 {
+		var address Address
+		if err := json.Unmarshal(fields["address"], &address); err == nil && address.hasParts() &&
+			address.Formatted != "" && address.Formatted != person.Address {
+			warnings = append(warnings, validation.FieldError{Field: "address.formatted", Message: "is replaced by the address built from its components"})
+		}
+	}
+	return warnings
+}
+
+// normalizedPersonV2 returns the v2 representation of a decoded person document
+func normalizedPersonV2(person models.Person, addressParts string) (PersonV2, error) {
+	v2 := PersonV2{
+		FirstName:           person.FirstName,
+		LastName:            person.LastName,
+		PhoneNumber:         person.PhoneNumber,
+		Email:               person.Email,
+		NotificationChannel: person.NotificationChannel,
+		TenantID:            person.TenantID,
+	}
+	if person.Address == "" {
+		return v2, nil
+	}
+	address := Address{}
+	if addressParts != "" {
+		if err := json.Unmarshal([]byte(addressParts), &address); err != nil {
+			return PersonV2{}, err
+		}
+	}
+	address.Formatted = person.Address
+	v2.Address = &address
+	return v2, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"aws-lambda-go/internal/models"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// API versions. Unversioned paths (/persons) are served as v1 so existing clients keep working.
+const (
+	apiV1 = "v1"
+	apiV2 = "v2"
+)
+
+type apiVersionKey struct{}
+
+// withAPIVersion returns a route middleware that tells the shared handlers which
+// version of the API the request was made against
+func withAPIVersion(version string) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+			return next(context.WithValue(ctx, apiVersionKey{}, version), request)
+		}
+	}
+}
+
+// apiVersion returns the API version of the request, v1 when none was set
+func apiVersion(ctx context.Context) string {
+	if version, ok := ctx.Value(apiVersionKey{}).(string); ok {
+		return version
+	}
+	return apiV1
+}
+
+// Address is the structured address of the v2 API. v1 only knows the single-line address,
+// which is always kept up to date as Formatted; the components are stored next to it in
+// addressParts when a v2 client wrote them.
+type Address struct {
+	Street     string `json:"street,omitempty"`
+	City       string `json:"city,omitempty"`
+	PostalCode string `json:"postalCode,omitempty"`
+	Country    string `json:"country,omitempty"`
+	// Formatted is the single-line address. It is derived from the components when they are set.
+	Formatted string `json:"formatted,omitempty"`
+}
+
+// hasParts reports whether any address component is set
+func (a Address) hasParts() bool {
+	return a.Street != "" || a.City != "" || a.PostalCode != "" || a.Country != ""
+}
+
+// format joins the components into the single-line address, e.g. "1 Main St, 12345 Springfield, US"
+func (a Address) format() string {
+	var parts []string
+	for _, part := range []string{a.Street, strings.TrimSpace(a.PostalCode + " " + a.City), a.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// PersonV2 is the v2 representation of a person: identical to Person except for the
+// structured address
+type PersonV2 struct {
+	PersonID            string   `json:"personId,omitempty"`
+	FirstName           string   `json:"firstName,omitempty"`
+	LastName            string   `json:"lastName,omitempty"`
+	Address             *Address `json:"address,omitempty"`
+	PhoneNumber         string   `json:"phoneNumber,omitempty"`
+	Email               string   `json:"email,omitempty"`
+	NotificationChannel string   `json:"notificationChannel,omitempty"`
+	Version             int64    `json:"version,omitempty"`
+	CreatedAt           string   `json:"createdAt,omitempty"`
+	UpdatedAt           string   `json:"updatedAt,omitempty"`
+	OwnerID             string   `json:"ownerId,omitempty"`
+	TenantID            string   `json:"tenantId,omitempty"`
+	Locale              string   `json:"locale,omitempty"`
+}
+
+// Envelope wraps every successful v2 response body
+type Envelope struct {
+	Data interface{}  `json:"data"`
+	Meta EnvelopeMeta `json:"meta"`
+}
+
+// EnvelopeMeta describes a v2 response
+type EnvelopeMeta struct {
+	RequestID string `json:"requestId,omitempty"`
+	// Count is the number of items of a list response
+	Count *int `json:"count,omitempty"`
+	// Partial is set when a list was cut short before the request deadline; NextToken continues it
+	Partial   bool   `json:"partial,omitempty"`
+	NextToken string `json:"nextToken,omitempty"`
+}
+
+// decodePerson parses a POST or PUT body in the request's API version. addressParts is
+// the JSON-encoded address components to store, empty when the client sent none.
+func decodePerson(ctx context.Context, body string) (person models.Person, addressParts string, err error) {
+	if apiVersion(ctx) != apiV2 {
+		err = json.Unmarshal([]byte(body), &person)
+		return person, "", err
+	}
+
+	var v2 PersonV2
+	if err := json.Unmarshal([]byte(body), &v2); err != nil {
+		return models.Person{}, "", err
+	}
+	person = models.Person{
+		FirstName:           v2.FirstName,
+		LastName:            v2.LastName,
+		PhoneNumber:         v2.PhoneNumber,
+		Email:               v2.Email,
+		NotificationChannel: v2.NotificationChannel,
+		Locale:              v2.Locale,
+	}
+	if v2.Address == nil {
+		return person, "", nil
+	}
+	person.Address = v2.Address.Formatted
+	if !v2.Address.hasParts() {
+		return person, "", nil
+	}
+	person.Address = v2.Address.format()
+	parts := *v2.Address
+	parts.Formatted = ""
+	partsJSON, err := json.Marshal(parts)
+	if err != nil {
+		return models.Person{}, "", err
+	}
+	return person, string(partsJSON), nil
+}
+
+// personV2FromItem converts a stored (decrypted) person item to its v2 representation
+func personV2FromItem(item map[string]types.AttributeValue) (PersonV2, error) {
+	person, err := models.UnmarshalPerson(item)
+	if err != nil {
+		return PersonV2{}, err
+	}
+	v2 := PersonV2{
+		PersonID:            person.PersonID,
+		FirstName:           person.FirstName,
+		LastName:            person.LastName,
+		PhoneNumber:         person.PhoneNumber,
+		Email:               person.Email,
+		NotificationChannel: person.NotificationChannel,
+		Version:             person.Version,
+		CreatedAt:           person.CreatedAt,
+		UpdatedAt:           person.UpdatedAt,
+		OwnerID:             person.OwnerID,
+		TenantID:            person.TenantID,
+		Locale:              person.Locale,
+	}
+	if person.Address == "" {
+		return v2, nil
+	}
+	address := Address{}
+	if person.AddressParts != "" {
+		if err := json.Unmarshal([]byte(person.AddressParts), &address); err != nil {
+			return PersonV2{}, fmt.Errorf("invalid addressParts of person %s: %w", person.PersonID, err)
+		}
+	}
+	address.Formatted = person.Address
+	v2.Address = &address
+	return v2, nil
+}
+
+// enveloped reports whether a v2 response is wrapped in an Envelope. The Envelope is rolled
+// out like a response format (ROLLOUT_ENVELOPE_PERCENT); v2 requests outside the rollout are
+// answered with the bare data.
+func enveloped(ctx context.Context, request events.APIGatewayProxyRequest) bool {
+	if apiVersion(ctx) != apiV2 {
+		return false
+	}
+	if !rolloutEnabled(featureEnvelope, rolloutKey(ctx, request)) {
+		useFormat(ctx, formatCleanJSON)
+		return false
+	}
+	useFormat(ctx, formatEnvelope)
+	return true
+}
+
+// envelopeResponse answers a v2 request with data wrapped in an Envelope, or with the bare
+// data outside the Envelope's rollout
+func envelopeResponse(ctx context.Context, request events.APIGatewayProxyRequest, statusCode int, data interface{}, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	var body interface{} = data
+	if enveloped(ctx, request) {
+		body = Envelope{Data: data, Meta: EnvelopeMeta{RequestID: request.RequestContext.RequestID}}
+	}
+	response, err := jsonResponse(ctx, request, statusCode, body)
+	for name, value := range headers {
+		response.Headers[name] = value
+	}
+	return response, err
+}
+
+// personWritten answers a successful POST, PUT or DELETE. v1 keeps its historic bodies;
+// v2 returns the person ID and, when known, the new version in an envelope.
+func personWritten(ctx context.Context, request events.APIGatewayProxyRequest, v1Body string, personID string, version int64, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	if apiVersion(ctx) != apiV2 {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Headers: headers, Body: v1Body}, nil
+	}
+	data := map[string]interface{}{"personId": personID}
+	if version > 0 {
+		data["version"] = version
+	}
+	return envelopeResponse(ctx, request, http.StatusOK, data, headers)
+}
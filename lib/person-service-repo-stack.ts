@@ -9,6 +9,18 @@ import * as eventTargets from 'aws-cdk-lib/aws-events-targets';
 import * as iam from 'aws-cdk-lib/aws-iam';
 import * as eventSources from 'aws-cdk-lib/aws-lambda-event-sources';
 import * as logs from 'aws-cdk-lib/aws-logs';
+import * as s3 from 'aws-cdk-lib/aws-s3';
+import * as s3n from 'aws-cdk-lib/aws-s3-notifications';
+import * as sqs from 'aws-cdk-lib/aws-sqs';
+import * as sns from 'aws-cdk-lib/aws-sns';
+import * as snsSubscriptions from 'aws-cdk-lib/aws-sns-subscriptions';
+import * as ses from 'aws-cdk-lib/aws-ses';
+import * as cloudwatch from 'aws-cdk-lib/aws-cloudwatch';
+import * as cognito from 'aws-cdk-lib/aws-cognito';
+import * as kms from 'aws-cdk-lib/aws-kms';
+import * as kinesis from 'aws-cdk-lib/aws-kinesis';
+import * as opensearch from 'aws-cdk-lib/aws-opensearchservice';
+import * as triggers from 'aws-cdk-lib/triggers';
 
 export class PersonServiceRepoStack extends cdk.Stack {
   constructor(scope: Construct, id: string, props?: StackProps) {
@@ -17,7 +29,8 @@ export class PersonServiceRepoStack extends cdk.Stack {
     // DynamoDB Table
     const dynamoTable = new dynamodb.Table(this, 'PersonsDynamoTable', {
       partitionKey: { name: 'personId', type: dynamodb.AttributeType.STRING },
-      stream: dynamodb.StreamViewType.NEW_IMAGE,
+      // Old images let the stream lambda report which fields changed
+      stream: dynamodb.StreamViewType.NEW_AND_OLD_IMAGES,
       removalPolicy: cdk.RemovalPolicy.DESTROY,
     });
 
@@ -28,18 +41,146 @@ export class PersonServiceRepoStack extends cdk.Stack {
       handler: 'main',
       code: lambda.Code.fromAsset('lambdas/stream'),
     });
+    // The redrive lambda runs the stream lambda's code on the dead-letter queue, so it gets
+    // the same sinks, filters and format
+    const streamRedriveLambda = new lambda.Function(this, 'StreamRedriveLambda', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.X86_64,
+      handler: 'main',
+      code: lambda.Code.fromAsset('lambdas/stream'),
+      environment: { STREAM_MODE: 'redrive' },
+    });
+    const streamPublishers = [streamLambda, streamRedriveLambda];
     dynamoTable.grantStreamRead(streamLambda);
 
     const eventBus = new eventbridge.EventBus(this, 'DDBStreamEventBus', {
       eventBusName: 'DDBStreamCustomEventBus',
     });
-    streamLambda.addToRolePolicy(new iam.PolicyStatement({
-      actions: ['events:PutEvents'],
-      resources: [eventBus.eventBusArn],
+    // The bus is a sink unless `-c streamEventBridgeSink=false`, for deployments that publish only to
+    // the other sinks below; the email and audit log rules on the bus then receive no person events
+    if (this.node.tryGetContext('streamEventBridgeSink') !== 'false') {
+      for (const fn of streamPublishers) {
+        fn.addToRolePolicy(new iam.PolicyStatement({
+          actions: ['events:PutEvents'],
+          resources: [eventBus.eventBusArn],
+        }));
+        fn.addEnvironment('EVENT_BUS_NAME', eventBus.eventBusName);
+      }
+    }
+
+    // Stream records that can't be converted into events are kept here with diagnostics
+    const quarantineBucket = new s3.Bucket(this, 'StreamQuarantineBucket', {
+      encryption: s3.BucketEncryption.S3_MANAGED,
+      blockPublicAccess: s3.BlockPublicAccess.BLOCK_ALL,
+      enforceSSL: true,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+      autoDeleteObjects: true,
+      lifecycleRules: [{ prefix: 'quarantine/', expiration: cdk.Duration.days(30) }],
+    });
+    for (const fn of streamPublishers) {
+      quarantineBucket.grantPut(fn);
+      fn.addEnvironment('QUARANTINE_BUCKET', quarantineBucket.bucketName);
+    }
+
+    // Additional sinks the stream lambda publishes to alongside EventBridge, each opt-in with an existing
+    // resource (`cdk deploy -c streamSnsTopicArn=... -c streamSqsQueueArn=... -c streamKinesisStreamArn=... -c streamFirehoseStreamArn=...`)
+    const streamSnsTopicArn = this.node.tryGetContext('streamSnsTopicArn');
+    if (streamSnsTopicArn) {
+      const sinkTopic = sns.Topic.fromTopicArn(this, 'StreamSinkTopic', streamSnsTopicArn);
+      for (const fn of streamPublishers) {
+        sinkTopic.grantPublish(fn);
+        fn.addEnvironment('STREAM_SNS_TOPIC_ARN', streamSnsTopicArn);
+      }
+    }
+    const streamSqsQueueArn = this.node.tryGetContext('streamSqsQueueArn');
+    if (streamSqsQueueArn) {
+      const sinkQueue = sqs.Queue.fromQueueArn(this, 'StreamSinkQueue', streamSqsQueueArn);
+      for (const fn of streamPublishers) {
+        sinkQueue.grantSendMessages(fn);
+        fn.addEnvironment('STREAM_SQS_QUEUE_URL', sinkQueue.queueUrl);
+      }
+    }
+    const streamKinesisStreamArn = this.node.tryGetContext('streamKinesisStreamArn');
+    if (streamKinesisStreamArn) {
+      const sinkStream = kinesis.Stream.fromStreamArn(this, 'StreamSinkKinesis', streamKinesisStreamArn);
+      for (const fn of streamPublishers) {
+        sinkStream.grantWrite(fn);
+        fn.addEnvironment('STREAM_KINESIS_STREAM_NAME', sinkStream.streamName);
+      }
+    }
+    const streamFirehoseStreamArn: string | undefined = this.node.tryGetContext('streamFirehoseStreamArn');
+    if (streamFirehoseStreamArn) {
+      for (const fn of streamPublishers) {
+        fn.addToRolePolicy(new iam.PolicyStatement({
+          actions: ['firehose:PutRecordBatch'],
+          resources: [streamFirehoseStreamArn],
+        }));
+        fn.addEnvironment('STREAM_FIREHOSE_STREAM_NAME', streamFirehoseStreamArn.split('/').pop()!);
+      }
+    }
+    for (const fn of streamPublishers) {
+      fn.addEnvironment('STREAM_PUBLISH_CONCURRENCY', String(this.node.tryGetContext('streamPublishConcurrency') ?? 4));
+    }
+    // Publish only some events, e.g. `-c streamEventNames=INSERT,MODIFY -c streamChangedFields=email,phoneNumber`
+    const streamEventNames = this.node.tryGetContext('streamEventNames');
+    if (streamEventNames) {
+      for (const fn of streamPublishers) {
+        fn.addEnvironment('STREAM_EVENT_NAMES', streamEventNames);
+      }
+    }
+    const streamChangedFields = this.node.tryGetContext('streamChangedFields');
+    if (streamChangedFields) {
+      for (const fn of streamPublishers) {
+        fn.addEnvironment('STREAM_CHANGED_FIELDS', streamChangedFields);
+      }
+    }
+    // Mask the before/after values of these attributes in changedFields, e.g. `-c streamMaskedChangedFields=email,phoneNumber`
+    const streamMaskedChangedFields = this.node.tryGetContext('streamMaskedChangedFields');
+    if (streamMaskedChangedFields) {
+      for (const fn of streamPublishers) {
+        fn.addEnvironment('STREAM_MASKED_CHANGED_FIELDS', streamMaskedChangedFields);
+      }
+    }
+    // Publish CloudEvents 1.0 envelopes instead of the legacy format (`-c streamEventFormat=cloudevents`)
+    const streamEventFormat = this.node.tryGetContext('streamEventFormat');
+    if (streamEventFormat) {
+      for (const fn of streamPublishers) {
+        fn.addEnvironment('STREAM_EVENT_FORMAT', streamEventFormat);
+      }
+    }
+
+    // Records that still fail after `streamDlqAfterAttempts` deliveries (default 3) go to the
+    // dead-letter queue with the error and the sinks that rejected them, so they no longer block the
+    // shard. The redrive lambda publishes them again; its event source is disabled until
+    // `-c streamRedriveEnabled=true`, e.g. once the failing sink has recovered.
+    const streamDeadLetterQueue = new sqs.Queue(this, 'StreamDeadLetterQueue', {
+      retentionPeriod: cdk.Duration.days(14),
+      encryption: sqs.QueueEncryption.SQS_MANAGED,
+    });
+    streamDeadLetterQueue.grantSendMessages(streamLambda);
+    streamLambda.addEnvironment('STREAM_DLQ_URL', streamDeadLetterQueue.queueUrl);
+    streamLambda.addEnvironment('STREAM_DLQ_AFTER_ATTEMPTS', String(this.node.tryGetContext('streamDlqAfterAttempts') ?? 3));
+    streamRedriveLambda.addEventSource(new eventSources.SqsEventSource(streamDeadLetterQueue, {
+      batchSize: 10,
+      reportBatchItemFailures: true,
+      enabled: this.node.tryGetContext('streamRedriveEnabled') === 'true',
     }));
 
+    // Records each sink took, keyed by "<eventID>/<sink>", so a batch Lambda delivers again publishes
+    // every record at most once per sink
+    const streamDedupTable = new dynamodb.Table(this, 'StreamDedupTable', {
+      partitionKey: { name: 'eventKey', type: dynamodb.AttributeType.STRING },
+      timeToLiveAttribute: 'expiresAt',
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    streamDedupTable.grantReadWriteData(streamLambda);
+    streamLambda.addEnvironment('STREAM_DEDUP_TABLE_NAME', streamDedupTable.tableName);
+
     streamLambda.addEventSource(new eventSources.DynamoEventSource(dynamoTable, {
       startingPosition: lambda.StartingPosition.LATEST,
+      // The handler returns only the records it could not publish
+      reportBatchItemFailures: true,
     }));
 
     // HTTP Lambda (API Gateway -> Lambda -> DynamoDB)
@@ -50,19 +191,152 @@ export class PersonServiceRepoStack extends cdk.Stack {
       handler: 'main',
       environment: {
         TABLE_NAME: dynamoTable.tableName,
+        // Percentage (0-100) of traffic served the clean JSON GET format, e.g. `cdk deploy -c rolloutCleanJsonGetPercent=10`
+        ROLLOUT_CLEAN_JSON_GET_PERCENT: this.node.tryGetContext('rolloutCleanJsonGetPercent') ?? '0',
+        // Percentage (0-100) of v2 traffic answered with the envelope, e.g. `cdk deploy -c rolloutEnvelopePercent=10`
+        ROLLOUT_ENVELOPE_PERCENT: this.node.tryGetContext('rolloutEnvelopePercent') ?? '100',
       },
     });
     dynamoTable.grantReadWriteData(httpLambda);
+
+    // PII attributes (address, phoneNumber) are envelope-encrypted with data keys from this key
+    const piiKey = new kms.Key(this, 'PiiKey', {
+      enableKeyRotation: true,
+      removalPolicy: cdk.RemovalPolicy.RETAIN,
+    });
+    piiKey.grantEncryptDecrypt(httpLambda);
+    httpLambda.addEnvironment('PII_KMS_KEY_ID', piiKey.keyArn);
+
+    // Keyed hashes of email and phone number (emailHash, phoneHash) let analytics join datasets
+    // on identity; the hashing key is derived from this HMAC key and never stored
+    const identityHashKey = new kms.Key(this, 'IdentityHashKey', {
+      keySpec: kms.KeySpec.HMAC_256,
+      keyUsage: kms.KeyUsage.GENERATE_VERIFY_MAC,
+      removalPolicy: cdk.RemovalPolicy.RETAIN,
+    });
+    identityHashKey.grantGenerateMac(httpLambda);
+    httpLambda.addEnvironment('IDENTITY_HASH_KMS_KEY_ID', identityHashKey.keyArn);
+
+    // Idempotency-Key records for POST /persons, expired by DynamoDB TTL
+    const idempotencyTable = new dynamodb.Table(this, 'IdempotencyTable', {
+      partitionKey: { name: 'idempotencyKey', type: dynamodb.AttributeType.STRING },
+      timeToLiveAttribute: 'expiresAt',
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    idempotencyTable.grantReadWriteData(httpLambda);
+    httpLambda.addEnvironment('IDEMPOTENCY_TABLE_NAME', idempotencyTable.tableName);
+
+    // Per-client request counters for rate limiting, one item per client and minute
+    const rateLimitTable = new dynamodb.Table(this, 'RateLimitTable', {
+      partitionKey: { name: 'clientId', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'windowStart', type: dynamodb.AttributeType.NUMBER },
+      timeToLiveAttribute: 'expiresAt',
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    rateLimitTable.grantReadWriteData(httpLambda);
+    httpLambda.addEnvironment('RATE_LIMIT_TABLE_NAME', rateLimitTable.tableName);
+    httpLambda.addEnvironment('RATE_LIMIT_PER_MINUTE', String(this.node.tryGetContext('rateLimitPerMinute') ?? 600));
+
+    // Deprecated routes and response formats, as JSON (`cdk deploy -c deprecations='{...}'`)
+    httpLambda.addEnvironment('DEPRECATIONS', this.node.tryGetContext('deprecations') ?? '');
+
+    // Per-role and per-tenant response field rules, as JSON (`cdk deploy -c responseFieldRules='[...]'`)
+    httpLambda.addEnvironment('RESPONSE_FIELD_RULES', this.node.tryGetContext('responseFieldRules') ?? '');
+
+    // Declarative allow/deny statements per person action, as JSON (`cdk deploy -c accessPolicy='{...}'`)
+    httpLambda.addEnvironment('ACCESS_POLICY', this.node.tryGetContext('accessPolicy') ?? '');
+
+    // Parallel Scan segments for unscoped GET /persons lists (`cdk deploy -c listScanSegments=8`), and the
+    // time kept free before the deadline to return a partial list
+    httpLambda.addEnvironment('LIST_SCAN_SEGMENTS', String(this.node.tryGetContext('listScanSegments') ?? 1));
+    httpLambda.addEnvironment('LIST_DEADLINE_MARGIN_MS', String(this.node.tryGetContext('listDeadlineMarginMs') ?? 500));
+    httpLambda.addEnvironment('MAX_RESPONSE_BYTES', String(this.node.tryGetContext('maxResponseBytes') ?? 5 * 1024 * 1024));
+
+    // Duplicate match ranking: relevance against recency of the last update (`cdk deploy -c matchRecencyWeight=0.5`)
+    httpLambda.addEnvironment('MATCH_RELEVANCE_WEIGHT', String(this.node.tryGetContext('matchRelevanceWeight') ?? 1));
+    httpLambda.addEnvironment('MATCH_RECENCY_WEIGHT', String(this.node.tryGetContext('matchRecencyWeight') ?? 0));
+    httpLambda.addEnvironment('MATCH_RECENCY_HALF_LIFE_DAYS', String(this.node.tryGetContext('matchRecencyHalfLifeDays') ?? 30));
+
+    // DynamoDB client tuning: per-operation deadlines (`cdk deploy -c dynamoDBOperationTimeouts=Scan=10s,GetItem=1s`)
+    // and the throttling circuit breaker
+    httpLambda.addEnvironment('DYNAMODB_OPERATION_TIMEOUTS', this.node.tryGetContext('dynamoDBOperationTimeouts') ?? '');
+    httpLambda.addEnvironment('DYNAMODB_BREAKER_THRESHOLD', String(this.node.tryGetContext('dynamoDBBreakerThreshold') ?? 10));
+
+    // Read-only maintenance mode for migrations and regional failovers (`cdk deploy -c maintenanceMode=true`):
+    // writes are rejected with 503 and Retry-After while reads keep working
+    httpLambda.addEnvironment('MAINTENANCE_MODE', this.node.tryGetContext('maintenanceMode') === 'true' ? 'true' : 'false');
+    httpLambda.addEnvironment('MAINTENANCE_MESSAGE', this.node.tryGetContext('maintenanceMessage') ?? '');
+    httpLambda.addEnvironment('MAINTENANCE_RETRY_AFTER_SECONDS', String(this.node.tryGetContext('maintenanceRetryAfterSeconds') ?? 300));
+
+    // Active/passive deployment across regions (`cdk deploy -c regionRole=standby -c activeRegion=eu-west-1`):
+    // a standby stack serves reads and rejects writes
+    httpLambda.addEnvironment('REGION_ROLE', this.node.tryGetContext('regionRole') ?? 'active');
+    httpLambda.addEnvironment('ACTIVE_REGION', this.node.tryGetContext('activeRegion') ?? '');
+
+    // Opt-in debug capture of failing requests (`cdk deploy -c debugCapture=true`)
+    if (this.node.tryGetContext('debugCapture') === 'true') {
+      const captureBucket = new s3.Bucket(this, 'DebugCaptureBucket', {
+        encryption: s3.BucketEncryption.S3_MANAGED,
+        blockPublicAccess: s3.BlockPublicAccess.BLOCK_ALL,
+        enforceSSL: true,
+        removalPolicy: cdk.RemovalPolicy.DESTROY,
+        autoDeleteObjects: true,
+        lifecycleRules: [{
+          prefix: 'captures/',
+          expiration: cdk.Duration.days(Number(this.node.tryGetContext('debugCaptureTtlDays') ?? 7)),
+        }],
+      });
+      captureBucket.grantPut(httpLambda);
+      // HeadBucket for the reachability check of GET /admin/diagnostics
+      httpLambda.addToRolePolicy(new iam.PolicyStatement({ actions: ['s3:ListBucket'], resources: [captureBucket.bucketArn] }));
+      httpLambda.addEnvironment('DEBUG_CAPTURE_BUCKET', captureBucket.bucketName);
+    }
     const api = new apigateway.RestApi(this, 'ApiGateway', {
       restApiName: 'PersonServiceAPI',
       description: 'This API handles person records.',
       defaultCorsPreflightOptions: {
         allowOrigins: apigateway.Cors.ALL_ORIGINS,
+        exposeHeaders: ['X-RateLimit-Limit', 'X-RateLimit-Remaining', 'X-RateLimit-Reset', 'Retry-After', 'Deprecation', 'Sunset', 'Link', 'X-Partial', 'X-Next-Token'],
       },
+      // X-Ray starts the trace that the lambdas continue
+      deployOptions: { tracingEnabled: true },
     });
 
+    // Opt-in Cognito authentication (`cdk deploy -c cognitoAuth=true`): persons are owned by the
+    // user who created them, and members of the `admin` group can access all of them. Roles come
+    // from the `admin`, `editor` and `reader` groups, or from the RolesTable keyed by user sub.
+    let personOptions: apigateway.MethodOptions = {};
+    if (this.node.tryGetContext('cognitoAuth') === 'true') {
+      const userPool = new cognito.UserPool(this, 'PersonUserPool', {
+        selfSignUpEnabled: false,
+        signInAliases: { email: true },
+        removalPolicy: cdk.RemovalPolicy.DESTROY,
+      });
+      userPool.addClient('PersonApiClient', { authFlows: { userSrp: true } });
+      new cognito.CfnUserPoolGroup(this, 'AdminGroup', { userPoolId: userPool.userPoolId, groupName: 'admin' });
+      new cognito.CfnUserPoolGroup(this, 'EditorGroup', { userPoolId: userPool.userPoolId, groupName: 'editor' });
+      new cognito.CfnUserPoolGroup(this, 'ReaderGroup', { userPoolId: userPool.userPoolId, groupName: 'reader' });
+      const rolesTable = new dynamodb.Table(this, 'RolesTable', {
+        partitionKey: { name: 'subject', type: dynamodb.AttributeType.STRING },
+        billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+        removalPolicy: cdk.RemovalPolicy.DESTROY,
+      });
+      rolesTable.grantReadData(httpLambda);
+      const authorizer = new apigateway.CognitoUserPoolsAuthorizer(this, 'PersonAuthorizer', {
+        cognitoUserPools: [userPool],
+      });
+      personOptions = { authorizer, authorizationType: apigateway.AuthorizationType.COGNITO };
+      httpLambda.addEnvironment('AUTH_REQUIRED', 'true');
+      httpLambda.addEnvironment('ADMIN_GROUP', 'admin');
+      httpLambda.addEnvironment('EDITOR_GROUP', 'editor');
+      httpLambda.addEnvironment('READER_GROUP', 'reader');
+      httpLambda.addEnvironment('ROLES_TABLE_NAME', rolesTable.tableName);
+    }
+
     const personsResource = api.root.addResource('persons');
-    personsResource.addMethod('GET');
+    personsResource.addMethod('GET', undefined, personOptions);
 
     const postModel = new apigateway.Model(this, 'PostModel', {
       restApi: api,
@@ -76,6 +350,8 @@ export class PersonServiceRepoStack extends cdk.Stack {
           phoneNumber: { type: apigateway.JsonSchemaType.STRING },
           lastName: { type: apigateway.JsonSchemaType.STRING },
           address: { type: apigateway.JsonSchemaType.STRING },
+          email: { type: apigateway.JsonSchemaType.STRING },
+          notificationChannel: { type: apigateway.JsonSchemaType.STRING, enum: ['email', 'sms'] },
         },
         required: ['firstName', 'phoneNumber', 'lastName', 'address'],
       },
@@ -85,19 +361,66 @@ export class PersonServiceRepoStack extends cdk.Stack {
       validateRequestBody: true,
     });
     personsResource.addMethod('POST', new apigateway.LambdaIntegration(httpLambda), {
+      ...personOptions,
       requestModels: { 'application/json': postModel },
       requestValidator,
     });
+    // Duplicate detection for intake forms: exact lookups on normalized email and last name.
+    // ownerId is projected so non-admin lookups can be scoped to the caller's persons.
+    dynamoTable.addGlobalSecondaryIndex({
+      indexName: 'EmailKeyIndex',
+      partitionKey: { name: 'emailKey', type: dynamodb.AttributeType.STRING },
+      projectionType: dynamodb.ProjectionType.INCLUDE,
+      nonKeyAttributes: ['ownerId'],
+    });
+    dynamoTable.addGlobalSecondaryIndex({
+      indexName: 'LastNameKeyIndex',
+      partitionKey: { name: 'lastNameKey', type: dynamodb.AttributeType.STRING },
+      projectionType: dynamodb.ProjectionType.INCLUDE,
+      nonKeyAttributes: ['ownerId'],
+    });
+    personsResource.addResource('match').addMethod('POST', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    personsResource.addResource('validate').addMethod('POST', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    personsResource.addResource('batch').addMethod('POST', new apigateway.LambdaIntegration(httpLambda), personOptions);
     const personById = personsResource.addResource('{personId}');
-    personById.addMethod('GET', new apigateway.LambdaIntegration(httpLambda));
-    personById.addMethod('PUT', new apigateway.LambdaIntegration(httpLambda));
-    personById.addMethod('DELETE', new apigateway.LambdaIntegration(httpLambda));
+    personById.addMethod('GET', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    personById.addMethod('PUT', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    personById.addMethod('DELETE', new apigateway.LambdaIntegration(httpLambda), personOptions);
+
+    // Notification templates (admin only): versioned bodies in S3, active version per name in DynamoDB
+    const templatesTable = new dynamodb.Table(this, 'TemplatesTable', {
+      partitionKey: { name: 'templateName', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    const templatesBucket = new s3.Bucket(this, 'TemplatesBucket', {
+      encryption: s3.BucketEncryption.S3_MANAGED,
+      blockPublicAccess: s3.BlockPublicAccess.BLOCK_ALL,
+      enforceSSL: true,
+      versioned: true,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+      autoDeleteObjects: true,
+    });
+    templatesTable.grantReadWriteData(httpLambda);
+    templatesBucket.grantReadWrite(httpLambda);
+    httpLambda.addEnvironment('TEMPLATES_TABLE_NAME', templatesTable.tableName);
+    httpLambda.addEnvironment('TEMPLATES_BUCKET', templatesBucket.bucketName);
+
+    const adminOptions: apigateway.MethodOptions = { authorizationType: apigateway.AuthorizationType.IAM };
+    const adminResource = api.root.addResource('admin');
+    // Resolved configuration, enabled features and dependency reachability of the HTTP Lambda
+    adminResource.addResource('diagnostics').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+    const templateByName = adminResource.addResource('templates').addResource('{templateName}');
+    templateByName.addMethod('GET', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+    templateByName.addMethod('PUT', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+    templateByName.addResource('activate').addMethod('POST', new apigateway.LambdaIntegration(httpLambda), adminOptions);
     // Email Lambda Function
     const emailServiceLambda = new lambda.Function(this, 'EmailSvcLambda', {
       runtime: lambda.Runtime.PROVIDED_AL2023,
       architecture: lambda.Architecture.X86_64,
       code: lambda.Code.fromAsset('lambdas/email'),
       handler: 'main',
+      timeout: cdk.Duration.seconds(30),
     });
 
     emailServiceLambda.addToRolePolicy(new iam.PolicyStatement({
@@ -111,16 +434,680 @@ export class PersonServiceRepoStack extends cdk.Stack {
       ],
     }));
 
+    templatesTable.grantReadData(emailServiceLambda);
+    templatesBucket.grantRead(emailServiceLambda);
+    piiKey.grantDecrypt(emailServiceLambda);
+    emailServiceLambda.addEnvironment('TEMPLATES_TABLE_NAME', templatesTable.tableName);
+    emailServiceLambda.addEnvironment('TEMPLATES_BUCKET', templatesBucket.bucketName);
+
     emailServiceLambda.role!.addManagedPolicy(iam.ManagedPolicy.fromAwsManagedPolicyName('service-role/AWSLambdaBasicExecutionRole'));
 
-    // EventBridge Rule (DynamoDB Stream -> Email Lambda)
+    // Email queue (EventBridge -> SQS -> Email Lambda) buffers and retries notifications
+    const emailDeadLetterQueue = new sqs.Queue(this, 'EmailDeadLetterQueue', {
+      retentionPeriod: cdk.Duration.days(14),
+    });
+    const emailQueue = new sqs.Queue(this, 'EmailQueue', {
+      // At least six times the function timeout, as recommended for SQS event sources
+      visibilityTimeout: cdk.Duration.seconds(180),
+      deadLetterQueue: {
+        queue: emailDeadLetterQueue,
+        maxReceiveCount: 5,
+      },
+    });
+    emailQueue.grant(emailServiceLambda, 'sqs:ChangeMessageVisibility');
+    emailServiceLambda.addEnvironment('EMAIL_QUEUE_URL', emailQueue.queueUrl);
+    // Messages that fail permanently skip the remaining retries
+    emailDeadLetterQueue.grantSendMessages(emailServiceLambda);
+    emailServiceLambda.addEnvironment('EMAIL_DEAD_LETTER_QUEUE_URL', emailDeadLetterQueue.queueUrl);
+    emailServiceLambda.addEventSource(new eventSources.SqsEventSource(emailQueue, {
+      batchSize: 10,
+      maxBatchingWindow: cdk.Duration.seconds(5),
+      reportBatchItemFailures: true,
+    }));
+
+    // EventBridge Rule (DynamoDB Stream -> Email Queue)
     new eventbridge.Rule(this, 'EventBridgeRule', {
       eventBus,
       eventPattern: {
         source: ['ddb.source'],
         detailType: ['DynamoDBStreamEvent'],
+        // Synthetic backfill events (POST /admin/events/emit) describe no change to notify about
+        detail: { synthetic: [{ exists: false }] },
+      },
+      targets: [new eventTargets.SqsQueue(emailQueue)],
+    });
+
+    // Notification delivery tracking: one item per notification, updated from SES events
+    const notificationsTable = new dynamodb.Table(this, 'NotificationsTable', {
+      partitionKey: { name: 'personId', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'notificationId', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    notificationsTable.grantReadWriteData(emailServiceLambda);
+    notificationsTable.grantReadData(httpLambda);
+    emailServiceLambda.addEnvironment('NOTIFICATIONS_TABLE_NAME', notificationsTable.tableName);
+    httpLambda.addEnvironment('NOTIFICATIONS_TABLE_NAME', notificationsTable.tableName);
+    personById.addResource('notifications').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), personOptions);
+
+    // Legal holds (admin only): exports are written once to an object-locked, KMS-encrypted bucket.
+    // Both are retained on stack deletion, since held data must outlive the stack.
+    const legalHoldKey = new kms.Key(this, 'LegalHoldKey', {
+      enableKeyRotation: true,
+      removalPolicy: cdk.RemovalPolicy.RETAIN,
+    });
+    const legalHoldBucket = new s3.Bucket(this, 'LegalHoldBucket', {
+      encryption: s3.BucketEncryption.KMS,
+      encryptionKey: legalHoldKey,
+      bucketKeyEnabled: true,
+      blockPublicAccess: s3.BlockPublicAccess.BLOCK_ALL,
+      enforceSSL: true,
+      versioned: true,
+      objectLockEnabled: true,
+      removalPolicy: cdk.RemovalPolicy.RETAIN,
+    });
+    const legalHoldsTable = new dynamodb.Table(this, 'LegalHoldsTable', {
+      partitionKey: { name: 'personId', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'holdId', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      pointInTimeRecovery: true,
+      removalPolicy: cdk.RemovalPolicy.RETAIN,
+    });
+    legalHoldBucket.grantPut(httpLambda);
+    httpLambda.addToRolePolicy(new iam.PolicyStatement({ actions: ['s3:ListBucket'], resources: [legalHoldBucket.bucketArn] }));
+    httpLambda.addToRolePolicy(new iam.PolicyStatement({
+      actions: ['s3:PutObjectRetention', 's3:PutObjectLegalHold'],
+      resources: [legalHoldBucket.arnForObjects('legal-holds/*')],
+    }));
+    legalHoldKey.grantEncrypt(httpLambda);
+    legalHoldsTable.grantReadWriteData(httpLambda);
+    httpLambda.addEnvironment('LEGAL_HOLDS_TABLE_NAME', legalHoldsTable.tableName);
+    httpLambda.addEnvironment('LEGAL_HOLD_BUCKET', legalHoldBucket.bucketName);
+    httpLambda.addEnvironment('LEGAL_HOLD_KMS_KEY_ID', legalHoldKey.keyArn);
+    adminResource.addResource('legal-holds').addMethod('POST', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+
+    // SES delivery events (SES -> SNS -> Email Queue) move notifications through their lifecycle
+    const sesEventsTopic = new sns.Topic(this, 'SesEventsTopic');
+    sesEventsTopic.addSubscription(new snsSubscriptions.SqsSubscription(emailQueue));
+    const sesConfigurationSet = new ses.ConfigurationSet(this, 'EmailConfigurationSet');
+    sesConfigurationSet.addEventDestination('SesEventsToSns', {
+      destination: ses.EventDestination.snsTopic(sesEventsTopic),
+      events: [
+        ses.EmailSendingEvent.SEND,
+        ses.EmailSendingEvent.DELIVERY,
+        ses.EmailSendingEvent.BOUNCE,
+        ses.EmailSendingEvent.COMPLAINT,
+        ses.EmailSendingEvent.REJECT,
+      ],
+    });
+    emailServiceLambda.addEnvironment('SES_CONFIGURATION_SET', sesConfigurationSet.configurationSetName);
+    // Permanent bounces and complaints mark the person's address undeliverable
+    dynamoTable.grant(emailServiceLambda, 'dynamodb:UpdateItem');
+    emailServiceLambda.addEnvironment('TABLE_NAME', dynamoTable.tableName);
+    // Send through per-tenant or per-domain SES identities and regions, e.g.
+    // `-c emailRoutes='{"tenants":{"acme":{"fromAddress":"noreply@mail.acme.com","region":"eu-west-1"}}}'`
+    const emailRoutes = this.node.tryGetContext('emailRoutes');
+    if (emailRoutes) {
+      emailServiceLambda.addEnvironment('EMAIL_ROUTES', emailRoutes);
+    }
+    // Deliver through SES from a verified address, e.g. `-c emailFromAddress=noreply@example.com`;
+    // without a sender (and for SES sandbox accounts, `-c emailDryRun=true`) emails are only logged
+    const emailFromAddress = this.node.tryGetContext('emailFromAddress');
+    if (emailFromAddress) {
+      emailServiceLambda.addEnvironment('EMAIL_FROM_ADDRESS', emailFromAddress);
+    }
+    const emailDryRun = this.node.tryGetContext('emailDryRun') === 'true' || (!emailFromAddress && !emailRoutes);
+    emailServiceLambda.addEnvironment('EMAIL_DRY_RUN', String(emailDryRun));
+    // Routes may send through identities in other regions or accounts
+    emailServiceLambda.addToRolePolicy(new iam.PolicyStatement({
+      actions: ['ses:SendEmail', 'ses:SendRawEmail'],
+      resources: ['*'],
+    }));
+
+    // Notification dedup markers, expired by DynamoDB TTL once the window has passed
+    const dedupTable = new dynamodb.Table(this, 'NotificationDedupTable', {
+      partitionKey: { name: 'dedupKey', type: dynamodb.AttributeType.STRING },
+      timeToLiveAttribute: 'expiresAt',
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    dedupTable.grantReadWriteData(emailServiceLambda);
+    emailServiceLambda.addEnvironment('DEDUP_TABLE_NAME', dedupTable.tableName);
+    // Windows per event name, e.g. `cdk deploy -c notificationDedupWindows=MODIFY=1h,INSERT=24h`
+    emailServiceLambda.addEnvironment('NOTIFICATION_DEDUP_WINDOWS', this.node.tryGetContext('notificationDedupWindows') ?? 'MODIFY=1h');
+
+    // Digest mode: emails of these event types are buffered and sent as one summary per recipient
+    // and interval by a scheduled run (`cdk deploy -c digestEventTypes=INSERT,MODIFY -c digestIntervalMinutes=60`)
+    const digestEventTypes: string = this.node.tryGetContext('digestEventTypes') ?? '';
+    if (digestEventTypes) {
+      const digestIntervalMinutes = Number(this.node.tryGetContext('digestIntervalMinutes') ?? 60);
+      const digestTable = new dynamodb.Table(this, 'NotificationDigestTable', {
+        partitionKey: { name: 'personId', type: dynamodb.AttributeType.STRING },
+        sortKey: { name: 'eventId', type: dynamodb.AttributeType.STRING },
+        timeToLiveAttribute: 'expiresAt',
+        billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+        removalPolicy: cdk.RemovalPolicy.DESTROY,
+      });
+      digestTable.grantReadWriteData(emailServiceLambda);
+      emailServiceLambda.addEnvironment('DIGEST_TABLE_NAME', digestTable.tableName);
+      emailServiceLambda.addEnvironment('DIGEST_EVENT_TYPES', digestEventTypes);
+      emailServiceLambda.addEnvironment('DIGEST_INTERVAL_MINUTES', String(digestIntervalMinutes));
+      // Runs more often than the interval, so each recipient's digest goes out soon after it is due
+      new eventbridge.Rule(this, 'NotificationDigestSchedule', {
+        schedule: eventbridge.Schedule.rate(cdk.Duration.minutes(Math.max(1, Math.min(15, Math.floor(digestIntervalMinutes / 4))))),
+        targets: [new eventTargets.LambdaFunction(emailServiceLambda)],
+      });
+    }
+
+    // SMS channel (SNS) for persons without an email address, with STOP/START reply handling
+    const smsOptOutTable = new dynamodb.Table(this, 'SmsOptOutTable', {
+      partitionKey: { name: 'phoneNumber', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    smsOptOutTable.grantReadWriteData(emailServiceLambda);
+    emailServiceLambda.addEnvironment('SMS_OPT_OUT_TABLE_NAME', smsOptOutTable.tableName);
+    // High-priority events sent by SMS to persons with a phone number (`cdk deploy -c smsEventTypes=REMOVE`)
+    emailServiceLambda.addEnvironment('SMS_EVENT_TYPES', this.node.tryGetContext('smsEventTypes') ?? '');
+    emailServiceLambda.addToRolePolicy(new iam.PolicyStatement({
+      // Direct-to-phone publishes have no topic ARN to scope to
+      actions: ['sns:Publish', 'sns:OptInPhoneNumber'],
+      resources: ['*'],
+    }));
+    // Two-way SMS replies are published to this topic (configured on the origination number)
+    const inboundSmsTopic = new sns.Topic(this, 'InboundSmsTopic');
+    inboundSmsTopic.addSubscription(new snsSubscriptions.SqsSubscription(emailQueue));
+
+    // Ops alerts to Slack, per environment (`cdk deploy -c slackWebhookUrl=... -c environmentName=prod`)
+    const loggingLambda = new lambda.Function(this, 'LoggingLambda', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.X86_64,
+      code: lambda.Code.fromAsset('lambdas/logging'),
+      handler: 'main',
+    });
+    // Processed event IDs, so a redelivered event is written to the audit log once
+    const eventIdempotencyTable = new dynamodb.Table(this, 'EventIdempotencyTable', {
+      partitionKey: { name: 'eventKey', type: dynamodb.AttributeType.STRING },
+      timeToLiveAttribute: 'expiresAt',
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    eventIdempotencyTable.grantReadWriteData(loggingLambda);
+    loggingLambda.addEnvironment('EVENT_IDEMPOTENCY_TABLE_NAME', eventIdempotencyTable.tableName);
+    // Immutable audit trail of every person change, keyed by person and time. The Logging Lambda
+    // only puts entries, deletes a person's entries when the person is erased, and strips their
+    // data from the earlier entries when the person is anonymized.
+    const auditTable = new dynamodb.Table(this, 'AuditTable', {
+      partitionKey: { name: 'personId', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'auditId', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      pointInTimeRecovery: true,
+      removalPolicy: cdk.RemovalPolicy.RETAIN,
+    });
+    auditTable.grant(loggingLambda, 'dynamodb:PutItem', 'dynamodb:Query', 'dynamodb:UpdateItem', 'dynamodb:DeleteItem');
+    loggingLambda.addEnvironment('AUDIT_TABLE_NAME', auditTable.tableName);
+    // Change history of a person from the audit trail
+    auditTable.grantReadData(httpLambda);
+    httpLambda.addEnvironment('AUDIT_TABLE_NAME', auditTable.tableName);
+    personById.addResource('history').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    // Audit log of every person event (EventBridge -> Logging Lambda)
+    new eventbridge.Rule(this, 'AuditLogRule', {
+      eventBus,
+      eventPattern: {
+        source: ['ddb.source', 'person.service'],
+      },
+      targets: [new eventTargets.LambdaFunction(loggingLambda)],
+    });
+
+    // GDPR: the export includes the person's audit records, erasure publishes PersonErased
+    httpLambda.addEnvironment('AUDIT_LOG_GROUP', loggingLambda.logGroup.logGroupName);
+    loggingLambda.logGroup.grant(httpLambda, 'logs:FilterLogEvents');
+    httpLambda.addEnvironment('EVENT_BUS_NAME', eventBus.eventBusName);
+    eventBus.grantPutEventsTo(httpLambda);
+    httpLambda.addToRolePolicy(new iam.PolicyStatement({ actions: ['events:DescribeEventBus'], resources: [eventBus.eventBusArn] }));
+    personById.addResource('restore').addMethod('POST', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    personById.addResource('export').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    // Support timeline: audit log, notifications and legal holds of a person in one feed
+    personById.addResource('timeline').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    personById.addResource('erase').addMethod('DELETE', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    // Notification opt-outs, read by the email lambda from the person events
+    personById.addResource('preferences').addMethod('PUT', new apigateway.LambdaIntegration(httpLambda), personOptions);
+
+    // Versioned API: /v1 and /v2 are proxied as a whole, the lambda routes the person paths
+    for (const version of ['v1', 'v2']) {
+      api.root.addResource(version).addProxy({
+        defaultIntegration: new apigateway.LambdaIntegration(httpLambda),
+        defaultMethodOptions: personOptions,
+        anyMethod: true,
+      });
+    }
+    // Nightly data-quality report per tenant (missing phones, unparseable addresses, blank names,
+    // emails without a confirmed delivery after 30 days)
+    const qualityReportBucket = new s3.Bucket(this, 'DataQualityReportBucket', {
+      encryption: s3.BucketEncryption.S3_MANAGED,
+      blockPublicAccess: s3.BlockPublicAccess.BLOCK_ALL,
+      enforceSSL: true,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+      autoDeleteObjects: true,
+      lifecycleRules: [{ prefix: 'reports/', expiration: cdk.Duration.days(90) }],
+    });
+    const qualityLambda = new lambda.Function(this, 'DataQualityLambda', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.X86_64,
+      code: lambda.Code.fromAsset('lambdas/quality'),
+      handler: 'main',
+      timeout: cdk.Duration.minutes(15),
+      environment: {
+        TABLE_NAME: dynamoTable.tableName,
+        NOTIFICATIONS_TABLE_NAME: notificationsTable.tableName,
+        REPORT_BUCKET: qualityReportBucket.bucketName,
+        PII_KMS_KEY_ID: piiKey.keyArn,
+      },
+    });
+    dynamoTable.grantReadData(qualityLambda);
+    notificationsTable.grantReadData(qualityLambda);
+    qualityReportBucket.grantPut(qualityLambda);
+    piiKey.grantDecrypt(qualityLambda);
+    // Locks of heavyweight jobs, so only one run of each job is active at a time. Runs renew
+    // their lock with heartbeats; a lock of a crashed run expires after its lease.
+    const jobLockTable = new dynamodb.Table(this, 'JobLockTable', {
+      partitionKey: { name: 'jobName', type: dynamodb.AttributeType.STRING },
+      timeToLiveAttribute: 'expiresAt',
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    jobLockTable.grantReadWriteData(qualityLambda);
+    qualityLambda.addEnvironment('JOB_LOCK_TABLE_NAME', jobLockTable.tableName);
+    new eventbridge.Rule(this, 'DataQualitySchedule', {
+      schedule: eventbridge.Schedule.cron({ minute: '0', hour: '3' }),
+      targets: [new eventTargets.LambdaFunction(qualityLambda)],
+    });
+
+    // Nightly purge of persons soft-deleted longer than the retention window
+    // (`cdk deploy -c purgeRetentionDays=90`), with their notifications and a PersonErased event each.
+    // `-c purgeDryRun=true` only writes the reports.
+    const purgeReportBucket = new s3.Bucket(this, 'PurgeReportBucket', {
+      encryption: s3.BucketEncryption.S3_MANAGED,
+      blockPublicAccess: s3.BlockPublicAccess.BLOCK_ALL,
+      enforceSSL: true,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+      autoDeleteObjects: true,
+      lifecycleRules: [{ prefix: 'reports/', expiration: cdk.Duration.days(365) }],
+    });
+    const purgeLambda = new lambda.Function(this, 'PurgeLambda', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.X86_64,
+      code: lambda.Code.fromAsset('lambdas/purge'),
+      handler: 'main',
+      timeout: cdk.Duration.minutes(15),
+      environment: {
+        TABLE_NAME: dynamoTable.tableName,
+        PURGE_RETENTION_DAYS: String(this.node.tryGetContext('purgeRetentionDays') ?? 30),
+        PURGE_DRY_RUN: String(this.node.tryGetContext('purgeDryRun') ?? false),
+        REPORT_BUCKET: purgeReportBucket.bucketName,
+        EVENT_BUS_NAME: eventBus.eventBusName,
+        NOTIFICATIONS_TABLE_NAME: notificationsTable.tableName,
+        LEGAL_HOLDS_TABLE_NAME: legalHoldsTable.tableName,
+        JOB_LOCK_TABLE_NAME: jobLockTable.tableName,
+      },
+    });
+    dynamoTable.grantReadWriteData(purgeLambda);
+    notificationsTable.grantReadWriteData(purgeLambda);
+    legalHoldsTable.grantReadData(purgeLambda);
+    jobLockTable.grantReadWriteData(purgeLambda);
+    purgeReportBucket.grantPut(purgeLambda);
+    eventBus.grantPutEventsTo(purgeLambda);
+    new eventbridge.Rule(this, 'SoftDeletePurgeSchedule', {
+      schedule: eventbridge.Schedule.cron({ minute: '0', hour: '4' }),
+      targets: [new eventTargets.LambdaFunction(purgeLambda)],
+    });
+
+    // Person search index lifecycle (index template, aliases, rollover, reindex on mapping changes)
+    // on an existing OpenSearch domain: `cdk deploy -c searchDomainArn=... -c searchDomainEndpoint=...`.
+    // The Search Index Lambda runs hourly and after deployments that change its code, which is
+    // how mapping changes ship. The Indexer Lambda keeps the index current from the person events,
+    // and the API answers GET /persons/search from it.
+    const searchDomainArn: string | undefined = this.node.tryGetContext('searchDomainArn');
+    let searchIndexLambda: lambda.Function | undefined;
+    let indexerLambda: lambda.Function | undefined;
+    if (searchDomainArn) {
+      const searchDomain = opensearch.Domain.fromDomainAttributes(this, 'SearchDomain', {
+        domainArn: searchDomainArn,
+        domainEndpoint: this.node.tryGetContext('searchDomainEndpoint'),
+      });
+      searchIndexLambda = new lambda.Function(this, 'SearchIndexLambda', {
+        runtime: lambda.Runtime.PROVIDED_AL2023,
+        architecture: lambda.Architecture.X86_64,
+        code: lambda.Code.fromAsset('lambdas/searchindex'),
+        handler: 'main',
+        timeout: cdk.Duration.minutes(1),
+        environment: {
+          OPENSEARCH_ENDPOINT: searchDomain.domainEndpoint,
+          SEARCH_ROLLOVER_MAX_DOCS: String(this.node.tryGetContext('searchRolloverMaxDocs') ?? 10000000),
+          SEARCH_ROLLOVER_MAX_SIZE: this.node.tryGetContext('searchRolloverMaxSize') ?? '30gb',
+          SEARCH_ROLLOVER_MAX_AGE: this.node.tryGetContext('searchRolloverMaxAge') ?? '',
+        },
+      });
+      searchDomain.grantReadWrite(searchIndexLambda);
+      jobLockTable.grantReadWriteData(searchIndexLambda);
+      searchIndexLambda.addEnvironment('JOB_LOCK_TABLE_NAME', jobLockTable.tableName);
+      new eventbridge.Rule(this, 'SearchIndexSchedule', {
+        schedule: eventbridge.Schedule.rate(cdk.Duration.hours(1)),
+        targets: [new eventTargets.LambdaFunction(searchIndexLambda)],
+      });
+      new triggers.Trigger(this, 'SearchIndexDeployTrigger', {
+        handler: searchIndexLambda,
+      });
+      indexerLambda = new lambda.Function(this, 'IndexerLambda', {
+        runtime: lambda.Runtime.PROVIDED_AL2023,
+        architecture: lambda.Architecture.X86_64,
+        code: lambda.Code.fromAsset('lambdas/indexer'),
+        handler: 'main',
+        timeout: cdk.Duration.seconds(30),
+        environment: {
+          OPENSEARCH_ENDPOINT: searchDomain.domainEndpoint,
+          PII_KMS_KEY_ID: piiKey.keyArn,
+        },
+      });
+      searchDomain.grantReadWrite(indexerLambda);
+      piiKey.grantDecrypt(indexerLambda);
+      new eventbridge.Rule(this, 'SearchIndexerRule', {
+        eventBus,
+        eventPattern: {
+          source: ['ddb.source', 'person.service'],
+        },
+        targets: [new eventTargets.LambdaFunction(indexerLambda)],
+      });
+      // Searches are POSTs to _search, which the read grant does not cover
+      searchDomain.grantReadWrite(httpLambda);
+      httpLambda.addEnvironment('OPENSEARCH_ENDPOINT', searchDomain.domainEndpoint);
+      personsResource.addResource('search').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), personOptions);
+    }
+
+    // Bulk import: CSV files uploaded as imports/<importId>.csv are imported by the Import Lambda,
+    // which records a report per file in the ImportsTable (GET /imports/{importId})
+    const importsBucket = new s3.Bucket(this, 'ImportsBucket', {
+      encryption: s3.BucketEncryption.S3_MANAGED,
+      blockPublicAccess: s3.BlockPublicAccess.BLOCK_ALL,
+      enforceSSL: true,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+      autoDeleteObjects: true,
+      lifecycleRules: [{ prefix: 'imports/', expiration: cdk.Duration.days(30) }],
+    });
+    const importsTable = new dynamodb.Table(this, 'ImportsTable', {
+      partitionKey: { name: 'importId', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    const importLambda = new lambda.Function(this, 'ImportLambda', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.X86_64,
+      code: lambda.Code.fromAsset('lambdas/import'),
+      handler: 'main',
+      timeout: cdk.Duration.minutes(15),
+      environment: {
+        TABLE_NAME: dynamoTable.tableName,
+        IMPORTS_TABLE_NAME: importsTable.tableName,
+        PII_KMS_KEY_ID: piiKey.keyArn,
+        IDENTITY_HASH_KMS_KEY_ID: identityHashKey.keyArn,
+        // Rows checked by previews (x-amz-meta-preview: true) that name no x-amz-meta-preview-rows
+        IMPORT_PREVIEW_ROWS: String(this.node.tryGetContext('importPreviewRows') ?? 1000),
+      },
+    });
+    dynamoTable.grantWriteData(importLambda);
+    importsTable.grantReadWriteData(importLambda);
+    importsBucket.grantRead(importLambda);
+    piiKey.grantEncrypt(importLambda);
+    identityHashKey.grantGenerateMac(importLambda);
+    importsBucket.addEventNotification(s3.EventType.OBJECT_CREATED, new s3n.LambdaDestination(importLambda), {
+      prefix: 'imports/',
+      suffix: '.csv',
+    });
+    importsTable.grantReadData(httpLambda);
+    httpLambda.addEnvironment('IMPORTS_TABLE_NAME', importsTable.tableName);
+    api.root.addResource('imports').addResource('{importId}').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+
+    // Async exports: POST /exports queues a job, the Export Lambda scans the table in parallel
+    // segments into S3 and GET /exports/{exportId} returns a pre-signed download URL
+    const exportBucket = new s3.Bucket(this, 'ExportBucket', {
+      encryption: s3.BucketEncryption.S3_MANAGED,
+      blockPublicAccess: s3.BlockPublicAccess.BLOCK_ALL,
+      enforceSSL: true,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+      autoDeleteObjects: true,
+      lifecycleRules: [{ prefix: 'exports/', expiration: cdk.Duration.days(7) }],
+    });
+    const exportsTable = new dynamodb.Table(this, 'ExportsTable', {
+      partitionKey: { name: 'exportId', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    const exportLambda = new lambda.Function(this, 'ExportLambda', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.X86_64,
+      code: lambda.Code.fromAsset('lambdas/export'),
+      handler: 'main',
+      timeout: cdk.Duration.minutes(15),
+      ephemeralStorageSize: cdk.Size.gibibytes(10),
+      environment: {
+        TABLE_NAME: dynamoTable.tableName,
+        EXPORTS_TABLE_NAME: exportsTable.tableName,
+        EXPORT_BUCKET: exportBucket.bucketName,
+        EXPORT_SCAN_SEGMENTS: String(this.node.tryGetContext('exportScanSegments') ?? 4),
+        PII_KMS_KEY_ID: piiKey.keyArn,
+        IDENTITY_HASH_KMS_KEY_ID: identityHashKey.keyArn,
+      },
+    });
+    const exportQueue = new sqs.Queue(this, 'ExportQueue', {
+      // At least the function timeout, so a running export is not handed out twice
+      visibilityTimeout: cdk.Duration.minutes(16),
+    });
+    exportLambda.addEventSource(new eventSources.SqsEventSource(exportQueue, {
+      batchSize: 1,
+      reportBatchItemFailures: true,
+    }));
+    dynamoTable.grantReadData(exportLambda);
+    exportsTable.grantReadWriteData(exportLambda);
+    exportBucket.grantPut(exportLambda);
+    piiKey.grantDecrypt(exportLambda);
+    identityHashKey.grantGenerateMac(exportLambda);
+    exportsTable.grantReadWriteData(httpLambda);
+    exportQueue.grantSendMessages(httpLambda);
+    exportBucket.grantRead(httpLambda);
+    httpLambda.addEnvironment('EXPORTS_TABLE_NAME', exportsTable.tableName);
+    httpLambda.addEnvironment('EXPORT_QUEUE_URL', exportQueue.queueUrl);
+    httpLambda.addEnvironment('EXPORT_BUCKET', exportBucket.bucketName);
+    const exportsResource = api.root.addResource('exports');
+    exportsResource.addMethod('POST', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+    exportsResource.addResource('{exportId}').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+
+    // Anonymization (admin only): POST /admin/anonymize queues a job, the Anonymize Lambda replaces
+    // the PII of inactive persons with pseudonyms and GET /admin/anonymize/{jobId} reports its outcome
+    const anonymizationsTable = new dynamodb.Table(this, 'AnonymizationsTable', {
+      partitionKey: { name: 'jobId', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    const anonymizeLambda = new lambda.Function(this, 'AnonymizeLambda', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.X86_64,
+      code: lambda.Code.fromAsset('lambdas/anonymize'),
+      handler: 'main',
+      timeout: cdk.Duration.minutes(15),
+      environment: {
+        TABLE_NAME: dynamoTable.tableName,
+        ANONYMIZATIONS_TABLE_NAME: anonymizationsTable.tableName,
+        LEGAL_HOLDS_TABLE_NAME: legalHoldsTable.tableName,
+        PII_KMS_KEY_ID: piiKey.keyArn,
+      },
+    });
+    const anonymizeQueue = new sqs.Queue(this, 'AnonymizeQueue', {
+      // At least the function timeout, so a running job is not handed out twice
+      visibilityTimeout: cdk.Duration.minutes(16),
+    });
+    anonymizeLambda.addEventSource(new eventSources.SqsEventSource(anonymizeQueue, {
+      batchSize: 1,
+      reportBatchItemFailures: true,
+    }));
+    dynamoTable.grantReadWriteData(anonymizeLambda);
+    anonymizationsTable.grantReadWriteData(anonymizeLambda);
+    legalHoldsTable.grantReadData(anonymizeLambda);
+    piiKey.grantDecrypt(anonymizeLambda);
+    anonymizationsTable.grantReadWriteData(httpLambda);
+    anonymizeQueue.grantSendMessages(httpLambda);
+    httpLambda.addEnvironment('ANONYMIZATIONS_TABLE_NAME', anonymizationsTable.tableName);
+    httpLambda.addEnvironment('ANONYMIZE_QUEUE_URL', anonymizeQueue.queueUrl);
+    const anonymizeResource = adminResource.addResource('anonymize');
+    anonymizeResource.addMethod('POST', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+    anonymizeResource.addResource('{jobId}').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+
+    // Pipeline status (admin only): GET /admin/pipeline/status reports the stream lag the Stream
+    // Lambda records, the queue depths and the last successful canary run in one document
+    const pipelineStatusTable = new dynamodb.Table(this, 'PipelineStatusTable', {
+      partitionKey: { name: 'component', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    pipelineStatusTable.grantWriteData(streamLambda);
+    streamLambda.addEnvironment('PIPELINE_STATUS_TABLE_NAME', pipelineStatusTable.tableName);
+    pipelineStatusTable.grantReadData(httpLambda);
+    httpLambda.addEnvironment('PIPELINE_STATUS_TABLE_NAME', pipelineStatusTable.tableName);
+    httpLambda.addEnvironment('EMAIL_QUEUE_URL', emailQueue.queueUrl);
+    httpLambda.addEnvironment('EMAIL_DEAD_LETTER_QUEUE_URL', emailDeadLetterQueue.queueUrl);
+    httpLambda.addEnvironment('STREAM_DLQ_URL', streamDeadLetterQueue.queueUrl);
+    for (const queue of [emailQueue, emailDeadLetterQueue, streamDeadLetterQueue, exportQueue, anonymizeQueue]) {
+      queue.grant(httpLambda, 'sqs:GetQueueAttributes');
+    }
+    adminResource.addResource('pipeline').addResource('status').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+
+    // Backfills (admin only): POST /admin/events/emit publishes synthetic events for existing persons;
+    // the HTTP Lambda may already put events on the bus for PersonErased
+    adminResource.addResource('events').addResource('emit').addMethod('POST', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+
+    // Event replay (admin only): person events are archived on the bus. POST /admin/replays replays a
+    // time range to the ReplayRule only, and the Replay Lambda passes the events matching the replay's
+    // filters on to one consumer: the email queue, the Logging Lambda (audit) or the Indexer Lambda (search)
+    const eventArchive = eventBus.archive('PersonEventArchive', {
+      eventPattern: { source: ['ddb.source', 'person.service'] },
+      retention: cdk.Duration.days(Number(this.node.tryGetContext('eventArchiveRetentionDays') ?? 90)),
+    });
+    const replaysTable = new dynamodb.Table(this, 'ReplaysTable', {
+      partitionKey: { name: 'replayName', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    const replayLambda = new lambda.Function(this, 'ReplayLambda', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.X86_64,
+      code: lambda.Code.fromAsset('lambdas/replay'),
+      handler: 'main',
+      timeout: cdk.Duration.seconds(30),
+      environment: {
+        REPLAYS_TABLE_NAME: replaysTable.tableName,
+        EMAIL_QUEUE_URL: emailQueue.queueUrl,
+        AUDIT_FUNCTION_NAME: loggingLambda.functionName,
+      },
+    });
+    replaysTable.grantReadWriteData(replayLambda);
+    emailQueue.grantSendMessages(replayLambda);
+    loggingLambda.grantInvoke(replayLambda);
+    if (indexerLambda) {
+      replayLambda.addEnvironment('SEARCH_FUNCTION_NAME', indexerLambda.functionName);
+      indexerLambda.grantInvoke(replayLambda);
+    }
+    const replayRule = new eventbridge.Rule(this, 'ReplayRule', {
+      eventBus,
+      eventPattern: { source: ['ddb.source', 'person.service'] },
+      targets: [new eventTargets.LambdaFunction(replayLambda)],
+    });
+    // Live events carry no replay-name, so only replays reach the rule; the typed pattern has no field for it
+    (replayRule.node.defaultChild as eventbridge.CfnRule).addPropertyOverride('EventPattern.replay-name', [{ exists: true }]);
+    replaysTable.grantReadWriteData(httpLambda);
+    httpLambda.addToRolePolicy(new iam.PolicyStatement({
+      actions: ['events:StartReplay', 'events:DescribeReplay'],
+      resources: [eventArchive.archiveArn, `arn:${cdk.Aws.PARTITION}:events:${this.region}:${this.account}:replay/persons-*`],
+    }));
+    httpLambda.addEnvironment('REPLAYS_TABLE_NAME', replaysTable.tableName);
+    httpLambda.addEnvironment('EVENT_ARCHIVE_ARN', eventArchive.archiveArn);
+    httpLambda.addEnvironment('EVENT_BUS_ARN', eventBus.eventBusArn);
+    httpLambda.addEnvironment('REPLAY_RULE_ARN', replayRule.ruleArn);
+    const replaysResource = adminResource.addResource('replays');
+    replaysResource.addMethod('POST', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+    replaysResource.addResource('{replayName}').addMethod('GET', new apigateway.LambdaIntegration(httpLambda), adminOptions);
+
+    // Tenant counters: the Stream Lambda keeps active persons and daily creations per tenant with
+    // ADD updates, GET /tenants/{tenantId}/stats reads them without a count scan
+    const tenantStatsTable = new dynamodb.Table(this, 'TenantStatsTable', {
+      partitionKey: { name: 'tenantId', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'period', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      timeToLiveAttribute: 'expiresAt',
+      removalPolicy: cdk.RemovalPolicy.DESTROY,
+    });
+    tenantStatsTable.grantWriteData(streamLambda);
+    streamLambda.addEnvironment('TENANT_STATS_TABLE_NAME', tenantStatsTable.tableName);
+    tenantStatsTable.grantReadData(httpLambda);
+    httpLambda.addEnvironment('TENANT_STATS_TABLE_NAME', tenantStatsTable.tableName);
+    api.root.addResource('tenants').addResource('{tenantId}').addResource('stats')
+      .addMethod('GET', new apigateway.LambdaIntegration(httpLambda), personOptions);
+
+    // Access audit: who ran unscoped lists, match scans and exports, with their filter, row count and duration
+    const accessAuditTable = new dynamodb.Table(this, 'AccessAuditTable', {
+      partitionKey: { name: 'actor', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'accessId', type: dynamodb.AttributeType.STRING },
+      timeToLiveAttribute: 'expiresAt',
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      pointInTimeRecovery: true,
+      removalPolicy: cdk.RemovalPolicy.RETAIN,
+    });
+    for (const fn of [httpLambda, exportLambda]) {
+      accessAuditTable.grantWriteData(fn);
+      fn.addEnvironment('ACCESS_AUDIT_TABLE_NAME', accessAuditTable.tableName);
+    }
+
+    const opsAlertEnvironment: Record<string, string> = {
+      SLACK_WEBHOOK_URL: this.node.tryGetContext('slackWebhookUrl') ?? '',
+      ENVIRONMENT_NAME: this.node.tryGetContext('environmentName') ?? 'dev',
+    };
+    for (const fn of [streamLambda, streamRedriveLambda, emailServiceLambda, loggingLambda]) {
+      for (const [name, value] of Object.entries(opsAlertEnvironment)) {
+        fn.addEnvironment(name, value);
+      }
+    }
+
+    // Tracing: X-Ray active tracing everywhere; with `-c adotLayerArn=...` the ADOT collector layer is
+    // added and the lambdas export OpenTelemetry spans to it over OTLP/HTTP
+    const adotLayerArn = this.node.tryGetContext('adotLayerArn');
+    const adotLayer = adotLayerArn ? lambda.LayerVersion.fromLayerVersionArn(this, 'AdotLayer', adotLayerArn) : undefined;
+    const tracedLambdas = [httpLambda, streamLambda, streamRedriveLambda, emailServiceLambda, loggingLambda, qualityLambda, purgeLambda, importLambda, exportLambda, anonymizeLambda];
+    if (searchIndexLambda && indexerLambda) {
+      tracedLambdas.push(searchIndexLambda, indexerLambda);
+    }
+    for (const fn of tracedLambdas) {
+      (fn.node.defaultChild as lambda.CfnFunction).tracingConfig = { mode: lambda.Tracing.ACTIVE };
+      fn.role!.addManagedPolicy(iam.ManagedPolicy.fromAwsManagedPolicyName('AWSXRayDaemonWriteAccess'));
+      if (adotLayer) {
+        fn.addLayers(adotLayer);
+        fn.addEnvironment('OTEL_EXPORTER_OTLP_ENDPOINT', this.node.tryGetContext('otelEndpoint') ?? 'http://localhost:4318');
+      }
+    }
+
+    // DLQ growth raises an alarm; alarm state changes reach the logging lambda via the default bus
+    const emailDlqAlarm = new cloudwatch.Alarm(this, 'EmailDeadLetterQueueAlarm', {
+      metric: emailDeadLetterQueue.metricApproximateNumberOfMessagesVisible({ period: cdk.Duration.minutes(5) }),
+      threshold: 1,
+      evaluationPeriods: 1,
+      comparisonOperator: cloudwatch.ComparisonOperator.GREATER_THAN_OR_EQUAL_TO_THRESHOLD,
+      treatMissingData: cloudwatch.TreatMissingData.NOT_BREACHING,
+      alarmDescription: 'Email notifications are landing in the dead-letter queue',
+    });
+    new eventbridge.Rule(this, 'OpsAlarmRule', {
+      eventPattern: {
+        source: ['aws.cloudwatch'],
+        detailType: ['CloudWatch Alarm State Change'],
+        resources: [emailDlqAlarm.alarmArn],
       },
-      targets: [new eventTargets.LambdaFunction(emailServiceLambda)],
+      targets: [new eventTargets.LambdaFunction(loggingLambda)],
     });
   }
 }
@@ -12,7 +12,7 @@ test('DynamoDB Table Created', () => {
       KeyType: 'HASH',
     }]),
     StreamSpecification: {
-      StreamViewType: 'NEW_IMAGE',
+      StreamViewType: 'NEW_AND_OLD_IMAGES',
     },
   });
 });